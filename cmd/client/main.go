@@ -10,6 +10,8 @@ import (
 	"CoLinkPlan/internal/client"
 	"CoLinkPlan/internal/config"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/telemetry"
+	"CoLinkPlan/pkg/version"
 )
 
 func main() {
@@ -24,7 +26,14 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger.Log.Info("Starting Co-Link Client", "config", configPath, "server", cfg.ServerURL, "max_parallel", cfg.MaxParallel)
+	logger.Log.Info("Starting Co-Link Client", "version", version.Version, "config", configPath, "server", cfg.ServerURL, "max_parallel", cfg.MaxParallel)
+
+	shutdownTracing, err := telemetry.Setup(context.Background(), "colink-client")
+	if err != nil {
+		logger.Log.Error("Failed to set up tracing", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -32,10 +41,27 @@ func main() {
 	mgr := client.NewManager(cfg)
 	go mgr.Start(ctx)
 
-	// Wait for interrupt signal to gracefully shutdown
+	// SIGHUP reloads the config file; interrupt signals shut down gracefully
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+
+	for running := true; running; {
+		select {
+		case <-reload:
+			newCfg, err := config.LoadClientConfig(configPath)
+			if err != nil {
+				logger.Log.Error("Failed to reload config, keeping the current one", "err", err)
+				continue
+			}
+			if err := mgr.Reload(newCfg); err != nil {
+				logger.Log.Error("Failed to send updated registration", "err", err)
+			}
+		case <-quit:
+			running = false
+		}
+	}
 
 	logger.Log.Info("Shutting down client...")
 	cancel()
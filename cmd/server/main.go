@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"mime"
@@ -8,12 +10,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"CoLinkPlan/internal/cache"
 	"CoLinkPlan/internal/config"
 	"CoLinkPlan/internal/db"
 	"CoLinkPlan/internal/limiter"
+	"CoLinkPlan/internal/protocol"
 	"CoLinkPlan/internal/server"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/telemetry"
+	"CoLinkPlan/pkg/version"
 	"CoLinkPlan/web"
 
 	"github.com/gin-gonic/gin"
@@ -22,29 +29,126 @@ import (
 func main() {
 	cfg := config.LoadServerConfig()
 
-	logger.Log.Info("Starting Co-Link Server", "port", cfg.Port)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg, os.Args[2:]))
+	}
+
+	logger.Log.Info("Starting Co-Link Server", "version", version.Version, "port", cfg.Port)
 
-	database, err := db.Connect(cfg.DatabaseURL)
+	shutdownTracing, err := telemetry.Setup(context.Background(), "colink-server")
 	if err != nil {
-		logger.Log.Error("Failed to connect to postgres database", "err", err)
+		logger.Log.Error("Failed to set up tracing", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	database, err := openStore(cfg)
+	if err != nil {
+		logger.Log.Error("Failed to open database", "driver", cfg.DBDriver, "err", err)
 		os.Exit(1)
 	}
 	defer database.Close()
 
-	if err := database.InitializeSchema(); err != nil {
-		logger.Log.Error("Failed to initialize database schema", "err", err)
+	applied, err := database.MigrateUp(context.Background())
+	if err != nil {
+		logger.Log.Error("Failed to apply database migrations", "err", err)
+		os.Exit(1)
+	}
+	for _, m := range applied {
+		logger.Log.Info("Applied database migration", "version", m.Version, "name", m.Name)
+	}
+
+	if err := database.PromoteAdmins(context.Background(), cfg.AdminEmails); err != nil {
+		logger.Log.Error("Failed to promote admin accounts", "err", err)
 	}
 
-	rl, err := limiter.NewRateLimiter(cfg.RedisURL)
+	rl, err := newLimiter(cfg)
 	if err != nil {
-		logger.Log.Error("Failed to connect to redis rate limiter", "err", err)
+		logger.Log.Error("Failed to set up rate limiter", "backend", cfg.LimiterBackend, "err", err)
 		os.Exit(1)
 	}
 
 	hub := server.NewHub()
+	if !cfg.WSCompression {
+		hub.DisableFeature(protocol.FeatureCompression)
+	}
+	if cfg.StreamCredits > 0 {
+		hub.StreamCredits = cfg.StreamCredits
+	}
+	hub.SessionGrace = cfg.SessionGrace
+	if cfg.SessionGrace <= 0 {
+		hub.DisableFeature(protocol.FeatureResume)
+	}
+	hub.HeartbeatInterval = cfg.HeartbeatInterval
+	if cfg.HeartbeatInterval < time.Second { // WELCOME gives it in whole seconds
+		hub.DisableFeature(protocol.FeatureHeartbeat)
+	}
+	hub.AffinityTTL = cfg.AffinityTTL
+	hub.QueueTimeout = cfg.QueueTimeout
+	hub.Reputation, err = server.NewReputationBook(database)
+	if err != nil {
+		logger.Log.Error("Failed to load node reputation", "err", err)
+		os.Exit(1)
+	}
+	for _, t := range cfg.TrustedNodeTokens {
+		hub.Reputation.Pinned[t] = true
+	}
+	go hub.Reputation.Run()
 	go hub.Run()
 
-	gw := server.NewGateway(hub, database, rl)
+	var requestLog *server.RequestLogger
+	if cfg.RequestLog {
+		requestLog, err = server.NewRequestLogger(database, cfg.RequestLogRetention, cfg.RequestLogRedactFile)
+		if err != nil {
+			logger.Log.Error("Failed to set up request log", "err", err)
+			os.Exit(1)
+		}
+		go requestLog.Run()
+	}
+
+	gw := server.NewGateway(hub, database, rl, requestLog)
+	if cfg.StreamStallTimeout > 0 {
+		gw.StallTimeout = cfg.StreamStallTimeout
+	}
+
+	if cfg.ModelAliasFile != "" {
+		gw.Aliases, err = server.LoadModelAliases(cfg.ModelAliasFile)
+		if err != nil {
+			logger.Log.Error("Failed to load model aliases", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.ResponseCacheTTL > 0 {
+		gw.Cache = &server.ResponseCache{
+			Store:       newResponseCache(cfg),
+			TTL:         cfg.ResponseCacheTTL,
+			MaxResponse: server.DefaultCacheMaxResponse,
+		}
+	}
+
+	batchConcurrency := server.DefaultBatchConcurrency
+	if cfg.BatchConcurrency > 0 {
+		batchConcurrency = cfg.BatchConcurrency
+	}
+	gw.Batches = server.NewBatchRunner(gw, batchConcurrency)
+	go gw.Batches.Run()
+
+	if cfg.VerifyInterval > 0 || cfg.VerifySampleRate > 0 {
+		verifier, err := server.NewVerifier(hub, database, cfg.VerifyCanaryFile)
+		if err != nil {
+			logger.Log.Error("Failed to set up verification", "err", err)
+			os.Exit(1)
+		}
+		verifier.Interval = cfg.VerifyInterval
+		verifier.SampleRate = cfg.VerifySampleRate
+		if cfg.VerifyMinSimilarity > 0 {
+			verifier.MinSimilarity = cfg.VerifyMinSimilarity
+		}
+		verifier.BanBelow = cfg.VerifyBanBelow
+		go verifier.Run()
+		gw.Verifier = verifier
+	}
 
 	router := gin.Default()
 
@@ -52,7 +156,7 @@ func main() {
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Client-Token")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Client-Token, "+server.SessionHeader)
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -67,6 +171,15 @@ func main() {
 		v1.POST("/chat/completions", gw.ChatCompletionsHandler)
 		v1.GET("/models", gw.ModelsHandler)
 		v1.GET("/models/:model", gw.ModelsHandler)
+		v1.POST("/files", gw.UploadFileHandler)
+		v1.GET("/files", gw.ListFilesHandler)
+		v1.GET("/files/:file_id", gw.GetFileHandler)
+		v1.GET("/files/:file_id/content", gw.FileContentHandler)
+		v1.DELETE("/files/:file_id", gw.DeleteFileHandler)
+		v1.POST("/batches", gw.CreateBatchHandler)
+		v1.GET("/batches", gw.ListBatchesHandler)
+		v1.GET("/batches/:batch_id", gw.GetBatchHandler)
+		v1.POST("/batches/:batch_id/cancel", gw.CancelBatchHandler)
 	}
 
 	// Internal Dashboard APIs
@@ -78,13 +191,68 @@ func main() {
 			auth.POST("/login", server.LoginHandler(database))
 		}
 
-		// Public API: nodes are visible without auth
+		// Public API: nodes are visible without auth, details of their own nodes need a login
 		api.GET("/nodes", server.NodesHandler(hub))
+		api.GET("/events", server.EventsHandler(database, hub))
 
 		protected := api.Group("/")
-		protected.Use(server.AuthMiddleware())
+		protected.Use(server.AuthMiddleware(database))
 		{
 			protected.GET("/user/me", server.MeHandler(database))
+			protected.GET("/user/requests", server.UserRequestsHandler(database))
+			protected.POST("/user/requests/:request_id/report", server.ReportRequestHandler(database, hub))
+
+			orgs := protected.Group("/orgs")
+			{
+				orgs.GET("", server.ListOrgsHandler(database))
+				orgs.POST("", server.CreateOrgHandler(database))
+				orgs.GET("/invitations", server.MyInvitationsHandler(database))
+				orgs.POST("/invitations/:token/accept", server.AcceptInvitationHandler(database))
+
+				member := orgs.Group("/:org_id", server.OrgAccess(database, db.OrgRoleMember))
+				{
+					member.GET("", server.GetOrgHandler(database))
+					member.GET("/members", server.ListOrgMembersHandler(database))
+					member.DELETE("/members/:user_id", server.RemoveOrgMemberHandler(database))
+				}
+
+				admin := orgs.Group("/:org_id", server.OrgAccess(database, db.OrgRoleAdmin))
+				{
+					admin.PUT("", server.UpdateOrgHandler(database))
+					admin.PUT("/members/:user_id", server.UpdateOrgMemberHandler(database))
+					admin.GET("/invitations", server.ListOrgInvitationsHandler(database))
+					admin.POST("/invitations", server.InviteOrgMemberHandler(database))
+					admin.DELETE("/invitations/:invitation_id", server.RevokeOrgInvitationHandler(database))
+					admin.GET("/keys", server.ListOrgKeysHandler(database))
+					admin.POST("/keys", server.CreateOrgKeyHandler(database))
+					admin.DELETE("/keys/:key_id", server.DeleteOrgKeyHandler(database))
+					admin.GET("/node-tokens", server.ListNodeTokensHandler(database))
+					admin.POST("/node-tokens", server.CreateNodeTokenHandler(database))
+					admin.DELETE("/node-tokens/:token_id", server.DeleteNodeTokenHandler(database, hub))
+				}
+
+				owner := orgs.Group("/:org_id", server.OrgAccess(database, db.OrgRoleOwner))
+				{
+					owner.DELETE("", server.DeleteOrgHandler(database))
+				}
+			}
+
+			admin := protected.Group("/admin", server.AdminMiddleware(database))
+			{
+				admin.GET("/stats", server.AdminStatsHandler(database, hub))
+				admin.GET("/users", server.AdminListUsersHandler(database))
+				admin.PUT("/users/:user_id", server.AdminUpdateUserHandler(database, hub))
+				admin.GET("/keys", server.AdminListKeysHandler(database))
+				admin.PUT("/keys/:key_id", server.AdminUpdateKeyHandler(database))
+				admin.GET("/nodes", server.AdminNodesHandler(hub))
+				admin.POST("/nodes/:node_id/disconnect", server.AdminDisconnectNodeHandler(hub))
+				admin.POST("/nodes/:node_id/ban", server.AdminBanNodeHandler(database, hub))
+				admin.GET("/reputation", server.AdminListReputationHandler(hub))
+				admin.PUT("/reputation/:token", server.AdminSetTierHandler(hub))
+				admin.GET("/reputation/:token/reports", server.AdminNodeReportsHandler(database))
+				admin.GET("/bans", server.AdminListBansHandler(database))
+				admin.DELETE("/bans/:token", server.AdminUnbanHandler(database))
+			}
 		}
 	}
 
@@ -153,3 +321,40 @@ func main() {
 		log.Fatalf("listen: %s\n", err)
 	}
 }
+
+// openStore connects to the storage backend selected by DB_DRIVER.
+func openStore(cfg *config.ServerConfig) (db.Store, error) {
+	switch cfg.DBDriver {
+	case "postgres":
+		return db.Connect(cfg.DatabaseURL)
+	case "sqlite":
+		return db.OpenSQLite(cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", cfg.DBDriver)
+	}
+}
+
+// newLimiter builds the rate limiter selected by LIMITER_BACKEND.
+func newLimiter(cfg *config.ServerConfig) (limiter.Limiter, error) {
+	switch cfg.LimiterBackend {
+	case "redis":
+		return limiter.NewRateLimiter(cfg.RedisURL)
+	case "memory":
+		return limiter.NewMemoryLimiter(), nil
+	default:
+		return nil, fmt.Errorf("unknown LIMITER_BACKEND %q", cfg.LimiterBackend)
+	}
+}
+
+// newResponseCache builds the response cache on the backend the rate limiter uses. The
+// cache is only an optimization, so one that can't reach Redis falls back to memory.
+func newResponseCache(cfg *config.ServerConfig) cache.Cache {
+	if cfg.LimiterBackend == "redis" {
+		rc, err := cache.NewRedisCache(cfg.RedisURL)
+		if err == nil {
+			return rc
+		}
+		logger.Log.Warn("Response cache falls back to memory", "err", err)
+	}
+	return cache.NewMemoryCache(cache.DefaultMemoryBytes)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"CoLinkPlan/internal/config"
+)
+
+const migrateUsage = `usage: colink-server migrate <command>
+
+commands:
+  up        apply all pending migrations
+  down [N]  revert the last N applied migrations (default 1)
+  status    list migrations and whether they are applied`
+
+// runMigrate implements the "migrate" subcommand and returns the process exit code.
+func runMigrate(cfg *config.ServerConfig, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	database, err := openStore(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s database: %v\n", cfg.DBDriver, err)
+		return 1
+	}
+	defer database.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, m := range applied {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintf(os.Stderr, "invalid step count %q\n", args[1])
+				return 2
+			}
+		}
+		reverted, err := database.MigrateDown(ctx, steps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no migrations to revert")
+		}
+
+	case "status":
+		states, err := database.MigrationStatus(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt.Valid {
+				applied = "applied " + s.AppliedAt.Time.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
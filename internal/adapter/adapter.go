@@ -2,6 +2,9 @@ package adapter
 
 import (
 	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // ProviderAdapter defines the interface for different AI providers
@@ -13,3 +16,10 @@ type ProviderAdapter interface {
 	// It closes streamCh when the response is fully read.
 	Call(ctx context.Context, requestID string, model string, reqBody []byte, streamCh chan<- interface{}, errCh chan<- error)
 }
+
+// newHTTPClient returns the client adapters use to reach providers. Its transport records
+// the provider call as a span of the trace carried by the request context and forwards
+// the trace context in the request headers.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+}
@@ -27,7 +27,7 @@ func NewClaudeAdapter(apiKey, baseURL string) *ClaudeAdapter {
 	return &ClaudeAdapter{
 		APIKey:  apiKey,
 		BaseURL: baseURL,
-		Client:  &http.Client{},
+		Client:  newHTTPClient(),
 	}
 }
 
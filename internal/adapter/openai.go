@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
@@ -25,7 +26,7 @@ func NewOpenAIAdapter(apiKey, baseURL string) *OpenAIAdapter {
 	return &OpenAIAdapter{
 		APIKey:  apiKey,
 		BaseURL: baseURL,
-		Client:  &http.Client{},
+		Client:  newHTTPClient(),
 	}
 }
 
@@ -80,13 +81,18 @@ func (a *OpenAIAdapter) Call(ctx context.Context, requestID string, model string
 	}
 
 	if !isStream {
-		var res map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		// Passed on as the provider's bytes, the gateway forwards them without decoding
+		res, err := io.ReadAll(resp.Body)
+		if err != nil {
 			errCh <- fmt.Errorf("error reading non-stream response: %w", err)
 			return
 		}
+		if !json.Valid(res) {
+			errCh <- fmt.Errorf("error reading non-stream response: invalid JSON")
+			return
+		}
 		select {
-		case streamCh <- res:
+		case streamCh <- json.RawMessage(res):
 		case <-ctx.Done():
 		}
 		return
@@ -107,10 +113,10 @@ func (a *OpenAIAdapter) Call(ctx context.Context, requestID string, model string
 				return
 			}
 
-			// We just read it as raw interface{} or map to push down the stream.
-			var chunk map[string]interface{}
-			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
-				logger.Log.Warn("Failed to unmarshal openai chunk", "request_id", requestID, "err", err, "data", data)
+			// Chunks are pushed down the stream as raw JSON, only checked for validity
+			chunk := json.RawMessage(data)
+			if !json.Valid(chunk) {
+				logger.Log.Warn("Invalid openai chunk", "request_id", requestID, "data", data)
 				continue
 			}
 
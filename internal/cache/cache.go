@@ -0,0 +1,16 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Cache stores responses for a while. RedisCache is shared by every server instance
+// pointing at the same Redis; MemoryCache keeps them in process for single-binary
+// deployments.
+type Cache interface {
+	// Get returns the value stored under key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key for ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryBytes is the size of a MemoryCache of a standalone deployment.
+	DefaultMemoryBytes = 64 << 20
+
+	// janitorInterval is how often MemoryCache drops expired entries.
+	janitorInterval = time.Minute
+)
+
+// MemoryCache is an in-process Cache holding up to a fixed number of bytes. Once full, new
+// entries are only stored as expired ones are dropped.
+type MemoryCache struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	size    int
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemoryCache(maxBytes int) *MemoryCache {
+	mc := &MemoryCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]memoryEntry),
+	}
+	go mc.janitor()
+	return mc
+}
+
+func (mc *MemoryCache) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		mc.mu.Lock()
+		for k, e := range mc.entries {
+			if !e.expires.After(now) {
+				mc.remove(k, e)
+			}
+		}
+		mc.mu.Unlock()
+	}
+}
+
+// remove drops the entry e of key. The caller must hold mu.
+func (mc *MemoryCache) remove(key string, e memoryEntry) {
+	delete(mc.entries, key)
+	mc.size -= len(key) + len(e.value)
+}
+
+func (mc *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	e, ok := mc.entries[key]
+	if !ok || !e.expires.After(time.Now()) {
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (mc *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if e, ok := mc.entries[key]; ok {
+		mc.remove(key, e)
+	}
+	if mc.size+len(key)+len(value) > mc.maxBytes {
+		return nil // full, the response just isn't cached
+	}
+	mc.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	mc.size += len(key) + len(value)
+	return nil
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache is the Redis-backed Cache, leaving expiry to Redis.
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(redisURL string) (*RedisCache, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("redis ping failed: %w", err)
+	}
+
+	return &RedisCache{client: client}, nil
+}
+
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := rc.client.Get(ctx, "response_cache:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rc.client.Set(ctx, "response_cache:"+key, value, ttl).Err()
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+)
+
+// unhealthyAfter is how many calls to a provider must fail in a row for it to be reported
+// unhealthy.
+const unhealthyAfter = 3
+
+// providerStats counts the outcomes of calls to a provider. Guarded by Manager.WorkerMutex.
+type providerStats struct {
+	requests, errors  int // since the last heartbeat
+	consecutiveErrors int
+	lastError         string
+}
+
+// recordCall counts the outcome of a call to provider; err is nil if it succeeded.
+func (m *Manager) recordCall(provider string, err error) {
+	m.WorkerMutex.Lock()
+	defer m.WorkerMutex.Unlock()
+	s := m.health[provider]
+	if s == nil {
+		s = &providerStats{}
+		m.health[provider] = s
+	}
+	s.requests++
+	if err == nil {
+		s.consecutiveErrors = 0
+		return
+	}
+	s.errors++
+	s.consecutiveErrors++
+	s.lastError = err.Error()
+}
+
+// heartbeatData reports the node's running tasks and the health of its providers, and
+// starts counting provider calls anew.
+func (m *Manager) heartbeatData() protocol.HeartbeatData {
+	providers := make(map[string]protocol.ProviderHealth)
+	m.RoutesMutex.RLock()
+	for model, route := range m.ModelMapping {
+		p := providers[route.Provider.Name()]
+		p.Models = append(p.Models, model)
+		providers[route.Provider.Name()] = p
+	}
+	reportHost := m.Cfg.ReportHostStats
+	m.RoutesMutex.RUnlock()
+
+	m.WorkerMutex.Lock()
+	hb := protocol.HeartbeatData{
+		ActiveTasks: m.ActiveWorkers,
+		Tasks:       slices.Collect(maps.Keys(m.Tasks)),
+		Providers:   providers,
+	}
+	for name, p := range providers {
+		p.Healthy = true
+		if s := m.health[name]; s != nil {
+			p.Requests, p.Errors = s.requests, s.errors
+			p.ConsecutiveErrors, p.LastError = s.consecutiveErrors, s.lastError
+			p.Healthy = s.consecutiveErrors < unhealthyAfter
+			s.requests, s.errors = 0, 0
+		}
+		providers[name] = p
+	}
+	m.WorkerMutex.Unlock()
+
+	if reportHost {
+		hb.Host = hostStats()
+	}
+	return hb
+}
+
+// sendHeartbeats sends a HEARTBEAT right away and then every interval, until ctx is done.
+func (m *Manager) sendHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := m.sendMessage(protocol.WSPayload{Type: protocol.MsgTypeHeartbeat, Data: m.heartbeatData()})
+		if err != nil {
+			logger.Log.Warn("Failed to send heartbeat", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// hostStats describes this machine. The load average and memory are read from /proc, so
+// they are only known on Linux.
+func hostStats() *protocol.HostStats {
+	stats := &protocol.HostStats{CPUs: runtime.NumCPU(), Goroutines: runtime.NumGoroutine()}
+	if b, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) > 0 {
+			stats.Load1, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	if b, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			switch fields[0] {
+			case "MemTotal:":
+				stats.MemoryTotal = kb * 1024
+			case "MemAvailable:":
+				stats.MemoryAvailable = kb * 1024
+			}
+		}
+	}
+	return stats
+}
@@ -2,9 +2,13 @@ package client
 
 import (
 	"context"
+	"crypto/ecdh"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -12,31 +16,57 @@ import (
 	"CoLinkPlan/internal/config"
 	"CoLinkPlan/internal/protocol"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/telemetry"
+	"CoLinkPlan/pkg/version"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Manager struct {
 	Cfg           *config.ClientConfig
 	Conn          *websocket.Conn
 	ConnMutex     sync.Mutex
+	Features      map[string]bool // negotiated with the server for the current connection
+	session       session         // guarded by ConnMutex
+	heartbeat     time.Duration   // interval the server asked for, 0 for none; guarded by ConnMutex
 	ActiveWorkers int
+	ModelWorkers  map[string]int            // active workers by server model, guarded by WorkerMutex
+	Tasks         map[string]*runningTask   // by request ID, guarded by WorkerMutex
+	health        map[string]*providerStats // by provider name, guarded by WorkerMutex
 	WorkerMutex   sync.Mutex
 	Adapters      map[string]adapter.ProviderAdapter
 	ModelMapping  map[string]ModelRoute // server_mapping -> ModelRoute
+	RoutesMutex   sync.RWMutex          // guards Cfg, Adapters and ModelMapping, replaced by Reload
+	key           *ecdh.PrivateKey      // opens sealed requests, registered with e2e_encryption
 }
 
 type ModelRoute struct {
-	Provider adapter.ProviderAdapter
-	Local    string
+	Provider     adapter.ProviderAdapter
+	Local        string
+	Capabilities *protocol.ModelCapabilities
+	MaxParallel  int // 0: limited by the node's max_parallel only
 }
 
 func NewManager(cfg *config.ClientConfig) *Manager {
-	m := &Manager{
-		Cfg:          cfg,
-		Adapters:     make(map[string]adapter.ProviderAdapter),
-		ModelMapping: make(map[string]ModelRoute),
+	m := &Manager{Cfg: cfg, ModelWorkers: make(map[string]int), Tasks: make(map[string]*runningTask),
+		health: make(map[string]*providerStats)}
+	m.Adapters, m.ModelMapping = buildRoutes(cfg)
+	// A new key pair for every run: the server learns it when the node registers
+	key, err := protocol.GenerateKey()
+	if err != nil {
+		logger.Log.Error("Failed to generate encryption key, requests will not be encrypted", "err", err)
 	}
+	m.key = key
+	return m
+}
+
+// buildRoutes creates the provider adapters of cfg and maps every served model to one.
+func buildRoutes(cfg *config.ClientConfig) (map[string]adapter.ProviderAdapter, map[string]ModelRoute) {
+	adapters := make(map[string]adapter.ProviderAdapter)
+	mapping := make(map[string]ModelRoute)
 
 	for _, p := range cfg.Providers {
 		var ad adapter.ProviderAdapter
@@ -48,16 +78,74 @@ func NewManager(cfg *config.ClientConfig) *Manager {
 			logger.Log.Warn("Unknown provider type", "type", p.Type)
 			continue
 		}
-		m.Adapters[p.Type] = ad
+		adapters[p.Type] = ad
 
 		for _, model := range p.Models {
-			m.ModelMapping[model.ServerMapping] = ModelRoute{
-				Provider: ad,
-				Local:    model.Local,
+			mapping[model.ServerMapping] = ModelRoute{
+				Provider:     ad,
+				Local:        model.Local,
+				Capabilities: model.Capabilities,
+				MaxParallel:  model.MaxParallel,
 			}
 		}
 	}
-	return m
+	return adapters, mapping
+}
+
+// Reload switches to the providers, models and parallelism of cfg and tells the server
+// with an UPDATE message, keeping the connection. Tasks already running finish on the
+// adapter they started with. The server URL and client token only change on restart.
+func (m *Manager) Reload(cfg *config.ClientConfig) error {
+	adapters, mapping := buildRoutes(cfg)
+
+	m.RoutesMutex.Lock()
+	if cfg.ServerURL != m.Cfg.ServerURL || cfg.ClientToken != m.Cfg.ClientToken {
+		logger.Log.Warn("server_url and client_token changes take effect after a restart")
+		cfg.ServerURL, cfg.ClientToken = m.Cfg.ServerURL, m.Cfg.ClientToken
+	}
+	m.Cfg, m.Adapters, m.ModelMapping = cfg, adapters, mapping
+	regData := m.registerData()
+	m.RoutesMutex.Unlock()
+
+	logger.Log.Info("Configuration reloaded", "max_parallel", regData.MaxParallel, "models", regData.Models)
+
+	m.ConnMutex.Lock()
+	connected := m.Conn != nil
+	m.ConnMutex.Unlock()
+	if !connected {
+		return nil // registered with the new configuration on the next connect
+	}
+	return m.sendMessage(protocol.WSPayload{
+		Type: protocol.MsgTypeUpdate,
+		Data: regData,
+	})
+}
+
+// registerData describes what this node serves. The caller must hold RoutesMutex.
+func (m *Manager) registerData() protocol.RegisterData {
+	var serverModels []string
+	capabilities := make(map[string]protocol.ModelCapabilities)
+	modelParallel := make(map[string]int)
+	for name, route := range m.ModelMapping {
+		serverModels = append(serverModels, name)
+		if route.Capabilities != nil {
+			capabilities[name] = *route.Capabilities
+		}
+		if route.MaxParallel > 0 {
+			modelParallel[name] = route.MaxParallel
+		}
+	}
+
+	reg := protocol.RegisterData{
+		MaxParallel:   m.Cfg.MaxParallel,
+		Models:        serverModels,
+		Capabilities:  capabilities,
+		ModelParallel: modelParallel,
+	}
+	if m.Cfg.E2EEncryption && m.key != nil {
+		reg.PublicKey = protocol.EncodeKey(m.key.PublicKey())
+	}
+	return reg
 }
 
 func (m *Manager) Start(ctx context.Context) {
@@ -85,35 +173,99 @@ func (m *Manager) Start(ctx context.Context) {
 
 		// Reset backoff on successful connect and loop
 		backoff = 2 * time.Second
+		m.ConnMutex.Lock()
+		interval := m.heartbeat
+		m.ConnMutex.Unlock()
+		heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+		if interval > 0 {
+			go m.sendHeartbeats(heartbeatCtx, interval)
+		}
 		m.readLoop(ctx)
+		stopHeartbeats()
 	}
 }
 
 func (m *Manager) connect(ctx context.Context) error {
 	header := http.Header{}
+	m.RoutesMutex.RLock()
+	serverURL := m.Cfg.ServerURL
 	header.Set("Client-Token", m.Cfg.ClientToken)
+	m.RoutesMutex.RUnlock()
+
+	// Ask to resume the session of a dropped connection, telling the server which of its
+	// requests are still running or have messages it may have missed
+	m.ConnMutex.Lock()
+	sessionID := m.session.id
+	known := m.session.requests()
+	m.ConnMutex.Unlock()
+	if sessionID != "" {
+		header.Set(protocol.SessionHeader, sessionID)
+		for _, id := range m.taskIDs() {
+			if !slices.Contains(known, id) {
+				known = append(known, id)
+			}
+		}
+	} else {
+		known = nil
+	}
 
-	logger.Log.Info("Dialing server", "url", m.Cfg.ServerURL)
-	c, _, err := websocket.DefaultDialer.DialContext(ctx, m.Cfg.ServerURL, header)
+	logger.Log.Info("Dialing server", "url", serverURL)
+	c, _, err := dialer.DialContext(ctx, serverURL, header)
 	if err != nil {
 		return err
 	}
+	// Messages are compressed only once the server agreed to it in the handshake
+	c.EnableWriteCompression(false)
+
+	welcome, err := handshake(c, known)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	features := make(map[string]bool, len(welcome.Features))
+	for _, f := range welcome.Features {
+		features[f] = true
+	}
+
+	if features[protocol.FeatureCompression] {
+		c.EnableWriteCompression(true)
+		c.SetCompressionLevel(protocol.CompressionLevel)
+	}
+
 	m.ConnMutex.Lock()
+	replayed := 0
+	if welcome.Resumed {
+		// Messages sent meanwhile wait for the replay, which holds ConnMutex
+		replayed, err = m.session.replay(c, welcome.LastSeq)
+		if err != nil {
+			m.ConnMutex.Unlock()
+			c.Close()
+			return fmt.Errorf("failed to resume session: %w", err)
+		}
+	} else {
+		m.session = session{id: welcome.SessionID}
+	}
 	m.Conn = c
+	m.Features = features
+	m.heartbeat = 0
+	if features[protocol.FeatureHeartbeat] {
+		m.heartbeat = time.Duration(welcome.HeartbeatInterval) * time.Second
+	}
 	m.ConnMutex.Unlock()
 
-	logger.Log.Info("Connected to server successfully")
-
-	// Register
-	var serverModels []string
-	for m := range m.ModelMapping {
-		serverModels = append(serverModels, m)
+	if !welcome.Resumed {
+		// Tasks of an earlier connection have nobody left to answer to
+		m.cancelTasks(errSessionLost)
 	}
 
-	regData := protocol.RegisterData{
-		MaxParallel: m.Cfg.MaxParallel,
-		Models:      serverModels,
-	}
+	logger.Log.Info("Connected to server successfully", "server_version", welcome.ServerVersion,
+		"protocol_version", welcome.ProtocolVersion, "features", welcome.Features,
+		"resumed", welcome.Resumed, "replayed", replayed)
+
+	// Register
+	m.RoutesMutex.RLock()
+	regData := m.registerData()
+	m.RoutesMutex.RUnlock()
 
 	err = m.sendMessage(protocol.WSPayload{
 		Type: protocol.MsgTypeRegister,
@@ -127,6 +279,63 @@ func (m *Manager) connect(ctx context.Context) error {
 	return nil
 }
 
+// clientFeatures are the optional protocol features this client implements.
+var clientFeatures = []string{protocol.FeatureBinary, protocol.FeatureCompression,
+	protocol.FeatureCancel, protocol.FeatureFlowControl, protocol.FeatureResume, protocol.FeatureHeartbeat}
+
+// dialer negotiates permessage-deflate with servers that support it.
+var dialer = &websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
+}
+
+// handshakeTimeout bounds the wait for the server's answer to HELLO.
+const handshakeTimeout = 10 * time.Second
+
+// handshake introduces the client on a fresh connection and returns the server's WELCOME,
+// or the server's reason for refusing it. tasks are the requests of a session being resumed.
+func handshake(c *websocket.Conn, tasks []string) (*protocol.WelcomeData, error) {
+	err := c.WriteJSON(protocol.WSPayload{
+		Type: protocol.MsgTypeHello,
+		Data: protocol.HelloData{
+			ProtocolVersion: protocol.ProtocolVersion,
+			ClientVersion:   version.Version,
+			Features:        clientFeatures,
+			Tasks:           tasks,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("no answer to hello, the server may predate protocol version %d: %w", protocol.ProtocolVersion, err)
+	}
+	reply, err := protocol.DecodeMessage(message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid answer to hello: %w", err)
+	}
+
+	switch reply.Type {
+	case protocol.MsgTypeWelcome:
+		welcome := reply.Data.(protocol.WelcomeData)
+		if _, ok := protocol.NegotiateVersion(welcome.ProtocolVersion); !ok {
+			return nil, fmt.Errorf("server speaks protocol version %d, this client needs %d or newer: please upgrade the server",
+				welcome.ProtocolVersion, protocol.MinProtocolVersion)
+		}
+		return &welcome, nil
+	case protocol.MsgTypeError:
+		return nil, fmt.Errorf("server refused connection: %s", reply.ErrorData().Message)
+	default:
+		return nil, fmt.Errorf("unexpected %s message during handshake", reply.Type)
+	}
+}
+
 func (m *Manager) readLoop(ctx context.Context) {
 	defer func() {
 		m.ConnMutex.Lock()
@@ -150,25 +359,53 @@ func (m *Manager) readLoop(ctx context.Context) {
 			return
 		}
 
-		var payload protocol.WSPayload
-		if err := json.Unmarshal(message, &payload); err != nil {
+		payload, err := protocol.DecodeMessage(message)
+		if err != nil {
 			logger.Log.Error("Failed to unmarshal strict payload", "err", err)
 			continue
 		}
 
-		if payload.Type == protocol.MsgTypeCall {
-			dataBytes, _ := json.Marshal(payload.Data)
-			var callData protocol.CallData
-			json.Unmarshal(dataBytes, &callData)
-
-			m.handleCall(ctx, callData)
+		switch payload.Type {
+		case protocol.MsgTypeCall:
+			m.handleCall(ctx, payload.Data.(protocol.CallData))
+		case protocol.MsgTypeCredit:
+			credit := payload.Data.(protocol.CreditData)
+			if t := m.task(credit.RequestID); t != nil {
+				t.grant(credit.Credits)
+			}
+		case protocol.MsgTypeCancel:
+			cancel := payload.Data.(protocol.CancelData)
+			if t := m.task(cancel.RequestID); t != nil {
+				logger.Log.Info("Task cancelled by server", "request_id", cancel.RequestID, "reason", cancel.Reason)
+				t.cancel(errors.New(cancel.Reason))
+			}
+		case protocol.MsgTypeAck:
+			m.ConnMutex.Lock()
+			m.session.ack(payload.Data.(protocol.AckData).Seq)
+			m.ConnMutex.Unlock()
+		case protocol.MsgTypeError:
+			// Sent before the server disconnects us, e.g. for a registration it refused
+			if errData := payload.ErrorData(); errData.RequestID == "" {
+				logger.Log.Error("Server error", "code", errData.Code, "message", errData.Message)
+			}
 		}
 	}
 }
 
 func (m *Manager) handleCall(ctx context.Context, callData protocol.CallData) {
+	m.RoutesMutex.RLock()
+	maxParallel := m.Cfg.MaxParallel
+	modelParallel := m.ModelMapping[callData.Model].MaxParallel
+	m.RoutesMutex.RUnlock()
+
 	m.WorkerMutex.Lock()
-	if m.ActiveWorkers >= m.Cfg.MaxParallel {
+	busy := ""
+	if m.ActiveWorkers >= maxParallel {
+		busy = "BUSY: Local concurrency limit reached"
+	} else if modelParallel > 0 && m.ModelWorkers[callData.Model] >= modelParallel {
+		busy = "BUSY: Local concurrency limit reached for model " + callData.Model
+	}
+	if busy != "" {
 		m.WorkerMutex.Unlock()
 		// Reject
 		m.sendMessage(protocol.WSPayload{
@@ -176,29 +413,74 @@ func (m *Manager) handleCall(ctx context.Context, callData protocol.CallData) {
 			Data: protocol.ErrorData{
 				RequestID: callData.RequestID,
 				Code:      http.StatusServiceUnavailable,
-				Message:   "BUSY: Local concurrency limit reached",
+				Message:   busy,
 			},
 		})
 		return
 	}
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	task := newRunningTask(cancel, callData.Credits)
 	m.ActiveWorkers++
+	m.ModelWorkers[callData.Model]++
+	m.Tasks[callData.RequestID] = task
 	m.WorkerMutex.Unlock()
 
 	go func() {
 		defer func() {
+			cancel(nil)
 			m.WorkerMutex.Lock()
 			m.ActiveWorkers--
+			m.ModelWorkers[callData.Model]--
+			if m.ModelWorkers[callData.Model] <= 0 {
+				delete(m.ModelWorkers, callData.Model)
+			}
+			delete(m.Tasks, callData.RequestID)
 			m.WorkerMutex.Unlock()
 		}()
-		m.executeTask(ctx, callData)
+		m.executeTask(taskCtx, callData, task)
 	}()
 }
 
-func (m *Manager) executeTask(ctx context.Context, callData protocol.CallData) {
+// statusClientClosedRequest is the code of the ERROR ending a task the server cancelled.
+const statusClientClosedRequest = 499
+
+// task returns the running task of a request, or nil if it has ended.
+func (m *Manager) task(requestID string) *runningTask {
+	m.WorkerMutex.Lock()
+	defer m.WorkerMutex.Unlock()
+	return m.Tasks[requestID]
+}
+
+// taskIDs returns the requests of the running tasks.
+func (m *Manager) taskIDs() []string {
+	m.WorkerMutex.Lock()
+	defer m.WorkerMutex.Unlock()
+	return slices.Collect(maps.Keys(m.Tasks))
+}
+
+// cancelTasks cancels every running task.
+func (m *Manager) cancelTasks(cause error) {
+	m.WorkerMutex.Lock()
+	defer m.WorkerMutex.Unlock()
+	for _, t := range m.Tasks {
+		t.cancel(cause)
+	}
+}
+
+func (m *Manager) executeTask(ctx context.Context, callData protocol.CallData, task *runningTask) {
 	logger.Log.Info("Executing task", "request_id", callData.RequestID, "model", callData.Model)
 
+	// Continue the server's trace so the provider call shows up under the gateway request
+	ctx, span := telemetry.Tracer.Start(telemetry.Extract(ctx, callData.TraceContext), "node.execute",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("request_id", callData.RequestID), attribute.String("model", callData.Model)))
+	defer span.End()
+
+	m.RoutesMutex.RLock()
 	route, ok := m.ModelMapping[callData.Model]
+	m.RoutesMutex.RUnlock()
 	if !ok {
+		span.SetStatus(codes.Error, "model not supported")
 		m.sendMessage(protocol.WSPayload{
 			Type: protocol.MsgTypeError,
 			Data: protocol.ErrorData{
@@ -211,6 +493,27 @@ func (m *Manager) executeTask(ctx context.Context, callData protocol.CallData) {
 	}
 
 	payloadBytes, _ := json.Marshal(callData.Payload)
+	if callData.Sealed != nil {
+		var err error
+		if m.key == nil {
+			err = errors.New("no key to open the request with")
+		} else {
+			payloadBytes, task.cipher, err = protocol.OpenPayload(m.key, callData.RequestID, callData.Sealed)
+		}
+		if err != nil {
+			logger.Log.Error("Failed to open sealed request", "request_id", callData.RequestID, "err", err)
+			span.SetStatus(codes.Error, err.Error())
+			m.sendMessage(protocol.WSPayload{
+				Type: protocol.MsgTypeError,
+				Data: protocol.ErrorData{
+					RequestID: callData.RequestID,
+					Code:      http.StatusBadRequest,
+					Message:   "Cannot open sealed request: " + err.Error(),
+				},
+			})
+			return
+		}
+	}
 	// context for adapter run
 	streamCh := make(chan interface{})
 	errCh := make(chan error, 1)
@@ -225,44 +528,106 @@ func (m *Manager) executeTask(ctx context.Context, callData protocol.CallData) {
 		select {
 		case err, ok := <-errCh:
 			if ok && err != nil {
-				logger.Log.Error("Adapter error", "err", err)
+				code := http.StatusInternalServerError
+				if errors.Is(context.Cause(ctx), errSessionLost) {
+					return // the server has already failed the request
+				}
+				if ctx.Err() != nil {
+					// Cancelled by the server, which only waits for the request to end
+					code, err = statusClientClosedRequest, errors.New("cancelled")
+				} else {
+					logger.Log.Error("Adapter error", "request_id", callData.RequestID, "err", err)
+					m.recordCall(route.Provider.Name(), err)
+				}
+				span.SetStatus(codes.Error, err.Error())
 				m.sendMessage(protocol.WSPayload{
 					Type: protocol.MsgTypeError,
 					Data: protocol.ErrorData{
 						RequestID: callData.RequestID,
-						Code:      http.StatusInternalServerError,
+						Code:      code,
 						Message:   err.Error(),
 					},
 				})
+				return
 			}
 		case chunk, ok := <-streamCh:
 			if !ok {
 				// Stream finished normally
-				m.sendMessage(protocol.WSPayload{
-					Type: protocol.MsgTypeFinish,
-					Data: protocol.FinishData{
-						RequestID: callData.RequestID,
-					},
-				})
+				m.recordCall(route.Provider.Name(), nil)
+				finish := protocol.FinishData{RequestID: callData.RequestID}
+				if task.cipher != nil {
+					finish.Sealed = task.cipher.SealFinish()
+				}
+				m.sendMessage(protocol.WSPayload{Type: protocol.MsgTypeFinish, Data: finish})
 				return
 			}
 
-			m.sendMessage(protocol.WSPayload{
-				Type: protocol.MsgTypeStream,
-				Data: protocol.StreamData{
-					RequestID: callData.RequestID,
-					Chunk:     chunk,
-				},
-			})
+			// Wait for the server to make room when flow controlled; if the task is cancelled
+			// meanwhile, the adapter stops and ends the stream
+			if task.acquire(ctx) {
+				m.sendChunk(callData.RequestID, chunk, task.cipher)
+			}
 		}
 	}
 }
 
+// sendMessage sends a message to the server. In a resumable session, task messages are
+// numbered and kept until the server acknowledges them, and only kept while the connection
+// is down.
 func (m *Manager) sendMessage(payload protocol.WSPayload) error {
 	m.ConnMutex.Lock()
 	defer m.ConnMutex.Unlock()
-	if m.Conn == nil {
+
+	requestID := payload.RequestID()
+	resumable := m.session.id != "" && requestID != ""
+	if !resumable && m.Conn == nil {
 		return fmt.Errorf("no active connection")
 	}
-	return m.Conn.WriteJSON(payload)
+	if resumable {
+		m.session.seq++
+		payload.Seq = m.session.seq
+	}
+
+	msgType, data, err := m.encode(payload)
+	if err != nil {
+		return err
+	}
+	if resumable {
+		m.session.keep(sentMessage{seq: payload.Seq, requestID: requestID, msgType: msgType, data: data})
+	}
+	if m.Conn == nil {
+		return nil
+	}
+	return m.Conn.WriteMessage(msgType, data)
+}
+
+// encode returns the WebSocket message type and bytes of payload: a binary frame for a
+// STREAM message if the server supports them, JSON otherwise. The caller must hold ConnMutex.
+func (m *Manager) encode(payload protocol.WSPayload) (int, []byte, error) {
+	if sd, ok := payload.Data.(protocol.StreamData); ok && m.Features[protocol.FeatureBinary] {
+		if raw, ok := sd.Chunk.(json.RawMessage); ok {
+			return websocket.BinaryMessage, protocol.EncodeStreamFrame(payload.Seq, sd.RequestID, raw), nil
+		}
+	}
+	data, err := json.Marshal(payload)
+	return websocket.TextMessage, data, err
+}
+
+// sendChunk sends a STREAM message, with the chunk sealed if cipher is not nil.
+func (m *Manager) sendChunk(requestID string, chunk interface{}, cipher *protocol.RequestCipher) error {
+	raw, ok := chunk.(json.RawMessage)
+	if !ok {
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		raw = b
+	}
+	if cipher != nil {
+		raw = cipher.SealChunk(raw)
+	}
+	return m.sendMessage(protocol.WSPayload{
+		Type: protocol.MsgTypeStream,
+		Data: protocol.StreamData{RequestID: requestID, Chunk: raw},
+	})
 }
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"slices"
+
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+// outboxLimit bounds how many unacknowledged task messages a resumable session keeps. A
+// node that falls further behind gives up on resuming.
+const outboxLimit = 4096
+
+// errSessionLost cancels the tasks of a session the server did not resume; their
+// responses can no longer be delivered.
+var errSessionLost = errors.New("session lost")
+
+// sentMessage is a numbered task message, as it was written to the connection.
+type sentMessage struct {
+	seq       uint64
+	requestID string
+	msgType   int
+	data      []byte
+}
+
+// session is the client's side of a resumable session, see protocol.WelcomeData. Guarded
+// by Manager.ConnMutex.
+type session struct {
+	id     string // empty when the server does not resume sessions
+	seq    uint64 // last number given to a task message
+	outbox []sentMessage
+}
+
+// keep holds a sent message until the server acknowledges it.
+func (s *session) keep(msg sentMessage) {
+	if len(s.outbox) >= outboxLimit {
+		logger.Log.Warn("Too many unacknowledged messages, the session can no longer be resumed", "session_id", s.id)
+		*s = session{}
+		return
+	}
+	s.outbox = append(s.outbox, msg)
+}
+
+// ack drops the messages the server acknowledged receiving.
+func (s *session) ack(seq uint64) {
+	i := 0
+	for i < len(s.outbox) && s.outbox[i].seq <= seq {
+		i++
+	}
+	s.outbox = slices.Delete(s.outbox, 0, i)
+}
+
+// requests lists the requests with messages the server may not have received.
+func (s *session) requests() []string {
+	var ids []string
+	for _, msg := range s.outbox {
+		if !slices.Contains(ids, msg.requestID) {
+			ids = append(ids, msg.requestID)
+		}
+	}
+	return ids
+}
+
+// replay sends again, on the resumed connection, every message after the last one the
+// server received.
+func (s *session) replay(c *websocket.Conn, lastSeq uint64) (int, error) {
+	s.ack(lastSeq)
+	for _, msg := range s.outbox {
+		if err := c.WriteMessage(msg.msgType, msg.data); err != nil {
+			return 0, err
+		}
+	}
+	return len(s.outbox), nil
+}
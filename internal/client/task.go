@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+
+	"CoLinkPlan/internal/protocol"
+)
+
+// runningTask is a task being executed, as far as the read loop needs to reach it.
+type runningTask struct {
+	cancel  context.CancelCauseFunc
+	granted chan int // credit totals from the server, see acquire
+
+	// Only touched by the goroutine executing the task
+	limit  int // STREAM messages the task may send in all, 0 when the server does not pace it
+	sent   int
+	cipher *protocol.RequestCipher // seals the chunks of a sealed request
+}
+
+func newRunningTask(cancel context.CancelCauseFunc, credits int) *runningTask {
+	return &runningTask{
+		cancel: cancel,
+		// Totals only grow, so when the task is slow to pick them up only the latest matters
+		granted: make(chan int, 1),
+		limit:   credits,
+	}
+}
+
+// grant raises the task's credit total from a CREDIT message. Called by the read loop, it
+// never blocks.
+func (t *runningTask) grant(total int) {
+	for {
+		select {
+		case t.granted <- total:
+			return
+		default:
+		}
+		// Replace a total the task has not picked up yet
+		select {
+		case old := <-t.granted:
+			total = max(total, old)
+		default:
+		}
+	}
+}
+
+// acquire takes the credit to send one STREAM message, waiting for the server to grant more
+// when there are none left. It returns false if ctx is done first.
+func (t *runningTask) acquire(ctx context.Context) bool {
+	if t.limit == 0 {
+		return true
+	}
+	for t.sent >= t.limit {
+		select {
+		case total := <-t.granted:
+			t.limit = max(t.limit, total)
+		case <-ctx.Done():
+			return false
+		}
+	}
+	t.sent++
+	return true
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 
+	"CoLinkPlan/internal/protocol"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,6 +14,9 @@ type ClientConfig struct {
 	ServerURL   string     `yaml:"server_url"`
 	MaxParallel int        `yaml:"max_parallel"`
 	Providers   []Provider `yaml:"providers"`
+
+	ReportHostStats bool `yaml:"report_host_stats"` // include CPU, load and memory in heartbeats
+	E2EEncryption   bool `yaml:"e2e_encryption"`    // register a public key, so requests are sealed to this node
 }
 
 type Provider struct {
@@ -24,6 +29,10 @@ type Provider struct {
 type Model struct {
 	Local         string `yaml:"local"`
 	ServerMapping string `yaml:"server_mapping"`
+	MaxParallel   int    `yaml:"max_parallel"` // optional cap for this model, within the node's max_parallel
+
+	// Optional; a model without capabilities is offered for every request
+	Capabilities *protocol.ModelCapabilities `yaml:"capabilities"`
 }
 
 func LoadClientConfig(path string) (*ClientConfig, error) {
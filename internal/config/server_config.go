@@ -2,12 +2,44 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ServerConfig struct {
-	Port        string
-	DatabaseURL string
-	RedisURL    string
+	Port           string
+	DBDriver       string // "postgres" or "sqlite"
+	DatabaseURL    string
+	SQLitePath     string
+	LimiterBackend string // "redis" or "memory"
+	RedisURL       string
+	AdminEmails    []string // accounts promoted to admin on startup
+	WSCompression  bool     // offer permessage-deflate to nodes
+
+	StreamCredits      int           // chunks a node may send ahead of the client, 0 for the default
+	StreamStallTimeout time.Duration // how long a client may stop reading before its request is abandoned, 0 for the default
+	SessionGrace       time.Duration // how long a dropped node may take to resume its session, 0 disables resumption
+	HeartbeatInterval  time.Duration // how often nodes report their load, 0 disables heartbeats
+	AffinityTTL        time.Duration // how long a conversation sticks to the node that served it, 0 disables affinity
+	QueueTimeout       time.Duration // how long a request waits for a free node, 0 fails it at once
+	BatchConcurrency   int           // requests of batches in flight at once, 0 for the default
+
+	RequestLog           bool
+	RequestLogRetention  time.Duration // 0 keeps entries forever
+	RequestLogRedactFile string        // regular expressions to redact from logged content, one per line
+
+	VerifyInterval      time.Duration // how often nodes get canary prompts, 0 disables them
+	VerifyCanaryFile    string        // JSON list of canaries replacing the built-in ones
+	VerifySampleRate    float64       // fraction of opted-in requests cross-checked on a trusted node
+	VerifyMinSimilarity float64       // 0 for the default
+	VerifyBanBelow      float64       // verification score below which a node is banned, 0 never bans
+
+	TrustedNodeTokens []string // client tokens always in the trusted tier
+
+	ModelAliasFile string // JSON object of model aliases and fallback chains
+
+	ResponseCacheTTL time.Duration // how long responses to deterministic requests are cached, 0 disables the cache
 }
 
 func LoadServerConfig() *ServerConfig {
@@ -16,6 +48,16 @@ func LoadServerConfig() *ServerConfig {
 		port = "8080"
 	}
 
+	dbDriver := os.Getenv("DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = "postgres"
+	}
+
+	sqlitePath := os.Getenv("SQLITE_PATH")
+	if sqlitePath == "" {
+		sqlitePath = "colink.db"
+	}
+
 	dbUrl := os.Getenv("DATABASE_URL")
 	if dbUrl == "" {
 		// Default dev URL
@@ -23,13 +65,118 @@ func LoadServerConfig() *ServerConfig {
 	}
 
 	redisUrl := os.Getenv("REDIS_URL")
+
+	// A standalone SQLite deployment shouldn't need Redis unless it is asked for.
+	limiterBackend := os.Getenv("LIMITER_BACKEND")
+	if limiterBackend == "" {
+		limiterBackend = "redis"
+		if dbDriver == "sqlite" && redisUrl == "" {
+			limiterBackend = "memory"
+		}
+	}
+
 	if redisUrl == "" {
 		redisUrl = "redis://localhost:6379/0"
 	}
 
+	var adminEmails []string
+	for _, e := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			adminEmails = append(adminEmails, e)
+		}
+	}
+
+	// Request logging is opt-in; entries are kept for 30 days unless configured otherwise
+	requestLog, _ := strconv.ParseBool(os.Getenv("REQUEST_LOG"))
+	retention := 30 * 24 * time.Hour
+	if v := os.Getenv("REQUEST_LOG_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			retention = d
+		}
+	}
+
+	// Compression costs CPU on both ends; it can be turned off for nodes on fast links
+	wsCompression := true
+	if v, err := strconv.ParseBool(os.Getenv("WS_COMPRESSION")); err == nil {
+		wsCompression = v
+	}
+
+	streamCredits, _ := strconv.Atoi(os.Getenv("STREAM_CREDITS"))
+	stallTimeout, _ := time.ParseDuration(os.Getenv("STREAM_STALL_TIMEOUT"))
+	sessionGrace := 30 * time.Second
+	if v := os.Getenv("SESSION_GRACE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			sessionGrace = d
+		}
+	}
+
+	heartbeatInterval := 15 * time.Second
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			heartbeatInterval = d
+		}
+	}
+
+	affinityTTL, _ := time.ParseDuration(os.Getenv("AFFINITY_TTL"))
+	queueTimeout := 30 * time.Second
+	if v := os.Getenv("QUEUE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			queueTimeout = d
+		}
+	}
+
+	batchConcurrency, _ := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY"))
+
+	// Verification is off unless canaries or cross-checks are asked for
+	verifyInterval, _ := time.ParseDuration(os.Getenv("VERIFY_INTERVAL"))
+	sampleRate, _ := strconv.ParseFloat(os.Getenv("VERIFY_SAMPLE_RATE"), 64)
+	minSimilarity, _ := strconv.ParseFloat(os.Getenv("VERIFY_MIN_SIMILARITY"), 64)
+	banBelow := 0.3
+	if v, err := strconv.ParseFloat(os.Getenv("VERIFY_BAN_BELOW"), 64); err == nil {
+		banBelow = v
+	}
+
+	responseCacheTTL, _ := time.ParseDuration(os.Getenv("RESPONSE_CACHE_TTL"))
+
+	var trustedTokens []string
+	for _, t := range strings.Split(os.Getenv("TRUSTED_NODE_TOKENS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			trustedTokens = append(trustedTokens, t)
+		}
+	}
+
 	return &ServerConfig{
-		Port:        port,
-		DatabaseURL: dbUrl,
-		RedisURL:    redisUrl,
+		Port:           port,
+		DBDriver:       dbDriver,
+		DatabaseURL:    dbUrl,
+		SQLitePath:     sqlitePath,
+		LimiterBackend: limiterBackend,
+		RedisURL:       redisUrl,
+		AdminEmails:    adminEmails,
+		WSCompression:  wsCompression,
+
+		StreamCredits:      streamCredits,
+		StreamStallTimeout: stallTimeout,
+		SessionGrace:       sessionGrace,
+		HeartbeatInterval:  heartbeatInterval,
+		AffinityTTL:        affinityTTL,
+		QueueTimeout:       queueTimeout,
+		BatchConcurrency:   batchConcurrency,
+
+		RequestLog:           requestLog,
+		RequestLogRetention:  retention,
+		RequestLogRedactFile: os.Getenv("REQUEST_LOG_REDACT_FILE"),
+
+		VerifyInterval:      verifyInterval,
+		VerifyCanaryFile:    os.Getenv("VERIFY_CANARIES"),
+		VerifySampleRate:    sampleRate,
+		VerifyMinSimilarity: minSimilarity,
+		VerifyBanBelow:      banBelow,
+
+		TrustedNodeTokens: trustedTokens,
+
+		ModelAliasFile: os.Getenv("MODEL_ALIASES"),
+
+		ResponseCacheTTL: responseCacheTTL,
 	}
 }
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// NodeBan is a banned node token. The ban covers every token of the user or organization
+// that owned it when it was banned.
+type NodeBan struct {
+	Token     string    `db:"token" json:"token"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UserID    *int      `db:"user_id" json:"user_id,omitempty"`
+	OrgID     *int      `db:"org_id" json:"org_id,omitempty"`
+}
+
+type GlobalStats struct {
+	Users              int `db:"users" json:"users"`
+	DisabledUsers      int `db:"disabled_users" json:"disabled_users"`
+	Organizations      int `db:"organizations" json:"organizations"`
+	APIKeys            int `db:"api_keys" json:"api_keys"`
+	TotalAPICalls      int `db:"total_api_calls" json:"total_api_calls"`
+	TotalProvidedCalls int `db:"total_provided_calls" json:"total_provided_calls"`
+	NodeBans           int `db:"node_bans" json:"node_bans"`
+}
+
+// SearchUsers lists users whose email contains query (all users if empty), newest first.
+func (db *DB) SearchUsers(ctx context.Context, query string, limit, offset int) ([]User, error) {
+	users := []User{}
+	err := db.SelectContext(ctx, &users, `
+		SELECT * FROM users WHERE email ILIKE '%' || $1 || '%'
+		ORDER BY id DESC LIMIT $2 OFFSET $3`, query, limit, offset)
+	return users, err
+}
+
+func (db *DB) GetUserByID(ctx context.Context, id int) (*User, error) {
+	var u User
+	err := db.GetContext(ctx, &u, "SELECT * FROM users WHERE id=$1", id)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetUserDisabled disables or re-enables a user together with their personal API key.
+func (db *DB) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET disabled=$1 WHERE id=$2", disabled, userID)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(res); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE api_keys SET disabled=$1 WHERE api_key=(SELECT api_token FROM users WHERE id=$2)", disabled, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) SetUserAdmin(ctx context.Context, userID int, isAdmin bool) error {
+	res, err := db.ExecContext(ctx, "UPDATE users SET is_admin=$1 WHERE id=$2", isAdmin, userID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// PromoteAdmins grants the admin role to the given emails. Used to bootstrap the first
+// administrators from configuration.
+func (db *DB) PromoteAdmins(ctx context.Context, emails []string) error {
+	for _, email := range emails {
+		if _, err := db.ExecContext(ctx, "UPDATE users SET is_admin=TRUE WHERE LOWER(email)=LOWER($1)", email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchAPIKeys lists API keys whose value contains query (all keys if empty).
+func (db *DB) SearchAPIKeys(ctx context.Context, query string, limit, offset int) ([]APIKeyRecord, error) {
+	keys := []APIKeyRecord{}
+	err := db.SelectContext(ctx, &keys, `
+		SELECT * FROM api_keys WHERE api_key LIKE '%' || $1 || '%'
+		ORDER BY id DESC LIMIT $2 OFFSET $3`, query, limit, offset)
+	return keys, err
+}
+
+func (db *DB) GetAPIKeyByID(ctx context.Context, id int) (*APIKeyRecord, error) {
+	var record APIKeyRecord
+	err := db.GetContext(ctx, &record, "SELECT * FROM api_keys WHERE id=$1", id)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (db *DB) UpdateAPIKey(ctx context.Context, record *APIKeyRecord) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE api_keys SET allowed_models=$1, rpm=$2, disabled=$3, tpm=$4, model_limits=$5, max_concurrent=$6,
+			log_content=$7, require_encryption=$8, allow_verification=$9, min_node_tier=$10, priority=$11, share_weight=$12
+		WHERE id=$13`,
+		record.AllowedModels, record.RPM, record.Disabled, record.TPM, record.ModelLimits, record.MaxConcurrent,
+		record.LogContent, record.RequireEncryption, record.AllowVerification, record.MinNodeTier,
+		record.Priority, record.ShareWeight, record.ID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// BanNodeToken prevents nodes from connecting with token, and with any other token of the
+// user or organization it belongs to, until the ban is lifted. It returns the tokens the
+// ban covers, so that the nodes connected with them can be dropped.
+func (db *DB) BanNodeToken(ctx context.Context, token, reason string) ([]string, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ban NodeBan
+	err = tx.GetContext(ctx, &ban, `
+		INSERT INTO node_bans (token, reason, user_id, org_id) VALUES ($1, $2,
+			(SELECT id FROM users WHERE client_token=$1),
+			(SELECT org_id FROM node_tokens WHERE token=$1))
+		ON CONFLICT (token) DO UPDATE SET reason=EXCLUDED.reason, user_id=EXCLUDED.user_id, org_id=EXCLUDED.org_id
+		RETURNING *`, token, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{token}
+	if ban.OrgID != nil {
+		var orgTokens []string
+		err := tx.SelectContext(ctx, &orgTokens, "SELECT token FROM node_tokens WHERE org_id=$1 AND token<>$2", *ban.OrgID, token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, orgTokens...)
+	}
+	return tokens, tx.Commit()
+}
+
+func (db *DB) UnbanNodeToken(ctx context.Context, token string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM node_bans WHERE token=$1", token)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (db *DB) ListNodeBans(ctx context.Context) ([]NodeBan, error) {
+	bans := []NodeBan{}
+	err := db.SelectContext(ctx, &bans, "SELECT * FROM node_bans ORDER BY created_at DESC")
+	return bans, err
+}
+
+// NodeTokenBlocked reports whether a node connecting with token must be refused, either
+// because the token or its owner is banned or because it belongs to a disabled user.
+func (db *DB) NodeTokenBlocked(ctx context.Context, token string) (bool, error) {
+	var blocked bool
+	err := db.GetContext(ctx, &blocked, `
+		SELECT EXISTS (SELECT 1 FROM node_bans WHERE token=$1)
+		    OR EXISTS (SELECT 1 FROM users u WHERE u.client_token=$1
+		               AND (u.disabled OR EXISTS (SELECT 1 FROM node_bans b WHERE b.user_id=u.id)))
+		    OR EXISTS (SELECT 1 FROM node_tokens t JOIN node_bans b ON b.org_id=t.org_id WHERE t.token=$1)`, token)
+	return blocked, err
+}
+
+func (db *DB) GetGlobalStats(ctx context.Context) (*GlobalStats, error) {
+	var s GlobalStats
+	err := db.GetContext(ctx, &s, `
+		SELECT
+			(SELECT COUNT(*) FROM users) AS users,
+			(SELECT COUNT(*) FROM users WHERE disabled) AS disabled_users,
+			(SELECT COUNT(*) FROM organizations) AS organizations,
+			(SELECT COUNT(*) FROM api_keys) AS api_keys,
+			(SELECT COALESCE(SUM(total_api_calls), 0) FROM users) +
+				(SELECT COALESCE(SUM(total_api_calls), 0) FROM organizations) AS total_api_calls,
+			(SELECT COALESCE(SUM(total_provided_calls), 0) FROM users) +
+				(SELECT COALESCE(SUM(total_provided_calls), 0) FROM organizations) AS total_provided_calls,
+			(SELECT COUNT(*) FROM node_bans) AS node_bans`)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Purposes of stored files
+const (
+	FilePurposeBatch       = "batch"        // input of a batch, uploaded by its owner
+	FilePurposeBatchOutput = "batch_output" // results or errors written by a batch
+)
+
+// Batch statuses. Batches start out validating; completed, failed, cancelled and expired
+// are final.
+const (
+	BatchValidating = "validating"
+	BatchInProgress = "in_progress"
+	BatchCancelling = "cancelling"
+	BatchCompleted  = "completed"
+	BatchFailed     = "failed"
+	BatchCancelled  = "cancelled"
+	BatchExpired    = "expired"
+)
+
+// File is a file uploaded with an API key, or written for it by a batch.
+type File struct {
+	ID        string    `db:"id"`
+	APIKey    string    `db:"api_key"`
+	Purpose   string    `db:"purpose"`
+	Filename  string    `db:"filename"`
+	Bytes     int64     `db:"bytes"`
+	Content   []byte    `db:"content"` // only loaded by GetFileContent
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Batch is a set of requests from an input file, run in the background.
+type Batch struct {
+	ID               string       `db:"id"`
+	APIKey           string       `db:"api_key"`
+	Endpoint         string       `db:"endpoint"`
+	InputFileID      string       `db:"input_file_id"`
+	OutputFileID     string       `db:"output_file_id"` // "" until the batch ends with results
+	ErrorFileID      string       `db:"error_file_id"`  // "" until the batch ends with failed requests
+	CompletionWindow string       `db:"completion_window"`
+	Status           string       `db:"status"`
+	Errors           string       `db:"errors"`   // JSON list of the input file's problems, if it failed validation
+	Metadata         string       `db:"metadata"` // JSON object set by the caller, "" if none
+	Total            int          `db:"total"`
+	Completed        int          `db:"completed"`
+	Failed           int          `db:"failed"`
+	CreatedAt        time.Time    `db:"created_at"`
+	ExpiresAt        time.Time    `db:"expires_at"`
+	InProgressAt     sql.NullTime `db:"in_progress_at"`
+	CancellingAt     sql.NullTime `db:"cancelling_at"`
+	FinishedAt       sql.NullTime `db:"finished_at"`
+}
+
+// BatchResult is the outcome of one request of a batch, kept until the batch ends and its
+// results are written to files.
+type BatchResult struct {
+	BatchID string `db:"batch_id"`
+	Line    int    `db:"line"` // of the request in the input file, from 1
+	Failed  bool   `db:"failed"`
+	Output  string `db:"output"` // JSON line for the output or error file
+}
+
+const fileColumns = "id, api_key, purpose, filename, bytes, created_at"
+
+func (db *DB) CreateFile(ctx context.Context, f *File) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO files (id, api_key, purpose, filename, bytes, content, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		f.ID, f.APIKey, f.Purpose, f.Filename, f.Bytes, f.Content, f.CreatedAt.UTC())
+	return err
+}
+
+// GetFile returns the file with the given ID owned by apiKey, without its content.
+func (db *DB) GetFile(ctx context.Context, apiKey, id string) (*File, error) {
+	var f File
+	err := db.GetContext(ctx, &f, "SELECT "+fileColumns+" FROM files WHERE api_key=$1 AND id=$2", apiKey, id)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (db *DB) GetFileContent(ctx context.Context, apiKey, id string) ([]byte, error) {
+	var content []byte
+	err := db.GetContext(ctx, &content, "SELECT content FROM files WHERE api_key=$1 AND id=$2", apiKey, id)
+	return content, err
+}
+
+// ListFiles returns the files of apiKey without their content, newest first.
+func (db *DB) ListFiles(ctx context.Context, apiKey string, limit, offset int) ([]File, error) {
+	files := []File{}
+	err := db.SelectContext(ctx, &files, `
+		SELECT `+fileColumns+` FROM files WHERE api_key=$1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`, apiKey, limit, offset)
+	return files, err
+}
+
+func (db *DB) DeleteFile(ctx context.Context, apiKey, id string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM files WHERE api_key=$1 AND id=$2", apiKey, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (db *DB) CreateBatch(ctx context.Context, b *Batch) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO batches (id, api_key, endpoint, input_file_id, completion_window, status, metadata, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		b.ID, b.APIKey, b.Endpoint, b.InputFileID, b.CompletionWindow, b.Status, b.Metadata,
+		b.CreatedAt.UTC(), b.ExpiresAt.UTC())
+	return err
+}
+
+// GetBatch returns the batch with the given ID created with apiKey.
+func (db *DB) GetBatch(ctx context.Context, apiKey, id string) (*Batch, error) {
+	var b Batch
+	err := db.GetContext(ctx, &b, "SELECT * FROM batches WHERE api_key=$1 AND id=$2", apiKey, id)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ListBatches returns the batches of apiKey, newest first.
+func (db *DB) ListBatches(ctx context.Context, apiKey string, limit, offset int) ([]Batch, error) {
+	batches := []Batch{}
+	err := db.SelectContext(ctx, &batches, `
+		SELECT * FROM batches WHERE api_key=$1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`, apiKey, limit, offset)
+	return batches, err
+}
+
+// ListActiveBatches returns the batches of every key that haven't ended, oldest first.
+func (db *DB) ListActiveBatches(ctx context.Context) ([]Batch, error) {
+	batches := []Batch{}
+	err := db.SelectContext(ctx, &batches, `
+		SELECT * FROM batches WHERE status IN ($1, $2, $3) ORDER BY created_at, id`,
+		BatchValidating, BatchInProgress, BatchCancelling)
+	return batches, err
+}
+
+// StartBatch moves a validated batch of total requests into progress. It returns
+// sql.ErrNoRows if the batch isn't validating any more.
+func (db *DB) StartBatch(ctx context.Context, id string, total int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE batches SET status=$1, total=$2, in_progress_at=$3 WHERE id=$4 AND status=$5`,
+		BatchInProgress, total, time.Now().UTC(), id, BatchValidating)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// CancelBatch asks for a batch of apiKey to be cancelled. It returns sql.ErrNoRows if
+// there is no such batch or it can't be cancelled any more.
+func (db *DB) CancelBatch(ctx context.Context, apiKey, id string) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE batches SET status=$1, cancelling_at=$2 WHERE api_key=$3 AND id=$4 AND status IN ($5, $6)`,
+		BatchCancelling, time.Now().UTC(), apiKey, id, BatchValidating, BatchInProgress)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// SaveBatchResult stores the result of one request of a batch and counts it. A result
+// already stored for the request is kept.
+func (db *DB) SaveBatchResult(ctx context.Context, r *BatchResult) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO batch_results (batch_id, line, failed, output) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (batch_id, line) DO NOTHING`, r.BatchID, r.Line, r.Failed, r.Output)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	counter := "completed"
+	if r.Failed {
+		counter = "failed"
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE batches SET "+counter+"="+counter+"+1 WHERE id=$1", r.BatchID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListBatchResults returns the results stored for a batch, in order of their lines.
+func (db *DB) ListBatchResults(ctx context.Context, batchID string) ([]BatchResult, error) {
+	results := []BatchResult{}
+	err := db.SelectContext(ctx, &results, "SELECT * FROM batch_results WHERE batch_id=$1 ORDER BY line", batchID)
+	return results, err
+}
+
+// FinishBatch ends a batch with b.Status, storing the files it wrote and the IDs and errors
+// set in b, and drops its stored results. It returns sql.ErrNoRows if the batch has ended
+// already.
+func (db *DB) FinishBatch(ctx context.Context, b *Batch, files []File) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, f := range files {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO files (id, api_key, purpose, filename, bytes, content, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			f.ID, f.APIKey, f.Purpose, f.Filename, f.Bytes, f.Content, f.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE batches SET status=$1, output_file_id=$2, error_file_id=$3, errors=$4, finished_at=$5
+		WHERE id=$6 AND status IN ($7, $8, $9)`,
+		b.Status, b.OutputFileID, b.ErrorFileID, b.Errors, time.Now().UTC(), b.ID,
+		BatchValidating, BatchInProgress, BatchCancelling)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM batch_results WHERE batch_id=$1", b.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
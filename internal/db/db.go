@@ -2,16 +2,27 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"strings"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 )
 
+// DB is the sqlx-backed Store. Queries are written for Postgres and adapted on the fly
+// when the connection is SQLite (see rebind).
 type DB struct {
 	*sqlx.DB
+	dialect string
 }
 
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
 type User struct {
 	ID                 int    `db:"id" json:"id"`
 	Email              string `db:"email" json:"email"`
@@ -20,13 +31,41 @@ type User struct {
 	ClientToken        string `db:"client_token" json:"client_token"`
 	TotalAPICalls      int    `db:"total_api_calls" json:"total_api_calls"`
 	TotalProvidedCalls int    `db:"total_provided_calls" json:"total_provided_calls"`
+	IsAdmin            bool   `db:"is_admin" json:"is_admin"`
+	Disabled           bool   `db:"disabled" json:"disabled"`
 }
 
 type APIKeyRecord struct {
-	ID            int    `db:"id"`
-	APIKey        string `db:"api_key"`
-	AllowedModels string `db:"allowed_models"` // comma separated string e.g. "gpt-3.5-turbo,gpt-4"
-	RPM           int    `db:"rpm"`            // requests per minute limit
+	ID            int           `db:"id"`
+	APIKey        string        `db:"api_key"`
+	AllowedModels string        `db:"allowed_models"` // comma separated string e.g. "gpt-3.5-turbo,gpt-4"
+	RPM           int           `db:"rpm"`            // requests per minute limit
+	OrgID         sql.NullInt64 `db:"org_id"`         // owning organization, NULL for personal keys
+	Disabled      bool          `db:"disabled"`
+	TPM           int           `db:"tpm"`            // tokens per minute limit, 0 means unlimited
+	ModelLimits   string        `db:"model_limits"`   // JSON object e.g. {"gpt-4":{"rpm":10,"tpm":20000}}
+	MaxConcurrent int           `db:"max_concurrent"` // in-flight request limit, 0 means unlimited
+	LogContent    bool          `db:"log_content"`    // keep prompts and completions in the request log
+
+	RequireEncryption bool   `db:"require_encryption"` // only route to nodes that take end-to-end encrypted requests
+	AllowVerification bool   `db:"allow_verification"` // requests may be replayed on a trusted node to check the answer
+	MinNodeTier       string `db:"min_node_tier"`      // lowest trust tier of the nodes serving the key, "" for any
+
+	Priority    string `db:"priority"`     // PriorityInteractive or PriorityBatch
+	ShareWeight int    `db:"share_weight"` // relative share of busy nodes, see server.Hub
+}
+
+// Priority classes of API keys. Queued interactive requests go to nodes before batch ones.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// ModelLimit is a per-model rate limit applied on top of the key-wide RPM/TPM.
+// Zero fields leave that dimension unlimited at the model level.
+type ModelLimit struct {
+	RPM int `json:"rpm"`
+	TPM int `json:"tpm"`
 }
 
 // AllowedModelList returns a slice of allowed models
@@ -37,43 +76,92 @@ func (a *APIKeyRecord) AllowedModelList() []string {
 	return strings.Split(a.AllowedModels, ",")
 }
 
+// AllowsModel reports whether the key may be used with model.
+func (a *APIKeyRecord) AllowsModel(model string) bool {
+	for _, m := range a.AllowedModelList() {
+		if m == "*" || m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelLimitFor returns the key's specific limit for model, if one is configured.
+func (a *APIKeyRecord) ModelLimitFor(model string) (ModelLimit, bool) {
+	if a.ModelLimits == "" {
+		return ModelLimit{}, false
+	}
+	var limits map[string]ModelLimit
+	if err := json.Unmarshal([]byte(a.ModelLimits), &limits); err != nil {
+		return ModelLimit{}, false
+	}
+	l, ok := limits[model]
+	return l, ok
+}
+
 func Connect(dsn string) (*DB, error) {
 	conn, err := sqlx.Connect("pgx", dsn)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{DB: conn}, nil
-}
-
-func (db *DB) InitializeSchema() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS api_keys (
-		id SERIAL PRIMARY KEY,
-		api_key VARCHAR(100) UNIQUE NOT NULL,
-		allowed_models VARCHAR(255) NOT NULL DEFAULT '*',
-		rpm INTEGER NOT NULL DEFAULT 60
-	);
-
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		email VARCHAR(255) UNIQUE NOT NULL,
-		password_hash VARCHAR(255) NOT NULL,
-		api_token VARCHAR(100) UNIQUE NOT NULL,
-		client_token VARCHAR(100) UNIQUE NOT NULL,
-		total_api_calls INTEGER DEFAULT 0,
-		total_provided_calls INTEGER DEFAULT 0
-	);
-	`
-	_, err := db.Exec(schema)
+	return &DB{DB: conn, dialect: DialectPostgres}, nil
+}
+
+// Dialect returns DialectPostgres or DialectSQLite.
+func (db *DB) Dialect() string {
+	return db.dialect
+}
+
+// rebind adapts a query written for Postgres to the connected dialect. SQLite understands
+// $N placeholders, RETURNING and ON CONFLICT natively, so only a few functions differ.
+func (db *DB) rebind(query string) string {
+	if db.dialect != DialectSQLite {
+		return query
+	}
+	return sqliteReplacer.Replace(query)
+}
+
+var sqliteReplacer = strings.NewReplacer(
+	"NOW()", "CURRENT_TIMESTAMP",
+	"ILIKE", "LIKE", // LIKE is already case-insensitive for ASCII in SQLite
+)
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.rebind(query), args...)
+}
+
+func (db *DB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return db.DB.GetContext(ctx, dest, db.rebind(query), args...)
+}
+
+func (db *DB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return db.DB.SelectContext(ctx, dest, db.rebind(query), args...)
+}
+
+// tx is a transaction that applies the same query rewriting as DB.
+type tx struct {
+	*sqlx.Tx
+	db *DB
+}
+
+func (db *DB) begin(ctx context.Context) (*tx, error) {
+	t, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &tx{Tx: t, db: db}, nil
+}
 
-	// Backward compatibility migrations
-	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS total_api_calls INTEGER DEFAULT 0;`)
-	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS total_provided_calls INTEGER DEFAULT 0;`)
+func (t *tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.db.rebind(query), args...)
+}
 
-	return nil
+func (t *tx) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.GetContext(ctx, dest, t.db.rebind(query), args...)
+}
+
+func (t *tx) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.SelectContext(ctx, dest, t.db.rebind(query), args...)
 }
 
 func (db *DB) GetAPIKey(ctx context.Context, key string) (*APIKeyRecord, error) {
@@ -105,12 +193,31 @@ func (db *DB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	return &u, nil
 }
 
+// IncrementAPICalls bumps the call counter of whoever owns apiToken: the user for
+// personal keys, the organization for org keys. An organization's count for its quota
+// restarts at the first call of each month.
 func (db *DB) IncrementAPICalls(ctx context.Context, apiToken string) error {
 	_, err := db.ExecContext(ctx, "UPDATE users SET total_api_calls = total_api_calls + 1 WHERE api_token=$1", apiToken)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE organizations SET total_api_calls = total_api_calls + 1,
+			period_api_calls = CASE WHEN quota_period = $2 THEN period_api_calls + 1 ELSE 1 END,
+			quota_period = $2
+		WHERE id = (SELECT org_id FROM api_keys WHERE api_key=$1)`, apiToken, quotaPeriod(time.Now()))
 	return err
 }
 
+// IncrementProvidedCalls bumps the provided counter of whoever owns clientToken: the user
+// for personal client tokens, the organization for org node tokens.
 func (db *DB) IncrementProvidedCalls(ctx context.Context, clientToken string) error {
 	_, err := db.ExecContext(ctx, "UPDATE users SET total_provided_calls = total_provided_calls + 1 WHERE client_token=$1", clientToken)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE organizations SET total_provided_calls = total_provided_calls + 1
+		WHERE id = (SELECT org_id FROM node_tokens WHERE token=$1)`, clientToken)
 	return err
 }
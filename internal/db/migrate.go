@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the numbered schema changes for each dialect, named
+// migrations/<dialect>/NNNN_name.up.sql and NNNN_name.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock key held while migrating.
+const migrationLockID = 0x636f6c696e6b // "colink"
+
+const schemaMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration and when it was applied, if it has been.
+type MigrationState struct {
+	Version   int          `db:"version"`
+	Name      string       `db:"name"`
+	AppliedAt sql.NullTime `db:"applied_at"`
+}
+
+// migrations returns the embedded migrations for the connected dialect in version order.
+func (db *DB) migrations() ([]Migration, error) {
+	dir := "migrations/" + db.dialect
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		file := e.Name()
+		base, up := strings.CutSuffix(file, ".up.sql")
+		if !up {
+			var down bool
+			if base, down = strings.CutSuffix(file, ".down.sql"); !down {
+				continue
+			}
+		}
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("malformed migration file name %q", file)
+		}
+		body, err := fs.ReadFile(migrationFiles, dir+"/"+file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has files named both %q and %q", version, m.Name, name)
+		}
+		if up {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// migrationTx starts the transaction a migration run happens in. It holds the migration
+// lock until commit so instances starting together never apply the same migration twice:
+// an advisory lock on Postgres, the IMMEDIATE write lock on SQLite (see OpenSQLite).
+func (db *DB) migrationTx(ctx context.Context) (*tx, error) {
+	t, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if db.dialect == DialectPostgres {
+		if _, err := t.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+			t.Rollback()
+			return nil, err
+		}
+	}
+	if _, err := t.ExecContext(ctx, schemaMigrationsTable); err != nil {
+		t.Rollback()
+		return nil, err
+	}
+	return t, nil
+}
+
+func appliedMigrations(ctx context.Context, t *tx) ([]MigrationState, error) {
+	applied := []MigrationState{}
+	err := t.SelectContext(ctx, &applied, "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	return applied, err
+}
+
+// MigrateUp applies every pending migration in order and returns the ones it applied.
+// The run is a single transaction: if any migration fails, none of them are applied.
+func (db *DB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	all, err := db.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.migrationTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+
+	applied, err := appliedMigrations(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	var ran []Migration
+	for _, m := range all {
+		if done[m.Version] {
+			continue
+		}
+		if _, err := t.ExecContext(ctx, m.Up); err != nil {
+			return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := t.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		ran = append(ran, m)
+	}
+
+	return ran, t.Commit()
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and returns them.
+func (db *DB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	all, err := db.migrations()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int]Migration, len(all))
+	for _, m := range all {
+		known[m.Version] = m
+	}
+
+	t, err := db.migrationTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+
+	applied, err := appliedMigrations(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for i := len(applied) - 1; i >= 0 && len(ran) < steps; i-- {
+		m, ok := known[applied[i].Version]
+		if !ok {
+			return nil, fmt.Errorf("migration %04d_%s is applied but unknown to this binary", applied[i].Version, applied[i].Name)
+		}
+		if _, err := t.ExecContext(ctx, m.Down); err != nil {
+			return nil, fmt.Errorf("reverting migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := t.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1", m.Version); err != nil {
+			return nil, err
+		}
+		ran = append(ran, m)
+	}
+
+	return ran, t.Commit()
+}
+
+// MigrationStatus lists every known or applied migration in version order.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	all, err := db.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.migrationTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+
+	applied, err := appliedMigrations(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[int]MigrationState)
+	for _, m := range all {
+		states[m.Version] = MigrationState{Version: m.Version, Name: m.Name}
+	}
+	for _, a := range applied {
+		states[a.Version] = a
+	}
+
+	list := make([]MigrationState, 0, len(states))
+	for _, s := range states {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, t.Commit()
+}
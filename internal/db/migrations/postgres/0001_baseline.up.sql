@@ -0,0 +1,75 @@
+-- Baseline: the schema previously created by InitializeSchema. Every statement is
+-- idempotent so databases created before migrations existed adopt it unchanged.
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	api_key VARCHAR(100) UNIQUE NOT NULL,
+	allowed_models VARCHAR(255) NOT NULL DEFAULT '*',
+	rpm INTEGER NOT NULL DEFAULT 60
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	email VARCHAR(255) UNIQUE NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	api_token VARCHAR(100) UNIQUE NOT NULL,
+	client_token VARCHAR(100) UNIQUE NOT NULL,
+	total_api_calls INTEGER DEFAULT 0,
+	total_provided_calls INTEGER DEFAULT 0
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS total_api_calls INTEGER DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS total_provided_calls INTEGER DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS organizations (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	total_api_calls INTEGER NOT NULL DEFAULT 0,
+	total_provided_calls INTEGER NOT NULL DEFAULT 0,
+	api_call_quota INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role VARCHAR(20) NOT NULL DEFAULT 'member',
+	joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (org_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS org_invitations (
+	id SERIAL PRIMARY KEY,
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	email VARCHAR(255) NOT NULL,
+	role VARCHAR(20) NOT NULL DEFAULT 'member',
+	token VARCHAR(100) UNIQUE NOT NULL,
+	invited_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	accepted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS node_tokens (
+	id SERIAL PRIMARY KEY,
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL DEFAULT '',
+	token VARCHAR(100) UNIQUE NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tpm INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS model_limits TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS max_concurrent INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS node_bans (
+	token VARCHAR(100) PRIMARY KEY,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,23 @@
+CREATE TABLE request_logs (
+	id BIGSERIAL PRIMARY KEY,
+	request_id VARCHAR(64) NOT NULL,
+	api_key VARCHAR(100) NOT NULL,
+	node_id VARCHAR(150) NOT NULL DEFAULT '',
+	model VARCHAR(255) NOT NULL,
+	stream BOOLEAN NOT NULL DEFAULT FALSE,
+	status INTEGER NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	first_chunk_ms INTEGER NOT NULL DEFAULT 0,
+	latency_ms INTEGER NOT NULL DEFAULT 0,
+	prompt_tokens INTEGER NOT NULL DEFAULT 0,
+	completion_tokens INTEGER NOT NULL DEFAULT 0,
+	total_tokens INTEGER NOT NULL DEFAULT 0,
+	prompt TEXT,
+	completion TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX request_logs_api_key_idx ON request_logs (api_key, created_at);
+CREATE INDEX request_logs_created_at_idx ON request_logs (created_at);
+
+ALTER TABLE api_keys ADD COLUMN log_content BOOLEAN NOT NULL DEFAULT FALSE;
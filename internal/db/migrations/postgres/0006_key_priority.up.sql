@@ -0,0 +1,2 @@
+ALTER TABLE api_keys ADD COLUMN priority VARCHAR(20) NOT NULL DEFAULT 'interactive';
+ALTER TABLE api_keys ADD COLUMN share_weight INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+DROP TABLE batch_results;
+DROP TABLE batches;
+DROP TABLE files;
@@ -0,0 +1,43 @@
+CREATE TABLE files (
+	id VARCHAR(64) PRIMARY KEY,
+	api_key VARCHAR(100) NOT NULL,
+	purpose VARCHAR(32) NOT NULL,
+	filename VARCHAR(255) NOT NULL DEFAULT '',
+	bytes BIGINT NOT NULL DEFAULT 0,
+	content BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX files_api_key_idx ON files (api_key, created_at);
+
+CREATE TABLE batches (
+	id VARCHAR(64) PRIMARY KEY,
+	api_key VARCHAR(100) NOT NULL,
+	endpoint VARCHAR(100) NOT NULL,
+	input_file_id VARCHAR(64) NOT NULL,
+	output_file_id VARCHAR(64) NOT NULL DEFAULT '',
+	error_file_id VARCHAR(64) NOT NULL DEFAULT '',
+	completion_window VARCHAR(20) NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	errors TEXT NOT NULL DEFAULT '',
+	metadata TEXT NOT NULL DEFAULT '',
+	total INTEGER NOT NULL DEFAULT 0,
+	completed INTEGER NOT NULL DEFAULT 0,
+	failed INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	in_progress_at TIMESTAMPTZ,
+	cancelling_at TIMESTAMPTZ,
+	finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX batches_api_key_idx ON batches (api_key, created_at);
+CREATE INDEX batches_status_idx ON batches (status);
+
+CREATE TABLE batch_results (
+	batch_id VARCHAR(64) NOT NULL,
+	line INTEGER NOT NULL,
+	failed BOOLEAN NOT NULL,
+	output TEXT NOT NULL,
+	PRIMARY KEY (batch_id, line)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE node_bans DROP COLUMN org_id;
+ALTER TABLE node_bans DROP COLUMN user_id;
@@ -0,0 +1,2 @@
+-- Merged records stay merged, under their owner
+ALTER TABLE node_reputation RENAME COLUMN owner TO token;
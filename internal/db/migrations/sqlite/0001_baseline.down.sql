@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS node_bans;
+DROP TABLE IF EXISTS node_tokens;
+DROP TABLE IF EXISTS org_invitations;
+DROP TABLE IF EXISTS org_members;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS organizations;
+DROP TABLE IF EXISTS users;
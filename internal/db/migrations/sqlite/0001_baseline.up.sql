@@ -0,0 +1,68 @@
+-- Baseline: the schema previously created by InitializeSchema.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email VARCHAR(255) UNIQUE NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	api_token VARCHAR(100) UNIQUE NOT NULL,
+	client_token VARCHAR(100) UNIQUE NOT NULL,
+	total_api_calls INTEGER DEFAULT 0,
+	total_provided_calls INTEGER DEFAULT 0,
+	is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS organizations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	total_api_calls INTEGER NOT NULL DEFAULT 0,
+	total_provided_calls INTEGER NOT NULL DEFAULT 0,
+	api_call_quota INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	api_key VARCHAR(100) UNIQUE NOT NULL,
+	allowed_models VARCHAR(255) NOT NULL DEFAULT '*',
+	rpm INTEGER NOT NULL DEFAULT 60,
+	org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	tpm INTEGER NOT NULL DEFAULT 0,
+	model_limits TEXT NOT NULL DEFAULT '',
+	max_concurrent INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role VARCHAR(20) NOT NULL DEFAULT 'member',
+	joined_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (org_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS org_invitations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	email VARCHAR(255) NOT NULL,
+	role VARCHAR(20) NOT NULL DEFAULT 'member',
+	token VARCHAR(100) UNIQUE NOT NULL,
+	invited_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	accepted_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS node_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL DEFAULT '',
+	token VARCHAR(100) UNIQUE NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS node_bans (
+	token VARCHAR(100) PRIMARY KEY,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
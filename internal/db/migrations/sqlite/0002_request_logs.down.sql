@@ -0,0 +1,2 @@
+ALTER TABLE api_keys DROP COLUMN log_content;
+DROP TABLE request_logs;
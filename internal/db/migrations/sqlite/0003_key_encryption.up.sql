@@ -0,0 +1 @@
+ALTER TABLE api_keys ADD COLUMN require_encryption BOOLEAN NOT NULL DEFAULT FALSE;
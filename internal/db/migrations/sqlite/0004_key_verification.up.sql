@@ -0,0 +1 @@
+ALTER TABLE api_keys ADD COLUMN allow_verification BOOLEAN NOT NULL DEFAULT FALSE;
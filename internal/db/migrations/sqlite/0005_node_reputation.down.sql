@@ -0,0 +1,3 @@
+ALTER TABLE api_keys DROP COLUMN min_node_tier;
+DROP TABLE node_reports;
+DROP TABLE node_reputation;
@@ -0,0 +1,25 @@
+CREATE TABLE node_reputation (
+	token VARCHAR(100) PRIMARY KEY,
+	first_seen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	online_seconds INTEGER NOT NULL DEFAULT 0,
+	requests INTEGER NOT NULL DEFAULT 0,
+	errors INTEGER NOT NULL DEFAULT 0,
+	verification_score REAL NOT NULL DEFAULT 1,
+	verifications_passed INTEGER NOT NULL DEFAULT 0,
+	verifications_failed INTEGER NOT NULL DEFAULT 0,
+	last_failure TEXT NOT NULL DEFAULT '',
+	reports INTEGER NOT NULL DEFAULT 0,
+	tier_override VARCHAR(20) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE node_reports (
+	request_id VARCHAR(64) PRIMARY KEY,
+	token VARCHAR(100) NOT NULL,
+	api_key VARCHAR(100) NOT NULL,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX node_reports_token_idx ON node_reports (token, created_at);
+
+ALTER TABLE api_keys ADD COLUMN min_node_tier VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- A ban covers every token of the user or organization owning the banned token
+ALTER TABLE node_bans ADD COLUMN user_id INTEGER;
+ALTER TABLE node_bans ADD COLUMN org_id INTEGER;
+
+UPDATE node_bans SET
+	user_id = (SELECT id FROM users WHERE client_token = node_bans.token),
+	org_id = (SELECT org_id FROM node_tokens WHERE token = node_bans.token);
@@ -0,0 +1 @@
+ALTER TABLE request_logs ADD COLUMN cached BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+ALTER TABLE organizations DROP COLUMN quota_period;
+ALTER TABLE organizations DROP COLUMN period_api_calls;
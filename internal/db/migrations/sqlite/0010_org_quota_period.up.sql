@@ -0,0 +1,3 @@
+-- API calls counted against the quota reset every calendar month (UTC)
+ALTER TABLE organizations ADD COLUMN period_api_calls INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE organizations ADD COLUMN quota_period VARCHAR(7) NOT NULL DEFAULT '';
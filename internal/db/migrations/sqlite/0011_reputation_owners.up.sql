@@ -0,0 +1,30 @@
+-- Reputation belongs to the user or organization running the nodes ("user:<id>" or
+-- "org:<id>"), so that a fresh token doesn't start over with a clean record. The records
+-- of an owner's tokens are merged.
+CREATE TABLE node_reputation_owners (
+	owner VARCHAR(100) PRIMARY KEY,
+	first_seen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	online_seconds INTEGER NOT NULL DEFAULT 0,
+	requests INTEGER NOT NULL DEFAULT 0,
+	errors INTEGER NOT NULL DEFAULT 0,
+	verification_score REAL NOT NULL DEFAULT 1,
+	verifications_passed INTEGER NOT NULL DEFAULT 0,
+	verifications_failed INTEGER NOT NULL DEFAULT 0,
+	last_failure TEXT NOT NULL DEFAULT '',
+	reports INTEGER NOT NULL DEFAULT 0,
+	tier_override VARCHAR(20) NOT NULL DEFAULT ''
+);
+
+INSERT INTO node_reputation_owners
+SELECT owner, MIN(first_seen), SUM(online_seconds), SUM(requests), SUM(errors), MIN(verification_score),
+	SUM(verifications_passed), SUM(verifications_failed), MAX(last_failure), SUM(reports), MAX(tier_override)
+FROM (
+	SELECT COALESCE('user:' || u.id, 'org:' || t.org_id, r.token) AS owner, r.*
+	FROM node_reputation r
+	LEFT JOIN users u ON u.client_token = r.token
+	LEFT JOIN node_tokens t ON t.token = r.token
+) merged
+GROUP BY owner;
+
+DROP TABLE node_reputation;
+ALTER TABLE node_reputation_owners RENAME TO node_reputation;
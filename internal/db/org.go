@@ -0,0 +1,327 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Organization member roles, ordered from most to least privileged.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// ValidOrgRole reports whether role is one of the known organization roles.
+func ValidOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+// OrgRoleAtLeast reports whether role grants at least the privileges of min.
+func OrgRoleAtLeast(role, min string) bool {
+	rank := map[string]int{OrgRoleMember: 1, OrgRoleAdmin: 2, OrgRoleOwner: 3}
+	return rank[role] >= rank[min]
+}
+
+type Organization struct {
+	ID                 int       `db:"id" json:"id"`
+	Name               string    `db:"name" json:"name"`
+	TotalAPICalls      int       `db:"total_api_calls" json:"total_api_calls"`
+	TotalProvidedCalls int       `db:"total_provided_calls" json:"total_provided_calls"`
+	APICallQuota       int       `db:"api_call_quota" json:"api_call_quota"` // monthly, 0 means unlimited
+	PeriodAPICalls     int       `db:"period_api_calls" json:"period_api_calls"`
+	QuotaPeriod        string    `db:"quota_period" json:"quota_period"` // month PeriodAPICalls counts, e.g. "2024-05"
+	CreatedAt          time.Time `db:"created_at" json:"created_at"`
+}
+
+// quotaPeriod returns the quota period t falls in. Quotas reset every calendar month, UTC.
+func quotaPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// rollPeriod zeroes the period count when it belongs to a month before now.
+func (o *Organization) rollPeriod(now time.Time) {
+	if period := quotaPeriod(now); o.QuotaPeriod != period {
+		o.QuotaPeriod, o.PeriodAPICalls = period, 0
+	}
+}
+
+// QuotaExceeded reports whether the organization has used up this month's API call quota.
+func (o *Organization) QuotaExceeded() bool {
+	return o.APICallQuota > 0 && o.QuotaPeriod == quotaPeriod(time.Now()) && o.PeriodAPICalls >= o.APICallQuota
+}
+
+// OrgMembership is an organization as seen by one of its members.
+type OrgMembership struct {
+	Organization
+	Role string `db:"role" json:"role"`
+}
+
+type OrgMember struct {
+	UserID   int       `db:"user_id" json:"user_id"`
+	Email    string    `db:"email" json:"email"`
+	Role     string    `db:"role" json:"role"`
+	JoinedAt time.Time `db:"joined_at" json:"joined_at"`
+}
+
+type OrgInvitation struct {
+	ID        int          `db:"id" json:"id"`
+	OrgID     int          `db:"org_id" json:"org_id"`
+	OrgName   string       `db:"org_name" json:"org_name"`
+	Email     string       `db:"email" json:"email"`
+	Role      string       `db:"role" json:"role"`
+	Token     string       `db:"token" json:"token"`
+	InvitedBy int          `db:"invited_by" json:"invited_by"`
+	CreatedAt time.Time    `db:"created_at" json:"created_at"`
+	ExpiresAt time.Time    `db:"expires_at" json:"expires_at"`
+	Accepted  sql.NullTime `db:"accepted_at" json:"-"`
+}
+
+type NodeToken struct {
+	ID        int       `db:"id" json:"id"`
+	OrgID     int       `db:"org_id" json:"org_id"`
+	Name      string    `db:"name" json:"name"`
+	Token     string    `db:"token" json:"token"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// CreateOrganization creates an organization and makes ownerID its owner.
+func (db *DB) CreateOrganization(ctx context.Context, name string, ownerID int) (*Organization, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var org Organization
+	err = tx.GetContext(ctx, &org, "INSERT INTO organizations (name) VALUES ($1) RETURNING *", name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)",
+		org.ID, ownerID, OrgRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &org, tx.Commit()
+}
+
+func (db *DB) GetOrganization(ctx context.Context, orgID int) (*Organization, error) {
+	var org Organization
+	err := db.GetContext(ctx, &org, "SELECT * FROM organizations WHERE id=$1", orgID)
+	if err != nil {
+		return nil, err
+	}
+	org.rollPeriod(time.Now())
+	return &org, nil
+}
+
+func (db *DB) UpdateOrganization(ctx context.Context, orgID int, name string, quota int) error {
+	_, err := db.ExecContext(ctx, "UPDATE organizations SET name=$1, api_call_quota=$2 WHERE id=$3", name, quota, orgID)
+	return err
+}
+
+func (db *DB) DeleteOrganization(ctx context.Context, orgID int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM organizations WHERE id=$1", orgID)
+	return err
+}
+
+// ListUserOrganizations returns every organization the user belongs to along with their role.
+func (db *DB) ListUserOrganizations(ctx context.Context, userID int) ([]OrgMembership, error) {
+	orgs := []OrgMembership{}
+	err := db.SelectContext(ctx, &orgs, `
+		SELECT o.*, m.role FROM organizations o
+		JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id=$1 ORDER BY o.id`, userID)
+	for i := range orgs {
+		orgs[i].rollPeriod(time.Now())
+	}
+	return orgs, err
+}
+
+// GetOrgRole returns the user's role in the organization, or sql.ErrNoRows if they are not a member.
+func (db *DB) GetOrgRole(ctx context.Context, orgID, userID int) (string, error) {
+	var role string
+	err := db.GetContext(ctx, &role, "SELECT role FROM org_members WHERE org_id=$1 AND user_id=$2", orgID, userID)
+	return role, err
+}
+
+func (db *DB) ListOrgMembers(ctx context.Context, orgID int) ([]OrgMember, error) {
+	members := []OrgMember{}
+	err := db.SelectContext(ctx, &members, `
+		SELECT m.user_id, u.email, m.role, m.joined_at FROM org_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id=$1 ORDER BY m.joined_at`, orgID)
+	return members, err
+}
+
+func (db *DB) SetOrgMemberRole(ctx context.Context, orgID, userID int, role string) error {
+	res, err := db.ExecContext(ctx, "UPDATE org_members SET role=$1 WHERE org_id=$2 AND user_id=$3", role, orgID, userID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (db *DB) RemoveOrgMember(ctx context.Context, orgID, userID int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM org_members WHERE org_id=$1 AND user_id=$2", orgID, userID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// CountOrgOwners is used to prevent an organization from losing its last owner.
+func (db *DB) CountOrgOwners(ctx context.Context, orgID int) (int, error) {
+	var n int
+	err := db.GetContext(ctx, &n, "SELECT COUNT(*) FROM org_members WHERE org_id=$1 AND role=$2", orgID, OrgRoleOwner)
+	return n, err
+}
+
+func (db *DB) CreateOrgInvitation(ctx context.Context, orgID int, email, role, token string, invitedBy int, ttl time.Duration) (*OrgInvitation, error) {
+	var inv OrgInvitation
+	err := db.GetContext(ctx, &inv, `
+		INSERT INTO org_invitations (org_id, email, role, token, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *, (SELECT name FROM organizations WHERE id=$1) AS org_name`,
+		orgID, email, role, token, invitedBy, time.Now().UTC().Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// ListOrgInvitations returns the organization's invitations that are still pending.
+// Expiry times are written and compared in UTC: SQLite compares them as text.
+func (db *DB) ListOrgInvitations(ctx context.Context, orgID int) ([]OrgInvitation, error) {
+	invs := []OrgInvitation{}
+	err := db.SelectContext(ctx, &invs, `
+		SELECT i.*, o.name AS org_name FROM org_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.org_id=$1 AND i.accepted_at IS NULL AND i.expires_at > $2
+		ORDER BY i.id`, orgID, time.Now().UTC())
+	return invs, err
+}
+
+// ListInvitationsForEmail returns pending invitations addressed to email.
+func (db *DB) ListInvitationsForEmail(ctx context.Context, email string) ([]OrgInvitation, error) {
+	invs := []OrgInvitation{}
+	err := db.SelectContext(ctx, &invs, `
+		SELECT i.*, o.name AS org_name FROM org_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE LOWER(i.email)=LOWER($1) AND i.accepted_at IS NULL AND i.expires_at > $2
+		ORDER BY i.id`, email, time.Now().UTC())
+	return invs, err
+}
+
+func (db *DB) DeleteOrgInvitation(ctx context.Context, orgID, invitationID int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM org_invitations WHERE org_id=$1 AND id=$2", orgID, invitationID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// AcceptOrgInvitation adds the user to the invitation's organization. The invitation must be
+// pending, unexpired and addressed to the user's email.
+func (db *DB) AcceptOrgInvitation(ctx context.Context, token string, userID int, email string) (*OrgInvitation, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var inv OrgInvitation
+	err = tx.GetContext(ctx, &inv, `
+		UPDATE org_invitations SET accepted_at=$3
+		WHERE token=$1 AND LOWER(email)=LOWER($2) AND accepted_at IS NULL AND expires_at > $3
+		RETURNING *, (SELECT name FROM organizations WHERE id=org_id) AS org_name`, token, email, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO NOTHING`, inv.OrgID, userID, inv.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, tx.Commit()
+}
+
+// CreateOrgAPIKey registers a new API key owned by the organization.
+func (db *DB) CreateOrgAPIKey(ctx context.Context, orgID int, apiKey, allowedModels string, rpm int) (*APIKeyRecord, error) {
+	var record APIKeyRecord
+	err := db.GetContext(ctx, &record, `
+		INSERT INTO api_keys (api_key, allowed_models, rpm, org_id) VALUES ($1, $2, $3, $4)
+		RETURNING *`, apiKey, allowedModels, rpm, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (db *DB) ListOrgAPIKeys(ctx context.Context, orgID int) ([]APIKeyRecord, error) {
+	keys := []APIKeyRecord{}
+	err := db.SelectContext(ctx, &keys, "SELECT * FROM api_keys WHERE org_id=$1 ORDER BY id", orgID)
+	return keys, err
+}
+
+func (db *DB) DeleteOrgAPIKey(ctx context.Context, orgID, keyID int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM api_keys WHERE org_id=$1 AND id=$2", orgID, keyID)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// CreateNodeToken issues a client token that lets nodes connect on behalf of the organization.
+func (db *DB) CreateNodeToken(ctx context.Context, orgID int, name, token string) (*NodeToken, error) {
+	var nt NodeToken
+	err := db.GetContext(ctx, &nt, "INSERT INTO node_tokens (org_id, name, token) VALUES ($1, $2, $3) RETURNING *",
+		orgID, name, token)
+	if err != nil {
+		return nil, err
+	}
+	return &nt, nil
+}
+
+func (db *DB) ListNodeTokens(ctx context.Context, orgID int) ([]NodeToken, error) {
+	tokens := []NodeToken{}
+	err := db.SelectContext(ctx, &tokens, "SELECT * FROM node_tokens WHERE org_id=$1 ORDER BY id", orgID)
+	return tokens, err
+}
+
+// DeleteNodeToken revokes a node token of the organization and returns the token, so that
+// the nodes still connected with it can be dropped.
+func (db *DB) DeleteNodeToken(ctx context.Context, orgID, tokenID int) (string, error) {
+	var token string
+	err := db.GetContext(ctx, &token, "DELETE FROM node_tokens WHERE org_id=$1 AND id=$2 RETURNING token", orgID, tokenID)
+	return token, err
+}
+
+// NodeTokenKnown reports whether nodes may connect with token: it is the client token of a
+// user, or a node token of an organization.
+func (db *DB) NodeTokenKnown(ctx context.Context, token string) (bool, error) {
+	var known bool
+	err := db.GetContext(ctx, &known, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE client_token=$1)
+		    OR EXISTS (SELECT 1 FROM node_tokens WHERE token=$1)`, token)
+	return known, err
+}
+
+// expectAffected turns an update or delete that matched nothing into sql.ErrNoRows.
+func expectAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a migrated SQLite database in a temporary directory.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func TestNodeTokenKnown(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.CreateUser(ctx, "a@x.io", "hash", "sk-a", "client-user"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	var ownerID int
+	if err := db.GetContext(ctx, &ownerID, "SELECT id FROM users WHERE email=$1", "a@x.io"); err != nil {
+		t.Fatalf("user id: %v", err)
+	}
+	org, err := db.CreateOrganization(ctx, "org", ownerID)
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	nt, err := db.CreateNodeToken(ctx, org.ID, "rack", "client-org")
+	if err != nil {
+		t.Fatalf("create node token: %v", err)
+	}
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"client-user", true},
+		{"client-org", true},
+		{"client-made-up", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		known, err := db.NodeTokenKnown(ctx, tt.token)
+		if err != nil {
+			t.Fatalf("NodeTokenKnown(%q): %v", tt.token, err)
+		}
+		if known != tt.want {
+			t.Errorf("NodeTokenKnown(%q) = %v, want %v", tt.token, known, tt.want)
+		}
+	}
+
+	if _, err := db.DeleteNodeToken(ctx, org.ID+1, nt.ID); err == nil {
+		t.Error("deleted a node token of another organization")
+	}
+	token, err := db.DeleteNodeToken(ctx, org.ID, nt.ID)
+	if err != nil {
+		t.Fatalf("delete node token: %v", err)
+	}
+	if token != "client-org" {
+		t.Errorf("DeleteNodeToken returned %q, want %q", token, "client-org")
+	}
+	if known, _ := db.NodeTokenKnown(ctx, "client-org"); known {
+		t.Error("revoked node token is still known")
+	}
+}
+
+func TestBanNodeTokenCoversOwner(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, u := range []struct{ email, token string }{{"a@x.io", "client-a"}, {"b@x.io", "client-b"}} {
+		if err := db.CreateUser(ctx, u.email, "hash", "sk-"+u.email, u.token); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	var ownerID int
+	if err := db.GetContext(ctx, &ownerID, "SELECT id FROM users WHERE email=$1", "a@x.io"); err != nil {
+		t.Fatalf("user id: %v", err)
+	}
+	org, err := db.CreateOrganization(ctx, "org", ownerID)
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	other, err := db.CreateOrganization(ctx, "other", ownerID)
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	for _, nt := range []struct {
+		orgID int
+		token string
+	}{{org.ID, "client-org-1"}, {org.ID, "client-org-2"}, {other.ID, "client-other"}} {
+		if _, err := db.CreateNodeToken(ctx, nt.orgID, "rack", nt.token); err != nil {
+			t.Fatalf("create node token: %v", err)
+		}
+	}
+
+	tokens, err := db.BanNodeToken(ctx, "client-org-1", "cheating")
+	if err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0] != "client-org-1" || tokens[1] != "client-org-2" {
+		t.Errorf("ban covers %v, want [client-org-1 client-org-2]", tokens)
+	}
+	if _, err := db.BanNodeToken(ctx, "client-a", "cheating"); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	// A node token created after the ban belongs to the banned organization too
+	if _, err := db.CreateNodeToken(ctx, org.ID, "new", "client-org-3"); err != nil {
+		t.Fatalf("create node token: %v", err)
+	}
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"client-org-1", true},
+		{"client-org-2", true},
+		{"client-org-3", true},
+		{"client-other", false},
+		{"client-a", true},
+		{"client-b", false},
+	}
+	for _, tt := range tests {
+		blocked, err := db.NodeTokenBlocked(ctx, tt.token)
+		if err != nil {
+			t.Fatalf("NodeTokenBlocked(%q): %v", tt.token, err)
+		}
+		if blocked != tt.want {
+			t.Errorf("NodeTokenBlocked(%q) = %v, want %v", tt.token, blocked, tt.want)
+		}
+	}
+
+	if err := db.UnbanNodeToken(ctx, "client-org-1"); err != nil {
+		t.Fatalf("unban: %v", err)
+	}
+	if blocked, _ := db.NodeTokenBlocked(ctx, "client-org-3"); blocked {
+		t.Error("node token still blocked after the organization's ban was lifted")
+	}
+}
+
+func TestOrgQuotaResetsMonthly(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.CreateUser(ctx, "a@x.io", "hash", "sk-a", "client-a"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	var ownerID int
+	if err := db.GetContext(ctx, &ownerID, "SELECT id FROM users WHERE email=$1", "a@x.io"); err != nil {
+		t.Fatalf("user id: %v", err)
+	}
+	org, err := db.CreateOrganization(ctx, "org", ownerID)
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	if err := db.UpdateOrganization(ctx, org.ID, "org", 2); err != nil {
+		t.Fatalf("set quota: %v", err)
+	}
+	if _, err := db.CreateOrgAPIKey(ctx, org.ID, "sk-org", "*", 60); err != nil {
+		t.Fatalf("create key: %v", err)
+	}
+
+	call := func() *Organization {
+		t.Helper()
+		if err := db.IncrementAPICalls(ctx, "sk-org"); err != nil {
+			t.Fatalf("increment: %v", err)
+		}
+		org, err := db.GetOrganization(ctx, org.ID)
+		if err != nil {
+			t.Fatalf("get org: %v", err)
+		}
+		return org
+	}
+	if o := call(); o.QuotaExceeded() || o.PeriodAPICalls != 1 {
+		t.Fatalf("after 1 of 2 calls: exceeded %v, %d calls this period", o.QuotaExceeded(), o.PeriodAPICalls)
+	}
+	if o := call(); !o.QuotaExceeded() {
+		t.Fatal("quota not exceeded after 2 of 2 calls")
+	}
+
+	// A new month starts the count over, without touching the lifetime total
+	if _, err := db.ExecContext(ctx, "UPDATE organizations SET quota_period='2000-01' WHERE id=$1", org.ID); err != nil {
+		t.Fatal(err)
+	}
+	o, err := db.GetOrganization(ctx, org.ID)
+	if err != nil {
+		t.Fatalf("get org: %v", err)
+	}
+	if o.QuotaExceeded() || o.PeriodAPICalls != 0 {
+		t.Errorf("last month's calls count: exceeded %v, %d calls this period", o.QuotaExceeded(), o.PeriodAPICalls)
+	}
+	if o := call(); o.QuotaExceeded() || o.PeriodAPICalls != 1 || o.TotalAPICalls != 3 {
+		t.Errorf("first call of the month: exceeded %v, %d calls this period, %d in total", o.QuotaExceeded(), o.PeriodAPICalls, o.TotalAPICalls)
+	}
+}
+
+func TestOrgInvitationExpiry(t *testing.T) {
+	// Far from UTC, so that a local expiry time compared with a UTC one is hours off
+	local := time.Local
+	time.Local = time.FixedZone("UTC-10", -10*3600)
+	t.Cleanup(func() { time.Local = local })
+
+	ctx := context.Background()
+	db := openTestDB(t)
+	if err := db.CreateUser(ctx, "a@x.io", "hash", "sk-a", "client-a"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	var ownerID int
+	if err := db.GetContext(ctx, &ownerID, "SELECT id FROM users WHERE email=$1", "a@x.io"); err != nil {
+		t.Fatalf("user id: %v", err)
+	}
+	org, err := db.CreateOrganization(ctx, "org", ownerID)
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+
+	tests := []struct {
+		email string
+		ttl   time.Duration
+		valid bool
+	}{
+		{"b@x.io", time.Hour, true},
+		{"c@x.io", -time.Hour, false},
+		{"d@x.io", -5 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		inv, err := db.CreateOrgInvitation(ctx, org.ID, tt.email, OrgRoleMember, "inv-"+tt.email, ownerID, tt.ttl)
+		if err != nil {
+			t.Fatalf("invite %s: %v", tt.email, err)
+		}
+		invs, err := db.ListInvitationsForEmail(ctx, tt.email)
+		if err != nil {
+			t.Fatalf("list %s: %v", tt.email, err)
+		}
+		if got := len(invs) == 1; got != tt.valid {
+			t.Errorf("invitation expiring in %v pending: %v, want %v", tt.ttl, got, tt.valid)
+		}
+		_, err = db.AcceptOrgInvitation(ctx, inv.Token, ownerID, tt.email)
+		if got := err == nil; got != tt.valid {
+			t.Errorf("invitation expiring in %v accepted: %v (%v), want %v", tt.ttl, got, err, tt.valid)
+		}
+	}
+	invs, err := db.ListOrgInvitations(ctx, org.ID)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(invs) != 0 {
+		t.Errorf("%d invitations still pending, want none", len(invs))
+	}
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Trust tiers of node owners, lowest first. API keys may require a minimum tier.
+const (
+	TierNew      = "new"
+	TierVerified = "verified"
+	TierTrusted  = "trusted"
+)
+
+// TierRank orders trust tiers; an unknown or empty tier ranks as TierNew.
+func TierRank(tier string) int {
+	switch tier {
+	case TierTrusted:
+		return 2
+	case TierVerified:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// NodeReputation is the track record of a node owner: the user or organization whose client
+// and node tokens its nodes connect with. Owner is "user:<id>" or "org:<id>", see
+// NodeTokenOwner.
+type NodeReputation struct {
+	Owner               string    `db:"owner" json:"owner"`
+	FirstSeen           time.Time `db:"first_seen" json:"first_seen"`
+	OnlineSeconds       int64     `db:"online_seconds" json:"online_seconds"`
+	Requests            int64     `db:"requests" json:"requests"`
+	Errors              int64     `db:"errors" json:"errors"`
+	VerificationScore   float64   `db:"verification_score" json:"verification_score"` // 1 until a verification fails
+	VerificationsPassed int       `db:"verifications_passed" json:"verifications_passed"`
+	VerificationsFailed int       `db:"verifications_failed" json:"verifications_failed"`
+	LastFailure         string    `db:"last_failure" json:"last_failure,omitempty"`
+	Reports             int       `db:"reports" json:"reports"`
+	TierOverride        string    `db:"tier_override" json:"tier_override,omitempty"` // set by an admin, "" if computed
+}
+
+// NodeReport is a user's complaint about the answer a node gave to one of their requests.
+type NodeReport struct {
+	RequestID string    `db:"request_id" json:"request_id"`
+	Token     string    `db:"token" json:"token"`
+	APIKey    string    `db:"api_key" json:"-"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func (db *DB) ListNodeReputations(ctx context.Context) ([]NodeReputation, error) {
+	reps := []NodeReputation{}
+	err := db.SelectContext(ctx, &reps, "SELECT * FROM node_reputation")
+	return reps, err
+}
+
+// SaveNodeReputation inserts or replaces the reputation of r.Owner.
+func (db *DB) SaveNodeReputation(ctx context.Context, r *NodeReputation) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO node_reputation (owner, first_seen, online_seconds, requests, errors, verification_score,
+			verifications_passed, verifications_failed, last_failure, reports, tier_override)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (owner) DO UPDATE SET online_seconds=EXCLUDED.online_seconds, requests=EXCLUDED.requests,
+			errors=EXCLUDED.errors, verification_score=EXCLUDED.verification_score,
+			verifications_passed=EXCLUDED.verifications_passed, verifications_failed=EXCLUDED.verifications_failed,
+			last_failure=EXCLUDED.last_failure, reports=EXCLUDED.reports, tier_override=EXCLUDED.tier_override`,
+		r.Owner, r.FirstSeen.UTC(), r.OnlineSeconds, r.Requests, r.Errors, r.VerificationScore,
+		r.VerificationsPassed, r.VerificationsFailed, r.LastFailure, r.Reports, r.TierOverride)
+	return err
+}
+
+// NodeTokenOwner returns the owner of a node token as recorded in NodeReputation.Owner:
+// "user:<id>" for a user's client token, "org:<id>" for an organization's node token. It
+// returns sql.ErrNoRows for an unknown token.
+func (db *DB) NodeTokenOwner(ctx context.Context, token string) (string, error) {
+	var owner struct {
+		UserID sql.NullInt64 `db:"user_id"`
+		OrgID  sql.NullInt64 `db:"org_id"`
+	}
+	err := db.GetContext(ctx, &owner, `
+		SELECT (SELECT id FROM users WHERE client_token=$1) AS user_id,
+		       (SELECT org_id FROM node_tokens WHERE token=$1) AS org_id`, token)
+	switch {
+	case err != nil:
+		return "", err
+	case owner.UserID.Valid:
+		return fmt.Sprintf("user:%d", owner.UserID.Int64), nil
+	case owner.OrgID.Valid:
+		return fmt.Sprintf("org:%d", owner.OrgID.Int64), nil
+	}
+	return "", sql.ErrNoRows
+}
+
+// CreateNodeReport files a report. A request can only be reported once; reporting it again
+// returns sql.ErrNoRows.
+func (db *DB) CreateNodeReport(ctx context.Context, r *NodeReport) error {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO node_reports (request_id, token, api_key, reason) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (request_id) DO NOTHING`, r.RequestID, r.Token, r.APIKey, r.Reason)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// ListNodeReports returns the reports about token, newest first.
+func (db *DB) ListNodeReports(ctx context.Context, token string, limit, offset int) ([]NodeReport, error) {
+	reports := []NodeReport{}
+	err := db.SelectContext(ctx, &reports, `
+		SELECT * FROM node_reports WHERE token=$1
+		ORDER BY created_at DESC LIMIT $2 OFFSET $3`, token, limit, offset)
+	return reports, err
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// RequestLog is one chat completion as recorded in the request log. Prompt and Completion
+// are only kept for keys with content logging enabled.
+type RequestLog struct {
+	ID               int64     `db:"id" json:"id"`
+	RequestID        string    `db:"request_id" json:"request_id"`
+	APIKey           string    `db:"api_key" json:"-"`
+	NodeID           string    `db:"node_id" json:"-"` // starts with the node's client token, never shown to users
+	Model            string    `db:"model" json:"model"`
+	Stream           bool      `db:"stream" json:"stream"`
+	Cached           bool      `db:"cached" json:"cached"` // answered from the response cache, without a node
+	Status           int       `db:"status" json:"status"`
+	Error            string    `db:"error" json:"error,omitempty"`
+	FirstChunkMS     int       `db:"first_chunk_ms" json:"first_chunk_ms"` // 0 if nothing was received
+	LatencyMS        int       `db:"latency_ms" json:"latency_ms"`
+	PromptTokens     int       `db:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int       `db:"completion_tokens" json:"completion_tokens"`
+	TotalTokens      int       `db:"total_tokens" json:"total_tokens"`
+	Prompt           *string   `db:"prompt" json:"prompt,omitempty"`
+	Completion       *string   `db:"completion" json:"completion,omitempty"`
+	CreatedAt        time.Time `db:"created_at" json:"created_at"`
+}
+
+func (db *DB) InsertRequestLog(ctx context.Context, l *RequestLog) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO request_logs (request_id, api_key, node_id, model, stream, status, error, first_chunk_ms,
+			latency_ms, prompt_tokens, completion_tokens, total_tokens, prompt, completion, cached)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		l.RequestID, l.APIKey, l.NodeID, l.Model, l.Stream, l.Status, l.Error, l.FirstChunkMS,
+		l.LatencyMS, l.PromptTokens, l.CompletionTokens, l.TotalTokens, l.Prompt, l.Completion, l.Cached)
+	return err
+}
+
+// ListRequestLogs returns the requests made with apiKey, newest first.
+func (db *DB) ListRequestLogs(ctx context.Context, apiKey string, limit, offset int) ([]RequestLog, error) {
+	logs := []RequestLog{}
+	err := db.SelectContext(ctx, &logs, `
+		SELECT * FROM request_logs WHERE api_key=$1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`, apiKey, limit, offset)
+	return logs, err
+}
+
+// GetRequestLog returns the request with the given ID made with apiKey.
+func (db *DB) GetRequestLog(ctx context.Context, apiKey, requestID string) (*RequestLog, error) {
+	var l RequestLog
+	err := db.GetContext(ctx, &l, "SELECT * FROM request_logs WHERE api_key=$1 AND request_id=$2", apiKey, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// PruneRequestLogs deletes entries created before cutoff and returns how many it removed.
+func (db *DB) PruneRequestLogs(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM request_logs WHERE created_at < $1", cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,23 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+// OpenSQLite opens (creating if needed) an embedded SQLite database at path. It lets the
+// server run as a single binary without Postgres.
+func OpenSQLite(path string) (*DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate", path)
+	conn, err := sqlx.Connect("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; funnelling everything through one connection avoids
+	// SQLITE_BUSY when a read transaction is upgraded to a write. Transactions begin
+	// IMMEDIATE for the same reason across processes, which also serializes migrations.
+	conn.SetMaxOpenConns(1)
+	return &DB{DB: conn, dialect: DialectSQLite}, nil
+}
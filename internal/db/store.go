@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the persistence layer used by the server. DB implements it on top of either
+// Postgres (Connect) or an embedded SQLite file (OpenSQLite).
+type Store interface {
+	Dialect() string
+	MigrateUp(ctx context.Context) ([]Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]Migration, error)
+	MigrationStatus(ctx context.Context) ([]MigrationState, error)
+	Close() error
+
+	// Users and API keys
+	CreateUser(ctx context.Context, email, pwHash, apiToken, clientToken string) error
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetAPIKey(ctx context.Context, key string) (*APIKeyRecord, error)
+	IncrementAPICalls(ctx context.Context, apiToken string) error
+	IncrementProvidedCalls(ctx context.Context, clientToken string) error
+
+	// Organizations
+	CreateOrganization(ctx context.Context, name string, ownerID int) (*Organization, error)
+	GetOrganization(ctx context.Context, orgID int) (*Organization, error)
+	UpdateOrganization(ctx context.Context, orgID int, name string, quota int) error
+	DeleteOrganization(ctx context.Context, orgID int) error
+	ListUserOrganizations(ctx context.Context, userID int) ([]OrgMembership, error)
+	GetOrgRole(ctx context.Context, orgID, userID int) (string, error)
+	ListOrgMembers(ctx context.Context, orgID int) ([]OrgMember, error)
+	SetOrgMemberRole(ctx context.Context, orgID, userID int, role string) error
+	RemoveOrgMember(ctx context.Context, orgID, userID int) error
+	CountOrgOwners(ctx context.Context, orgID int) (int, error)
+	CreateOrgInvitation(ctx context.Context, orgID int, email, role, token string, invitedBy int, ttl time.Duration) (*OrgInvitation, error)
+	ListOrgInvitations(ctx context.Context, orgID int) ([]OrgInvitation, error)
+	ListInvitationsForEmail(ctx context.Context, email string) ([]OrgInvitation, error)
+	DeleteOrgInvitation(ctx context.Context, orgID, invitationID int) error
+	AcceptOrgInvitation(ctx context.Context, token string, userID int, email string) (*OrgInvitation, error)
+	CreateOrgAPIKey(ctx context.Context, orgID int, apiKey, allowedModels string, rpm int) (*APIKeyRecord, error)
+	ListOrgAPIKeys(ctx context.Context, orgID int) ([]APIKeyRecord, error)
+	DeleteOrgAPIKey(ctx context.Context, orgID, keyID int) error
+	CreateNodeToken(ctx context.Context, orgID int, name, token string) (*NodeToken, error)
+	ListNodeTokens(ctx context.Context, orgID int) ([]NodeToken, error)
+	DeleteNodeToken(ctx context.Context, orgID, tokenID int) (string, error)
+	NodeTokenKnown(ctx context.Context, token string) (bool, error)
+
+	// Request log
+	InsertRequestLog(ctx context.Context, l *RequestLog) error
+	ListRequestLogs(ctx context.Context, apiKey string, limit, offset int) ([]RequestLog, error)
+	GetRequestLog(ctx context.Context, apiKey, requestID string) (*RequestLog, error)
+	PruneRequestLogs(ctx context.Context, cutoff time.Time) (int64, error)
+
+	// Administration
+	SearchUsers(ctx context.Context, query string, limit, offset int) ([]User, error)
+	SetUserDisabled(ctx context.Context, userID int, disabled bool) error
+	SetUserAdmin(ctx context.Context, userID int, isAdmin bool) error
+	PromoteAdmins(ctx context.Context, emails []string) error
+	SearchAPIKeys(ctx context.Context, query string, limit, offset int) ([]APIKeyRecord, error)
+	GetAPIKeyByID(ctx context.Context, id int) (*APIKeyRecord, error)
+	UpdateAPIKey(ctx context.Context, record *APIKeyRecord) error
+	BanNodeToken(ctx context.Context, token, reason string) ([]string, error)
+	UnbanNodeToken(ctx context.Context, token string) error
+	ListNodeBans(ctx context.Context) ([]NodeBan, error)
+	NodeTokenBlocked(ctx context.Context, token string) (bool, error)
+	GetGlobalStats(ctx context.Context) (*GlobalStats, error)
+
+	// Node reputation
+	ListNodeReputations(ctx context.Context) ([]NodeReputation, error)
+	SaveNodeReputation(ctx context.Context, r *NodeReputation) error
+	NodeTokenOwner(ctx context.Context, token string) (string, error)
+	CreateNodeReport(ctx context.Context, r *NodeReport) error
+	ListNodeReports(ctx context.Context, token string, limit, offset int) ([]NodeReport, error)
+
+	// Files and batches
+	CreateFile(ctx context.Context, f *File) error
+	GetFile(ctx context.Context, apiKey, id string) (*File, error)
+	GetFileContent(ctx context.Context, apiKey, id string) ([]byte, error)
+	ListFiles(ctx context.Context, apiKey string, limit, offset int) ([]File, error)
+	DeleteFile(ctx context.Context, apiKey, id string) error
+	CreateBatch(ctx context.Context, b *Batch) error
+	GetBatch(ctx context.Context, apiKey, id string) (*Batch, error)
+	ListBatches(ctx context.Context, apiKey string, limit, offset int) ([]Batch, error)
+	ListActiveBatches(ctx context.Context) ([]Batch, error)
+	StartBatch(ctx context.Context, id string, total int) error
+	CancelBatch(ctx context.Context, apiKey, id string) error
+	SaveBatchResult(ctx context.Context, r *BatchResult) error
+	ListBatchResults(ctx context.Context, batchID string) ([]BatchResult, error)
+	FinishBatch(ctx context.Context, b *Batch, files []File) error
+}
+
+var _ Store = (*DB)(nil)
@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// window is the period both RPM and TPM limits refer to.
+const window = time.Minute
+
+// leaseTTL bounds how long a concurrency slot outlives a crashed request. Live requests
+// keep renewing their lease well before it expires.
+const leaseTTL = 30 * time.Second
+
+// Limiter enforces per-key request/token rates and concurrency. RateLimiter keeps its state
+// in Redis and is shared across server instances; MemoryLimiter keeps it in process for
+// single-binary deployments.
+type Limiter interface {
+	// Allow checks every bucket and, if all of them have room, charges one request to each.
+	Allow(ctx context.Context, buckets ...Bucket) (*Result, error)
+	// ConsumeTokens charges tokens used by a finished request to each bucket's TPM budget.
+	ConsumeTokens(ctx context.Context, tokens int, buckets ...Bucket) error
+	// AcquireConcurrency takes one of max concurrent slots for apiKey. It returns
+	// (nil, false) if all slots are taken.
+	AcquireConcurrency(ctx context.Context, apiKey string, max int) (*Lease, bool, error)
+}
+
+// Bucket is one independently limited dimension of a request, e.g. the API key as a whole
+// (empty Scope) or the API key for one specific model (Scope "model:<name>").
+// A zero RPM or TPM leaves that dimension unlimited.
+type Bucket struct {
+	Key   string
+	Scope string
+	RPM   int
+	TPM   int
+}
+
+// BucketState is the limiter's view of one bucket after a check.
+type BucketState struct {
+	Bucket
+	RemainingRequests int // -1 if RPM is unlimited
+	RemainingTokens   int // -1 if TPM is unlimited
+	ResetRequests     time.Duration
+	ResetTokens       time.Duration
+}
+
+// Result is the outcome of Allow. States is in the same order as the buckets passed in.
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	States     []BucketState
+}
+
+// Headers renders the OpenAI-style x-ratelimit-* headers for the most constrained bucket
+// of each dimension. Dimensions that are unlimited in every bucket are omitted.
+func (r *Result) Headers() map[string]string {
+	h := make(map[string]string)
+
+	var req, tok *BucketState
+	for i := range r.States {
+		s := &r.States[i]
+		if s.RPM > 0 && (req == nil || s.RemainingRequests < req.RemainingRequests) {
+			req = s
+		}
+		if s.TPM > 0 && (tok == nil || s.RemainingTokens < tok.RemainingTokens) {
+			tok = s
+		}
+	}
+
+	if req != nil {
+		h["x-ratelimit-limit-requests"] = strconv.Itoa(req.RPM)
+		h["x-ratelimit-remaining-requests"] = strconv.Itoa(req.RemainingRequests)
+		h["x-ratelimit-reset-requests"] = req.ResetRequests.Round(time.Millisecond).String()
+	}
+	if tok != nil {
+		h["x-ratelimit-limit-tokens"] = strconv.Itoa(tok.TPM)
+		h["x-ratelimit-remaining-tokens"] = strconv.Itoa(tok.RemainingTokens)
+		h["x-ratelimit-reset-tokens"] = tok.ResetTokens.Round(time.Millisecond).String()
+	}
+	if !r.Allowed {
+		secs := int((r.RetryAfter + time.Second - 1) / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		h["Retry-After"] = strconv.Itoa(secs)
+	}
+	return h
+}
+
+// Lease is a held concurrency slot.
+type Lease struct {
+	release func()
+	once    sync.Once
+}
+
+func newLease(release func()) *Lease {
+	return &Lease{release: release}
+}
+
+// Release frees the slot. It is safe to call on a nil lease and more than once.
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(l.release)
+}
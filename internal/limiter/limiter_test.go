@@ -0,0 +1,212 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// limiters returns the implementations to test: MemoryLimiter, and RateLimiter too if
+// LIMITER_TEST_REDIS_URL names a Redis server to run against.
+func limiters(t *testing.T) map[string]Limiter {
+	t.Helper()
+	ls := map[string]Limiter{"memory": NewMemoryLimiter()}
+	if url := os.Getenv("LIMITER_TEST_REDIS_URL"); url != "" {
+		rl, err := NewRateLimiter(url)
+		if err != nil {
+			t.Fatalf("redis: %v", err)
+		}
+		ls["redis"] = rl
+	}
+	return ls
+}
+
+// testKey returns an API key no other test run uses, since Redis keeps state between runs.
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestAllowRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		rpm     int
+		calls   int // allowed in a row
+		retryLE time.Duration
+	}{
+		{"one per minute", 1, 1, time.Minute},
+		{"burst of the whole minute", 60, 60, time.Second},
+		{"fraction of a second apart", 600, 600, 100 * time.Millisecond},
+	}
+	for name, l := range limiters(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				b := Bucket{Key: testKey(t), RPM: tt.rpm}
+				for i := range tt.calls {
+					res, err := l.Allow(ctx, b)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !res.Allowed {
+						t.Fatalf("request %d of %d denied", i+1, tt.calls)
+					}
+					if want := tt.rpm - i - 1; res.States[0].RemainingRequests != want {
+						t.Fatalf("request %d: %d remaining, want %d", i+1, res.States[0].RemainingRequests, want)
+					}
+				}
+
+				res, err := l.Allow(ctx, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Allowed {
+					t.Fatal("request over the limit allowed")
+				}
+				if res.RetryAfter <= 0 || res.RetryAfter > tt.retryLE {
+					t.Errorf("retry after %v, want up to %v", res.RetryAfter, tt.retryLE)
+				}
+				if res.States[0].RemainingRequests != 0 {
+					t.Errorf("%d remaining after a denial", res.States[0].RemainingRequests)
+				}
+			})
+		}
+	}
+}
+
+func TestAllowChargesAllBucketsOrNone(t *testing.T) {
+	for name, l := range limiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+			whole := Bucket{Key: key, RPM: 10}
+			model := Bucket{Key: key, Scope: "model:m", RPM: 2}
+
+			for range 2 {
+				if res, _ := l.Allow(ctx, whole, model); !res.Allowed {
+					t.Fatal("request within both limits denied")
+				}
+			}
+			res, err := l.Allow(ctx, whole, model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed {
+				t.Fatal("request over the model's limit allowed")
+			}
+			// Buckets with room report what would remain had the request been allowed
+			if res.States[0].RemainingRequests != 7 || res.States[1].RemainingRequests != 0 {
+				t.Errorf("remaining %d and %d, want 7 and 0", res.States[0].RemainingRequests, res.States[1].RemainingRequests)
+			}
+
+			// The denied request was not charged to the key as a whole
+			res, _ = l.Allow(ctx, whole, Bucket{Key: key, Scope: "model:other", RPM: 2})
+			if !res.Allowed || res.States[0].RemainingRequests != 7 {
+				t.Errorf("allowed %v with %d remaining, want true with 7", res.Allowed, res.States[0].RemainingRequests)
+			}
+		})
+	}
+}
+
+func TestAllowUnlimited(t *testing.T) {
+	for name, l := range limiters(t) {
+		t.Run(name, func(t *testing.T) {
+			b := Bucket{Key: testKey(t)}
+			for range 100 {
+				res, err := l.Allow(context.Background(), b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.Allowed || res.States[0].RemainingRequests != -1 || res.States[0].RemainingTokens != -1 {
+					t.Fatalf("unlimited bucket: %+v", res)
+				}
+			}
+			if h := (&Result{Allowed: true, States: []BucketState{{Bucket: b, RemainingRequests: -1, RemainingTokens: -1}}}).Headers(); len(h) != 0 {
+				t.Errorf("headers for an unlimited bucket: %v", h)
+			}
+		})
+	}
+}
+
+func TestConsumeTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		consumed  []int
+		allowed   bool
+		remaining int // tokens, roughly
+		retryLE   time.Duration
+	}{
+		{"nothing used", nil, true, 1000, 0},
+		{"half used", []int{300, 200}, true, 500, 0},
+		{"no tokens", []int{0, -5}, true, 1000, 0},
+		{"budget used up", []int{1001}, false, 0, time.Second},
+		{"in debt", []int{1500}, false, 0, 31 * time.Second},
+	}
+	for name, l := range limiters(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				b := Bucket{Key: testKey(t), TPM: 1000}
+				for _, tokens := range tt.consumed {
+					// Buckets without a token limit are left alone
+					if err := l.ConsumeTokens(ctx, tokens, b, Bucket{Key: b.Key, Scope: "model:m"}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				res, err := l.Allow(ctx, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Allowed != tt.allowed {
+					t.Fatalf("allowed = %v, want %v", res.Allowed, tt.allowed)
+				}
+				// Tokens trickle back while the test runs
+				if got := res.States[0].RemainingTokens; got < tt.remaining || got > tt.remaining+10 {
+					t.Errorf("%d tokens remaining, want about %d", got, tt.remaining)
+				}
+				if !tt.allowed && (res.RetryAfter <= 0 || res.RetryAfter > tt.retryLE) {
+					t.Errorf("retry after %v, want up to %v", res.RetryAfter, tt.retryLE)
+				}
+			})
+		}
+	}
+}
+
+func TestAcquireConcurrency(t *testing.T) {
+	for name, l := range limiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+
+			var leases []*Lease
+			for range 2 {
+				lease, ok, err := l.AcquireConcurrency(ctx, key, 2)
+				if err != nil || !ok {
+					t.Fatalf("slot within the limit refused: %v", err)
+				}
+				leases = append(leases, lease)
+			}
+			if _, ok, _ := l.AcquireConcurrency(ctx, key, 2); ok {
+				t.Fatal("slot over the limit acquired")
+			}
+			if _, ok, _ := l.AcquireConcurrency(ctx, key+"-other", 2); !ok {
+				t.Fatal("slots of another key taken")
+			}
+
+			// Releasing twice frees one slot only
+			leases[0].Release()
+			leases[0].Release()
+			lease, ok, _ := l.AcquireConcurrency(ctx, key, 2)
+			if !ok {
+				t.Fatal("released slot not available")
+			}
+			if _, ok, _ := l.AcquireConcurrency(ctx, key, 2); ok {
+				t.Fatal("slot released twice counted twice")
+			}
+			lease.Release()
+			leases[1].Release()
+			(*Lease)(nil).Release()
+		})
+	}
+}
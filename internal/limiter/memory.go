@@ -0,0 +1,146 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MemoryLimiter is an in-process Limiter implementing the same GCRA and lease semantics as
+// RateLimiter. Limits are only enforced per server instance, which is what a standalone
+// deployment needs.
+type MemoryLimiter struct {
+	mu     sync.Mutex
+	tats   map[string]time.Time // theoretical arrival time per request/token key
+	leases map[string]int       // held concurrency slots per API key
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	ml := &MemoryLimiter{
+		tats:   make(map[string]time.Time),
+		leases: make(map[string]int),
+	}
+	go ml.janitor()
+	return ml
+}
+
+// janitor drops TATs in the past, which are equivalent to having no entry at all.
+func (ml *MemoryLimiter) janitor() {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		ml.mu.Lock()
+		for k, tat := range ml.tats {
+			if tat.Before(now) {
+				delete(ml.tats, k)
+			}
+		}
+		ml.mu.Unlock()
+	}
+}
+
+// tat returns the stored TAT for key, or now if it has none or it lies in the past.
+func (ml *MemoryLimiter) tat(key string, now time.Time) time.Time {
+	if t, ok := ml.tats[key]; ok && t.After(now) {
+		return t
+	}
+	return now
+}
+
+func (ml *MemoryLimiter) Allow(ctx context.Context, buckets ...Bucket) (*Result, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := time.Now()
+	res := &Result{Allowed: true, States: make([]BucketState, len(buckets))}
+	writes := make(map[string]time.Time)
+
+	for i, b := range buckets {
+		reqKey, tokKey := keys(b)
+		st := BucketState{Bucket: b, RemainingRequests: -1, RemainingTokens: -1}
+
+		if b.RPM > 0 {
+			interval := window / time.Duration(b.RPM)
+			tat := ml.tat(reqKey, now)
+			newTat := tat.Add(interval)
+			if allowAt := newTat.Add(-window); allowAt.After(now) {
+				res.Allowed = false
+				res.RetryAfter = max(res.RetryAfter, allowAt.Sub(now))
+				st.RemainingRequests = 0
+				st.ResetRequests = tat.Sub(now)
+			} else {
+				writes[reqKey] = newTat
+				st.RemainingRequests = int((window - newTat.Sub(now)) / interval)
+				st.ResetRequests = newTat.Sub(now)
+			}
+		}
+
+		if b.TPM > 0 {
+			interval := float64(window) / float64(b.TPM)
+			tat := ml.tat(tokKey, now)
+			if debt := tat.Sub(now); debt >= window {
+				res.Allowed = false
+				res.RetryAfter = max(res.RetryAfter, debt-window+time.Duration(interval))
+				st.RemainingTokens = 0
+			} else {
+				st.RemainingTokens = int(math.Floor(float64(window-debt) / interval))
+			}
+			st.ResetTokens = tat.Sub(now)
+		}
+
+		res.States[i] = st
+	}
+
+	if res.Allowed {
+		for k, tat := range writes {
+			ml.tats[k] = tat
+		}
+	}
+	return res, nil
+}
+
+func (ml *MemoryLimiter) ConsumeTokens(ctx context.Context, tokens int, buckets ...Bucket) error {
+	if tokens <= 0 {
+		return nil
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range buckets {
+		if b.TPM <= 0 {
+			continue
+		}
+		_, tokKey := keys(b)
+		cost := time.Duration(float64(tokens) * float64(window) / float64(b.TPM))
+		ml.tats[tokKey] = ml.tat(tokKey, now).Add(cost)
+	}
+	return nil
+}
+
+// AcquireConcurrency counts slots in process. Leases can't leak here without the whole
+// process (and with it the count) going away, so they need no expiry.
+func (ml *MemoryLimiter) AcquireConcurrency(ctx context.Context, apiKey string, max int) (*Lease, bool, error) {
+	key := fmt.Sprintf("concurrency:{%s}", apiKey)
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.leases[key] >= max {
+		return nil, false, nil
+	}
+	ml.leases[key]++
+
+	return newLease(func() {
+		ml.mu.Lock()
+		defer ml.mu.Unlock()
+		if ml.leases[key]--; ml.leases[key] <= 0 {
+			delete(ml.leases, key)
+		}
+	}), true, nil
+}
@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"time"
 
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
+// RateLimiter is the Redis-backed Limiter. State is shared by every server instance
+// pointing at the same Redis.
 type RateLimiter struct {
 	client *redis.Client
 }
@@ -27,29 +32,238 @@ func NewRateLimiter(redisURL string) (*RateLimiter, error) {
 	return &RateLimiter{client: client}, nil
 }
 
-// Allow checks if the given apiKey exceeds the rpm (Requests Per Minute) limit.
-// Uses a basic Redis-backed counter with 1-minute expiration as a simple Token Bucket approximation.
-func (rl *RateLimiter) Allow(ctx context.Context, apiKey string, rpm int) (bool, error) {
-	if rpm <= 0 {
-		return false, nil // 0 means blocked
+// gcraScript implements GCRA (the generic cell rate algorithm) over any number of buckets
+// atomically: a request is admitted only if every bucket admits it, and only then is a
+// request charged to each of them. Each bucket keeps two theoretical arrival times (TAT),
+// one for requests and one for tokens; since the TAT key is written with its expiry in a
+// single SET, a crash can never leave a key without a TTL.
+//
+// The token TAT is only checked here (is there any budget left?); tokens are charged after
+// the response via debitScript because usage isn't known upfront.
+//
+// KEYS: request TAT key, token TAT key, for each bucket
+// ARGV: now (ms), window (ms), then rpm, tpm for each bucket
+// Returns: allowed (0/1), retry after (ms), then for each bucket remaining requests,
+// request reset (ms), remaining tokens, token reset (ms)
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local allowed = 1
+local retry = 0
+local out = {}
+local writes = {}
+
+for i = 1, #KEYS / 2 do
+	local rpm = tonumber(ARGV[1 + 2 * i])
+	local tpm = tonumber(ARGV[2 + 2 * i])
+	local reqRemaining, reqReset, tokRemaining, tokReset = -1, 0, -1, 0
+
+	if rpm > 0 then
+		local interval = window / rpm
+		local tat = tonumber(redis.call('GET', KEYS[2 * i - 1]) or now)
+		if tat < now then tat = now end
+		local newTat = tat + interval
+		local allowAt = newTat - window
+		if allowAt > now then
+			allowed = 0
+			retry = math.max(retry, allowAt - now)
+			reqRemaining = 0
+			reqReset = tat - now
+		else
+			writes[KEYS[2 * i - 1]] = newTat
+			reqRemaining = math.floor((window - (newTat - now)) / interval)
+			reqReset = newTat - now
+		end
+	end
+
+	if tpm > 0 then
+		local interval = window / tpm
+		local tat = tonumber(redis.call('GET', KEYS[2 * i]) or now)
+		if tat < now then tat = now end
+		if tat - now >= window then
+			allowed = 0
+			retry = math.max(retry, tat - now - window + interval)
+			tokRemaining = 0
+		else
+			tokRemaining = math.floor((window - (tat - now)) / interval)
+		end
+		tokReset = tat - now
+	end
+
+	table.insert(out, reqRemaining)
+	table.insert(out, math.ceil(reqReset))
+	table.insert(out, tokRemaining)
+	table.insert(out, math.ceil(tokReset))
+end
+
+if allowed == 1 then
+	for key, tat in pairs(writes) do
+		redis.call('SET', key, string.format('%.3f', tat), 'PX', math.ceil(tat - now))
+	end
+end
+
+table.insert(out, 1, math.ceil(retry))
+table.insert(out, 1, allowed)
+return out
+`)
+
+// debitScript charges a number of tokens to the token TAT of each bucket.
+//
+// KEYS: token TAT key for each bucket
+// ARGV: now (ms), window (ms), tokens, then tpm for each bucket
+var debitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local tokens = tonumber(ARGV[3])
+
+for i, key in ipairs(KEYS) do
+	local tpm = tonumber(ARGV[3 + i])
+	if tpm > 0 then
+		local tat = tonumber(redis.call('GET', key) or now)
+		if tat < now then tat = now end
+		tat = tat + tokens * (window / tpm)
+		redis.call('SET', key, string.format('%.3f', tat), 'PX', math.ceil(tat - now))
+	end
+end
+return 0
+`)
+
+// keys returns the request and token TAT keys of a bucket. The {key} hash tag keeps all
+// buckets of one API key in the same cluster slot so a script may touch them together.
+func keys(b Bucket) (string, string) {
+	prefix := fmt.Sprintf("rate_limit:{%s}", b.Key)
+	if b.Scope != "" {
+		prefix += ":" + b.Scope
 	}
+	return prefix + ":req", prefix + ":tok"
+}
 
-	key := fmt.Sprintf("rate_limit:%s", apiKey)
+// Allow checks every bucket and, if all of them have room, charges one request to each.
+func (rl *RateLimiter) Allow(ctx context.Context, buckets ...Bucket) (*Result, error) {
+	scriptKeys := make([]string, 0, 2*len(buckets))
+	args := []interface{}{time.Now().UnixMilli(), window.Milliseconds()}
+	for _, b := range buckets {
+		reqKey, tokKey := keys(b)
+		scriptKeys = append(scriptKeys, reqKey, tokKey)
+		args = append(args, b.RPM, b.TPM)
+	}
 
-	// Increment the counter
-	val, err := rl.client.Incr(ctx, key).Result()
+	vals, err := gcraScript.Run(ctx, rl.client, scriptKeys, args...).Int64Slice()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if len(vals) != 2+4*len(buckets) {
+		return nil, fmt.Errorf("unexpected rate limit script reply of length %d", len(vals))
+	}
+
+	res := &Result{
+		Allowed:    vals[0] == 1,
+		RetryAfter: time.Duration(vals[1]) * time.Millisecond,
+		States:     make([]BucketState, len(buckets)),
 	}
+	for i, b := range buckets {
+		v := vals[2+4*i:]
+		res.States[i] = BucketState{
+			Bucket:            b,
+			RemainingRequests: int(v[0]),
+			ResetRequests:     time.Duration(v[1]) * time.Millisecond,
+			RemainingTokens:   int(v[2]),
+			ResetTokens:       time.Duration(v[3]) * time.Millisecond,
+		}
+	}
+	return res, nil
+}
 
-	// If this is the first request in the window, set expiration to 60 seconds
-	if val == 1 {
-		rl.client.Expire(ctx, key, time.Minute)
+// ConsumeTokens charges tokens used by a finished request to each bucket's TPM budget.
+func (rl *RateLimiter) ConsumeTokens(ctx context.Context, tokens int, buckets ...Bucket) error {
+	if tokens <= 0 {
+		return nil
 	}
 
-	if int(val) > rpm {
-		return false, nil // Limit exceeded
+	scriptKeys := make([]string, 0, len(buckets))
+	args := []interface{}{time.Now().UnixMilli(), window.Milliseconds(), tokens}
+	for _, b := range buckets {
+		_, tokKey := keys(b)
+		scriptKeys = append(scriptKeys, tokKey)
+		args = append(args, b.TPM)
 	}
+	return debitScript.Run(ctx, rl.client, scriptKeys, args...).Err()
+}
+
+// acquireScript takes a slot in a concurrency semaphore kept as a sorted set of lease IDs
+// scored by expiry. Expired leases (from crashed requests) are purged first, so leaked
+// slots free themselves after leaseTTL.
+//
+// KEYS[1]: semaphore key
+// ARGV: now (ms), lease TTL (ms), max concurrent, lease ID
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
 
-	return true, nil
+// renewScript extends a lease if it still exists.
+//
+// KEYS[1]: semaphore key
+// ARGV: now (ms), lease TTL (ms), lease ID
+var renewScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+if redis.call('ZSCORE', KEYS[1], ARGV[3]) then
+	redis.call('ZADD', KEYS[1], now + ttl, ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	return 1
+end
+return 0
+`)
+
+// AcquireConcurrency takes one of max concurrent slots for apiKey. It returns (nil, false)
+// if all slots are taken.
+func (rl *RateLimiter) AcquireConcurrency(ctx context.Context, apiKey string, max int) (*Lease, bool, error) {
+	key := fmt.Sprintf("concurrency:{%s}", apiKey)
+	id := uuid.New().String()
+
+	ok, err := acquireScript.Run(ctx, rl.client, []string{key},
+		time.Now().UnixMilli(), leaseTTL.Milliseconds(), max, id).Int()
+	if err != nil {
+		return nil, false, err
+	}
+	if ok == 0 {
+		return nil, false, nil
+	}
+
+	stop := make(chan struct{})
+	go rl.renew(key, id, stop)
+
+	return newLease(func() {
+		close(stop)
+		if err := rl.client.ZRem(context.Background(), key, id).Err(); err != nil {
+			logger.Log.Warn("Failed to release concurrency lease", "key", key, "err", err)
+		}
+	}), true, nil
+}
+
+// renew keeps a lease alive until stop is closed.
+func (rl *RateLimiter) renew(key, id string, stop chan struct{}) {
+	ticker := time.NewTicker(leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := renewScript.Run(context.Background(), rl.client, []string{key},
+				time.Now().UnixMilli(), leaseTTL.Milliseconds(), id).Err()
+			if err != nil {
+				logger.Log.Warn("Failed to renew concurrency lease", "key", key, "err", err)
+			}
+		}
+	}
 }
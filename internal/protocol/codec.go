@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// envelope is a WSPayload whose data has not been decoded yet.
+type envelope struct {
+	Type MessageType     `json:"type"`
+	Data json.RawMessage `json:"data"`
+	Seq  uint64          `json:"seq"`
+}
+
+// rawStreamData is StreamData with the chunk left encoded.
+type rawStreamData struct {
+	RequestID string          `json:"request_id"`
+	Chunk     json.RawMessage `json:"chunk"`
+}
+
+// DecodeMessage decodes a text message, with its data decoded into the struct of its type
+// (RegisterData, CallData, ...). The chunk of a STREAM message and the payload of a CALL
+// stay json.RawMessage, so they can be passed on without decoding them. Data of unknown
+// message types is left as json.RawMessage.
+func DecodeMessage(message []byte) (WSPayload, error) {
+	var env envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		return WSPayload{}, err
+	}
+
+	var data interface{}
+	var err error
+	switch env.Type {
+	case MsgTypeHello:
+		data, err = decodeData[HelloData](env.Data)
+	case MsgTypeWelcome:
+		data, err = decodeData[WelcomeData](env.Data)
+	case MsgTypeRegister, MsgTypeUpdate:
+		data, err = decodeData[RegisterData](env.Data)
+	case MsgTypeCall:
+		var call struct {
+			CallData
+			Payload json.RawMessage `json:"payload"`
+		}
+		err = json.Unmarshal(env.Data, &call)
+		call.CallData.Payload = call.Payload
+		data = call.CallData
+	case MsgTypeStream:
+		var sd rawStreamData
+		err = json.Unmarshal(env.Data, &sd)
+		data = StreamData{RequestID: sd.RequestID, Chunk: sd.Chunk}
+	case MsgTypeError:
+		data, err = decodeData[ErrorData](env.Data)
+	case MsgTypeFinish:
+		data, err = decodeData[FinishData](env.Data)
+	case MsgTypeCredit:
+		data, err = decodeData[CreditData](env.Data)
+	case MsgTypeCancel:
+		data, err = decodeData[CancelData](env.Data)
+	case MsgTypeAck:
+		data, err = decodeData[AckData](env.Data)
+	case MsgTypeHeartbeat:
+		data, err = decodeData[HeartbeatData](env.Data)
+	default:
+		data = env.Data
+	}
+	if err != nil {
+		return WSPayload{}, fmt.Errorf("invalid %s message: %w", env.Type, err)
+	}
+	return WSPayload{Type: env.Type, Data: data, Seq: env.Seq}, nil
+}
+
+func decodeData[T any](raw json.RawMessage) (T, error) {
+	var v T
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+// CompressionLevel is the flate level of connections that negotiated FeatureCompression.
+// Go's fastest levels store messages the size of a stream chunk uncompressed.
+const CompressionLevel = 6
+
+// Binary frames carry STREAM messages on connections that negotiated FeatureBinary. The
+// chunk travels as the provider's JSON bytes, so it is never re-encoded on the way:
+//
+//	byte 0       frame type, frameStream or frameStreamSeq
+//	bytes 1-8    frameStreamSeq only: sequence number, big-endian
+//	next 2       length of the request ID, big-endian
+//	...          request ID
+//	rest         chunk, JSON
+const (
+	frameStream    byte = 1
+	frameStreamSeq byte = 2 // numbered, in resumable sessions
+)
+
+var errShortFrame = errors.New("binary frame too short")
+
+// EncodeStreamFrame builds the binary frame of a STREAM message, numbered unless seq is 0.
+func EncodeStreamFrame(seq uint64, requestID string, chunk []byte) []byte {
+	header := 3
+	if seq > 0 {
+		header += 8
+	}
+	frame := make([]byte, header+len(requestID)+len(chunk))
+	frame[0] = frameStream
+	if seq > 0 {
+		frame[0] = frameStreamSeq
+		binary.BigEndian.PutUint64(frame[1:], seq)
+	}
+	binary.BigEndian.PutUint16(frame[header-2:], uint16(len(requestID)))
+	n := copy(frame[header:], requestID)
+	copy(frame[header+n:], chunk)
+	return frame
+}
+
+// DecodeFrame decodes a binary frame into the message it carries. The chunk of the
+// returned StreamData is a json.RawMessage sharing frame's memory.
+func DecodeFrame(frame []byte) (WSPayload, error) {
+	if len(frame) == 0 {
+		return WSPayload{}, errShortFrame
+	}
+	var seq uint64
+	rest := frame[1:]
+	switch frame[0] {
+	case frameStream:
+	case frameStreamSeq:
+		if len(rest) < 8 {
+			return WSPayload{}, errShortFrame
+		}
+		seq, rest = binary.BigEndian.Uint64(rest), rest[8:]
+	default:
+		return WSPayload{}, fmt.Errorf("unknown binary frame type %d", frame[0])
+	}
+
+	if len(rest) < 2 {
+		return WSPayload{}, errShortFrame
+	}
+	idLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < idLen {
+		return WSPayload{}, errShortFrame
+	}
+	return WSPayload{
+		Type: MsgTypeStream,
+		Data: StreamData{
+			RequestID: string(rest[:idLen]),
+			Chunk:     json.RawMessage(rest[idLen:]),
+		},
+		Seq: seq,
+	}, nil
+}
+
+// RequestID returns the request a message belongs to, "" for connection-level messages.
+func (p WSPayload) RequestID() string {
+	switch d := p.Data.(type) {
+	case CallData:
+		return d.RequestID
+	case StreamData:
+		return d.RequestID
+	case FinishData:
+		return d.RequestID
+	case ErrorData:
+		return d.RequestID
+	case CreditData:
+		return d.RequestID
+	case CancelData:
+		return d.RequestID
+	}
+	return ""
+}
+
+// ChunkBytes returns the JSON encoding of a STREAM message's chunk. Chunks decoded by
+// DecodeMessage or DecodeFrame are returned as they are, without copying.
+func (p WSPayload) ChunkBytes() ([]byte, bool) {
+	sd, ok := p.Data.(StreamData)
+	if !ok {
+		return nil, false
+	}
+	if raw, ok := sd.Chunk.(json.RawMessage); ok {
+		return raw, true
+	}
+	b, err := json.Marshal(sd.Chunk)
+	return b, err == nil
+}
+
+// ErrorData returns the data of an ERROR message.
+func (p WSPayload) ErrorData() ErrorData {
+	if d, ok := p.Data.(ErrorData); ok {
+		return d
+	}
+	var d ErrorData
+	if b, err := json.Marshal(p.Data); err == nil {
+		json.Unmarshal(b, &d)
+	}
+	return d
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// The benchmarks compare the cost of carrying a stream chunk from a node to an SSE client
+// over each WebSocket encoding: the original JSON path that decoded and re-encoded the
+// chunk at every hop, the pass-through JSON path, and binary frames. Besides CPU and
+// allocations per chunk they report the bytes on the wire, with and without
+// permessage-deflate.
+//
+//	go test -run '^$' -bench . -benchmem ./internal/protocol
+
+const benchChunk = `{"id":"chatcmpl-9Xq2bW4m8v1nLr0f3kTzE7aP","object":"chat.completion.chunk","created":1760000000,"model":"gpt-4o-mini-2024-07-18","system_fingerprint":"fp_0ba0d124f1","choices":[{"index":0,"delta":{"content":" the"},"logprobs":null,"finish_reason":null}]}`
+
+const benchRequestID = "8f14e45f-ceea-467f-a0e6-5b4c3d2a1f90"
+
+// usageChunk is what the gateway's usage meter and request log read from each chunk.
+type usageChunk struct {
+	Usage   *UsageStat `json:"usage"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+func BenchmarkLegacyJSON(b *testing.B)  { benchmarkPath(b, legacyPath) }
+func BenchmarkPassThrough(b *testing.B) { benchmarkPath(b, passThroughPath) }
+func BenchmarkBinaryFrame(b *testing.B) { benchmarkPath(b, binaryPath) }
+
+// benchmarkPath runs a path that carries one provider line to the SSE writer and returns
+// the WebSocket message sent.
+func benchmarkPath(b *testing.B, run func(line []byte, sse io.Writer) []byte) {
+	line := []byte(benchChunk)
+	message := run(line, io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		run(line, io.Discard)
+	}
+	b.ReportMetric(float64(len(message)), "wire-B/op")
+	b.ReportMetric(float64(deflatedSize(message)), "deflate-B/op")
+}
+
+// legacyPath is the chunk's way through the node and gateway before pass-through: decoded
+// into a map by the adapter, re-encoded for the socket, decoded generically by the read
+// loop, re-encoded to peek at the request ID and again for the usage meter and request
+// log, and once more for the SSE writer.
+func legacyPath(line []byte, sse io.Writer) []byte {
+	// Node
+	var chunk map[string]interface{}
+	json.Unmarshal(line, &chunk)
+	message, _ := json.Marshal(WSPayload{
+		Type: MsgTypeStream,
+		Data: StreamData{RequestID: benchRequestID, Chunk: chunk},
+	})
+
+	// Gateway read loop
+	var payload WSPayload
+	json.Unmarshal(message, &payload)
+	dataBytes, _ := json.Marshal(payload.Data)
+	var generic map[string]interface{}
+	json.Unmarshal(dataBytes, &generic)
+
+	// Usage meter and request log
+	for range 2 {
+		dataBytes, _ := json.Marshal(payload.Data)
+		var sd struct {
+			Chunk usageChunk `json:"chunk"`
+		}
+		json.Unmarshal(dataBytes, &sd)
+	}
+
+	// SSE writer
+	dataBytes, _ = json.Marshal(payload.Data)
+	var sd StreamData
+	json.Unmarshal(dataBytes, &sd)
+	chunkBytes, _ := json.Marshal(sd.Chunk)
+	sse.Write([]byte(fmt.Sprintf("data: %s\n\n", string(chunkBytes))))
+	return message
+}
+
+func passThroughPath(line []byte, sse io.Writer) []byte {
+	raw := json.RawMessage(line)
+	json.Valid(raw)
+	message, _ := json.Marshal(WSPayload{
+		Type: MsgTypeStream,
+		Data: StreamData{RequestID: benchRequestID, Chunk: raw},
+	})
+
+	payload, _ := DecodeMessage(message)
+	deliver(payload, sse)
+	return message
+}
+
+func binaryPath(line []byte, sse io.Writer) []byte {
+	json.Valid(line)
+	message := EncodeStreamFrame(0, benchRequestID, line)
+
+	payload, _ := DecodeFrame(message)
+	deliver(payload, sse)
+	return message
+}
+
+// deliver is the gateway's side of a pass-through path, after decoding the message.
+func deliver(payload WSPayload, sse io.Writer) {
+	payload.RequestID()
+	chunk, _ := payload.ChunkBytes()
+	for range 2 {
+		var u usageChunk
+		json.Unmarshal(chunk, &u)
+	}
+	buf := make([]byte, 0, len(chunk)+8)
+	buf = append(buf, "data: "...)
+	buf = append(buf, chunk...)
+	buf = append(buf, "\n\n"...)
+	sse.Write(buf)
+}
+
+// deflatedSize is the size of message compressed the way gorilla/websocket compresses it:
+// each message on its own, at the level nodes and the gateway use.
+func deflatedSize(message []byte) int {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, CompressionLevel)
+	w.Write(message)
+	w.Flush()
+	// The trailing empty block of a flush is not sent
+	return buf.Len() - 4
+}
@@ -2,14 +2,16 @@ package protocol
 
 // ChatCompletionRequest represents a standard OpenAI API request body
 type ChatCompletionRequest struct {
-	Model          string      `json:"model"`
-	Messages       []Message   `json:"messages"`
-	Stream         bool        `json:"stream,omitempty"`
-	Temperature    float64     `json:"temperature,omitempty"`
-	MaxTokens      int         `json:"max_tokens,omitempty"`
-	Tools          interface{} `json:"tools,omitempty"`
-	ToolChoice     interface{} `json:"tool_choice,omitempty"`
-	ResponseFormat interface{} `json:"response_format,omitempty"`
+	Model               string      `json:"model"`
+	Messages            []Message   `json:"messages"`
+	Stream              bool        `json:"stream,omitempty"`
+	Temperature         float64     `json:"temperature,omitempty"`
+	MaxTokens           int         `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int         `json:"max_completion_tokens,omitempty"`
+	Tools               interface{} `json:"tools,omitempty"`
+	ToolChoice          interface{} `json:"tool_choice,omitempty"`
+	ResponseFormat      interface{} `json:"response_format,omitempty"`
+	User                string      `json:"user,omitempty"`
 }
 
 type Message struct {
@@ -1,33 +1,181 @@
 package protocol
 
+import "slices"
+
 // MessageType defines the type of message sent over WebSocket
 type MessageType string
 
 const (
-	MsgTypeRegister MessageType = "REGISTER"
-	MsgTypeCall     MessageType = "CALL"
-	MsgTypeStream   MessageType = "STREAM"
-	MsgTypeError    MessageType = "ERROR"
-	MsgTypeFinish   MessageType = "FINISH"
+	MsgTypeHello     MessageType = "HELLO"   // first message of a client, before REGISTER
+	MsgTypeWelcome   MessageType = "WELCOME" // server's answer to an accepted HELLO
+	MsgTypeRegister  MessageType = "REGISTER"
+	MsgTypeUpdate    MessageType = "UPDATE" // re-registration with RegisterData, replacing it
+	MsgTypeCall      MessageType = "CALL"
+	MsgTypeStream    MessageType = "STREAM"
+	MsgTypeError     MessageType = "ERROR"
+	MsgTypeFinish    MessageType = "FINISH"
+	MsgTypeCredit    MessageType = "CREDIT"    // more STREAM messages a flow-controlled node may send
+	MsgTypeCancel    MessageType = "CANCEL"    // the server no longer wants a request's response
+	MsgTypeAck       MessageType = "ACK"       // the server received every numbered message up to a sequence number
+	MsgTypeHeartbeat MessageType = "HEARTBEAT" // periodic report of a client's load and health
 )
 
+// Protocol versions. Version 1 is the protocol from before the handshake, spoken by clients
+// that send REGISTER without a HELLO. Bump ProtocolVersion whenever message shapes change
+// incompatibly, and MinProtocolVersion once older clients can no longer be served.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Optional features a side can announce in HELLO/WELCOME. A feature is only used on a
+// connection when both sides announce it.
+const (
+	FeatureCancel      = "cancel"       // requests can be cancelled mid-flight
+	FeatureCompression = "compression"  // messages may be compressed
+	FeatureBinary      = "binary"       // messages may use binary frames
+	FeatureFlowControl = "flow_control" // STREAM messages are paced by CREDIT messages
+	FeatureResume      = "resume"       // a dropped connection can resume its session, see WelcomeData
+	FeatureHeartbeat   = "heartbeat"    // the client sends HEARTBEAT messages, see HeartbeatData
+)
+
+// SessionHeader is the header of the WebSocket upgrade request naming the session a
+// reconnecting client wants to resume.
+const SessionHeader = "Session-ID"
+
 // WSPayload represents the base structure for WebSocket communication
 type WSPayload struct {
 	Type MessageType `json:"type"`
 	Data interface{} `json:"data"`
+	Seq  uint64      `json:"seq,omitempty"` // numbers a client's task messages in resumable sessions
+}
+
+// HelloData opens the handshake, sent by the client right after connecting
+type HelloData struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ClientVersion   string   `json:"client_version"` // build version, for display
+	Features        []string `json:"features,omitempty"`
+	Tasks           []string `json:"tasks,omitempty"` // when resuming, the requests the client still has something for
+}
+
+// WelcomeData accepts a HELLO. An incompatible client gets an ERROR instead and is
+// disconnected.
+//
+// With FeatureResume, the client numbers its STREAM, FINISH and ERROR messages and keeps
+// them until the server acknowledges them with ACK. After a dropped connection it
+// reconnects with the session ID in SessionHeader; if the session is still held, WELCOME
+// says so with the last message the server received, and the client sends the rest again.
+type WelcomeData struct {
+	ProtocolVersion int      `json:"protocol_version"` // version used on this connection
+	ServerVersion   string   `json:"server_version"`
+	Features        []string `json:"features,omitempty"` // announced by both sides
+	SessionID       string   `json:"session_id,omitempty"`
+	Resumed         bool     `json:"resumed,omitempty"`
+	LastSeq         uint64   `json:"last_seq,omitempty"` // when resumed
+
+	// Seconds between HEARTBEAT messages, with FeatureHeartbeat
+	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
+}
+
+// NegotiateVersion returns the protocol version two sides speaking ours and theirs use,
+// and whether it is one this build still supports.
+func NegotiateVersion(theirs int) (int, bool) {
+	v := min(theirs, ProtocolVersion)
+	return v, v >= MinProtocolVersion
+}
+
+// CommonFeatures returns the features present in both lists.
+func CommonFeatures(ours, theirs []string) []string {
+	var common []string
+	for _, f := range theirs {
+		if slices.Contains(ours, f) {
+			common = append(common, f)
+		}
+	}
+	return common
 }
 
-// RegisterData is sent by the client upon connection
+// RegisterData is sent by the client upon connection, and again in UPDATE whenever its
+// models or parallelism change
 type RegisterData struct {
-	MaxParallel int      `json:"max_parallel"`
-	Models      []string `json:"models"` // e.g., ["pro-model", "ultra-model"]
+	MaxParallel   int                          `json:"max_parallel"`
+	Models        []string                     `json:"models"`                   // e.g., ["pro-model", "ultra-model"]
+	Capabilities  map[string]ModelCapabilities `json:"capabilities,omitempty"`   // by model; models without an entry are not restricted
+	ModelParallel map[string]int               `json:"model_parallel,omitempty"` // per-model caps within MaxParallel; models without an entry only share it
+	PublicKey     string                       `json:"public_key,omitempty"`     // requests are sealed to it when set, see SealedPayload
+}
+
+// ModelCapabilities is what a node declares a model can do. The gateway only routes
+// requests needing a feature (images, tools, JSON mode, a large context or output) to nodes
+// whose model declares it. Zero token limits mean unknown.
+type ModelCapabilities struct {
+	ContextWindow   int  `json:"context_window,omitempty" yaml:"context_window"`
+	MaxOutputTokens int  `json:"max_output_tokens,omitempty" yaml:"max_output_tokens"`
+	Vision          bool `json:"vision" yaml:"vision"`
+	Tools           bool `json:"tools" yaml:"tools"`
+	JSONMode        bool `json:"json_mode" yaml:"json_mode"`
+	Embeddings      bool `json:"embeddings" yaml:"embeddings"`
 }
 
 // CallData is sent by the server to the client
 type CallData struct {
-	RequestID string      `json:"request_id"`
-	Model     string      `json:"model"`
-	Payload   interface{} `json:"payload"` // OpenAI API ChatCompletion payload mapped as interface{}
+	RequestID    string            `json:"request_id"`
+	Model        string            `json:"model"`
+	Payload      interface{}       `json:"payload"`                 // OpenAI API ChatCompletion payload mapped as interface{}
+	TraceContext map[string]string `json:"trace_context,omitempty"` // W3C trace context of the dispatch span
+	Credits      int               `json:"credits,omitempty"`       // STREAM messages the node may send before waiting for CREDIT, 0 for no limit
+	Sealed       *SealedPayload    `json:"sealed,omitempty"`        // replaces Payload for nodes with a public key; their chunks are sealed too
+}
+
+// CreditData is sent by the server as the consumer of a flow-controlled request catches up.
+// Credits is the total number of STREAM messages the node may have sent for the request,
+// including those of CallData.Credits, so a repeated CREDIT grants nothing new.
+type CreditData struct {
+	RequestID string `json:"request_id"`
+	Credits   int    `json:"credits"`
+}
+
+// AckData is sent by the server in resumable sessions, acknowledging every numbered message
+// up to Seq.
+type AckData struct {
+	Seq uint64 `json:"seq"`
+}
+
+// HeartbeatData is sent by the client every WelcomeData.HeartbeatInterval. The server
+// reconciles its view of the node with it: requests the node no longer runs are failed, and
+// tasks it runs that the server no longer waits for count towards its load. A client that
+// stops sending heartbeats is disconnected.
+type HeartbeatData struct {
+	ActiveTasks int                       `json:"active_tasks"`
+	Tasks       []string                  `json:"tasks"`               // requests being executed
+	Providers   map[string]ProviderHealth `json:"providers,omitempty"` // by provider type
+	Host        *HostStats                `json:"host,omitempty"`      // only if the client reports it
+}
+
+// ProviderHealth is how a client's calls to an upstream provider have been going.
+type ProviderHealth struct {
+	Models            []string `json:"models"` // served models backed by the provider
+	Healthy           bool     `json:"healthy"`
+	Requests          int      `json:"requests"` // since the previous heartbeat
+	Errors            int      `json:"errors"`   // since the previous heartbeat
+	ConsecutiveErrors int      `json:"consecutive_errors"`
+	LastError         string   `json:"last_error,omitempty"`
+}
+
+// HostStats describes the machine a client runs on. Zero values are unknown.
+type HostStats struct {
+	CPUs            int     `json:"cpus"`
+	Load1           float64 `json:"load1,omitempty"`            // one-minute load average
+	MemoryTotal     uint64  `json:"memory_total,omitempty"`     // bytes
+	MemoryAvailable uint64  `json:"memory_available,omitempty"` // bytes
+	Goroutines      int     `json:"goroutines"`
+}
+
+// CancelData is sent by the server when it abandons a request, so that the node can stop
+// working on it. The node still ends the request with FINISH or ERROR.
+type CancelData struct {
+	RequestID string `json:"request_id"`
+	Reason    string `json:"reason,omitempty"`
 }
 
 // StreamData is sent by the client back to the server
@@ -46,4 +194,5 @@ type ErrorData struct {
 // FinishData is sent by the client when a stream is complete
 type FinishData struct {
 	RequestID string `json:"request_id"`
+	Sealed    []byte `json:"sealed,omitempty"` // for a sealed request, the number of chunks sent, see RequestCipher.SealFinish
 }
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// End-to-end encryption of requests. A node that registers a public key gets the payload of
+// its CALLs sealed to it, and seals the chunks it sends back, so that only the gateway and
+// the node can read them: whatever relays or logs the messages in between sees ciphertext.
+//
+// For each request the gateway makes an ephemeral X25519 key. Its shared secret with the
+// node's key gives, through HKDF-SHA256, an AES-256-GCM key for that request alone. The
+// payload is sealed with nonce 0 and the n-th chunk with nonce n, with the request ID as
+// additional data, so chunks cannot be moved to another request, reordered or dropped
+// without the gateway noticing. FINISH carries the number of chunks sent, sealed with the
+// nonce after the last chunk's, so that the tail of a response cannot be dropped either.
+
+// SealedPayload is the payload of a CALL, sealed to the node's public key.
+type SealedPayload struct {
+	Key        string `json:"key"`        // the gateway's ephemeral public key, see EncodeKey
+	Ciphertext []byte `json:"ciphertext"` // base64 in JSON
+}
+
+var (
+	errSealedChunk  = errors.New("invalid sealed chunk")
+	errSealedFinish = errors.New("invalid sealed finish")
+)
+
+// GenerateKey creates a node's key pair.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeKey returns the form of a public key sent over the wire.
+func EncodeKey(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// ParsePublicKey decodes a public key from EncodeKey.
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// RequestCipher seals or opens the chunks of one request. Each side only uses it in one
+// direction, from a single goroutine.
+type RequestCipher struct {
+	aead      cipher.AEAD
+	requestID []byte
+	chunks    uint64
+}
+
+func newRequestCipher(secret []byte, gatewayKey, nodeKey *ecdh.PublicKey, requestID string) (*RequestCipher, error) {
+	salt := append(gatewayKey.Bytes(), nodeKey.Bytes()...)
+	key, err := hkdf.Key(sha256.New, secret, salt, "CoLink request "+requestID, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestCipher{aead: aead, requestID: []byte(requestID)}, nil
+}
+
+func (c *RequestCipher) nonce(n uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// SealPayload seals the payload of a request to the node's public key, returning the
+// cipher that opens the node's chunks.
+func SealPayload(nodeKey *ecdh.PublicKey, requestID string, payload []byte) (*SealedPayload, *RequestCipher, error) {
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := ephemeral.ECDH(nodeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newRequestCipher(secret, ephemeral.PublicKey(), nodeKey, requestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &SealedPayload{
+		Key:        EncodeKey(ephemeral.PublicKey()),
+		Ciphertext: c.aead.Seal(nil, c.nonce(0), payload, c.requestID),
+	}, c, nil
+}
+
+// OpenPayload opens a payload sealed to key, returning the cipher that seals the chunks
+// sent back.
+func OpenPayload(key *ecdh.PrivateKey, requestID string, sealed *SealedPayload) ([]byte, *RequestCipher, error) {
+	gatewayKey, err := ParsePublicKey(sealed.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid gateway key: %w", err)
+	}
+	secret, err := key.ECDH(gatewayKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newRequestCipher(secret, gatewayKey, key.PublicKey(), requestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := c.aead.Open(nil, c.nonce(0), sealed.Ciphertext, c.requestID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open payload: %w", err)
+	}
+	return payload, c, nil
+}
+
+// SealChunk seals the next chunk of the response. The sealed chunk is still JSON, a
+// base64 string, so it travels in STREAM messages and binary frames alike.
+func (c *RequestCipher) SealChunk(chunk []byte) json.RawMessage {
+	c.chunks++
+	sealed := c.aead.Seal(nil, c.nonce(c.chunks), chunk, c.requestID)
+	out, _ := json.Marshal(sealed)
+	return out
+}
+
+// OpenChunk opens the next chunk of the response.
+func (c *RequestCipher) OpenChunk(sealed json.RawMessage) (json.RawMessage, error) {
+	var ciphertext []byte
+	if err := json.Unmarshal(sealed, &ciphertext); err != nil {
+		return nil, errSealedChunk
+	}
+	c.chunks++
+	chunk, err := c.aead.Open(nil, c.nonce(c.chunks), ciphertext, c.requestID)
+	if err != nil {
+		return nil, errSealedChunk
+	}
+	return chunk, nil
+}
+
+// finishData is the additional data of a sealed FINISH, keeping it apart from a chunk.
+func (c *RequestCipher) finishData() []byte {
+	return append([]byte("FINISH "), c.requestID...)
+}
+
+// SealFinish seals the number of chunks sent, for the FINISH ending the response.
+func (c *RequestCipher) SealFinish() []byte {
+	count := binary.BigEndian.AppendUint64(nil, c.chunks)
+	return c.aead.Seal(nil, c.nonce(c.chunks+1), count, c.finishData())
+}
+
+// OpenFinish checks the sealed FINISH of a response against the chunks opened, failing if
+// any were dropped or the FINISH is not the node's.
+func (c *RequestCipher) OpenFinish(sealed []byte) error {
+	count, err := c.aead.Open(nil, c.nonce(c.chunks+1), sealed, c.finishData())
+	if err != nil || len(count) != 8 || binary.BigEndian.Uint64(count) != c.chunks {
+		return errSealedFinish
+	}
+	return nil
+}
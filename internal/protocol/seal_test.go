@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// sealedRequest seals payload to a new node key for requestID, returning the gateway's
+// cipher and the node's.
+func sealedRequest(t *testing.T, requestID string, payload []byte) (gateway, node *RequestCipher) {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, gateway, err := SealPayload(key.PublicKey(), requestID, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, node, err := OpenPayload(key, requestID, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, payload) {
+		t.Fatalf("payload opened as %q, want %q", opened, payload)
+	}
+	return gateway, node
+}
+
+func TestSealPayload(t *testing.T) {
+	payload := []byte(`{"model":"m","messages":[{"role":"user","content":"secret"}]}`)
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _, err := SealPayload(key.PublicKey(), "req-1", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Ciphertext, []byte("secret")) {
+		t.Error("payload sealed in the clear")
+	}
+
+	// The public key survives the trip over the wire
+	parsed, err := ParsePublicKey(EncodeKey(key.PublicKey()))
+	if err != nil || !parsed.Equal(key.PublicKey()) {
+		t.Fatalf("public key parsed as %v, %v", parsed, err)
+	}
+	if _, err := ParsePublicKey("not base64!"); err == nil {
+		t.Error("invalid public key parsed")
+	}
+	if _, err := ParsePublicKey(EncodeKey(key.PublicKey())[:8]); err == nil {
+		t.Error("short public key parsed")
+	}
+
+	other, _ := GenerateKey()
+	tampered := *sealed
+	tampered.Ciphertext = bytes.Clone(sealed.Ciphertext)
+	tampered.Ciphertext[0] ^= 1
+	tests := []struct {
+		name      string
+		sealed    *SealedPayload
+		requestID string
+		key       *ecdh.PrivateKey
+		ok        bool
+	}{
+		{"round trip", sealed, "req-1", key, true},
+		{"tampered ciphertext", &tampered, "req-1", key, false},
+		{"wrong request ID", sealed, "req-2", key, false},
+		{"wrong key", sealed, "req-1", other, false},
+		{"invalid gateway key", &SealedPayload{Key: "x", Ciphertext: sealed.Ciphertext}, "req-1", key, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, _, err := OpenPayload(tt.key, tt.requestID, tt.sealed)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(opened, payload) {
+				t.Errorf("opened %q, want %q", opened, payload)
+			}
+		})
+	}
+}
+
+func TestSealChunks(t *testing.T) {
+	chunks := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}
+	tamper := func(sealed json.RawMessage) json.RawMessage {
+		var b []byte
+		json.Unmarshal(sealed, &b)
+		b[len(b)-1] ^= 1
+		out, _ := json.Marshal(b)
+		return out
+	}
+	tests := []struct {
+		name   string
+		order  []int // indexes of the sealed chunks the gateway gets, in order
+		change func(i int, sealed json.RawMessage) json.RawMessage
+		bad    int // index into order of the first chunk that must not open, -1 for none
+	}{
+		{name: "in order", order: []int{0, 1, 2}, bad: -1},
+		{name: "reordered", order: []int{0, 2, 1}, bad: 1},
+		{name: "dropped", order: []int{0, 2}, bad: 1},
+		{name: "repeated", order: []int{0, 0, 1}, bad: 1},
+		{name: "tampered", order: []int{0, 1, 2}, bad: 1, change: func(i int, s json.RawMessage) json.RawMessage {
+			if i == 1 {
+				return tamper(s)
+			}
+			return s
+		}},
+		{name: "not a sealed chunk", order: []int{0, 1}, bad: 0, change: func(i int, s json.RawMessage) json.RawMessage {
+			return json.RawMessage(`{"n":1}`)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, node := sealedRequest(t, "req-1", []byte(`{}`))
+			var sealed []json.RawMessage
+			for _, c := range chunks {
+				s := node.SealChunk([]byte(c))
+				if bytes.Contains(s, []byte(`"n"`)) {
+					t.Fatalf("chunk %s sealed in the clear: %s", c, s)
+				}
+				sealed = append(sealed, s)
+			}
+			for i, idx := range tt.order {
+				s := sealed[idx]
+				if tt.change != nil {
+					s = tt.change(idx, s)
+				}
+				chunk, err := gateway.OpenChunk(s)
+				if i == tt.bad {
+					if err == nil {
+						t.Fatalf("chunk %d of %v opened", idx, tt.order)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("chunk %d: %v", idx, err)
+				}
+				if string(chunk) != chunks[idx] {
+					t.Errorf("chunk %d opened as %s, want %s", idx, chunk, chunks[idx])
+				}
+			}
+			if tt.bad >= 0 {
+				t.Fatal("every chunk opened")
+			}
+		})
+	}
+}
+
+func TestSealChunksOfAnotherRequest(t *testing.T) {
+	key, _ := GenerateKey()
+	_, gateway, _ := SealPayload(key.PublicKey(), "req-1", []byte(`{}`))
+	sealed, _, _ := SealPayload(key.PublicKey(), "req-2", []byte(`{}`))
+	_, node, err := OpenPayload(key, "req-2", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.OpenChunk(node.SealChunk([]byte(`{"n":1}`))); err == nil {
+		t.Error("chunk of another request opened")
+	}
+}
+
+func TestSealFinish(t *testing.T) {
+	tests := []struct {
+		sent, opened int // chunks the node sealed and the gateway opened
+		ok           bool
+	}{
+		{0, 0, true},
+		{3, 3, true},
+		{3, 2, false}, // the last chunk dropped
+		{3, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.opened, tt.sent), func(t *testing.T) {
+			gateway, node := sealedRequest(t, "req-1", []byte(`{}`))
+			for i := range tt.sent {
+				s := node.SealChunk([]byte(`{}`))
+				if i < tt.opened {
+					if _, err := gateway.OpenChunk(s); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			finish := node.SealFinish()
+			if err := gateway.OpenFinish(finish); (err == nil) != tt.ok {
+				t.Errorf("finish error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	// A FINISH without its seal, or with a chunk's, does not do
+	gateway, node := sealedRequest(t, "req-1", []byte(`{}`))
+	if err := gateway.OpenFinish(nil); err == nil {
+		t.Error("unsealed finish accepted")
+	}
+	var chunk []byte
+	json.Unmarshal(node.SealChunk(nil), &chunk)
+	if err := gateway.OpenFinish(chunk); err == nil {
+		t.Error("sealed chunk accepted as finish")
+	}
+}
@@ -0,0 +1,461 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminUpdateUserRequest struct {
+	Disabled *bool `json:"disabled"`
+	IsAdmin  *bool `json:"is_admin"`
+}
+
+type AdminUpdateKeyRequest struct {
+	AllowedModels     *string                  `json:"allowed_models"`
+	RPM               *int                     `json:"rpm" binding:"omitempty,min=0"`
+	TPM               *int                     `json:"tpm" binding:"omitempty,min=0"`
+	ModelLimits       map[string]db.ModelLimit `json:"model_limits"`
+	MaxConcurrent     *int                     `json:"max_concurrent" binding:"omitempty,min=0"`
+	LogContent        *bool                    `json:"log_content"`
+	RequireEncryption *bool                    `json:"require_encryption"`
+	AllowVerification *bool                    `json:"allow_verification"`
+	MinNodeTier       *string                  `json:"min_node_tier" binding:"omitempty,oneof=new verified trusted"`
+	Priority          *string                  `json:"priority" binding:"omitempty,oneof=interactive batch"`
+	ShareWeight       *int                     `json:"share_weight" binding:"omitempty,min=1,max=100"`
+	Disabled          *bool                    `json:"disabled"`
+}
+
+type AdminSetTierRequest struct {
+	Tier string `json:"tier" binding:"omitempty,oneof=new verified trusted"` // empty to compute it again
+}
+
+type AdminBanNodeRequest struct {
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+// AdminMiddleware must run after AuthMiddleware. It rejects users that are not (or are no
+// longer) administrators; AuthMiddleware loads the user anew for every request, so a revoked
+// admin loses access at once.
+func AdminMiddleware(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		if !u.IsAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// pagination reads ?limit= and ?offset= with sane defaults and bounds.
+func pagination(c *gin.Context) (int, int) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// AdminListUsersHandler lists users, optionally filtered by ?q= (email substring).
+func AdminListUsersHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset := pagination(c)
+		users, err := database.SearchUsers(c.Request.Context(), c.Query("q"), limit, offset)
+		if err != nil {
+			logger.Log.Error("Failed to list users", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"users": users})
+	}
+}
+
+// AdminUpdateUserHandler disables/enables an account or grants/revokes admin. Disabling a
+// user also disconnects every node running on their client token.
+func AdminUpdateUserHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("user_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+			return
+		}
+		var req AdminUpdateUserRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		target, err := database.GetUserByID(ctx, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		admin := c.MustGet("user").(*db.User)
+		if target.ID == admin.ID && ((req.Disabled != nil && *req.Disabled) || (req.IsAdmin != nil && !*req.IsAdmin)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot disable or demote themselves"})
+			return
+		}
+
+		if req.Disabled != nil {
+			if err := database.SetUserDisabled(ctx, userID, *req.Disabled); err != nil {
+				logger.Log.Error("Failed to update user", "err", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+				return
+			}
+			if *req.Disabled {
+				hub.DisconnectToken(target.ClientToken)
+			}
+		}
+		if req.IsAdmin != nil {
+			if err := database.SetUserAdmin(ctx, userID, *req.IsAdmin); err != nil {
+				logger.Log.Error("Failed to update user", "err", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+				return
+			}
+		}
+
+		logger.Log.Info("Admin updated user", "admin", admin.Email, "user_id", userID, "disabled", req.Disabled, "is_admin", req.IsAdmin)
+		c.JSON(http.StatusOK, gin.H{"message": "User updated"})
+	}
+}
+
+// AdminListKeysHandler lists API keys, optionally filtered by ?q= (key substring).
+func AdminListKeysHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset := pagination(c)
+		keys, err := database.SearchAPIKeys(c.Request.Context(), c.Query("q"), limit, offset)
+		if err != nil {
+			logger.Log.Error("Failed to list keys", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+
+		type KeyInfo struct {
+			ID                int             `json:"id"`
+			APIKey            string          `json:"api_key"`
+			AllowedModels     string          `json:"allowed_models"`
+			RPM               int             `json:"rpm"`
+			TPM               int             `json:"tpm"`
+			ModelLimits       json.RawMessage `json:"model_limits,omitempty"`
+			MaxConcurrent     int             `json:"max_concurrent"`
+			LogContent        bool            `json:"log_content"`
+			RequireEncryption bool            `json:"require_encryption"`
+			AllowVerification bool            `json:"allow_verification"`
+			MinNodeTier       string          `json:"min_node_tier,omitempty"`
+			Priority          string          `json:"priority"`
+			ShareWeight       int             `json:"share_weight"`
+			OrgID             *int64          `json:"org_id"`
+			Disabled          bool            `json:"disabled"`
+		}
+		out := make([]KeyInfo, 0, len(keys))
+		for _, k := range keys {
+			info := KeyInfo{ID: k.ID, APIKey: k.APIKey, AllowedModels: k.AllowedModels, RPM: k.RPM, TPM: k.TPM, MaxConcurrent: k.MaxConcurrent, LogContent: k.LogContent, RequireEncryption: k.RequireEncryption, AllowVerification: k.AllowVerification, MinNodeTier: k.MinNodeTier, Priority: k.Priority, ShareWeight: k.ShareWeight, Disabled: k.Disabled}
+			if k.ModelLimits != "" {
+				info.ModelLimits = json.RawMessage(k.ModelLimits)
+			}
+			if k.OrgID.Valid {
+				info.OrgID = &k.OrgID.Int64
+			}
+			out = append(out, info)
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": out})
+	}
+}
+
+// AdminUpdateKeyHandler edits a key's RPM/TPM, per-model limits, concurrency limit, allowed
+// models, content logging, encryption policy, verification opt-in, minimum node tier,
+// priority class, share weight or disabled flag. Omitted fields are left unchanged; an empty model_limits object clears them.
+func AdminUpdateKeyHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := strconv.Atoi(c.Param("key_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key id"})
+			return
+		}
+		var req AdminUpdateKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		record, err := database.GetAPIKeyByID(ctx, keyID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+			return
+		}
+		if req.AllowedModels != nil {
+			record.AllowedModels = *req.AllowedModels
+			if record.AllowedModels == "" {
+				record.AllowedModels = "*"
+			}
+		}
+		if req.RPM != nil {
+			record.RPM = *req.RPM
+		}
+		if req.TPM != nil {
+			record.TPM = *req.TPM
+		}
+		if req.ModelLimits != nil {
+			limits, _ := json.Marshal(req.ModelLimits)
+			record.ModelLimits = string(limits)
+		}
+		if req.MaxConcurrent != nil {
+			record.MaxConcurrent = *req.MaxConcurrent
+		}
+		if req.LogContent != nil {
+			record.LogContent = *req.LogContent
+		}
+		if req.RequireEncryption != nil {
+			record.RequireEncryption = *req.RequireEncryption
+		}
+		if req.AllowVerification != nil {
+			record.AllowVerification = *req.AllowVerification
+		}
+		if req.MinNodeTier != nil {
+			record.MinNodeTier = *req.MinNodeTier
+		}
+		if req.Priority != nil {
+			record.Priority = *req.Priority
+		}
+		if req.ShareWeight != nil {
+			record.ShareWeight = *req.ShareWeight
+		}
+		if req.Disabled != nil {
+			record.Disabled = *req.Disabled
+		}
+
+		if err := database.UpdateAPIKey(ctx, record); err != nil {
+			logger.Log.Error("Failed to update key", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update key"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key updated"})
+	}
+}
+
+// AdminNodesHandler is the unredacted counterpart of NodesHandler: it includes the client
+// token behind each connection so admins can ban it, and the reputation of its owner.
+func AdminNodesHandler(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+
+		type AdminNodeInfo struct {
+			ID              string         `json:"id"`
+			Token           string         `json:"token"`
+			Registered      bool           `json:"registered"`
+			MaxParallel     int            `json:"max_parallel"`
+			ActiveTasks     int            `json:"active_tasks"`
+			SupportedModels []string       `json:"supported_models"`
+			ModelParallel   map[string]int `json:"model_parallel,omitempty"`
+			ModelTasks      map[string]int `json:"model_tasks,omitempty"`
+			PenaltyUntil    time.Time      `json:"penalty_until"`
+			ClientVersion   string         `json:"client_version,omitempty"`
+			ProtocolVersion int            `json:"protocol_version,omitempty"`
+			Features        []string       `json:"features"`
+			Encrypted       bool           `json:"encrypted"`
+			Orphaned        int            `json:"orphaned,omitempty"`
+			Heartbeat       *NodeHeartbeat `json:"heartbeat,omitempty"`
+			Reputation      *NodeStanding  `json:"reputation,omitempty"`
+		}
+
+		nodes := make([]AdminNodeInfo, 0, len(hub.clients))
+		for client := range hub.clients {
+			models := make([]string, 0, len(client.SupportedModels))
+			for m := range client.SupportedModels {
+				models = append(models, m)
+			}
+			nodes = append(nodes, AdminNodeInfo{
+				ID:              client.ID,
+				Token:           client.Token(),
+				Registered:      client.MaxParallel > 0,
+				MaxParallel:     client.MaxParallel,
+				ActiveTasks:     client.ActiveTasks,
+				SupportedModels: models,
+				ModelParallel:   maps.Clone(client.ModelParallel),
+				ModelTasks:      maps.Clone(client.ModelTasks),
+				PenaltyUntil:    client.PenaltyUntil,
+				ClientVersion:   client.ClientVersion,
+				ProtocolVersion: client.ProtocolVersion,
+				Features:        slices.Sorted(maps.Keys(client.Features)),
+				Encrypted:       client.PublicKey != nil,
+				Orphaned:        client.Orphaned,
+				Heartbeat:       client.Heartbeat,
+				Reputation:      hub.Reputation.Get(client.Token()),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"nodes": nodes, "queue": gin.H{
+			"interactive": len(hub.queues[0].tickets),
+			"batch":       len(hub.queues[1].tickets),
+		}})
+	}
+}
+
+// AdminDisconnectNodeHandler force-closes a single node connection. The node may reconnect.
+func AdminDisconnectNodeHandler(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.Disconnect(c.Param("node_id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Node not connected"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Node disconnected"})
+	}
+}
+
+// AdminBanNodeHandler bans the client token of a connected node, together with its owner's
+// other tokens, and disconnects every node using them, so it can neither stay nor come back.
+func AdminBanNodeHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AdminBanNodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		client := hub.FindClient(c.Param("node_id"))
+		if client == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Node not connected"})
+			return
+		}
+
+		tokens, err := database.BanNodeToken(c.Request.Context(), client.Token(), req.Reason)
+		if err != nil {
+			logger.Log.Error("Failed to ban node", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to ban node"})
+			return
+		}
+		n := 0
+		for _, token := range tokens {
+			n += hub.DisconnectToken(token)
+		}
+
+		logger.Log.Info("Node banned", "client_id", client.ID, "disconnected", n, "reason", req.Reason)
+		c.JSON(http.StatusOK, gin.H{"message": "Node banned", "disconnected": n})
+	}
+}
+
+// AdminListReputationHandler lists the reputation of every node owner, lowest score first.
+func AdminListReputationHandler(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"reputation": hub.Reputation.List()})
+	}
+}
+
+// AdminSetTierHandler fixes the trust tier of the owner of a client token, or lets it be
+// computed from its record again.
+func AdminSetTierHandler(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AdminSetTierRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err := hub.Reputation.SetTier(c.Request.Context(), c.Param("token"), req.Tier)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown token"})
+			return
+		}
+		if err != nil {
+			logger.Log.Error("Failed to set node tier", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set tier"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Tier updated"})
+	}
+}
+
+// AdminNodeReportsHandler lists the reports users filed about the answers of a client
+// token's nodes, newest first.
+func AdminNodeReportsHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset := pagination(c)
+		reports, err := database.ListNodeReports(c.Request.Context(), c.Param("token"), limit, offset)
+		if err != nil {
+			logger.Log.Error("Failed to list node reports", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reports": reports})
+	}
+}
+
+func AdminListBansHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bans, err := database.ListNodeBans(c.Request.Context())
+		if err != nil {
+			logger.Log.Error("Failed to list bans", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"bans": bans})
+	}
+}
+
+func AdminUnbanHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := database.UnbanNodeToken(c.Request.Context(), c.Param("token")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Ban not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Ban lifted"})
+	}
+}
+
+// AdminStatsHandler combines persisted totals with the Hub's live view.
+func AdminStatsHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := database.GetGlobalStats(c.Request.Context())
+		if err != nil {
+			logger.Log.Error("Failed to load stats", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+
+		hub.mu.RLock()
+		online, penalized, capacity, active := 0, 0, 0, 0
+		for client := range hub.clients {
+			if client.MaxParallel == 0 {
+				continue
+			}
+			online++
+			if time.Now().Before(client.PenaltyUntil) {
+				penalized++
+			}
+			capacity += client.MaxParallel
+			active += client.ActiveTasks
+		}
+		hub.mu.RUnlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"stats": stats,
+			"nodes": gin.H{
+				"online":       online,
+				"penalized":    penalized,
+				"capacity":     capacity,
+				"active_tasks": active,
+			},
+			"models": hub.ListModels(),
+		})
+	}
+}
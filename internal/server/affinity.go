@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+)
+
+// SessionHeader names the conversation a request belongs to, for affinity routing.
+const SessionHeader = "X-CoLink-Session"
+
+// affinityEntry is the node that served the last turn of a conversation.
+type affinityEntry struct {
+	clientID string
+	expires  time.Time
+}
+
+// affinityKey identifies the conversation req belongs to, so that its turns can be sent to
+// the node that served the previous one and may still hold its KV cache. The conversation
+// is named by session if set, then by the request's user field, else by its first messages,
+// up to the first user message, which every later turn repeats.
+func affinityKey(apiKey, model, session string, req *protocol.ChatCompletionRequest) string {
+	h := sha256.New()
+	h.Write([]byte(apiKey))
+	h.Write([]byte{0})
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	switch {
+	case session != "":
+		h.Write([]byte("session:" + session))
+	case req.User != "":
+		h.Write([]byte("user:" + req.User))
+	default:
+		prefix := req.Messages
+		for i, msg := range req.Messages {
+			if msg.Role == "user" {
+				prefix = req.Messages[:i+1]
+				break
+			}
+		}
+		if len(prefix) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(prefix)
+		h.Write([]byte("prefix:"))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// affine returns the ID of the node that served the conversation key, or "" if none did
+// within AffinityTTL.
+func (h *Hub) affine(key string) string {
+	if key == "" || h.AffinityTTL <= 0 {
+		return ""
+	}
+	h.affinityMu.Lock()
+	defer h.affinityMu.Unlock()
+	e, ok := h.affinity[key]
+	if !ok || time.Now().After(e.expires) {
+		return ""
+	}
+	return e.clientID
+}
+
+// remember notes that the node clientID serves the conversation key.
+func (h *Hub) remember(key, clientID string) {
+	if key == "" || h.AffinityTTL <= 0 {
+		return
+	}
+	h.affinityMu.Lock()
+	defer h.affinityMu.Unlock()
+	h.affinity[key] = affinityEntry{clientID: clientID, expires: time.Now().Add(h.AffinityTTL)}
+}
+
+// pruneAffinity forgets the conversations whose affinity expired.
+func (h *Hub) pruneAffinity() {
+	now := time.Now()
+	h.affinityMu.Lock()
+	defer h.affinityMu.Unlock()
+	for key, e := range h.affinity {
+		if now.After(e.expires) {
+			delete(h.affinity, key)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// maxAliasDepth bounds how deeply aliases may refer to other aliases.
+const maxAliasDepth = 8
+
+// ModelAliases maps names callers may use to the models nodes register. An alias stands for
+// a single model, or for a fallback chain of models tried in order until one of them
+// answers. Entries may name other aliases. A nil ModelAliases resolves every name to itself.
+type ModelAliases map[string][]string
+
+// LoadModelAliases reads aliases from a JSON object, mapping each alias to a model name or
+// to an array of them, e.g. {"gpt-4o-latest": "gpt-4o", "smart": ["gpt-4o", "qwen-72b"]}.
+func LoadModelAliases(path string) (ModelAliases, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	aliases := make(ModelAliases, len(raw))
+	for name, v := range raw {
+		var target string
+		if err := json.Unmarshal(v, &target); err == nil {
+			aliases[name] = []string{target}
+			continue
+		}
+		var chain []string
+		if err := json.Unmarshal(v, &chain); err != nil {
+			return nil, fmt.Errorf("alias %q: want a model name or an array of them", name)
+		}
+		aliases[name] = chain
+	}
+	for name, targets := range aliases {
+		if len(targets) == 0 || slices.Contains(targets, "") {
+			return nil, fmt.Errorf("alias %q: empty model name", name)
+		}
+		if err := aliases.expand(name, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+	return aliases, nil
+}
+
+// Resolve returns the models to try for name, in order: those its alias stands for, or
+// name itself if it is no alias.
+func (a ModelAliases) Resolve(name string) []string {
+	var models []string
+	a.expand(name, 0, func(model string) {
+		if !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	})
+	return models
+}
+
+// expand calls visit with each model name stands for, failing if the aliases loop.
+func (a ModelAliases) expand(name string, depth int, visit func(string)) error {
+	targets, ok := a[name]
+	if !ok {
+		if visit != nil {
+			visit(name)
+		}
+		return nil
+	}
+	if depth >= maxAliasDepth {
+		return fmt.Errorf("alias %q: aliases loop or nest deeper than %d", name, maxAliasDepth)
+	}
+	for _, t := range targets {
+		if err := a.expand(t, depth+1, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names returns the aliases, sorted.
+func (a ModelAliases) Names() []string {
+	return slices.Sorted(maps.Keys(a))
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// aliasChain returns n aliases each standing for the next, the last for model.
+func aliasChain(n int) string {
+	entries := make([]string, n)
+	for i := range n {
+		target := fmt.Sprintf("a%d", i+1)
+		if i == n-1 {
+			target = "model"
+		}
+		entries[i] = fmt.Sprintf("%q: %q", fmt.Sprintf("a%d", i), target)
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func TestLoadModelAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string // part of the error, "" if none
+	}{
+		{"model name", `{"latest": "gpt-4o"}`, ""},
+		{"fallback chain", `{"smart": ["gpt-4o", "qwen-72b"]}`, ""},
+		{"nested", `{"best": ["smart", "llama"], "smart": ["gpt-4o", "qwen-72b"]}`, ""},
+		{"same alias twice in a chain", `{"a": ["b", "b"], "b": "model"}`, ""},
+		{"nested to the limit", aliasChain(maxAliasDepth), ""},
+		{"nested too deep", aliasChain(maxAliasDepth + 1), "deeper than"},
+		{"self loop", `{"a": "a"}`, "loop"},
+		{"loop", `{"a": "b", "b": ["model", "c"], "c": "a"}`, "loop"},
+		{"empty name", `{"a": ""}`, "empty model name"},
+		{"empty name in chain", `{"a": ["model", ""]}`, "empty model name"},
+		{"empty chain", `{"a": []}`, "empty model name"},
+		{"number", `{"a": 4}`, "want a model name or an array"},
+		{"not an object", `["a", "b"]`, "aliases.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "aliases.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadModelAliases(path)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("no error, want one containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error %q, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModelAliasesResolve(t *testing.T) {
+	aliases := ModelAliases{
+		"latest": {"gpt-4o"},
+		"smart":  {"gpt-4o", "qwen-72b"},
+		"best":   {"smart", "llama", "latest"},
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"latest", []string{"gpt-4o"}},
+		{"smart", []string{"gpt-4o", "qwen-72b"}},
+		{"best", []string{"gpt-4o", "qwen-72b", "llama"}},
+		{"gpt-4o", []string{"gpt-4o"}},
+		{"unknown", []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		if got := aliases.Resolve(tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("Resolve(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var none ModelAliases
+	if got := none.Resolve("gpt-4o"); !slices.Equal(got, []string{"gpt-4o"}) {
+		t.Errorf("nil aliases resolve gpt-4o to %v", got)
+	}
+}
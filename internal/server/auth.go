@@ -33,25 +33,11 @@ func generateToken(prefix string) string {
 	return fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(b))
 }
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware checks the JWT and loads its user on every request, rejecting accounts
+// disabled since the token was issued, and stores the user on the context.
+func AuthMiddleware(database db.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
-		}
-
-		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
+		claims, ok := bearerClaims(c)
 		if !ok {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
@@ -59,11 +45,35 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		c.Set("user_id", claims["sub"])
 		c.Set("email", claims["email"])
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		c.Set("user", u)
 		c.Next()
 	}
 }
 
-func RegisterHandler(database *db.DB) gin.HandlerFunc {
+// bearerClaims validates the JWT in the Authorization header and returns its claims.
+func bearerClaims(c *gin.Context) (jwt.MapClaims, bool) {
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, false
+	}
+
+	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return claims, ok
+}
+
+func RegisterHandler(database db.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req RegisterRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -89,7 +99,7 @@ func RegisterHandler(database *db.DB) gin.HandlerFunc {
 	}
 }
 
-func LoginHandler(database *db.DB) gin.HandlerFunc {
+func LoginHandler(database db.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req LoginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -108,6 +118,11 @@ func LoginHandler(database *db.DB) gin.HandlerFunc {
 			return
 		}
 
+		if u.Disabled {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+			return
+		}
+
 		claims := jwt.MapClaims{
 			"sub":   u.ID,
 			"email": u.Email,
@@ -120,49 +135,32 @@ func LoginHandler(database *db.DB) gin.HandlerFunc {
 	}
 }
 
-func MeHandler(database *db.DB) gin.HandlerFunc {
+func MeHandler(database db.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		email := c.GetString("email")
-		u, err := database.GetUserByEmail(c.Request.Context(), email)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		u, ok := currentUser(c, database)
+		if !ok {
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"user": u})
 	}
 }
 
+// NodesHandler lists the connected nodes with what anyone may see of them, like the events
+// of anonymous subscribers: no client tokens in their IDs, no host details in heartbeats.
 func NodesHandler(hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		hub.mu.RLock()
 		defer hub.mu.RUnlock()
 
-		type NodeInfo struct {
-			ID              string   `json:"id"`
-			MaxParallel     int      `json:"max_parallel"`
-			ActiveTasks     int      `json:"active_tasks"`
-			SupportedModels []string `json:"supported_models"`
-			Penalized       bool     `json:"penalized"`
-		}
-
 		nodes := make([]NodeInfo, 0, len(hub.clients))
 		for client := range hub.clients {
 			if client.MaxParallel == 0 {
 				continue // not fully registered
 			}
-
-			models := make([]string, 0, len(client.SupportedModels))
-			for m := range client.SupportedModels {
-				models = append(models, m)
-			}
-
-			nodes = append(nodes, NodeInfo{
-				ID:              client.ID, // the client token technically
-				MaxParallel:     client.MaxParallel,
-				ActiveTasks:     client.ActiveTasks,
-				SupportedModels: models,
-				Penalized:       time.Now().Before(client.PenaltyUntil),
-			})
+			info := client.info()
+			info.ID = publicNodeID(info.ID)
+			info.Heartbeat = info.Heartbeat.public()
+			nodes = append(nodes, info)
 		}
 
 		c.JSON(http.StatusOK, gin.H{"nodes": nodes})
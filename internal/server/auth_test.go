@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthMiddlewareRejectsDisabledUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := openTestStore(t)
+	router := gin.New()
+	router.POST("/api/auth/register", RegisterHandler(store))
+	router.POST("/api/auth/login", LoginHandler(store))
+	router.GET("/api/user/me", AuthMiddleware(store), MeHandler(store))
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	const credentials = `{"email":"a@x.io","password":"secret1"}`
+	if w := do(http.MethodPost, "/api/auth/register", "", credentials); w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	w := do(http.MethodPost, "/api/auth/login", "", credentials)
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodGet, "/api/user/me", login.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("enabled user: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/api/user/me", "not-a-jwt", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid token: %d, want 401", w.Code)
+	}
+
+	u, err := store.GetUserByEmail(context.Background(), "a@x.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserDisabled(context.Background(), u.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(http.MethodGet, "/api/user/me", login.Token, ""); w.Code != http.StatusForbidden {
+		t.Errorf("user disabled after login: %d %s, want 403", w.Code, w.Body)
+	}
+}
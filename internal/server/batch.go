@@ -0,0 +1,696 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/limiter"
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+// BatchEndpoint is the only endpoint the requests of a batch may call.
+const BatchEndpoint = "/v1/chat/completions"
+
+// DefaultBatchConcurrency is how many requests of batches are in flight at once.
+const DefaultBatchConcurrency = 8
+
+const (
+	batchCompletionWindow = 24 * time.Hour
+	maxBatchRequests      = 50000
+	maxBatchProblems      = 100              // reported of an input file that fails validation
+	batchPoll             = 10 * time.Second // how often batches are looked for in the database
+	batchRetry            = 10 * time.Second // how long a request waits when no node serves its model
+	batchAttempts         = 3                // of a request that nodes answer with errors
+)
+
+var (
+	errBatchCancelled = errors.New("batch cancelled")
+	errBatchExpired   = errors.New("batch expired")
+)
+
+// BatchRunner works through batches in the background. Their requests go through the hub
+// as batch priority requests, which only get nodes no interactive request is waiting for,
+// and wait for capacity rather than fail while all nodes are busy. Each result is stored as
+// soon as it arrives, so a batch interrupted by a restart resumes where it stopped; once
+// all requests are done the results are written to an output file and an error file.
+//
+// Batches are picked up from the database, so BatchRunner assumes a single server runs
+// them.
+type BatchRunner struct {
+	gw    *Gateway
+	slots chan struct{} // one taken per request in flight
+	wake  chan struct{}
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc // batches being worked on, by ID
+}
+
+func NewBatchRunner(gw *Gateway, concurrency int) *BatchRunner {
+	return &BatchRunner{
+		gw:      gw,
+		slots:   make(chan struct{}, max(1, concurrency)),
+		wake:    make(chan struct{}, 1),
+		running: make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// Run starts work on the batches that haven't ended, those left over from before a restart
+// first, and on new ones as they are created. It never returns.
+func (r *BatchRunner) Run() {
+	ticker := time.NewTicker(batchPoll)
+	defer ticker.Stop()
+	for {
+		r.startBatches()
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// poke has Run look for batches at once.
+func (r *BatchRunner) poke() {
+	if r == nil {
+		return
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cancel stops work on a batch whose cancellation was requested. Requests in flight are
+// abandoned.
+func (r *BatchRunner) cancel(id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	cancel, ok := r.running[id]
+	r.mu.Unlock()
+	if ok {
+		cancel(errBatchCancelled)
+	} else {
+		r.poke()
+	}
+}
+
+func (r *BatchRunner) startBatches() {
+	batches, err := r.gw.DB.ListActiveBatches(context.Background())
+	if err != nil {
+		logger.Log.Error("Failed to list batches", "err", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range batches {
+		b := &batches[i]
+		if _, ok := r.running[b.ID]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancelCause(context.Background())
+		r.running[b.ID] = cancel
+		go func() {
+			defer func() {
+				r.mu.Lock()
+				delete(r.running, b.ID)
+				r.mu.Unlock()
+				cancel(nil)
+			}()
+			r.work(ctx, b)
+		}()
+	}
+}
+
+// work runs the requests of b that have no result yet, then ends it. It returns early,
+// leaving b to be picked up again, if its key or input can't be loaded.
+func (r *BatchRunner) work(ctx context.Context, b *db.Batch) {
+	if b.Status == db.BatchCancelling {
+		r.finish(b, db.BatchCancelled)
+		return
+	}
+
+	key, err := r.gw.DB.GetAPIKey(context.Background(), b.APIKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		r.fail(b, "api_key_deleted", "The API key of the batch was deleted")
+		return
+	}
+	if err != nil {
+		logger.Log.Error("Failed to load batch API key", "batch_id", b.ID, "err", err)
+		return
+	}
+	if key.Disabled {
+		r.fail(b, "api_key_disabled", "The API key of the batch is disabled")
+		return
+	}
+	content, err := r.gw.DB.GetFileContent(context.Background(), b.APIKey, b.InputFileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		r.fail(b, "input_file_deleted", "The input file of the batch was deleted")
+		return
+	}
+	if err != nil {
+		logger.Log.Error("Failed to load batch input", "batch_id", b.ID, "err", err)
+		return
+	}
+
+	requests, problems := parseBatchInput(content, b.Endpoint)
+	if b.Status == db.BatchValidating {
+		if len(problems) > 0 {
+			b.Errors, _ = marshalString(problems)
+			r.finish(b, db.BatchFailed)
+			return
+		}
+		if err := r.gw.DB.StartBatch(context.Background(), b.ID, len(requests)); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) { // else cancelled meanwhile
+				logger.Log.Error("Failed to start batch", "batch_id", b.ID, "err", err)
+			}
+			return
+		}
+		logger.Log.Info("Batch started", "batch_id", b.ID, "requests", len(requests))
+	}
+
+	results, err := r.gw.DB.ListBatchResults(context.Background(), b.ID)
+	if err != nil {
+		logger.Log.Error("Failed to load batch results", "batch_id", b.ID, "err", err)
+		return
+	}
+	done := make(map[int]bool, len(results))
+	for _, res := range results {
+		done[res.Line] = true
+	}
+
+	ctx, stop := context.WithDeadlineCause(ctx, b.ExpiresAt, errBatchExpired)
+	defer stop()
+	var wg sync.WaitGroup
+dispatching:
+	for i := range requests {
+		req := &requests[i]
+		if done[req.Line] {
+			continue
+		}
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			break dispatching
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-r.slots }()
+			res, ok := r.call(ctx, key, req)
+			if !ok {
+				return // stopped before it was answered
+			}
+			res.BatchID = b.ID
+			if err := r.gw.DB.SaveBatchResult(context.Background(), res); err != nil {
+				logger.Log.Error("Failed to save batch result", "batch_id", b.ID, "line", req.Line, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	switch context.Cause(ctx) {
+	case nil:
+		r.finish(b, db.BatchCompleted)
+	case errBatchCancelled:
+		r.finish(b, db.BatchCancelled)
+	case errBatchExpired:
+		r.finish(b, db.BatchExpired)
+	}
+}
+
+// fail ends b as failed for a reason other than its input.
+func (r *BatchRunner) fail(b *db.Batch, code, message string) {
+	b.Errors, _ = marshalString([]batchProblem{{Code: code, Message: message}})
+	r.finish(b, db.BatchFailed)
+}
+
+// finish ends b with status, writing the results stored so far to its output and error
+// files.
+func (r *BatchRunner) finish(b *db.Batch, status string) {
+	ctx := context.Background()
+	results, err := r.gw.DB.ListBatchResults(ctx, b.ID)
+	if err != nil {
+		logger.Log.Error("Failed to load batch results", "batch_id", b.ID, "err", err)
+		return
+	}
+	var output, errorOutput bytes.Buffer
+	for _, res := range results {
+		w := &output
+		if res.Failed {
+			w = &errorOutput
+		}
+		w.WriteString(res.Output)
+		w.WriteByte('\n')
+	}
+
+	var files []db.File
+	addFile := func(name string, content []byte) string {
+		f := db.File{
+			ID:        newObjectID("file-"),
+			APIKey:    b.APIKey,
+			Purpose:   db.FilePurposeBatchOutput,
+			Filename:  fmt.Sprintf("%s_%s.jsonl", b.ID, name),
+			Bytes:     int64(len(content)),
+			Content:   content,
+			CreatedAt: time.Now(),
+		}
+		files = append(files, f)
+		return f.ID
+	}
+	if output.Len() > 0 {
+		b.OutputFileID = addFile("output", output.Bytes())
+	}
+	if errorOutput.Len() > 0 {
+		b.ErrorFileID = addFile("error", errorOutput.Bytes())
+	}
+
+	b.Status = status
+	err = r.gw.DB.FinishBatch(ctx, b, files)
+	if errors.Is(err, sql.ErrNoRows) {
+		return // ended already
+	}
+	if err != nil {
+		logger.Log.Error("Failed to finish batch", "batch_id", b.ID, "err", err)
+		return
+	}
+	logger.Log.Info("Batch finished", "batch_id", b.ID, "status", status, "results", len(results))
+}
+
+// call runs one request of a batch until it is answered or fails, and returns its result.
+// It reports false if ctx ended first.
+//
+// Like the gateway, a request must be within its key's limits and the organization's quota
+// to be sent, but rather than being turned away it waits until it is. The request is only
+// admitted once a node serves its model, so that it doesn't hold one of the key's
+// concurrency slots while waiting for one, and its tokens are charged after each attempt.
+func (r *BatchRunner) call(ctx context.Context, key *db.APIKeyRecord, req *batchRequest) (*db.BatchResult, bool) {
+	g := r.gw
+	model := req.chat.Model
+	notAllowed := func() *db.BatchResult {
+		return req.failed("", http.StatusForbidden, "invalid_request_error", "model_not_allowed",
+			fmt.Sprintf("Model %s not allowed for this API Key", model))
+	}
+	if !g.allowsModel(key, model) {
+		return notAllowed(), true
+	}
+
+	var adm *admission
+	defer func() {
+		if adm != nil {
+			adm.Lease.Release()
+		}
+	}()
+	for attempt := 1; ; {
+		if adm == nil {
+			if !r.awaitNode(ctx, key, model, keyRequirements(key, &req.chat)) {
+				return nil, false
+			}
+			var err error
+			adm, err = r.admit(ctx, key.APIKey, model)
+			if errors.Is(err, errModelNotAllowed) {
+				return notAllowed(), true
+			}
+			if err != nil {
+				return nil, false
+			}
+			key = adm.Key
+		}
+		need := keyRequirements(key, &req.chat)
+		need.Batch = true
+
+		reqID := "req-" + uuid.New().String()
+		stream, served, buckets, err := r.dispatch(ctx, reqID, adm, model, need, req.body)
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		var limited *modelLimitError
+		if errors.As(err, &limited) {
+			// Over the key's limits of every model: keep the slot, as for a busy node
+			select {
+			case <-time.After(max(limited.res.RetryAfter, queuePoll/10)):
+			case <-ctx.Done():
+				return nil, false
+			}
+			continue
+		}
+		if err != nil {
+			// Nodes are all busy, in which case it queues again, or none serves the model any
+			// more: give back the concurrency slot while waiting for one
+			if !errors.Is(err, errQueueTimeout) {
+				adm.Lease.Release()
+				adm = nil
+			}
+			continue
+		}
+
+		usage := newUsageMeter(req.size)
+		rt := newRequestTrace(reqID, key, &req.chat, req.raw, key.LogContent && g.RequestLog != nil)
+		rt.entry.NodeID, rt.entry.Model = stream.Client.ID, served
+		go func() {
+			if err := g.DB.IncrementAPICalls(context.Background(), key.APIKey); err != nil {
+				logger.Log.Error("Failed to increment API calls", "err", err)
+			}
+			if err := g.DB.IncrementProvidedCalls(context.Background(), stream.Client.Token()); err != nil {
+				logger.Log.Error("Failed to increment provided calls", "err", err)
+			}
+		}()
+
+		report := ""
+		if served != model {
+			report = served
+		}
+		msg, err := recvResponse(ctx, stream)
+		if ctx.Err() != nil {
+			stream.Abandon(context.Cause(ctx).Error())
+			return nil, false
+		}
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case msg.Type == protocol.MsgTypeError:
+			reason = errorMessage(msg)
+		default:
+			msg = withChunkModel(msg, report)
+			usage.Observe(msg)
+			rt.Observe(msg)
+		}
+		if err := g.Limiter.ConsumeTokens(context.Background(), usage.Total(), buckets...); err != nil {
+			logger.Log.Error("Failed to record token usage", "request_id", reqID, "err", err)
+		}
+		if reason == "" {
+			g.RequestLog.Record(rt.Finish(http.StatusOK, usage.Usage()))
+			body, _ := msg.ChunkBytes()
+			return req.succeeded(reqID, body), true
+		}
+
+		rt.Fail(reason)
+		g.RequestLog.Record(rt.Finish(http.StatusBadGateway, protocol.UsageStat{}))
+		if attempt == batchAttempts {
+			return req.failed(reqID, http.StatusBadGateway, "upstream_error", "upstream_error", reason), true
+		}
+		logger.Log.Warn("Batch request failed, retrying", "request_id", reqID, "err", reason, "attempt", attempt)
+		attempt++
+	}
+}
+
+var errModelNotAllowed = errors.New("model not allowed for this API key")
+
+// awaitNode waits until a node serves model, or one of its fallback chain key may use, and
+// meets need. It reports false if ctx ended first.
+func (r *BatchRunner) awaitNode(ctx context.Context, key *db.APIKeyRecord, model string, need Requirements) bool {
+	for {
+		models, _ := r.gw.candidates(key, model, need)
+		for _, m := range models {
+			if r.gw.Hub.serves(m, need) {
+				return true
+			}
+		}
+		select {
+		case <-time.After(batchRetry):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// admit waits until a request of apiKey for model passes the checks the gateway makes of
+// every request, and returns its admission. The key is looked up anew each time, so that
+// changes to its limits, or it being blocked or disabled, apply to batches under way. It
+// returns errModelNotAllowed if the key may not use model, or ctx's error if it ended first.
+func (r *BatchRunner) admit(ctx context.Context, apiKey, model string) (*admission, error) {
+	for {
+		wait := batchRetry
+		key, err := r.gw.DB.GetAPIKey(ctx, apiKey)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				logger.Log.Error("Failed to load batch API key", "err", err)
+			}
+		case !r.gw.allowsModel(key, model):
+			return nil, errModelNotAllowed
+		case key.Disabled || key.RPM <= 0:
+			// Blocked until an admin lifts it
+		default:
+			var adm *admission
+			adm, wait, err = r.tryAdmit(ctx, key, model)
+			if adm != nil {
+				return adm, nil
+			}
+			if err != nil && ctx.Err() == nil {
+				logger.Log.Error("Failed to check batch request limits", "err", err)
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryAdmit checks a request of key for model against its organization's quota, the key's
+// concurrency limit and its rate limits, charging it to them if it passes all of them. It
+// returns the admission, or else how long to wait before trying again.
+func (r *BatchRunner) tryAdmit(ctx context.Context, key *db.APIKeyRecord, model string) (*admission, time.Duration, error) {
+	g := r.gw
+	exceeded, err := g.orgQuotaExceeded(ctx, key)
+	if err != nil || exceeded {
+		return nil, batchRetry, err
+	}
+
+	var lease *limiter.Lease
+	if key.MaxConcurrent > 0 {
+		l, acquired, err := g.Limiter.AcquireConcurrency(ctx, key.APIKey, key.MaxConcurrent)
+		if err != nil {
+			return nil, batchRetry, err
+		}
+		if !acquired {
+			return nil, queuePoll, nil
+		}
+		lease = l
+	}
+
+	buckets := limitBuckets(key, model)
+	res, err := g.Limiter.Allow(ctx, buckets...)
+	if err != nil {
+		lease.Release()
+		return nil, batchRetry, err
+	}
+	if !res.Allowed {
+		lease.Release()
+		return nil, max(res.RetryAfter, queuePoll/10), nil
+	}
+	return &admission{Key: key, Buckets: buckets, Lease: lease}, 0, nil
+}
+
+// dispatch sends a request admitted with adm to a node serving model or, failing that, each
+// model of its fallback chain in turn, and returns the stream, the model that accepted it and
+// the buckets to charge its tokens to. Models over the key's limits for them are skipped; if
+// that is all of them, it returns a *modelLimitError.
+func (r *BatchRunner) dispatch(ctx context.Context, reqID string, adm *admission, model string, need Requirements, payload interface{}) (*TaskStream, string, []limiter.Bucket, error) {
+	models, missing := r.gw.candidates(adm.Key, model, need)
+	if len(models) == 0 {
+		if missing != nil {
+			return nil, "", nil, fmt.Errorf("no node serving model %s supports %s", model, strings.Join(missing, ", "))
+		}
+		return nil, "", nil, fmt.Errorf("no available clients for model: %s", model)
+	}
+	var err error
+	for _, m := range models {
+		buckets, res, aerr := r.gw.admitServed(ctx, adm, m)
+		if aerr != nil {
+			err = aerr
+			continue
+		}
+		if res != nil {
+			if err == nil {
+				err = &modelLimitError{res: res}
+			}
+			continue
+		}
+		var stream *TaskStream
+		stream, err = r.gw.Hub.RouteCall(ctx, reqID, m, need, withModel(payload, m))
+		if err == nil {
+			return stream, m, buckets, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", nil, err
+}
+
+// modelLimitError is returned by BatchRunner.dispatch when a request's key is over its limits
+// for every model that could serve it.
+type modelLimitError struct {
+	res *limiter.Result
+}
+
+func (e *modelLimitError) Error() string {
+	return fmt.Sprintf("model rate limit exceeded, retry after %s", e.res.RetryAfter.Round(time.Millisecond))
+}
+
+// recvResponse waits for the response to a non-stream request: the STREAM message holding
+// it, or an ERROR.
+func recvResponse(ctx context.Context, stream *TaskStream) (protocol.WSPayload, error) {
+	for {
+		msg, err := stream.Recv(ctx)
+		if err != nil {
+			return msg, err
+		}
+		switch msg.Type {
+		case protocol.MsgTypeFinish:
+			return msg, errors.New("stream finished before returning data")
+		case protocol.MsgTypeError, protocol.MsgTypeStream:
+			return msg, nil
+		}
+	}
+}
+
+// batchInputLine is a line of a batch's input file.
+type batchInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchRequest is a request of a batch, ready to be sent.
+type batchRequest struct {
+	Line     int
+	CustomID string
+
+	chat protocol.ChatCompletionRequest
+	body map[string]interface{} // with streaming turned off
+	raw  []byte
+	size int
+}
+
+// batchProblem is a reason a batch failed, in the format of the OpenAI API.
+type batchProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// parseBatchInput reads the requests of an input file, one JSON object per line, and
+// returns them, or what is wrong with the file.
+func parseBatchInput(content []byte, endpoint string) ([]batchRequest, []batchProblem) {
+	var requests []batchRequest
+	var problems []batchProblem
+	seen := make(map[string]bool)
+	problem := func(line int, code, format string, args ...interface{}) {
+		if len(problems) < maxBatchProblems {
+			problems = append(problems, batchProblem{Code: code, Message: fmt.Sprintf(format, args...), Line: line})
+		}
+	}
+
+	for i, text := range bytes.Split(content, []byte("\n")) {
+		line := i + 1
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		var in batchInputLine
+		if err := json.Unmarshal(text, &in); err != nil {
+			problem(line, "invalid_json_line", "This line is not parseable as valid JSON")
+			continue
+		}
+		req := batchRequest{Line: line, CustomID: in.CustomID, raw: in.Body, size: len(in.Body)}
+		switch {
+		case in.CustomID == "":
+			problem(line, "missing_required_parameter", "custom_id is required")
+			continue
+		case seen[in.CustomID]:
+			problem(line, "duplicate_custom_id", "The custom_id %q is used more than once", in.CustomID)
+			continue
+		case in.Method != http.MethodPost:
+			problem(line, "invalid_method", "The method must be POST")
+			continue
+		case in.URL != endpoint:
+			problem(line, "invalid_url", "The url must be %s, the endpoint of the batch", endpoint)
+			continue
+		case json.Unmarshal(in.Body, &req.body) != nil || json.Unmarshal(in.Body, &req.chat) != nil:
+			problem(line, "invalid_request", "The body must be a JSON object")
+			continue
+		case req.chat.Model == "":
+			problem(line, "missing_required_parameter", "The body must name a model")
+			continue
+		}
+		seen[in.CustomID] = true
+
+		// Responses are collected whole
+		req.chat.Stream = false
+		delete(req.body, "stream")
+		delete(req.body, "stream_options")
+		requests = append(requests, req)
+	}
+
+	switch {
+	case len(problems) == 0 && len(requests) == 0:
+		problem(0, "empty_file", "The input file holds no requests")
+	case len(requests) > maxBatchRequests:
+		problem(0, "too_many_tasks", "A batch may hold at most %d requests", maxBatchRequests)
+	}
+	return requests, problems
+}
+
+// batchOutput is a line of a batch's output or error file.
+type batchOutput struct {
+	ID       string         `json:"id"`
+	CustomID string         `json:"custom_id"`
+	Response *batchResponse `json:"response"`
+	Error    *batchProblem  `json:"error"`
+}
+
+type batchResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (req *batchRequest) succeeded(reqID string, body []byte) *db.BatchResult {
+	return req.result(false, reqID, http.StatusOK, body)
+}
+
+func (req *batchRequest) failed(reqID string, status int, errType, code, message string) *db.BatchResult {
+	body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{
+		"message": message,
+		"type":    errType,
+		"code":    code,
+	}})
+	return req.result(true, reqID, status, body)
+}
+
+func (req *batchRequest) result(failed bool, reqID string, status int, body []byte) *db.BatchResult {
+	output, _ := marshalString(batchOutput{
+		ID:       newObjectID("batch_req_"),
+		CustomID: req.CustomID,
+		Response: &batchResponse{StatusCode: status, RequestID: reqID, Body: body},
+	})
+	return &db.BatchResult{Line: req.Line, Failed: failed, Output: output}
+}
+
+func marshalString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// newObjectID returns a random ID for a file, batch or batch request, with prefix.
+func newObjectID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
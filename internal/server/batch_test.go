@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// batchLine is a line of a batch input file calling the batch endpoint with body.
+func batchLine(customID, body string) string {
+	return fmt.Sprintf(`{"custom_id":%q,"method":"POST","url":%q,"body":%s}`, customID, BatchEndpoint, body)
+}
+
+func TestParseBatchInput(t *testing.T) {
+	const chat = `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name     string
+		lines    []string
+		requests []string // custom IDs of the requests read
+		problems []string // code@line of the problems found
+	}{
+		{
+			name:     "valid",
+			lines:    []string{batchLine("a", chat), batchLine("b", chat)},
+			requests: []string{"a", "b"},
+		},
+		{
+			name:     "blank lines and CRLF are skipped",
+			lines:    []string{"", batchLine("a", chat) + "\r", "   ", batchLine("b", chat), ""},
+			requests: []string{"a", "b"},
+		},
+		{
+			name:     "empty file",
+			lines:    []string{"", "  "},
+			problems: []string{"empty_file@0"},
+		},
+		{
+			name:     "not JSON",
+			lines:    []string{batchLine("a", chat), "{custom_id: a}"},
+			requests: []string{"a"},
+			problems: []string{"invalid_json_line@2"},
+		},
+		{
+			name:     "missing custom_id",
+			lines:    []string{batchLine("", chat)},
+			problems: []string{"missing_required_parameter@1"},
+		},
+		{
+			name:     "duplicate custom_id",
+			lines:    []string{batchLine("a", chat), batchLine("b", chat), batchLine("a", chat)},
+			requests: []string{"a", "b"},
+			problems: []string{"duplicate_custom_id@3"},
+		},
+		{
+			name:     "wrong method",
+			lines:    []string{strings.Replace(batchLine("a", chat), `"POST"`, `"GET"`, 1)},
+			problems: []string{"invalid_method@1"},
+		},
+		{
+			name:     "wrong url",
+			lines:    []string{strings.Replace(batchLine("a", chat), BatchEndpoint, "/v1/embeddings", 1)},
+			problems: []string{"invalid_url@1"},
+		},
+		{
+			name:     "body not an object",
+			lines:    []string{batchLine("a", `"hi"`), batchLine("b", `[1]`), `{"custom_id":"c","method":"POST","url":"/v1/chat/completions"}`},
+			problems: []string{"invalid_request@1", "invalid_request@2", "invalid_request@3"},
+		},
+		{
+			name:     "no model",
+			lines:    []string{batchLine("a", `{"messages":[]}`), batchLine("b", `null`)},
+			problems: []string{"missing_required_parameter@1", "missing_required_parameter@2"},
+		},
+		{
+			name:     "custom_id of a rejected line may be used again",
+			lines:    []string{batchLine("a", `{"messages":[]}`), batchLine("a", chat)},
+			requests: []string{"a"},
+			problems: []string{"missing_required_parameter@1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, problems := parseBatchInput([]byte(strings.Join(tt.lines, "\n")), BatchEndpoint)
+			var ids, codes []string
+			for _, r := range requests {
+				ids = append(ids, r.CustomID)
+			}
+			for _, p := range problems {
+				codes = append(codes, fmt.Sprintf("%s@%d", p.Code, p.Line))
+			}
+			if !slices.Equal(ids, tt.requests) {
+				t.Errorf("requests %v, want %v", ids, tt.requests)
+			}
+			if !slices.Equal(codes, tt.problems) {
+				t.Errorf("problems %v, want %v", codes, tt.problems)
+			}
+		})
+	}
+}
+
+func TestParseBatchInputTurnsOffStreaming(t *testing.T) {
+	content := batchLine("a", `{"model":"m","stream":true,"stream_options":{"include_usage":true},"messages":[]}`)
+	requests, problems := parseBatchInput([]byte(content), BatchEndpoint)
+	if len(problems) > 0 || len(requests) != 1 {
+		t.Fatalf("got %d requests and problems %v", len(requests), problems)
+	}
+	req := requests[0]
+	if req.chat.Stream {
+		t.Error("request still streams")
+	}
+	if _, ok := req.body["stream"]; ok {
+		t.Error("body still asks for a stream")
+	}
+	if _, ok := req.body["stream_options"]; ok {
+		t.Error("body still has stream options")
+	}
+	if req.Line != 1 || req.chat.Model != "m" {
+		t.Errorf("line %d, model %q", req.Line, req.chat.Model)
+	}
+}
+
+func TestParseBatchInputLimits(t *testing.T) {
+	lines := make([]string, 0, maxBatchRequests+1)
+	for i := range maxBatchRequests + 1 {
+		lines = append(lines, batchLine(fmt.Sprint(i), `{"model":"m","messages":[]}`))
+	}
+	_, problems := parseBatchInput([]byte(strings.Join(lines, "\n")), BatchEndpoint)
+	if len(problems) != 1 || problems[0].Code != "too_many_tasks" {
+		t.Errorf("problems %v, want too_many_tasks", problems)
+	}
+
+	lines = lines[:0]
+	for range maxBatchProblems + 10 {
+		lines = append(lines, "not json")
+	}
+	_, problems = parseBatchInput([]byte(strings.Join(lines, "\n")), BatchEndpoint)
+	if len(problems) != maxBatchProblems {
+		t.Errorf("%d problems reported, want at most %d", len(problems), maxBatchProblems)
+	}
+}
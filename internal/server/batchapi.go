@@ -0,0 +1,359 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFileBytes is the size of the largest file that may be uploaded.
+const maxFileBytes = 100 << 20
+
+// apiError writes an error in the format of the OpenAI API.
+func apiError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, gin.H{"error": gin.H{
+		"message": message,
+		"type":    "invalid_request_error",
+		"code":    code,
+	}})
+}
+
+func fileObject(f *db.File) gin.H {
+	return gin.H{
+		"id":         f.ID,
+		"object":     "file",
+		"bytes":      f.Bytes,
+		"created_at": f.CreatedAt.Unix(),
+		"filename":   f.Filename,
+		"purpose":    f.Purpose,
+	}
+}
+
+func batchObject(b *db.Batch) gin.H {
+	unix := func(t sql.NullTime) interface{} {
+		if !t.Valid {
+			return nil
+		}
+		return t.Time.Unix()
+	}
+	var metadata interface{}
+	if b.Metadata != "" {
+		metadata = json.RawMessage(b.Metadata)
+	}
+	fileID := func(id string) interface{} {
+		if id == "" {
+			return nil
+		}
+		return id
+	}
+
+	obj := gin.H{
+		"id":                b.ID,
+		"object":            "batch",
+		"endpoint":          b.Endpoint,
+		"errors":            nil,
+		"input_file_id":     b.InputFileID,
+		"completion_window": b.CompletionWindow,
+		"status":            b.Status,
+		"output_file_id":    fileID(b.OutputFileID),
+		"error_file_id":     fileID(b.ErrorFileID),
+		"created_at":        b.CreatedAt.Unix(),
+		"in_progress_at":    unix(b.InProgressAt),
+		"expires_at":        b.ExpiresAt.Unix(),
+		"finalizing_at":     nil,
+		"completed_at":      nil,
+		"failed_at":         nil,
+		"expired_at":        nil,
+		"cancelling_at":     unix(b.CancellingAt),
+		"cancelled_at":      nil,
+		"request_counts": gin.H{
+			"total":     b.Total,
+			"completed": b.Completed,
+			"failed":    b.Failed,
+		},
+		"metadata": metadata,
+	}
+	if b.Errors != "" {
+		obj["errors"] = gin.H{"object": "list", "data": json.RawMessage(b.Errors)}
+	}
+	switch b.Status {
+	case db.BatchCompleted:
+		obj["completed_at"] = unix(b.FinishedAt)
+	case db.BatchFailed:
+		obj["failed_at"] = unix(b.FinishedAt)
+	case db.BatchExpired:
+		obj["expired_at"] = unix(b.FinishedAt)
+	case db.BatchCancelled:
+		obj["cancelled_at"] = unix(b.FinishedAt)
+	}
+	return obj
+}
+
+// listObject is a page of a list, fetched one item past limit to tell if there are more.
+func listObject[T any](items []T, limit int, object func(*T) gin.H, id func(*T) string) gin.H {
+	hasMore := len(items) > limit
+	items = items[:min(len(items), limit)]
+	data := make([]gin.H, len(items))
+	for i := range items {
+		data[i] = object(&items[i])
+	}
+	list := gin.H{"object": "list", "data": data, "has_more": hasMore, "first_id": nil, "last_id": nil}
+	if len(items) > 0 {
+		list["first_id"], list["last_id"] = id(&items[0]), id(&items[len(items)-1])
+	}
+	return list
+}
+
+// UploadFileHandler stores a file uploaded as multipart form data, for use as the input of a
+// batch: "file" holds the JSONL file, "purpose" must be "batch".
+// POST /v1/files
+func (g *Gateway) UploadFileHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFileBytes+1<<20)
+	if purpose := c.PostForm("purpose"); purpose != db.FilePurposeBatch {
+		apiError(c, http.StatusBadRequest, "invalid_purpose", fmt.Sprintf("Unsupported purpose %q, files are uploaded for %q", purpose, db.FilePurposeBatch))
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "missing_file", "A file is required")
+		return
+	}
+	if header.Size > maxFileBytes {
+		apiError(c, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("Files may be at most %d MB", maxFileBytes>>20))
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "missing_file", "A file is required")
+		return
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "missing_file", "The file couldn't be read")
+		return
+	}
+
+	file := &db.File{
+		ID:        newObjectID("file-"),
+		APIKey:    key.APIKey,
+		Purpose:   db.FilePurposeBatch,
+		Filename:  header.Filename,
+		Bytes:     int64(len(content)),
+		Content:   content,
+		CreatedAt: time.Now(),
+	}
+	if err := g.DB.CreateFile(c.Request.Context(), file); err != nil {
+		logger.Log.Error("Failed to store file", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, fileObject(file))
+}
+
+// ListFilesHandler lists the files of the API key, newest first.
+// GET /v1/files
+func (g *Gateway) ListFilesHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	limit, offset := pagination(c)
+	files, err := g.DB.ListFiles(c.Request.Context(), key.APIKey, limit+1, offset)
+	if err != nil {
+		logger.Log.Error("Failed to list files", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, listObject(files, limit, fileObject, func(f *db.File) string { return f.ID }))
+}
+
+// GetFileHandler returns a file of the API key.
+// GET /v1/files/:file_id
+func (g *Gateway) GetFileHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	f, err := g.DB.GetFile(c.Request.Context(), key.APIKey, c.Param("file_id"))
+	if err != nil {
+		apiError(c, http.StatusNotFound, "file_not_found", "No such file")
+		return
+	}
+	c.JSON(http.StatusOK, fileObject(f))
+}
+
+// FileContentHandler returns the content of a file of the API key, such as the results of a
+// batch.
+// GET /v1/files/:file_id/content
+func (g *Gateway) FileContentHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	content, err := g.DB.GetFileContent(c.Request.Context(), key.APIKey, c.Param("file_id"))
+	if err != nil {
+		apiError(c, http.StatusNotFound, "file_not_found", "No such file")
+		return
+	}
+	c.Data(http.StatusOK, "application/jsonl", content)
+}
+
+// DeleteFileHandler deletes a file of the API key.
+// DELETE /v1/files/:file_id
+func (g *Gateway) DeleteFileHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	id := c.Param("file_id")
+	err := g.DB.DeleteFile(c.Request.Context(), key.APIKey, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		apiError(c, http.StatusNotFound, "file_not_found", "No such file")
+		return
+	}
+	if err != nil {
+		logger.Log.Error("Failed to delete file", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+type CreateBatchRequest struct {
+	InputFileID      string            `json:"input_file_id" binding:"required"`
+	Endpoint         string            `json:"endpoint" binding:"required"`
+	CompletionWindow string            `json:"completion_window" binding:"required"`
+	Metadata         map[string]string `json:"metadata" binding:"omitempty,max=16"`
+}
+
+// CreateBatchHandler creates a batch running the requests of an uploaded file. The file is
+// validated once the batch is picked up.
+// POST /v1/batches
+func (g *Gateway) CreateBatchHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	var req CreateBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.Endpoint != BatchEndpoint {
+		apiError(c, http.StatusBadRequest, "unsupported_endpoint", fmt.Sprintf("Batches may only call %s", BatchEndpoint))
+		return
+	}
+	if req.CompletionWindow != "24h" {
+		apiError(c, http.StatusBadRequest, "unsupported_completion_window", "The completion window must be 24h")
+		return
+	}
+
+	ctx := c.Request.Context()
+	f, err := g.DB.GetFile(ctx, key.APIKey, req.InputFileID)
+	if err != nil {
+		apiError(c, http.StatusNotFound, "file_not_found", "No such input file")
+		return
+	}
+	if f.Purpose != db.FilePurposeBatch {
+		apiError(c, http.StatusBadRequest, "invalid_input_file", fmt.Sprintf("The input file must have purpose %q", db.FilePurposeBatch))
+		return
+	}
+
+	now := time.Now()
+	b := &db.Batch{
+		ID:               newObjectID("batch_"),
+		APIKey:           key.APIKey,
+		Endpoint:         req.Endpoint,
+		InputFileID:      f.ID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           db.BatchValidating,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(batchCompletionWindow),
+	}
+	if len(req.Metadata) > 0 {
+		b.Metadata, _ = marshalString(req.Metadata)
+	}
+	if err := g.DB.CreateBatch(ctx, b); err != nil {
+		logger.Log.Error("Failed to create batch", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	g.Batches.poke()
+	c.JSON(http.StatusOK, batchObject(b))
+}
+
+// ListBatchesHandler lists the batches of the API key, newest first.
+// GET /v1/batches
+func (g *Gateway) ListBatchesHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	limit, offset := pagination(c)
+	batches, err := g.DB.ListBatches(c.Request.Context(), key.APIKey, limit+1, offset)
+	if err != nil {
+		logger.Log.Error("Failed to list batches", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, listObject(batches, limit, batchObject, func(b *db.Batch) string { return b.ID }))
+}
+
+// GetBatchHandler returns a batch of the API key, with its status and progress.
+// GET /v1/batches/:batch_id
+func (g *Gateway) GetBatchHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	b, err := g.DB.GetBatch(c.Request.Context(), key.APIKey, c.Param("batch_id"))
+	if err != nil {
+		apiError(c, http.StatusNotFound, "batch_not_found", "No such batch")
+		return
+	}
+	c.JSON(http.StatusOK, batchObject(b))
+}
+
+// CancelBatchHandler cancels a batch that hasn't ended. It is cancelling until the requests
+// in flight are abandoned, then cancelled, with the results it got so far in its output and
+// error files.
+// POST /v1/batches/:batch_id/cancel
+func (g *Gateway) CancelBatchHandler(c *gin.Context) {
+	key, ok := g.bearerKey(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	id := c.Param("batch_id")
+	err := g.DB.CancelBatch(ctx, key.APIKey, id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Log.Error("Failed to cancel batch", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return
+	}
+	b, getErr := g.DB.GetBatch(ctx, key.APIKey, id)
+	if getErr != nil {
+		apiError(c, http.StatusNotFound, "batch_not_found", "No such batch")
+		return
+	}
+	if err != nil {
+		apiError(c, http.StatusConflict, "batch_not_cancellable", fmt.Sprintf("A batch that is %s can't be cancelled", b.Status))
+		return
+	}
+	g.Batches.cancel(id)
+	c.JSON(http.StatusOK, batchObject(b))
+}
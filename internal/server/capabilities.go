@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/protocol"
+)
+
+// Requirements is what a chat completion needs from the model serving it.
+type Requirements struct {
+	Vision       bool
+	Tools        bool
+	JSONMode     bool
+	PromptTokens int // estimated from the message text
+	OutputTokens int // requested maximum, 0 if not set
+
+	Encrypted bool   // the API key only allows nodes that take sealed requests
+	MinTier   string // the lowest trust tier of node owner allowed, see ReputationBook
+
+	Affinity string // the conversation, to prefer the node that served it, see affinityKey
+
+	// Whose share of busy nodes the request takes and how, see acquire
+	Flow   string
+	Weight int
+	Batch  bool
+}
+
+// requirementsOf inspects a chat completion request for the capabilities it relies on.
+func requirementsOf(req *protocol.ChatCompletionRequest) Requirements {
+	var r Requirements
+
+	if tools, ok := req.Tools.([]interface{}); ok && len(tools) > 0 {
+		r.Tools = true
+	}
+	if rf, ok := req.ResponseFormat.(map[string]interface{}); ok {
+		if t, _ := rf["type"].(string); t == "json_object" || t == "json_schema" {
+			r.JSONMode = true
+		}
+	}
+
+	r.OutputTokens = req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		r.OutputTokens = req.MaxCompletionTokens
+	}
+
+	textBytes := 0
+	for _, msg := range req.Messages {
+		switch content := msg.Content.(type) {
+		case string:
+			textBytes += len(content)
+		case []interface{}:
+			// Multi-part content: {"type": "text", "text": ...} or {"type": "image_url", ...}
+			for _, p := range content {
+				part, _ := p.(map[string]interface{})
+				switch part["type"] {
+				case "text":
+					text, _ := part["text"].(string)
+					textBytes += len(text)
+				case "image_url", "input_image", "image":
+					r.Vision = true
+				}
+			}
+		}
+	}
+	r.PromptTokens = (textBytes + bytesPerToken - 1) / bytesPerToken
+	return r
+}
+
+// Missing lists what caps lacks to serve r. A model that declared no capabilities is
+// assumed to handle anything, as nodes did before capabilities existed.
+func (r Requirements) Missing(caps *protocol.ModelCapabilities) []string {
+	if caps == nil {
+		return nil
+	}
+
+	var out []string
+	if r.Vision && !caps.Vision {
+		out = append(out, "vision")
+	}
+	if r.Tools && !caps.Tools {
+		out = append(out, "tool calling")
+	}
+	if r.JSONMode && !caps.JSONMode {
+		out = append(out, "JSON mode")
+	}
+	if caps.MaxOutputTokens > 0 && r.OutputTokens > caps.MaxOutputTokens {
+		out = append(out, fmt.Sprintf("%d output tokens", r.OutputTokens))
+	}
+	if caps.ContextWindow > 0 && r.PromptTokens+r.OutputTokens > caps.ContextWindow {
+		out = append(out, fmt.Sprintf("a context window of %d tokens", r.PromptTokens+r.OutputTokens))
+	}
+	return out
+}
+
+// lacks lists what the node lacks to serve r with model. The caller must hold Hub.mu.
+func (c *ClientConn) lacks(model string, r Requirements) []string {
+	missing := r.Missing(c.capabilities(model))
+	if r.Encrypted && c.PublicKey == nil {
+		missing = append(missing, "end-to-end encryption")
+	}
+	if db.TierRank(c.Hub.Reputation.Tier(c.Token())) < db.TierRank(r.MinTier) {
+		missing = append(missing, "trust tier "+r.MinTier)
+	}
+	return missing
+}
+
+// capabilities returns what the node declared for model, or nil. The caller must hold Hub.mu.
+func (c *ClientConn) capabilities(model string) *protocol.ModelCapabilities {
+	caps, ok := c.Capabilities[model]
+	if !ok {
+		return nil
+	}
+	return &caps
+}
+
+// mergeCapabilities combines the capabilities of a model across nodes into what the
+// network as a whole can serve.
+func mergeCapabilities(into *protocol.ModelCapabilities, caps protocol.ModelCapabilities) {
+	into.ContextWindow = max(into.ContextWindow, caps.ContextWindow)
+	into.MaxOutputTokens = max(into.MaxOutputTokens, caps.MaxOutputTokens)
+	into.Vision = into.Vision || caps.Vision
+	into.Tools = into.Tools || caps.Tools
+	into.JSONMode = into.JSONMode || caps.JSONMode
+	into.Embeddings = into.Embeddings || caps.Embeddings
+}
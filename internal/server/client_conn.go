@@ -1,12 +1,18 @@
 package server
 
 import (
-	"encoding/json"
+	"crypto/ecdh"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"CoLinkPlan/internal/protocol"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/version"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,28 +26,173 @@ type ClientConn struct {
 	MaxParallel     int
 	ActiveTasks     int
 	SupportedModels map[string]bool
+	Capabilities    map[string]protocol.ModelCapabilities // by model, only those that declared any
+	ModelParallel   map[string]int                        // per-model caps, only those that declared one
+	ModelTasks      map[string]int                        // active tasks by model
+	PublicKey       *ecdh.PublicKey                       // requests are sealed to it, nil if the node registered none
+
+	// Negotiated in the HELLO/WELCOME handshake; ProtocolVersion is 0 until the node has
+	// said hello or registered
+	ProtocolVersion int
+	ClientVersion   string
+	Features        map[string]bool
+
+	// Resumable session, see Hub.suspend. SessionID, resuming, detached and the suspension
+	// fields are guarded by Hub.mu; the sequence numbers belong to ReadLoop.
+	SessionID  string
+	recvSeq    uint64 // last numbered message received
+	ackedSeq   uint64
+	resuming   bool        // attached to a suspended session, until the node says hello
+	closing    atomic.Bool // disconnected on purpose, the session must not be resumed
+	detached   chan struct{}
+	suspension uint64      // counts the times the session was suspended
+	graceTimer *time.Timer // expires the current suspension
+
+	// Reported by the node in HEARTBEAT messages, see Hub.checkHeartbeats. Guarded by Hub.mu.
+	Heartbeat *NodeHeartbeat
+	Orphaned  int       // tasks the node runs that the hub no longer waits for
+	lastSeen  time.Time // last heartbeat, or the handshake
 
 	// Penalized until this time
 	PenaltyUntil time.Time
 
 	// Pending streams mapped by RequestID
-	PendingStreams map[string]chan protocol.WSPayload
+	PendingStreams map[string]*TaskStream
 	PendingMutex   sync.RWMutex
+	pendingTasks   map[string]pendingTask // guarded by PendingMutex
 
 	closeCh chan struct{}
 }
 
+// pendingTask is what the hub remembers about a dispatched request for its task events.
+type pendingTask struct {
+	model   string
+	started time.Time
+}
+
 func NewClientConn(hub *Hub, conn *websocket.Conn, id string) *ClientConn {
 	return &ClientConn{
 		ID:              id,
 		Conn:            conn,
 		Hub:             hub,
 		SupportedModels: make(map[string]bool),
-		PendingStreams:  make(map[string]chan protocol.WSPayload),
+		Features:        make(map[string]bool),
+		Capabilities:    make(map[string]protocol.ModelCapabilities),
+		ModelParallel:   make(map[string]int),
+		ModelTasks:      make(map[string]int),
+		PendingStreams:  make(map[string]*TaskStream),
+		pendingTasks:    make(map[string]pendingTask),
 		closeCh:         make(chan struct{}),
+		detached:        make(chan struct{}),
+	}
+}
+
+// handshake answers a HELLO with WELCOME, or with an ERROR if the node's protocol version is
+// no longer supported, returning false when the node must be disconnected.
+func (c *ClientConn) handshake(hello protocol.HelloData) bool {
+	negotiated, ok := protocol.NegotiateVersion(hello.ProtocolVersion)
+	if !ok {
+		logger.Log.Warn("Rejected incompatible client", "client_id", c.ID,
+			"protocol_version", hello.ProtocolVersion, "client_version", hello.ClientVersion)
+		c.refuse(http.StatusUpgradeRequired, websocket.CloseProtocolError, "unsupported protocol version",
+			fmt.Sprintf("client protocol version %d is no longer supported, this server needs version %d or newer: please upgrade the Co-Link client",
+				hello.ProtocolVersion, protocol.MinProtocolVersion))
+		return false
+	}
+
+	features := protocol.CommonFeatures(c.Hub.features, hello.Features)
+	resumable := slices.Contains(features, protocol.FeatureResume)
+	c.Hub.mu.Lock()
+	resuming := c.resuming
+	c.resuming = false
+	c.Hub.mu.Unlock()
+	resumed := resuming && resumable
+	if resuming && !resumable {
+		c.failPending("node disconnected")
+	}
+
+	c.Hub.mu.Lock()
+	c.ProtocolVersion = negotiated
+	c.ClientVersion = hello.ClientVersion
+	c.Features = make(map[string]bool, len(features))
+	for _, f := range features {
+		c.Features[f] = true
+	}
+	compress := c.Features[protocol.FeatureCompression]
+	c.lastSeen = time.Now()
+	switch {
+	case resumed:
+	case resumable:
+		c.newSession()
+	default:
+		c.SessionID = ""
+	}
+	c.Hub.mu.Unlock()
+
+	logger.Log.Info("Client handshake", "client_id", c.ID, "protocol_version", negotiated,
+		"client_version", hello.ClientVersion, "features", features)
+	welcome := protocol.WelcomeData{
+		ProtocolVersion: negotiated,
+		ServerVersion:   version.Version,
+		Features:        features,
+		SessionID:       c.SessionID,
+	}
+	if resumed {
+		welcome.Resumed, welcome.LastSeq = true, c.recvSeq
+	}
+	if c.Features[protocol.FeatureHeartbeat] {
+		welcome.HeartbeatInterval = int(c.Hub.HeartbeatInterval / time.Second)
+	}
+	err := c.SendMessage(protocol.WSPayload{Type: protocol.MsgTypeWelcome, Data: welcome})
+
+	// permessage-deflate was negotiated in the upgrade already, but only nodes that asked
+	// for compression get compressed messages
+	c.ConnMutex.Lock()
+	c.Conn.EnableWriteCompression(compress)
+	if compress {
+		c.Conn.SetCompressionLevel(protocol.CompressionLevel)
+	}
+	c.ConnMutex.Unlock()
+
+	if resumed && err == nil {
+		c.resumeSession(hello.Tasks)
+	}
+	return err == nil
+}
+
+// refuse tells the node why it is being disconnected with an ERROR, and closes the
+// connection with closeCode and reason. The caller then ends ReadLoop.
+func (c *ClientConn) refuse(code, closeCode int, reason, message string) {
+	c.SendMessage(protocol.WSPayload{
+		Type: protocol.MsgTypeError,
+		Data: protocol.ErrorData{Code: code, Message: message},
+	})
+	c.ConnMutex.Lock()
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason),
+		time.Now().Add(time.Second))
+	c.ConnMutex.Unlock()
+}
+
+// reserve takes a slot of the node for a task of model. The caller must hold Hub.mu.
+func (c *ClientConn) reserve(model string) {
+	c.ActiveTasks++
+	c.ModelTasks[model]++
+}
+
+// releaseModelTask frees a slot of model taken when a task was dispatched. The caller must
+// hold Hub.mu.
+func (c *ClientConn) releaseModelTask(model string) {
+	c.ModelTasks[model]--
+	if c.ModelTasks[model] <= 0 {
+		delete(c.ModelTasks, model)
 	}
 }
 
+// Token returns the client token the node authenticated with.
+func (c *ClientConn) Token() string {
+	return strings.Split(c.ID, "_")[0]
+}
+
 func (c *ClientConn) SendMessage(payload protocol.WSPayload) error {
 	c.ConnMutex.Lock()
 	defer c.ConnMutex.Unlock()
@@ -49,28 +200,21 @@ func (c *ClientConn) SendMessage(payload protocol.WSPayload) error {
 }
 
 func (c *ClientConn) ReadLoop() {
+	c.Hub.mu.RLock()
+	detached := c.detached
+	c.Hub.mu.RUnlock()
 	defer func() {
 		c.Hub.unregister <- c
 		c.ConnMutex.Lock()
 		c.Conn.Close()
 		c.ConnMutex.Unlock()
 
-		c.PendingMutex.Lock()
-		for reqID, ch := range c.PendingStreams {
-			// Ensure wait handlers are unblocked and gracefully exit
-			close(ch)
-
-			c.Hub.mu.Lock()
-			c.ActiveTasks--
-			if c.ActiveTasks < 0 {
-				c.ActiveTasks = 0
-			}
-			c.Hub.mu.Unlock()
-			delete(c.PendingStreams, reqID)
+		// A resumable session keeps its pending requests for a while
+		if !c.Hub.suspend(c) {
+			c.failPending("node disconnected")
+			close(c.closeCh)
 		}
-		c.PendingMutex.Unlock()
-
-		close(c.closeCh)
+		close(detached)
 	}()
 
 	c.Conn.SetReadDeadline(time.Now().Add(15 * time.Second * 2)) // Expect pong
@@ -80,56 +224,101 @@ func (c *ClientConn) ReadLoop() {
 	})
 
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		msgType, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			logger.Log.Error("Read error from client", "client_id", c.ID, "err", err)
 			break
 		}
 
 		var payload protocol.WSPayload
-		if err := json.Unmarshal(message, &payload); err != nil {
+		if msgType == websocket.BinaryMessage {
+			payload, err = protocol.DecodeFrame(message)
+		} else {
+			payload, err = protocol.DecodeMessage(message)
+		}
+		if err != nil {
 			logger.Log.Error("Invalid WS payload", "client_id", c.ID, "err", err)
 			continue
 		}
 
 		switch payload.Type {
-		case protocol.MsgTypeRegister:
-			dataBytes, _ := json.Marshal(payload.Data)
-			var reg protocol.RegisterData
-			json.Unmarshal(dataBytes, &reg)
-
-			c.Hub.mu.Lock()
-			c.MaxParallel = reg.MaxParallel
-			for _, m := range reg.Models {
-				c.SupportedModels[m] = true
+		case protocol.MsgTypeHello:
+			if !c.handshake(payload.Data.(protocol.HelloData)) {
+				return
 			}
-			logger.Log.Info("Client registered", "client_id", c.ID, "max_parallel", c.MaxParallel, "models", reg.Models)
-			c.Hub.mu.Unlock()
 
-		case protocol.MsgTypeStream, protocol.MsgTypeFinish, protocol.MsgTypeError:
-			dataBytes, _ := json.Marshal(payload.Data)
-
-			var reqID string
+		case protocol.MsgTypeRegister, protocol.MsgTypeUpdate:
+			reg := payload.Data.(protocol.RegisterData)
 
-			// Just quickly peak for RequestID using a generic map to route
-			var generic map[string]interface{}
-			json.Unmarshal(dataBytes, &generic)
+			// Both replace what the node serves; tasks already dispatched are unaffected
+			models := make(map[string]bool, len(reg.Models))
+			for _, m := range reg.Models {
+				models[m] = true
+			}
+			capabilities := make(map[string]protocol.ModelCapabilities, len(reg.Capabilities))
+			for m, caps := range reg.Capabilities {
+				capabilities[m] = caps
+			}
+			modelParallel := make(map[string]int, len(reg.ModelParallel))
+			for m, n := range reg.ModelParallel {
+				if n > 0 {
+					modelParallel[m] = n
+				}
+			}
 
-			if idVal, ok := generic["request_id"].(string); ok {
-				reqID = idVal
+			// A node asking for sealed requests never gets them in plaintext instead
+			var publicKey *ecdh.PublicKey
+			if reg.PublicKey != "" {
+				key, err := protocol.ParsePublicKey(reg.PublicKey)
+				if err != nil {
+					logger.Log.Warn("Refused node with invalid public key", "client_id", c.ID, "err", err)
+					c.refuse(http.StatusBadRequest, websocket.ClosePolicyViolation, "invalid public key",
+						fmt.Sprintf("invalid public key, registration refused: %v", err))
+					return
+				}
+				publicKey = key
 			}
 
-			if reqID != "" {
-				c.PendingMutex.RLock()
-				streamCh, ok := c.PendingStreams[reqID]
-				c.PendingMutex.RUnlock()
+			c.Hub.mu.Lock()
+			if c.ProtocolVersion == 0 {
+				c.ProtocolVersion = 1 // registered without a HELLO: a client from before the handshake
+			}
+			c.MaxParallel = reg.MaxParallel
+			c.SupportedModels = models
+			c.Capabilities = capabilities
+			c.ModelParallel = modelParallel
+			c.PublicKey = publicKey
+			evType := EventNodeRegistered
+			if payload.Type == protocol.MsgTypeUpdate {
+				evType = EventNodeUpdated
+				logger.Log.Info("Client updated", "client_id", c.ID, "max_parallel", c.MaxParallel, "models", reg.Models)
+			} else {
+				logger.Log.Info("Client registered", "client_id", c.ID, "max_parallel", c.MaxParallel, "models", reg.Models)
+			}
+			c.Hub.scheduleLocked()
+			ev := c.event(evType)
+			c.Hub.mu.Unlock()
+			c.Hub.publish(ev)
 
-				if ok {
-					streamCh <- payload
+		case protocol.MsgTypeHeartbeat:
+			c.heartbeat(payload.Data.(protocol.HeartbeatData))
 
+		case protocol.MsgTypeStream, protocol.MsgTypeFinish, protocol.MsgTypeError:
+			if !c.received(payload.Seq) {
+				continue // already received before the node resumed
+			}
+			if reqID := payload.RequestID(); reqID != "" {
+				if c.deliver(reqID, payload) {
 					// Release the parallel slot when the request is done (Finish or Error)
-					if payload.Type == protocol.MsgTypeFinish || payload.Type == protocol.MsgTypeError {
-						c.Hub.CompleteTask(c, reqID)
+					switch payload.Type {
+					case protocol.MsgTypeFinish:
+						c.Hub.CompleteTask(c, reqID, "")
+					case protocol.MsgTypeError:
+						if refused(payload) {
+							c.Hub.RefuseTask(c, reqID, errorMessage(payload))
+						} else {
+							c.Hub.CompleteTask(c, reqID, errorMessage(payload))
+						}
 					}
 				} else {
 					logger.Log.Warn("Received message for unknown stream", "request_id", reqID, "client_id", c.ID)
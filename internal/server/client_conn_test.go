@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRegisterInvalidPublicKey(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	conn, node := wsPair(t)
+	c := NewClientConn(h, conn, "client-t_0123abcd")
+	h.register <- c
+	go c.ReadLoop()
+
+	reg := protocol.RegisterData{MaxParallel: 1, Models: []string{"m"}, PublicKey: "not a key"}
+	if err := node.WriteJSON(protocol.WSPayload{Type: protocol.MsgTypeRegister, Data: reg}); err != nil {
+		t.Fatal(err)
+	}
+
+	node.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := node.ReadMessage()
+	if err != nil {
+		t.Fatalf("no reply to the registration: %v", err)
+	}
+	payload, err := protocol.DecodeMessage(message)
+	if err != nil || payload.Type != protocol.MsgTypeError {
+		t.Fatalf("node got %s, want an ERROR", message)
+	}
+	if code := payload.ErrorData().Code; code != http.StatusBadRequest {
+		t.Errorf("error code %d, want 400", code)
+	}
+	if _, _, err := node.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("connection not closed for the invalid key: %v", err)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if c.MaxParallel != 0 || len(c.SupportedModels) != 0 {
+		t.Errorf("node registered with %d slots for %v", c.MaxParallel, c.SupportedModels)
+	}
+	if h.selectLocked("m", Requirements{}) != nil {
+		t.Error("node refused registration is selectable")
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hub event types, also used as the SSE event names of /api/events.
+const (
+	EventSnapshot               = "snapshot"
+	EventNodeConnected          = "node_connected"
+	EventNodeRegistered         = "node_registered"
+	EventNodeUpdated            = "node_updated"
+	EventNodeDisconnected       = "node_disconnected"
+	EventNodePenalized          = "node_penalized"
+	EventNodeHeartbeat          = "node_heartbeat"
+	EventNodeVerificationFailed = "node_verification_failed"
+	EventTaskStarted            = "task_started"
+	EventTaskFinished           = "task_finished"
+)
+
+const (
+	eventBufferSize = 64
+	eventKeepAlive  = 15 * time.Second
+)
+
+// NodeInfo is the public state of a node, as listed by /api/nodes.
+type NodeInfo struct {
+	ID              string   `json:"id"`
+	Token           string   `json:"token,omitempty"` // only shown to admins
+	Mine            bool     `json:"mine,omitempty"`
+	MaxParallel     int      `json:"max_parallel"`
+	ActiveTasks     int      `json:"active_tasks"`
+	SupportedModels []string `json:"supported_models"`
+	Penalized       bool     `json:"penalized"`
+	ClientVersion   string   `json:"client_version,omitempty"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Encrypted       bool     `json:"encrypted,omitempty"` // takes end-to-end encrypted requests
+	Tier            string   `json:"tier"`                // trust tier of the node's owner
+
+	Orphaned  int            `json:"orphaned,omitempty"`
+	Heartbeat *NodeHeartbeat `json:"heartbeat,omitempty"`
+}
+
+// HubEvent is something that happened to a node. Node is its state right after the event,
+// so a subscriber that missed events is back in sync with the next one about that node.
+type HubEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Node      NodeInfo  `json:"node"`
+	RequestID string    `json:"request_id,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	LatencyMS int64     `json:"latency_ms,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	token string // client token of the node, decides who may see the details
+}
+
+// info returns the node's current state. The caller must hold Hub.mu.
+func (c *ClientConn) info() NodeInfo {
+	models := make([]string, 0, len(c.SupportedModels))
+	for m := range c.SupportedModels {
+		models = append(models, m)
+	}
+	return NodeInfo{
+		ID:              c.ID,
+		MaxParallel:     c.MaxParallel,
+		ActiveTasks:     c.ActiveTasks,
+		SupportedModels: models,
+		Penalized:       time.Now().Before(c.PenaltyUntil),
+		ClientVersion:   c.ClientVersion,
+		ProtocolVersion: c.ProtocolVersion,
+		Encrypted:       c.PublicKey != nil,
+		Tier:            c.Hub.Reputation.Tier(c.Token()),
+		Orphaned:        c.Orphaned,
+		Heartbeat:       c.Heartbeat,
+	}
+}
+
+// event builds an event about c. The caller must hold Hub.mu.
+func (c *ClientConn) event(typ string) HubEvent {
+	return HubEvent{Type: typ, Time: time.Now(), Node: c.info(), token: c.Token()}
+}
+
+// Subscribe returns a channel receiving every Hub event from now on. Events are dropped
+// for subscribers that fall more than eventBufferSize behind. Call Unsubscribe when done.
+func (h *Hub) Subscribe() chan HubEvent {
+	ch := make(chan HubEvent, eventBufferSize)
+	h.subMu.Lock()
+	h.subscribers[ch] = true
+	h.subMu.Unlock()
+	return ch
+}
+
+func (h *Hub) Unsubscribe(ch chan HubEvent) {
+	h.subMu.Lock()
+	delete(h.subscribers, ch)
+	h.subMu.Unlock()
+}
+
+func (h *Hub) publish(ev HubEvent) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// snapshot returns a registered event for every registered node.
+func (h *Hub) snapshot() []HubEvent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	events := make([]HubEvent, 0, len(h.clients))
+	for client := range h.clients {
+		if client.MaxParallel > 0 {
+			events = append(events, client.event(EventNodeRegistered))
+		}
+	}
+	return events
+}
+
+// eventViewer decides how much of an event a subscriber sees: admins everything, users the
+// details of the nodes running on their own tokens, everyone else the public node state.
+type eventViewer struct {
+	admin  bool
+	tokens map[string]bool
+}
+
+func (v eventViewer) view(ev HubEvent) HubEvent {
+	switch {
+	case v.admin:
+		ev.Node.Token = ev.token
+		ev.Node.Mine = v.tokens[ev.token]
+		return ev
+	case v.tokens[ev.token]:
+		ev.Node.Mine = true
+		return ev
+	}
+
+	ev.Node.ID = publicNodeID(ev.Node.ID)
+	ev.Node.Heartbeat = ev.Node.Heartbeat.public()
+	return HubEvent{Type: ev.Type, Time: ev.Time, Node: ev.Node}
+}
+
+// publicNodeID returns the part of a node ID that may be shown to anyone. Node IDs start with
+// the node's client token; only the connection suffix after it is public.
+func publicNodeID(id string) string {
+	if i := strings.LastIndex(id, "_"); i >= 0 {
+		return id[i+1:]
+	}
+	return id
+}
+
+// resolveEventViewer identifies the subscriber from an optional bearer token. Anonymous
+// subscribers get the public view; an invalid token is rejected.
+func resolveEventViewer(c *gin.Context, database db.Store) (eventViewer, bool) {
+	v := eventViewer{tokens: make(map[string]bool)}
+	if c.GetHeader("Authorization") == "" {
+		return v, true
+	}
+	claims, ok := bearerClaims(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return v, false
+	}
+	c.Set("email", claims["email"])
+	u, ok := currentUser(c, database)
+	if !ok {
+		return v, false
+	}
+
+	v.admin = u.IsAdmin
+	v.tokens[u.ClientToken] = true
+
+	orgs, err := database.ListUserOrganizations(c.Request.Context(), u.ID)
+	if err != nil {
+		logger.Log.Error("Failed to list organizations", "err", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return v, false
+	}
+	for _, org := range orgs {
+		if !db.OrgRoleAtLeast(org.Role, db.OrgRoleAdmin) {
+			continue
+		}
+		tokens, err := database.ListNodeTokens(c.Request.Context(), org.ID)
+		if err != nil {
+			logger.Log.Error("Failed to list node tokens", "err", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return v, false
+		}
+		for _, t := range tokens {
+			v.tokens[t.Token] = true
+		}
+	}
+	return v, true
+}
+
+// EventsHandler streams Hub events as server-sent events. The stream opens with a snapshot
+// of the registered nodes, followed by node and task events as they happen.
+// GET /api/events
+func EventsHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		viewer, ok := resolveEventViewer(c, database)
+		if !ok {
+			return
+		}
+
+		// Subscribe before taking the snapshot so nothing falls between the two.
+		events := hub.Subscribe()
+		defer hub.Unsubscribe(events)
+
+		nodes := []NodeInfo{}
+		for _, ev := range hub.snapshot() {
+			nodes = append(nodes, viewer.view(ev).Node)
+		}
+
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Writer.Header().Set("X-Accel-Buffering", "no")
+		c.SSEvent(EventSnapshot, gin.H{"nodes": nodes})
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case ev := <-events:
+				c.SSEvent(ev.Type, viewer.view(ev))
+				c.Writer.Flush()
+			case <-keepAlive.C:
+				c.Writer.WriteString(": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -3,9 +3,12 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -13,23 +16,41 @@ import (
 	"CoLinkPlan/internal/limiter"
 	"CoLinkPlan/internal/protocol"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/telemetry"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Gateway struct {
-	Hub     *Hub
-	DB      *db.DB
-	Limiter *limiter.RateLimiter
+	Hub        *Hub
+	DB         db.Store
+	Limiter    limiter.Limiter
+	RequestLog *RequestLogger // nil when request logging is disabled
+	Verifier   *Verifier      // nil when no requests are cross-checked
+	Aliases    ModelAliases   // model names resolved before routing, nil if none
+	Cache      *ResponseCache // nil when responses aren't cached
+	Batches    *BatchRunner   // nil when batches aren't run
+
+	// How long a response write may block before the request is abandoned
+	StallTimeout time.Duration
 }
 
-func NewGateway(hub *Hub, database *db.DB, rl *limiter.RateLimiter) *Gateway {
+// DefaultStallTimeout is how long a client may stop reading a response before the gateway
+// gives up on it.
+const DefaultStallTimeout = 30 * time.Second
+
+func NewGateway(hub *Hub, database db.Store, rl limiter.Limiter, requestLog *RequestLogger) *Gateway {
 	return &Gateway{
-		Hub:     hub,
-		DB:      database,
-		Limiter: rl,
+		Hub:          hub,
+		DB:           database,
+		Limiter:      rl,
+		RequestLog:   requestLog,
+		StallTimeout: DefaultStallTimeout,
 	}
 }
 
@@ -37,6 +58,8 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	// Messages are compressed once a node asks for it in the handshake, see ClientConn.handshake
+	EnableCompression: true,
 }
 
 func (g *Gateway) WsHandler(c *gin.Context) {
@@ -46,42 +69,118 @@ func (g *Gateway) WsHandler(c *gin.Context) {
 		return
 	}
 
+	// Nodes connect with a user's client token or an organization's node token
+	known, err := g.DB.NodeTokenKnown(c.Request.Context(), token)
+	if err != nil {
+		logger.Log.Error("Failed to check node token", "err", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		logger.Log.Warn("Refused node with unknown token", "remote", c.ClientIP())
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	blocked, err := g.DB.NodeTokenBlocked(c.Request.Context(), token)
+	if err != nil {
+		logger.Log.Error("Failed to check node token", "err", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		logger.Log.Warn("Refused banned node", "remote", c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	// Reputation is kept per user or organization
+	owner, err := g.DB.NodeTokenOwner(c.Request.Context(), token)
+	if err != nil {
+		logger.Log.Error("Failed to look up node token owner", "err", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	g.Hub.Reputation.bind(token, owner)
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logger.Log.Error("Failed to upgrade to websocket", "err", err)
 		return
 	}
 
-	client := NewClientConn(g.Hub, conn, token+"_"+uuid.New().String()[:8])
+	conn.EnableWriteCompression(false)
+
+	// A node back from a dropped connection picks up its session where it left off
+	var client *ClientConn
+	if sessionID := c.GetHeader(protocol.SessionHeader); sessionID != "" {
+		client = g.Hub.resume(sessionID, token, conn)
+	}
+	if client == nil {
+		client = NewClientConn(g.Hub, conn, token+"_"+uuid.New().String()[:8])
+	}
 	g.Hub.register <- client
 
 	go client.ReadLoop()
 }
 
-// ModelsHandler returns all model names currently available across connected nodes.
+// ModelsHandler returns all model names currently available across connected nodes, with
+// the capabilities their nodes declared, and the aliases standing for any of them.
 // GET /v1/models
 // GET /v1/models/:model
 func (g *Gateway) ModelsHandler(c *gin.Context) {
 	now := time.Now().Unix()
 	modelNames := g.Hub.ListModels()
+	capabilities := g.Hub.ModelCapabilities()
 
 	type ModelObject struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		OwnedBy string `json:"owned_by"`
+		ID           string                      `json:"id"`
+		Object       string                      `json:"object"`
+		Created      int64                       `json:"created"`
+		OwnedBy      string                      `json:"owned_by"`
+		Capabilities *protocol.ModelCapabilities `json:"capabilities,omitempty"`
+	}
+	capabilitiesOf := func(model string) *protocol.ModelCapabilities {
+		if caps, ok := capabilities[model]; ok {
+			return &caps
+		}
+		return nil
+	}
+
+	data := make([]ModelObject, 0, len(modelNames))
+	for _, m := range modelNames {
+		data = append(data, ModelObject{
+			ID:           m,
+			Object:       "model",
+			Created:      now,
+			OwnedBy:      "co-link",
+			Capabilities: capabilitiesOf(m),
+		})
+	}
+	// An alias is available while one of its models is; it has the capabilities of the first
+	for _, alias := range g.Aliases.Names() {
+		if slices.Contains(modelNames, alias) {
+			continue // listed already
+		}
+		for _, m := range g.Aliases.Resolve(alias) {
+			if slices.Contains(modelNames, m) {
+				data = append(data, ModelObject{
+					ID:           alias,
+					Object:       "model",
+					Created:      now,
+					OwnedBy:      "co-link",
+					Capabilities: capabilitiesOf(m),
+				})
+				break
+			}
+		}
 	}
 
 	// If a specific model is requested
 	if id := c.Param("model"); id != "" {
-		for _, m := range modelNames {
-			if m == id {
-				c.JSON(http.StatusOK, ModelObject{
-					ID:      m,
-					Object:  "model",
-					Created: now,
-					OwnedBy: "co-link",
-				})
+		for _, m := range data {
+			if m.ID == id {
+				c.JSON(http.StatusOK, m)
 				return
 			}
 		}
@@ -93,21 +192,79 @@ func (g *Gateway) ModelsHandler(c *gin.Context) {
 		return
 	}
 
-	data := make([]ModelObject, 0, len(modelNames))
-	for _, m := range modelNames {
-		data = append(data, ModelObject{
-			ID:      m,
-			Object:  "model",
-			Created: now,
-			OwnedBy: "co-link",
-		})
-	}
 	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
 }
 
-// authAndRateCheck validates the API key and enforces rate limits.
-// Returns (keyRecord, true) on success, or writes an error JSON and returns (nil, false).
-func (g *Gateway) authAndRateCheck(c *gin.Context) (*db.APIKeyRecord, bool) {
+// admission is what authAndRateCheck hands back for an accepted request.
+type admission struct {
+	Key     *db.APIKeyRecord
+	Buckets []limiter.Bucket // needed afterwards to charge the request's token usage
+	Lease   *limiter.Lease   // concurrency slot, nil if the key has no concurrency limit
+}
+
+// authAndRateCheck validates the API key, checks that it may use model and enforces the
+// key's concurrency limit and key-wide and per-model rate limits, setting x-ratelimit-*
+// headers on the response. Returns (admission, true) on success, or writes an error JSON
+// and returns (nil, false). The caller must release the admission's lease when done.
+func (g *Gateway) authAndRateCheck(c *gin.Context, model string) (*admission, bool) {
+	keyRecord, ok := g.authenticate(c, model)
+	if !ok {
+		return nil, false
+	}
+	return g.rateLimit(c, keyRecord, model)
+}
+
+// authenticate is the "auth" step of authAndRateCheck: key, model and quota checks.
+func (g *Gateway) authenticate(c *gin.Context, model string) (keyRecord *db.APIKeyRecord, ok bool) {
+	ctx, span := telemetry.Tracer.Start(c.Request.Context(), "auth")
+	defer func() { endStep(span, c, ok) }()
+
+	keyRecord, ok = g.bearerKey(c)
+	if !ok {
+		return nil, false
+	}
+
+	if !g.allowsModel(keyRecord, model) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Model %s not allowed for this API Key", model)})
+		return nil, false
+	}
+
+	exceeded, err := g.orgQuotaExceeded(ctx, keyRecord)
+	if err != nil {
+		logger.Log.Error("Failed to load key organization", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return nil, false
+	}
+	if exceeded {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Organization quota exceeded"})
+		return nil, false
+	}
+
+	return keyRecord, true
+}
+
+// allowsModel reports whether key may be used with model and, if model is an alias, with at
+// least one of the models it stands for. Only those are tried, see candidates.
+func (g *Gateway) allowsModel(key *db.APIKeyRecord, model string) bool {
+	return key.AllowsModel(model) && slices.ContainsFunc(g.Aliases.Resolve(model), key.AllowsModel)
+}
+
+// orgQuotaExceeded reports whether key belongs to an organization that has used up its API
+// call quota.
+func (g *Gateway) orgQuotaExceeded(ctx context.Context, key *db.APIKeyRecord) (bool, error) {
+	if !key.OrgID.Valid {
+		return false, nil
+	}
+	org, err := g.DB.GetOrganization(ctx, int(key.OrgID.Int64))
+	if err != nil {
+		return false, err
+	}
+	return org.QuotaExceeded(), nil
+}
+
+// bearerKey looks up the enabled API key given in the Authorization header, writing an
+// error JSON and returning (nil, false) if there is none.
+func (g *Gateway) bearerKey(c *gin.Context) (*db.APIKeyRecord, bool) {
 	authHeader := c.GetHeader("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid Authorization header"})
@@ -120,25 +277,122 @@ func (g *Gateway) authAndRateCheck(c *gin.Context) (*db.APIKeyRecord, bool) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API Key"})
 		return nil, false
 	}
+	if keyRecord.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API Key disabled"})
+		return nil, false
+	}
+	return keyRecord, true
+}
+
+// rateLimit is the "rate_limit" step of authAndRateCheck.
+func (g *Gateway) rateLimit(c *gin.Context, keyRecord *db.APIKeyRecord, model string) (adm *admission, ok bool) {
+	ctx, span := telemetry.Tracer.Start(c.Request.Context(), "rate_limit")
+	defer func() { endStep(span, c, ok) }()
+
+	apiKey := keyRecord.APIKey
+	if keyRecord.RPM <= 0 {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		return nil, false // 0 means blocked
+	}
+
+	buckets := limitBuckets(keyRecord, model)
 
-	allowed, err := g.Limiter.Allow(c.Request.Context(), apiKey, keyRecord.RPM)
+	// Take the concurrency slot first so a request turned away here isn't charged to RPM
+	var lease *limiter.Lease
+	if keyRecord.MaxConcurrent > 0 {
+		l, acquired, err := g.Limiter.AcquireConcurrency(ctx, apiKey, keyRecord.MaxConcurrent)
+		if err != nil {
+			logger.Log.Error("Concurrency limiter error", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return nil, false
+		}
+		if !acquired {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+				"message": fmt.Sprintf("Too many concurrent requests, this key allows %d", keyRecord.MaxConcurrent),
+				"type":    "rate_limit_error",
+				"code":    "concurrency_limit_exceeded",
+			}})
+			return nil, false
+		}
+		lease = l
+	}
+
+	res, err := g.Limiter.Allow(ctx, buckets...)
 	if err != nil {
+		lease.Release()
 		logger.Log.Error("Rate limiter error", "err", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
 		return nil, false
 	}
-	if !allowed {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+	for k, v := range res.Headers() {
+		c.Header(k, v)
+	}
+	if !res.Allowed {
+		lease.Release()
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+			"message": fmt.Sprintf("Rate limit exceeded, retry after %s", res.RetryAfter.Round(time.Millisecond)),
+			"type":    "rate_limit_error",
+			"code":    "rate_limit_exceeded",
+		}})
 		return nil, false
 	}
-	return keyRecord, true
+	return &admission{Key: keyRecord, Buckets: buckets, Lease: lease}, true
 }
 
-func (g *Gateway) ChatCompletionsHandler(c *gin.Context) {
-	keyRecord, ok := g.authAndRateCheck(c)
+// limitBuckets returns the rate limits a request of key for model is subject to: the key's
+// own and, if it has one, its limit for the model.
+func limitBuckets(key *db.APIKeyRecord, model string) []limiter.Bucket {
+	buckets := []limiter.Bucket{{Key: key.APIKey, RPM: key.RPM, TPM: key.TPM}}
+	if b, ok := modelBucket(key, model); ok {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// modelBucket returns key's rate limit for model, if it has one.
+func modelBucket(key *db.APIKeyRecord, model string) (limiter.Bucket, bool) {
+	ml, ok := key.ModelLimitFor(model)
 	if !ok {
-		return
+		return limiter.Bucket{}, false
+	}
+	return limiter.Bucket{Key: key.APIKey, Scope: "model:" + model, RPM: ml.RPM, TPM: ml.TPM}, true
+}
+
+// admitServed charges a request about to be sent to a node serving model to the key's limit
+// for that model, unless the request's admission was charged to it already. That leaves the
+// models an alias stands for, which are subject to their own limits whichever name the
+// caller used. It returns the buckets to charge the request's tokens to, or the limiter's
+// result if the model's limit is reached.
+func (g *Gateway) admitServed(ctx context.Context, adm *admission, model string) ([]limiter.Bucket, *limiter.Result, error) {
+	b, ok := modelBucket(adm.Key, model)
+	if !ok || slices.ContainsFunc(adm.Buckets, func(a limiter.Bucket) bool { return a.Scope == b.Scope }) {
+		return adm.Buckets, nil, nil
+	}
+	res, err := g.Limiter.Allow(ctx, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !res.Allowed {
+		return nil, res, nil
+	}
+	return append(slices.Clip(adm.Buckets), b), nil, nil
+}
+
+// endStep ends the span of a request handling step, marking it failed with the status of
+// the error response if the step rejected the request.
+func endStep(span trace.Span, c *gin.Context, ok bool) {
+	if !ok {
+		span.SetStatus(codes.Error, http.StatusText(c.Writer.Status()))
 	}
+	span.End()
+}
+
+func (g *Gateway) ChatCompletionsHandler(c *gin.Context) {
+	// Continue the caller's trace, if any. Every step below runs under this span.
+	ctx, span := telemetry.Tracer.Start(telemetry.ExtractHTTP(c.Request.Context(), c.Request.Header),
+		"chat.completions", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
 
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -152,20 +406,42 @@ func (g *Gateway) ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 
-	// Model allowed check
-	modelAllowed := false
-	for _, m := range keyRecord.AllowedModelList() {
-		if m == "*" || m == req.Model {
-			modelAllowed = true
-			break
-		}
+	span.SetAttributes(attribute.String("model", req.Model), attribute.Bool("stream", req.Stream))
+
+	adm, ok := g.authAndRateCheck(c, req.Model)
+	if !ok {
+		span.SetStatus(codes.Error, http.StatusText(c.Writer.Status()))
+		return
 	}
-	if !modelAllowed {
-		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Model %s not allowed for this API Key", req.Model)})
+	// Frees the concurrency slot once the response handlers below have finished
+	defer adm.Lease.Release()
+	keyRecord := adm.Key
+
+	// A deterministic request made before may be answered without a node
+	cacheAs, cached := g.Cache.lookup(c, keyRecord.APIKey, req.Model, bodyBytes)
+	if cached != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		g.serveCached(c, keyRecord, &req, bodyBytes, cached)
+		return
+	}
+
+	// An alias may stand for several models, tried in order. Leave out those served only by
+	// nodes that can't handle what this request needs, and refuse it if that is all of them.
+	need := keyRequirements(keyRecord, &req)
+	models, missing := g.candidates(keyRecord, req.Model, need)
+	if len(models) == 0 {
+		msg := fmt.Sprintf("No node serving model %s supports %s", req.Model, strings.Join(missing, ", "))
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+			"message": msg,
+			"type":    "invalid_request_error",
+			"code":    "model_capability_unavailable",
+		}})
+		span.SetStatus(codes.Error, msg)
 		return
 	}
 
 	reqID := "req-" + uuid.New().String()
+	span.SetAttributes(attribute.String("request_id", reqID))
 
 	var payload interface{}
 	json.Unmarshal(bodyBytes, &payload)
@@ -173,15 +449,84 @@ func (g *Gateway) ChatCompletionsHandler(c *gin.Context) {
 	// We no longer force stream=true so the client adapter knows if it should proxy a stream or not
 
 	// Dispatch and stream from hub
-	streamCh, clientConn, dispatchErr := g.dispatchWithRetry(c, reqID, req.Model, payload)
+	usage := newUsageMeter(len(bodyBytes))
+	rt := newRequestTrace(reqID, keyRecord, &req, bodyBytes, keyRecord.LogContent && g.RequestLog != nil)
+	rt.collect = g.Verifier.sampled(keyRecord, payload)
+	if cacheAs != "" {
+		rt.cached, rt.cachedLimit = &cachedResponse{}, g.Cache.MaxResponse
+	}
+
+	var stream *TaskStream
+	var dispatchErr error
+	var limited *limiter.Result // the last model over the key's limit for it
+	tried := false
+	served, buckets := req.Model, adm.Buckets
+	for i, m := range models {
+		if i > 0 {
+			logger.Log.Info("Falling back to next model", "request_id", reqID, "model", req.Model, "failed", models[i-1], "next", m)
+		}
+		charged, res, err := g.admitServed(ctx, adm, m)
+		if err != nil {
+			logger.Log.Error("Rate limiter error", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+		if res != nil {
+			limited = res
+			continue
+		}
+		tried = true
+		if g.Hub.AffinityTTL > 0 {
+			need.Affinity = affinityKey(keyRecord.APIKey, m, c.GetHeader(SessionHeader), &req)
+		}
+		stream, dispatchErr = g.dispatchWithRetry(c, reqID, m, need, withModel(payload, m))
+		if dispatchErr == nil {
+			served, buckets = m, charged
+			break
+		}
+		if c.Request.Context().Err() != nil {
+			break
+		}
+	}
+	if !tried && limited != nil {
+		for k, v := range limited.Headers() {
+			c.Header(k, v)
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+			"message": fmt.Sprintf("Rate limit exceeded, retry after %s", limited.RetryAfter.Round(time.Millisecond)),
+			"type":    "rate_limit_error",
+			"code":    "rate_limit_exceeded",
+		}})
+		span.SetStatus(codes.Error, "rate limit exceeded")
+		return
+	}
 	if dispatchErr != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": dispatchErr.Error()})
+		span.SetStatus(codes.Error, dispatchErr.Error())
+		rt.Fail(dispatchErr.Error())
+		g.RequestLog.Record(rt.Finish(http.StatusServiceUnavailable, protocol.UsageStat{}))
 		return
 	}
+	clientConn := stream.Client
+	g.Hub.remember(need.Affinity, clientConn.ID)
+	rt.entry.NodeID = clientConn.ID
+	rt.entry.Model = served
+	if rt.cached != nil {
+		rt.cached.Model = served
+	}
+	span.SetAttributes(attribute.String("node.id", clientConn.ID), attribute.String("model.served", served))
+	c.Header("X-CoLink-Model", served)
+
+	// Callers of an alias see which model answered, rather than the node's own name for it
+	report := ""
+	if served != req.Model {
+		report = served
+	}
 
 	// Increment metrics asynchronously right after successful dispatch
 	go func() {
-		clientTokenStr := strings.Split(clientConn.ID, "_")[0]
+		clientTokenStr := clientConn.Token()
 		err1 := g.DB.IncrementAPICalls(context.Background(), keyRecord.APIKey)
 		err2 := g.DB.IncrementProvidedCalls(context.Background(), clientTokenStr)
 		if err1 != nil {
@@ -192,118 +537,240 @@ func (g *Gateway) ChatCompletionsHandler(c *gin.Context) {
 		}
 	}()
 
+	_, completion := telemetry.Tracer.Start(ctx, "completion")
 	if req.Stream {
-		g.handleStreamResponse(c, streamCh)
+		g.handleStreamResponse(c, report, stream, usage, rt)
 	} else {
-		g.handleNonStreamResponse(c, req.Model, streamCh)
+		g.handleNonStreamResponse(c, report, stream, usage, rt)
+	}
+	entry := rt.Finish(c.Writer.Status(), usage.Usage())
+	if entry.Error != "" {
+		// Stop the node working on a response nobody will read; no-op if it already ended
+		stream.Abandon(entry.Error)
+	}
+	completion.SetAttributes(
+		attribute.Int("usage.prompt_tokens", entry.PromptTokens),
+		attribute.Int("usage.completion_tokens", entry.CompletionTokens),
+	)
+	if entry.Error != "" {
+		completion.SetStatus(codes.Error, entry.Error)
+		span.SetStatus(codes.Error, entry.Error)
+	}
+	completion.End()
+	span.SetAttributes(attribute.Int("http.status_code", entry.Status))
+	g.RequestLog.Record(entry)
+	if cacheAs != "" && entry.Error == "" && entry.Status == http.StatusOK {
+		go g.Cache.store(cacheAs, rt.cached)
+	}
+	if rt.collect && entry.Error == "" {
+		go g.Verifier.crossCheck(clientConn, served, need, withModel(payload, served), rt.Completion())
+	}
+
+	// Charge the tokens against the TPM budgets once usage is known
+	if err := g.Limiter.ConsumeTokens(context.Background(), usage.Total(), buckets...); err != nil {
+		logger.Log.Error("Failed to record token usage", "request_id", reqID, "err", err)
+	}
+}
+
+// serveCached answers a request from the response cache. A hit is recorded in the request
+// log and counts as an API call of the key, like a request a node answers, but no node
+// served it and it uses none of the key's tokens per minute.
+func (g *Gateway) serveCached(c *gin.Context, key *db.APIKeyRecord, req *protocol.ChatCompletionRequest, body []byte, cached *cachedResponse) {
+	rt := newRequestTrace("req-"+uuid.New().String(), key, req, body, key.LogContent && g.RequestLog != nil)
+	rt.entry.Model, rt.entry.Cached = cached.Model, true
+
+	// Callers of an alias see which model answered, as they would without the cache
+	report := ""
+	if cached.Model != req.Model {
+		report = cached.Model
+	}
+	g.Cache.serve(c, req.Stream, report, cached, rt)
+	g.RequestLog.Record(rt.Finish(c.Writer.Status(), protocol.UsageStat{}))
+
+	go func() {
+		if err := g.DB.IncrementAPICalls(context.Background(), key.APIKey); err != nil {
+			logger.Log.Error("Failed to increment API calls", "err", err)
+		}
+	}()
+}
+
+// keyRequirements returns what req needs of a node when made with key.
+func keyRequirements(key *db.APIKeyRecord, req *protocol.ChatCompletionRequest) Requirements {
+	need := requirementsOf(req)
+	need.Encrypted = key.RequireEncryption
+	need.MinTier = key.MinNodeTier
+	need.Flow, need.Weight = key.APIKey, key.ShareWeight
+	if key.OrgID.Valid {
+		need.Flow = fmt.Sprintf("org:%d", key.OrgID.Int64) // the organization's keys share
 	}
+	need.Batch = key.Priority == db.PriorityBatch
+	return need
 }
 
-// dispatchWithRetry attempts to route the call up to maxRetries times,
-// returning the stream channel, the chosen client or an error.
-func (g *Gateway) dispatchWithRetry(c *gin.Context, reqID, model string, payload interface{}) (chan protocol.WSPayload, *ClientConn, error) {
+// candidates returns the models to try, in order, for a request of key for model, leaving out
+// those the key may not use and those served only by nodes that can't meet need. If that
+// leaves none, it also returns what the first usable model's nodes lack.
+func (g *Gateway) candidates(key *db.APIKeyRecord, model string, need Requirements) (models, missing []string) {
+	for _, m := range g.Aliases.Resolve(model) {
+		if !key.AllowsModel(m) {
+			continue
+		}
+		if lack := g.Hub.Unsatisfiable(m, need); lack != nil {
+			if missing == nil {
+				missing = lack
+			}
+			continue
+		}
+		models = append(models, m)
+	}
+	return models, missing
+}
+
+// dispatchWithRetry attempts to route the call up to maxRetries times, returning the
+// stream of the node that accepted it or an error. Only the first attempt prefers the node
+// need has affinity with.
+func (g *Gateway) dispatchWithRetry(c *gin.Context, reqID, model string, need Requirements, payload interface{}) (*TaskStream, error) {
 	maxRetries := 3
 	for i := 0; i < maxRetries; i++ {
-		streamCh, bestClient, err := g.Hub.RouteCall(c.Request.Context(), reqID, model, payload)
+		ctx, dispatch := telemetry.Tracer.Start(c.Request.Context(), "dispatch", trace.WithAttributes(attribute.Int("attempt", i+1)))
+		stream, err := g.Hub.RouteCall(ctx, reqID, model, need, payload)
+		if errors.Is(err, errQueueTimeout) || errors.Is(err, context.Canceled) {
+			dispatch.SetStatus(codes.Error, err.Error())
+			dispatch.End()
+			return nil, err // waited long enough
+		}
 		if err != nil {
-			logger.Log.Warn("Dispatch failed", "err", err, "attempt", i+1)
+			dispatch.SetStatus(codes.Error, err.Error())
+			dispatch.End()
+			logger.Log.Warn("Dispatch failed", "request_id", reqID, "err", err, "attempt", i+1)
+			need.Affinity = ""
 			continue
 		}
+		dispatch.SetAttributes(attribute.String("node.id", stream.Client.ID))
+		dispatch.End()
 
 		// Peek at first message to detect early errors
-		firstMsg, ok := <-streamCh
-		if !ok {
+		_, wait := telemetry.Tracer.Start(c.Request.Context(), "first_chunk", trace.WithAttributes(attribute.String("node.id", stream.Client.ID)))
+		firstMsg, err := stream.Peek(c.Request.Context())
+		if err != nil {
+			wait.SetStatus(codes.Error, err.Error())
+			wait.End()
+			if c.Request.Context().Err() != nil {
+				stream.Abandon("client disconnected")
+				return nil, fmt.Errorf("client disconnected")
+			}
+			need.Affinity = ""
 			continue
 		}
 		if firstMsg.Type == protocol.MsgTypeError {
-			logger.Log.Warn("Client returned error on first message, retrying", "attempt", i+1)
+			wait.SetStatus(codes.Error, errorMessage(firstMsg))
+			wait.End()
+			logger.Log.Warn("Client returned error on first message, retrying", "request_id", reqID, "attempt", i+1)
+			need.Affinity = ""
 			continue
 		}
-
-		// Rebuild a channel that includes the already-consumed firstMsg
-		merged := make(chan protocol.WSPayload, 64)
-		go func() {
-			merged <- firstMsg
-			for msg := range streamCh {
-				merged <- msg
-			}
-			close(merged)
-		}()
-		return merged, bestClient, nil
+		wait.End()
+		return stream, nil
 	}
-	return nil, nil, fmt.Errorf("no available clients after %d retries", maxRetries)
+	return nil, fmt.Errorf("no available clients after %d retries", maxRetries)
 }
 
-// handleStreamResponse pipes the hub stream directly to the HTTP client as SSE.
-func (g *Gateway) handleStreamResponse(c *gin.Context, streamCh chan protocol.WSPayload) {
+// handleStreamResponse pipes the hub stream directly to the HTTP client as SSE, with model
+// in the chunks' model field unless it is empty. A client that stops reading for longer
+// than StallTimeout fails the request.
+func (g *Gateway) handleStreamResponse(c *gin.Context, model string, stream *TaskStream, usage *usageMeter, rt *requestTrace) {
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 
+	rc := http.NewResponseController(c.Writer)
+	write := func(msg protocol.WSPayload) error {
+		rc.SetWriteDeadline(time.Now().Add(g.StallTimeout))
+		if err := writeSSEChunk(c.Writer, msg); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
 	for {
-		select {
-		case <-c.Request.Context().Done():
-			return
-		case msg, ok := <-streamCh:
-			if !ok {
-				return
+		msg, err := stream.Recv(c.Request.Context())
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				rt.Fail("client disconnected")
+			} else {
+				rt.Fail(err.Error())
 			}
-			switch msg.Type {
-			case protocol.MsgTypeFinish:
-				c.Writer.Write([]byte("data: [DONE]\n\n"))
-				c.Writer.Flush()
-				return
-			case protocol.MsgTypeError:
-				writeSSEChunk(c.Writer, msg)
-				c.Writer.Flush()
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgTypeFinish:
+			c.Writer.Write([]byte("data: [DONE]\n\n"))
+			c.Writer.Flush()
+			return
+		case protocol.MsgTypeError:
+			rt.Fail(errorMessage(msg))
+			writeSSEChunk(c.Writer, msg)
+			c.Writer.Flush()
+			return
+		default:
+			msg = withChunkModel(msg, model)
+			usage.Observe(msg)
+			rt.Observe(msg)
+			if err := write(msg); err != nil {
+				rt.Fail("client stopped reading")
 				return
-			default:
-				writeSSEChunk(c.Writer, msg)
-				c.Writer.Flush()
 			}
 		}
 	}
 }
 
-// handleNonStreamResponse collects the single non-stream response object from upstream
-func (g *Gateway) handleNonStreamResponse(c *gin.Context, model string, streamCh chan protocol.WSPayload) {
+// handleNonStreamResponse collects the single non-stream response object from upstream,
+// setting its model field to model unless that is empty.
+func (g *Gateway) handleNonStreamResponse(c *gin.Context, model string, stream *TaskStream, usage *usageMeter, rt *requestTrace) {
 	for {
-		select {
-		case <-c.Request.Context().Done():
-			c.JSON(http.StatusRequestTimeout, gin.H{"error": "Client disconnected"})
-			return
-		case msg, ok := <-streamCh:
-			if !ok {
-				// Channel closed early
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Stream closed prematurely"})
+		msg, err := stream.Recv(c.Request.Context())
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				rt.Fail("client disconnected")
+				c.JSON(http.StatusRequestTimeout, gin.H{"error": "Client disconnected"})
 				return
 			}
-			switch msg.Type {
-			case protocol.MsgTypeFinish:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Stream finished before returning data"})
-				return
-			case protocol.MsgTypeError:
-				dataBytes, _ := json.Marshal(msg.Data)
-				var errData protocol.ErrorData
-				json.Unmarshal(dataBytes, &errData)
-				c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
-					"message": errData.Message,
-					"type":    "upstream_error",
-					"code":    errData.Code,
-				}})
+			// Stream closed early
+			rt.Fail(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stream closed prematurely"})
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgTypeFinish:
+			rt.Fail("stream finished before returning data")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stream finished before returning data"})
+			return
+		case protocol.MsgTypeError:
+			errData := msg.ErrorData()
+			rt.Fail(errData.Message)
+			c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
+				"message": errData.Message,
+				"type":    "upstream_error",
+				"code":    errData.Code,
+			}})
+			return
+		case protocol.MsgTypeStream:
+			// For non-streaming requests, the very first chunk contains the entire JSON response from upstream.
+			// The node forwards the provider's JSON as it is, pass it on without decoding
+			msg = withChunkModel(msg, model)
+			body, ok := msg.ChunkBytes()
+			if !ok {
+				rt.Fail("failed to parse provider response")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse provider response"})
 				return
-			case protocol.MsgTypeStream:
-				// For non-streaming requests, the very first chunk contains the entire JSON response from upstream.
-				dataBytes, _ := json.Marshal(msg.Data)
-				var sd protocol.StreamData
-				if err := json.Unmarshal(dataBytes, &sd); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse provider response"})
-					return
-				}
-				c.JSON(http.StatusOK, sd.Chunk)
-
-				return // we are fully done after receiving the one response object
 			}
+			usage.Observe(msg)
+			rt.Observe(msg)
+			c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+
+			return // we are fully done after receiving the one response object
 		}
 	}
 }
@@ -315,11 +782,50 @@ func writeSSEChunk(w http.ResponseWriter, msg protocol.WSPayload) error {
 		return nil
 	}
 
-	dataBytes, _ := json.Marshal(msg.Data)
-	var streamData protocol.StreamData
-	json.Unmarshal(dataBytes, &streamData)
-
-	chunkBytes, _ := json.Marshal(streamData.Chunk)
-	_, err := w.Write([]byte(fmt.Sprintf("data: %s\n\n", string(chunkBytes))))
+	chunk, ok := msg.ChunkBytes()
+	if !ok {
+		return nil
+	}
+	buf := make([]byte, 0, len(chunk)+8)
+	buf = append(buf, "data: "...)
+	buf = append(buf, chunk...)
+	buf = append(buf, "\n\n"...)
+	_, err := w.Write(buf)
 	return err
 }
+
+// withModel returns a copy of a request payload asking for model instead.
+func withModel(payload interface{}, model string) interface{} {
+	body, ok := payload.(map[string]interface{})
+	if !ok || body["model"] == model {
+		return payload
+	}
+	body = maps.Clone(body)
+	body["model"] = model
+	return body
+}
+
+// withChunkModel sets the model field of a STREAM message's chunk, if it has one and model
+// isn't empty.
+func withChunkModel(msg protocol.WSPayload, model string) protocol.WSPayload {
+	if model == "" {
+		return msg
+	}
+	chunk, ok := msg.ChunkBytes()
+	if !ok {
+		return msg
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(chunk, &fields) != nil || fields["model"] == nil {
+		return msg
+	}
+	fields["model"], _ = json.Marshal(model)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return msg
+	}
+	sd := msg.Data.(protocol.StreamData)
+	sd.Chunk = json.RawMessage(b)
+	msg.Data = sd
+	return msg
+}
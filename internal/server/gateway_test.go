@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/limiter"
+	"CoLinkPlan/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openTestStore opens a migrated SQLite database in a temporary directory.
+func openTestStore(t *testing.T) *db.DB {
+	t.Helper()
+	store, err := db.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return store
+}
+
+// startNode connects a node serving models to h. It answers every call at once with a
+// completion naming the model it was asked for.
+func startNode(t *testing.T, h *Hub, models ...string) *ClientConn {
+	t.Helper()
+	conn, node := wsPair(t)
+	c := NewClientConn(h, conn, fmt.Sprintf("client-%s_0123abcd", strings.Join(models, "-")))
+	h.register <- c
+	go c.ReadLoop()
+
+	send := func(payload protocol.WSPayload) {
+		if err := node.WriteJSON(payload); err != nil {
+			t.Errorf("node: %v", err)
+		}
+	}
+	send(protocol.WSPayload{Type: protocol.MsgTypeRegister, Data: protocol.RegisterData{MaxParallel: 4, Models: models}})
+	go func() {
+		for {
+			_, message, err := node.ReadMessage()
+			if err != nil {
+				return
+			}
+			payload, err := protocol.DecodeMessage(message)
+			if err != nil || payload.Type != protocol.MsgTypeCall {
+				continue
+			}
+			call := payload.Data.(protocol.CallData)
+			chunk := map[string]interface{}{
+				"object": "chat.completion",
+				"model":  call.Model,
+				"choices": []map[string]interface{}{
+					{"index": 0, "message": map[string]string{"role": "assistant", "content": "hi"}},
+				},
+			}
+			send(protocol.WSPayload{Type: protocol.MsgTypeStream, Data: protocol.StreamData{RequestID: call.RequestID, Chunk: chunk}})
+			send(protocol.WSPayload{Type: protocol.MsgTypeFinish, Data: protocol.FinishData{RequestID: call.RequestID}})
+		}
+	}()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		h.mu.RLock()
+		registered := c.MaxParallel > 0
+		h.mu.RUnlock()
+		if registered {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node never registered")
+		}
+	}
+}
+
+// chat makes a non-stream chat completion request of model with apiKey.
+func chat(router http.Handler, apiKey, model string) *httptest.ResponseRecorder {
+	return complete(router, apiKey, fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"hi"}]}`, model))
+}
+
+// complete makes a chat completion request with apiKey.
+func complete(router http.Handler, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestChatCompletionsAliasRestrictedKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestStore(t)
+	h := NewHub()
+	go h.Run()
+	startNode(t, h, "gpt-4o", "qwen-72b")
+
+	g := NewGateway(h, store, limiter.NewMemoryLimiter(), nil)
+	g.Aliases = ModelAliases{"smart": {"gpt-4o", "qwen-72b"}}
+	router := gin.New()
+	router.POST("/v1/chat/completions", g.ChatCompletionsHandler)
+
+	tests := []struct {
+		name    string
+		allowed string
+		limits  string
+		model   string
+		want    []string // model served by each request in turn, or the status code
+	}{
+		{name: "any model", allowed: "*", model: "smart", want: []string{"gpt-4o"}},
+		{name: "alias only", allowed: "smart", model: "smart", want: []string{"403"}},
+		{name: "alias and one of its models", allowed: "smart,qwen-72b", model: "smart", want: []string{"qwen-72b", "qwen-72b"}},
+		{name: "models but not the alias", allowed: "gpt-4o,qwen-72b", model: "smart", want: []string{"403"}},
+		{name: "model directly", allowed: "qwen-72b", model: "qwen-72b", want: []string{"qwen-72b"}},
+		{
+			name: "model limit falls back", allowed: "*", limits: `{"gpt-4o":{"rpm":1}}`, model: "smart",
+			want: []string{"gpt-4o", "qwen-72b", "qwen-72b"},
+		},
+		{
+			name: "every model limited", allowed: "*", limits: `{"gpt-4o":{"rpm":1},"qwen-72b":{"rpm":1}}`, model: "smart",
+			want: []string{"gpt-4o", "qwen-72b", "429"},
+		},
+		{
+			name: "limit of a model asked for directly", allowed: "*", limits: `{"gpt-4o":{"rpm":1}}`, model: "gpt-4o",
+			want: []string{"gpt-4o", "429"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiKey := fmt.Sprintf("sk-test-%d", i)
+			if err := store.CreateUser(ctx, fmt.Sprintf("u%d@x.io", i), "hash", apiKey, fmt.Sprintf("client-u%d", i)); err != nil {
+				t.Fatal(err)
+			}
+			key, err := store.GetAPIKey(ctx, apiKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key.AllowedModels, key.ModelLimits, key.RPM = tt.allowed, tt.limits, 60
+			if err := store.UpdateAPIKey(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for range tt.want {
+				w := chat(router, apiKey, tt.model)
+				if w.Code != http.StatusOK {
+					got = append(got, fmt.Sprint(w.Code))
+					continue
+				}
+				var resp struct {
+					Model string `json:"model"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("response %s: %v", w.Body, err)
+				}
+				if served := w.Header().Get("X-CoLink-Model"); served != resp.Model {
+					t.Errorf("X-CoLink-Model %q, response model %q", served, resp.Model)
+				}
+				got = append(got, resp.Model)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("served %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"slices"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+)
+
+// DefaultHeartbeatInterval is how often nodes that support it send a HEARTBEAT.
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// heartbeatMisses is how many heartbeats in a row a node may miss before it is
+// disconnected.
+const heartbeatMisses = 3
+
+// NodeHeartbeat is the last heartbeat of a node, as shown with its state.
+type NodeHeartbeat struct {
+	Time        time.Time                          `json:"time"`
+	ActiveTasks int                                `json:"active_tasks"` // as counted by the node
+	Providers   map[string]protocol.ProviderHealth `json:"providers,omitempty"`
+	Host        *protocol.HostStats                `json:"host,omitempty"` // only shown to the node's owners
+}
+
+// public returns the heartbeat without what may say more about the node's owner than its
+// load does: upstream errors and the host.
+func (hb *NodeHeartbeat) public() *NodeHeartbeat {
+	if hb == nil {
+		return nil
+	}
+	public := &NodeHeartbeat{Time: hb.Time, ActiveTasks: hb.ActiveTasks,
+		Providers: make(map[string]protocol.ProviderHealth, len(hb.Providers))}
+	for name, p := range hb.Providers {
+		p.LastError = ""
+		public.Providers[name] = p
+	}
+	return public
+}
+
+// heartbeat reconciles the hub's view of the node with what it reports. Requests the node
+// does not run although they were dispatched a heartbeat ago have been lost on the way and
+// fail; tasks it runs that the hub no longer waits for still take its capacity.
+func (c *ClientConn) heartbeat(hb protocol.HeartbeatData) {
+	now := time.Now()
+	settled := now.Add(-c.Hub.HeartbeatInterval)
+
+	var lost []string
+	orphaned := 0
+	c.PendingMutex.RLock()
+	for reqID, task := range c.pendingTasks {
+		if task.started.Before(settled) && !slices.Contains(hb.Tasks, reqID) {
+			lost = append(lost, reqID)
+		}
+	}
+	for _, reqID := range hb.Tasks {
+		if _, ok := c.pendingTasks[reqID]; !ok {
+			orphaned++
+		}
+	}
+	c.PendingMutex.RUnlock()
+
+	if len(lost) > 0 {
+		logger.Log.Warn("Node no longer runs dispatched requests", "client_id", c.ID, "lost", len(lost))
+	}
+	for _, reqID := range lost {
+		c.Hub.CompleteTask(c, reqID, "node lost the request")
+	}
+
+	c.Hub.mu.Lock()
+	c.lastSeen = now
+	c.Heartbeat = &NodeHeartbeat{
+		Time:        now,
+		ActiveTasks: hb.ActiveTasks,
+		Providers:   hb.Providers,
+		Host:        hb.Host,
+	}
+	if orphaned != c.Orphaned {
+		logger.Log.Info("Node runs tasks the hub no longer waits for", "client_id", c.ID, "orphaned", orphaned)
+	}
+	c.Orphaned = orphaned
+	c.Hub.scheduleLocked()
+	ev := c.event(EventNodeHeartbeat)
+	c.Hub.mu.Unlock()
+	c.Hub.publish(ev)
+}
+
+// load is the number of tasks taking the node's capacity. The caller must hold Hub.mu.
+func (c *ClientConn) load() int {
+	return c.ActiveTasks + c.Orphaned
+}
+
+// upstreamHealthy reports whether the provider behind model was healthy in the node's last
+// heartbeat; it is assumed to be without one. The caller must hold Hub.mu.
+func (c *ClientConn) upstreamHealthy(model string) bool {
+	if c.Heartbeat == nil {
+		return true
+	}
+	for _, p := range c.Heartbeat.Providers {
+		if slices.Contains(p.Models, model) {
+			return p.Healthy
+		}
+	}
+	return true
+}
+
+// checkHeartbeats disconnects the nodes that stopped sending heartbeats. Their connection
+// may look alive to WebSocket pings while the client no longer works.
+func (h *Hub) checkHeartbeats() {
+	deadline := time.Now().Add(-heartbeatMisses * h.HeartbeatInterval)
+
+	h.mu.RLock()
+	var silent []*ClientConn
+	for client := range h.clients {
+		if client.Features[protocol.FeatureHeartbeat] && client.lastSeen.Before(deadline) {
+			silent = append(silent, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range silent {
+		logger.Log.Warn("Node stopped sending heartbeats", "client_id", client.ID, "interval", h.HeartbeatInterval)
+		client.ConnMutex.Lock()
+		client.Conn.Close()
+		client.ConnMutex.Unlock()
+	}
+}
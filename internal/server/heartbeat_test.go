@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+)
+
+func TestHeartbeatReconciles(t *testing.T) {
+	const interval = time.Minute
+	tests := []struct {
+		name       string
+		dispatched map[string]time.Duration // request ID: how long ago it was dispatched
+		running    []string                 // as reported by the node
+		lost       []string
+		orphaned   int
+	}{
+		{name: "idle"},
+		{
+			name:       "all running",
+			dispatched: map[string]time.Duration{"a": 2 * interval, "b": 0},
+			running:    []string{"a", "b"},
+		},
+		{
+			name:       "lost after a heartbeat",
+			dispatched: map[string]time.Duration{"a": 2 * interval, "b": interval / 2},
+			lost:       []string{"a"},
+		},
+		{name: "orphaned", running: []string{"x", "y"}, orphaned: 2},
+		{
+			name:       "lost and orphaned",
+			dispatched: map[string]time.Duration{"a": 2 * interval, "c": 2 * interval},
+			running:    []string{"a", "z"},
+			lost:       []string{"c"},
+			orphaned:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub()
+			h.HeartbeatInterval = interval
+			c := NewClientConn(h, nil, "client-t_0123abcd")
+			streams := make(map[string]*TaskStream)
+			for reqID, ago := range tt.dispatched {
+				s := newTaskStream(c, reqID, 0)
+				streams[reqID] = s
+				c.PendingStreams[reqID] = s
+				c.pendingTasks[reqID] = pendingTask{model: "m", started: time.Now().Add(-ago)}
+				c.ActiveTasks++
+			}
+
+			c.heartbeat(protocol.HeartbeatData{ActiveTasks: len(tt.running), Tasks: tt.running})
+
+			// Lost requests fail, the others go on
+			var lost []string
+			for _, reqID := range slices.Sorted(maps.Keys(streams)) {
+				c.PendingMutex.RLock()
+				_, pending := c.PendingStreams[reqID]
+				c.PendingMutex.RUnlock()
+				if pending {
+					continue
+				}
+				lost = append(lost, reqID)
+				if _, err := streams[reqID].Recv(context.Background()); err == nil {
+					t.Errorf("lost request %s still streams", reqID)
+				}
+			}
+			if !slices.Equal(lost, tt.lost) {
+				t.Errorf("lost %v, want %v", lost, tt.lost)
+			}
+
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			if want := len(tt.dispatched) - len(tt.lost); c.ActiveTasks != want {
+				t.Errorf("%d active tasks, want %d", c.ActiveTasks, want)
+			}
+			if c.Orphaned != tt.orphaned {
+				t.Errorf("%d orphaned tasks, want %d", c.Orphaned, tt.orphaned)
+			}
+			if c.Heartbeat == nil || c.Heartbeat.ActiveTasks != len(tt.running) {
+				t.Errorf("heartbeat recorded as %+v", c.Heartbeat)
+			}
+		})
+	}
+}
+
+func TestHeartbeatOrphansFinish(t *testing.T) {
+	h := NewHub()
+	c := NewClientConn(h, nil, "client-t_0123abcd")
+	c.heartbeat(protocol.HeartbeatData{ActiveTasks: 2, Tasks: []string{"x", "y"}})
+	c.heartbeat(protocol.HeartbeatData{ActiveTasks: 1, Tasks: []string{"y"}})
+
+	h.mu.RLock()
+	if c.Orphaned != 1 || c.load() != 1 {
+		t.Errorf("%d orphaned tasks, load %d, want 1", c.Orphaned, c.load())
+	}
+	h.mu.RUnlock()
+
+	c.heartbeat(protocol.HeartbeatData{})
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if c.Orphaned != 0 {
+		t.Errorf("%d orphaned tasks once the node runs none", c.Orphaned)
+	}
+}
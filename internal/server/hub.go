@@ -2,14 +2,22 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"CoLinkPlan/internal/protocol"
 	"CoLinkPlan/pkg/logger"
+	"CoLinkPlan/pkg/telemetry"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Hub struct {
@@ -19,16 +27,63 @@ type Hub struct {
 	unregister chan *ClientConn
 
 	mu sync.RWMutex
+
+	// Event stream subscribers, see Subscribe
+	subscribers map[chan HubEvent]bool
+	subMu       sync.Mutex
+
+	// Optional protocol features offered to nodes in the handshake
+	features []string
+
+	// STREAM messages a flow-controlled node may send ahead of the consumer
+	StreamCredits int
+
+	// Sessions of nodes whose connection dropped, by session ID, held for SessionGrace
+	suspended    map[string]*ClientConn // guarded by mu
+	SessionGrace time.Duration
+
+	// How often nodes send a HEARTBEAT, see checkHeartbeats
+	HeartbeatInterval time.Duration
+
+	// Track record of node owners, nil if not kept
+	Reputation *ReputationBook
+
+	// Node that served each conversation last, kept for AffinityTTL, see affinityKey
+	affinity    map[string]affinityEntry // guarded by affinityMu
+	affinityMu  sync.Mutex
+	AffinityTTL time.Duration
+
+	// Requests waiting for a free node, interactive and batch, see acquire
+	queues       [2]fairQueue // guarded by mu
+	queueSeq     uint64
+	QueueTimeout time.Duration
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		clients:    make(map[*ClientConn]bool),
-		register:   make(chan *ClientConn),
-		unregister: make(chan *ClientConn),
+		clients:     make(map[*ClientConn]bool),
+		register:    make(chan *ClientConn),
+		unregister:  make(chan *ClientConn),
+		subscribers: make(map[chan HubEvent]bool),
+		features: []string{protocol.FeatureBinary, protocol.FeatureCompression,
+			protocol.FeatureCancel, protocol.FeatureFlowControl, protocol.FeatureResume, protocol.FeatureHeartbeat},
+		StreamCredits: DefaultStreamCredits,
+		suspended:     make(map[string]*ClientConn),
+		affinity:      make(map[string]affinityEntry),
+		queues:        [2]fairQueue{{finish: make(map[string]float64)}, {finish: make(map[string]float64)}},
+		QueueTimeout:  DefaultQueueTimeout,
+		SessionGrace:  DefaultSessionGrace,
+
+		HeartbeatInterval: DefaultHeartbeatInterval,
 	}
 }
 
+// DisableFeature stops offering an optional protocol feature to nodes that connect from
+// now on. It must be called before the hub accepts nodes.
+func (h *Hub) DisableFeature(feature string) {
+	h.features = slices.DeleteFunc(h.features, func(f string) bool { return f == feature })
+}
+
 func (h *Hub) Run() {
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
@@ -38,16 +93,26 @@ func (h *Hub) Run() {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
+			ev := client.event(EventNodeConnected)
 			h.mu.Unlock()
 			logger.Log.Info("New client connected", "client_id", client.ID)
+			h.Reputation.connected(client.Token())
+			h.publish(ev)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
+			_, ok := h.clients[client]
+			if ok {
 				delete(h.clients, client)
 				logger.Log.Info("Client disconnected", "client_id", client.ID)
+				h.scheduleLocked() // fails the requests only it served
 			}
+			ev := client.event(EventNodeDisconnected)
 			h.mu.Unlock()
+			if ok {
+				h.Reputation.disconnected(client.Token())
+				h.publish(ev)
+			}
 
 		case <-ticker.C:
 			h.mu.RLock()
@@ -61,14 +126,29 @@ func (h *Hub) Run() {
 				}
 			}
 			h.mu.RUnlock()
+			h.checkHeartbeats()
+			h.pruneAffinity()
 		}
 	}
 }
 
-func (h *Hub) SelectClient(model string) (*ClientConn, error) {
+// SelectClient picks the least loaded node that serves model and meets need, unless the
+// node that served need's conversation before has a free slot.
+func (h *Hub) SelectClient(model string, need Requirements) (*ClientConn, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	c := h.selectLocked(model, need)
+	if c == nil {
+		return nil, fmt.Errorf("no available clients for model: %s", model)
+	}
+	return c, nil
+}
+
+// selectLocked is SelectClient, returning nil if no node is free. The caller must hold mu.
+func (h *Hub) selectLocked(model string, need Requirements) *ClientConn {
+	preferred := h.affine(need.Affinity)
+
 	var bestClient *ClientConn
 	lowestRatio := 1.0 // Ratio: ActiveTasks / MaxParallel
 
@@ -77,6 +157,10 @@ func (h *Hub) SelectClient(model string) (*ClientConn, error) {
 			continue
 		}
 
+		if len(c.lacks(model, need)) > 0 {
+			continue
+		}
+
 		// Check penalty
 		if time.Now().Before(c.PenaltyUntil) {
 			continue
@@ -86,74 +170,137 @@ func (h *Hub) SelectClient(model string) (*ClientConn, error) {
 			continue // Not registered yet
 		}
 
-		if c.ActiveTasks >= c.MaxParallel {
+		if c.load() >= c.MaxParallel {
 			continue // Fully booked
 		}
 
-		ratio := float64(c.ActiveTasks) / float64(c.MaxParallel)
+		// The node's per-model cap, if any, counts as much as its global one
+		ratio := float64(c.load()) / float64(c.MaxParallel)
+		if limit := c.ModelParallel[model]; limit > 0 {
+			if c.ModelTasks[model] >= limit {
+				continue // Model fully booked
+			}
+			ratio = max(ratio, float64(c.ModelTasks[model])/float64(limit))
+		}
+		if !c.upstreamHealthy(model) {
+			ratio++ // only if no node with a healthy provider is free
+		} else if c.ID == preferred {
+			return c
+		}
+
 		if bestClient == nil || ratio < lowestRatio {
 			bestClient = c
 			lowestRatio = ratio
 		}
 	}
 
-	if bestClient == nil {
-		return nil, fmt.Errorf("no available clients for model: %s", model)
-	}
-
-	return bestClient, nil
+	return bestClient
 }
 
-// RouteCall finds a client, sends the payload and returns the stream channel and the chosen client.
+// RouteCall finds a client, waiting in the queue while all are busy, sends the payload and
+// returns the stream channel and the chosen client.
 // Performs Failover: silent retries up to 3 times on disonnects or BUSY.
-func (h *Hub) RouteCall(ctx context.Context, requestID, model string, payload interface{}) (chan protocol.WSPayload, *ClientConn, error) {
+// The trace context of ctx is forwarded to the node so it can continue the trace.
+func (h *Hub) RouteCall(ctx context.Context, requestID, model string, need Requirements, payload interface{}) (*TaskStream, error) {
+	_, span := telemetry.Tracer.Start(ctx, "schedule", trace.WithAttributes(attribute.String("model", model)))
+	defer span.End()
+
 	var lastErr error
-	var bestClient *ClientConn
 
 	for i := 0; i < 3; i++ {
-		c, err := h.SelectClient(model)
+		c, err := h.acquire(ctx, model, need)
 		if err != nil {
-			return nil, nil, fmt.Errorf("scheduling failed: %w (last err: %v)", err, lastErr)
-		}
-
-		bestClient = c
-		streamCh := make(chan protocol.WSPayload, 10)
-
-		bestClient.PendingMutex.Lock()
-		bestClient.PendingStreams[requestID] = streamCh
-		bestClient.PendingMutex.Unlock()
-
-		bestClient.Hub.mu.Lock()
-		bestClient.ActiveTasks++
-		bestClient.Hub.mu.Unlock()
-
-		sndErr := bestClient.SendMessage(protocol.WSPayload{
-			Type: protocol.MsgTypeCall,
-			Data: protocol.CallData{
-				RequestID: requestID,
-				Model:     model,
-				Payload:   payload,
-			},
-		})
-
-		if sndErr != nil {
-			lastErr = sndErr
-			bestClient.Hub.mu.Lock()
-			bestClient.ActiveTasks--
-			bestClient.PenaltyUntil = time.Now().Add(60 * time.Second) // Penalty 60s
-			bestClient.Hub.mu.Unlock()
-
-			bestClient.PendingMutex.Lock()
-			delete(bestClient.PendingStreams, requestID)
-			bestClient.PendingMutex.Unlock()
+			span.SetStatus(codes.Error, err.Error())
+			return nil, fmt.Errorf("scheduling failed: %w (last err: %v)", err, lastErr)
+		}
+		span.AddEvent("selected node", trace.WithAttributes(attribute.String("node.id", c.ID)))
+
+		stream, err := h.send(ctx, c, requestID, model, payload)
+		if errors.Is(err, errSendFailed) {
+			lastErr = err
 			continue // Retry
 		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
 
 		// Successfully dispatched to client
-		return streamCh, bestClient, nil
+		span.SetAttributes(attribute.String("node.id", c.ID))
+		return stream, nil
+	}
+
+	span.SetStatus(codes.Error, "send failed")
+	return nil, fmt.Errorf("failed to route call after 3 retries, last error: %v", lastErr)
+}
+
+var errSendFailed = errors.New("failed to send call")
+
+// send sends the payload as a CALL to the given client, a slot of which is reserved for
+// it, and returns its stream. If the call cannot be sent the slot is freed, the client is
+// penalized and errSendFailed is returned.
+func (h *Hub) send(ctx context.Context, c *ClientConn, requestID, model string, payload interface{}) (*TaskStream, error) {
+	call := protocol.CallData{
+		RequestID:    requestID,
+		Model:        model,
+		Payload:      payload,
+		TraceContext: telemetry.Inject(ctx),
+	}
+
+	// Nodes with a public key only get the payload sealed to it
+	var cipher *protocol.RequestCipher
+	h.mu.RLock()
+	publicKey := c.PublicKey
+	h.mu.RUnlock()
+	if publicKey != nil {
+		plain, err := json.Marshal(payload)
+		if err == nil {
+			call.Payload = nil
+			call.Sealed, cipher, err = protocol.SealPayload(publicKey, requestID, plain)
+		}
+		if err != nil {
+			h.mu.Lock()
+			h.release(c, model)
+			h.mu.Unlock()
+			return nil, fmt.Errorf("failed to seal request: %w", err)
+		}
 	}
 
-	return nil, nil, fmt.Errorf("failed to route call after 3 retries, last error: %v", lastErr)
+	h.mu.Lock()
+	if c.Features[protocol.FeatureFlowControl] {
+		call.Credits = h.StreamCredits
+	}
+	started := c.event(EventTaskStarted)
+	h.mu.Unlock()
+
+	stream := newTaskStream(c, requestID, call.Credits)
+	stream.cipher = cipher
+	c.PendingMutex.Lock()
+	c.PendingStreams[requestID] = stream
+	c.pendingTasks[requestID] = pendingTask{model: model, started: time.Now()}
+	c.PendingMutex.Unlock()
+
+	if sndErr := c.SendMessage(protocol.WSPayload{Type: protocol.MsgTypeCall, Data: call}); sndErr != nil {
+		h.mu.Lock()
+		c.PenaltyUntil = time.Now().Add(60 * time.Second) // Penalty 60s
+		h.release(c, model)
+		penalized := c.event(EventNodePenalized)
+		h.mu.Unlock()
+
+		c.PendingMutex.Lock()
+		delete(c.PendingStreams, requestID)
+		delete(c.pendingTasks, requestID)
+		c.PendingMutex.Unlock()
+
+		penalized.Error = sndErr.Error()
+		h.publish(penalized)
+		return nil, fmt.Errorf("%w: %v", errSendFailed, sndErr)
+	}
+
+	started.RequestID = requestID
+	started.Model = model
+	h.publish(started)
+	return stream, nil
 }
 
 // ListModels returns the set of model names currently advertised by at least one
@@ -182,18 +329,155 @@ func (h *Hub) ListModels() []string {
 	return models
 }
 
-func (h *Hub) CompleteTask(client *ClientConn, requestID string) {
+// ModelCapabilities returns, for every model some available node declared capabilities for,
+// the best the network can currently offer: a feature is listed if any node has it.
+func (h *Hub) ModelCapabilities() map[string]protocol.ModelCapabilities {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	merged := make(map[string]protocol.ModelCapabilities)
+	for c := range h.clients {
+		if c.MaxParallel == 0 || time.Now().Before(c.PenaltyUntil) {
+			continue
+		}
+		for m, caps := range c.Capabilities {
+			into := merged[m]
+			mergeCapabilities(&into, caps)
+			merged[m] = into
+		}
+	}
+	return merged
+}
+
+// Unsatisfiable reports why no registered node serving model can meet need, or nil if one
+// can (busy or not) or none serves the model at all. The reasons are those of the node that
+// comes closest.
+func (h *Hub) Unsatisfiable(model string, need Requirements) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var closest []string
+	for c := range h.clients {
+		if c.MaxParallel == 0 || !c.SupportedModels[model] {
+			continue
+		}
+		missing := c.lacks(model, need)
+		if len(missing) == 0 {
+			return nil
+		}
+		if closest == nil || len(missing) < len(closest) {
+			closest = missing
+		}
+	}
+	return closest
+}
+
+// CompleteTask releases the node's slot for requestID and closes its stream.
+// errMsg is empty if the task succeeded.
+func (h *Hub) CompleteTask(client *ClientConn, requestID, errMsg string) {
+	h.completeTask(client, requestID, errMsg, true)
+}
+
+// RefuseTask ends a task the node turned down before calling its upstream, because it had
+// no slot left or cannot serve the request. Unlike a failed task it says nothing about the
+// node's reliability and is left out of its reputation.
+func (h *Hub) RefuseTask(client *ClientConn, requestID, errMsg string) {
+	h.completeTask(client, requestID, errMsg, false)
+}
+
+// refused reports whether an ERROR from a node turns the request down rather than reporting
+// a failure of its upstream. Nodes answer BUSY with 503 and requests they cannot serve
+// with 400; errors of the upstream come as 500.
+func refused(msg protocol.WSPayload) bool {
+	code := msg.ErrorData().Code
+	return code == http.StatusServiceUnavailable || code == http.StatusBadRequest
+}
+
+func (h *Hub) completeTask(client *ClientConn, requestID, errMsg string, counted bool) {
+	client.PendingMutex.Lock()
+	task, ok := client.pendingTasks[requestID]
+	delete(client.pendingTasks, requestID)
+	client.PendingMutex.Unlock()
+
 	client.Hub.mu.Lock()
 	client.ActiveTasks--
 	if client.ActiveTasks < 0 {
 		client.ActiveTasks = 0
 	}
+	if ok {
+		client.releaseModelTask(task.model)
+	}
+	h.scheduleLocked()
+	ev := client.event(EventTaskFinished)
 	client.Hub.mu.Unlock()
 
+	abandoned := false
 	client.PendingMutex.Lock()
-	if ch, ok := client.PendingStreams[requestID]; ok {
+	if s, ok := client.PendingStreams[requestID]; ok {
 		delete(client.PendingStreams, requestID)
-		close(ch)
+		abandoned = s.closed
+		if !s.closed {
+			s.closed = true
+			close(s.ch)
+		}
 	}
 	client.PendingMutex.Unlock()
+
+	if ok {
+		// A request given up by the gateway is no failure of the node
+		if counted {
+			h.Reputation.served(client.Token(), errMsg != "" && !abandoned)
+		}
+		ev.RequestID = requestID
+		ev.Model = task.model
+		ev.LatencyMS = time.Since(task.started).Milliseconds()
+		ev.Error = errMsg
+		h.publish(ev)
+	}
+}
+
+// Disconnect closes the connection of the node with the given ID. Its ReadLoop then fails
+// any in-flight requests and unregisters it. Returns false if no such node is connected.
+func (h *Hub) Disconnect(clientID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client.ID == clientID {
+			client.closing.Store(true)
+			client.Conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// DisconnectToken closes every node connected with the given client token and returns how
+// many were disconnected.
+func (h *Hub) DisconnectToken(token string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for client := range h.clients {
+		if client.Token() == token {
+			client.closing.Store(true)
+			client.Conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// FindClient returns the connected node with the given ID, or nil.
+func (h *Hub) FindClient(clientID string) *ClientConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client.ID == clientID {
+			return client
+		}
+	}
+	return nil
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+)
+
+func TestRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want bool
+	}{
+		{"busy", http.StatusServiceUnavailable, true},
+		{"model not supported", http.StatusBadRequest, true},
+		{"upstream error", http.StatusInternalServerError, false},
+		{"cancelled", 499, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := protocol.WSPayload{Type: protocol.MsgTypeError, Data: protocol.ErrorData{RequestID: "r", Code: tt.code}}
+			if got := refused(msg); got != tt.want {
+				t.Errorf("refused(%d) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefusedTasksLeaveReputation(t *testing.T) {
+	h := NewHub()
+	h.Reputation = &ReputationBook{Pinned: make(map[string]bool), records: make(map[string]*reputationRecord)}
+	c := NewClientConn(h, nil, "client-t_0123abcd")
+
+	replies := map[string]protocol.ErrorData{
+		"busy":     {Code: http.StatusServiceUnavailable, Message: "BUSY: Local concurrency limit reached"},
+		"upstream": {Code: http.StatusInternalServerError, Message: "upstream returned 502"},
+		"ok":       {},
+	}
+	for reqID, reply := range replies {
+		c.pendingTasks[reqID] = pendingTask{model: "m", started: time.Now()}
+		c.ActiveTasks++
+		switch msg := (protocol.WSPayload{Type: protocol.MsgTypeError, Data: reply}); {
+		case reply.Code == 0:
+			h.CompleteTask(c, reqID, "")
+		case refused(msg):
+			h.RefuseTask(c, reqID, reply.Message)
+		default:
+			h.CompleteTask(c, reqID, reply.Message)
+		}
+	}
+
+	r := h.Reputation.records[c.Token()]
+	if r == nil {
+		t.Fatal("no reputation recorded")
+	}
+	if r.Requests != 2 || r.Errors != 1 {
+		t.Errorf("recorded %d requests with %d errors, want 2 with 1", r.Requests, r.Errors)
+	}
+	if c.ActiveTasks != 0 {
+		t.Errorf("%d tasks still active", c.ActiveTasks)
+	}
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Invitations are valid for a week; after that the inviter has to send a new one.
+const orgInvitationTTL = 7 * 24 * time.Hour
+
+type CreateOrgRequest struct {
+	Name string `json:"name" binding:"required,max=255"`
+}
+
+type UpdateOrgRequest struct {
+	Name         string `json:"name" binding:"required,max=255"`
+	APICallQuota int    `json:"api_call_quota" binding:"min=0"`
+}
+
+type InviteMemberRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type CreateOrgKeyRequest struct {
+	AllowedModels string `json:"allowed_models"`
+	RPM           *int   `json:"rpm" binding:"omitempty,min=1"` // 60 when omitted
+}
+
+type CreateNodeTokenRequest struct {
+	Name string `json:"name" binding:"max=255"`
+}
+
+// currentUser returns the user AuthMiddleware loaded for the request or, without it, loads
+// the one identified by the JWT's email. Disabled users are rejected.
+func currentUser(c *gin.Context, database db.Store) (*db.User, bool) {
+	if u, ok := c.Get("user"); ok {
+		return u.(*db.User), true
+	}
+	u, err := database.GetUserByEmail(c.Request.Context(), c.GetString("email"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if u.Disabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return nil, false
+	}
+	return u, true
+}
+
+// OrgAccess resolves the :org_id path parameter and checks that the current user holds at
+// least minRole in it. On success the org ID, user and role are stored on the context.
+func OrgAccess(database db.Store, minRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID, err := strconv.Atoi(c.Param("org_id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid organization id"})
+			return
+		}
+
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+
+		role, err := database.GetOrgRole(c.Request.Context(), orgID, u.ID)
+		if err != nil {
+			// Don't reveal whether the organization exists to non-members
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		if !db.OrgRoleAtLeast(role, minRole) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient organization role"})
+			return
+		}
+
+		c.Set("org_id", orgID)
+		c.Set("org_role", role)
+		c.Set("user", u)
+		c.Next()
+	}
+}
+
+func ListOrgsHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		orgs, err := database.ListUserOrganizations(c.Request.Context(), u.ID)
+		if err != nil {
+			logger.Log.Error("Failed to list organizations", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"organizations": orgs})
+	}
+}
+
+func CreateOrgHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateOrgRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+
+		org, err := database.CreateOrganization(c.Request.Context(), strings.TrimSpace(req.Name), u.ID)
+		if err != nil {
+			logger.Log.Error("Failed to create organization", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"organization": db.OrgMembership{Organization: *org, Role: db.OrgRoleOwner}})
+	}
+}
+
+func GetOrgHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, err := database.GetOrganization(c.Request.Context(), c.GetInt("org_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"organization": db.OrgMembership{Organization: *org, Role: c.GetString("org_role")}})
+	}
+}
+
+func UpdateOrgHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req UpdateOrgRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := database.UpdateOrganization(c.Request.Context(), c.GetInt("org_id"), strings.TrimSpace(req.Name), req.APICallQuota); err != nil {
+			logger.Log.Error("Failed to update organization", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update organization"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Organization updated"})
+	}
+}
+
+func DeleteOrgHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := database.DeleteOrganization(c.Request.Context(), c.GetInt("org_id")); err != nil {
+			logger.Log.Error("Failed to delete organization", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete organization"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Organization deleted"})
+	}
+}
+
+func ListOrgMembersHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		members, err := database.ListOrgMembers(c.Request.Context(), c.GetInt("org_id"))
+		if err != nil {
+			logger.Log.Error("Failed to list organization members", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"members": members})
+	}
+}
+
+// UpdateOrgMemberHandler changes a member's role. Only owners may grant or revoke ownership,
+// and an organization always keeps at least one owner.
+func UpdateOrgMemberHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req UpdateMemberRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !db.ValidOrgRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		userID, err := strconv.Atoi(c.Param("user_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		orgID := c.GetInt("org_id")
+		targetRole, err := database.GetOrgRole(ctx, orgID, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		callerRole := c.GetString("org_role")
+		if (req.Role == db.OrgRoleOwner || targetRole == db.OrgRoleOwner) && callerRole != db.OrgRoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can change ownership"})
+			return
+		}
+		if targetRole == db.OrgRoleOwner && req.Role != db.OrgRoleOwner && !hasOtherOwner(c, database, orgID) {
+			return
+		}
+
+		if err := database.SetOrgMemberRole(ctx, orgID, userID, req.Role); err != nil {
+			logger.Log.Error("Failed to update member role", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Member updated"})
+	}
+}
+
+// RemoveOrgMemberHandler removes a member. Any member may remove themselves; removing others
+// requires admin, and removing an owner requires owner.
+func RemoveOrgMemberHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("user_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		orgID := c.GetInt("org_id")
+		caller := c.MustGet("user").(*db.User)
+		callerRole := c.GetString("org_role")
+
+		targetRole, err := database.GetOrgRole(ctx, orgID, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		if userID != caller.ID {
+			if !db.OrgRoleAtLeast(callerRole, db.OrgRoleAdmin) ||
+				(targetRole == db.OrgRoleOwner && callerRole != db.OrgRoleOwner) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient organization role"})
+				return
+			}
+		}
+		if targetRole == db.OrgRoleOwner && !hasOtherOwner(c, database, orgID) {
+			return
+		}
+
+		if err := database.RemoveOrgMember(ctx, orgID, userID); err != nil {
+			logger.Log.Error("Failed to remove member", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+	}
+}
+
+// hasOtherOwner writes a conflict response and returns false if demoting or removing one
+// owner would leave the organization without any.
+func hasOtherOwner(c *gin.Context, database db.Store, orgID int) bool {
+	owners, err := database.CountOrgOwners(c.Request.Context(), orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		return false
+	}
+	if owners <= 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Organization must keep at least one owner"})
+		return false
+	}
+	return true
+}
+
+func ListOrgInvitationsHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invs, err := database.ListOrgInvitations(c.Request.Context(), c.GetInt("org_id"))
+		if err != nil {
+			logger.Log.Error("Failed to list invitations", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"invitations": invs})
+	}
+}
+
+// InviteOrgMemberHandler creates an invitation addressed to an email. The invitee sees it in
+// GET /api/orgs/invitations once they log in with that email and can accept it from there.
+func InviteOrgMemberHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req InviteMemberRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Role == "" {
+			req.Role = db.OrgRoleMember
+		}
+		if !db.ValidOrgRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		if req.Role == db.OrgRoleOwner && c.GetString("org_role") != db.OrgRoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can invite owners"})
+			return
+		}
+
+		inviter := c.MustGet("user").(*db.User)
+		inv, err := database.CreateOrgInvitation(c.Request.Context(), c.GetInt("org_id"), strings.TrimSpace(req.Email),
+			req.Role, generateToken("invite"), inviter.ID, orgInvitationTTL)
+		if err != nil {
+			logger.Log.Error("Failed to create invitation", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		logger.Log.Info("Organization invitation created", "org_id", inv.OrgID, "email", inv.Email, "role", inv.Role)
+		c.JSON(http.StatusOK, gin.H{"invitation": inv})
+	}
+}
+
+func RevokeOrgInvitationHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invID, err := strconv.Atoi(c.Param("invitation_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation id"})
+			return
+		}
+		if err := database.DeleteOrgInvitation(c.Request.Context(), c.GetInt("org_id"), invID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+	}
+}
+
+// MyInvitationsHandler lists pending invitations addressed to the current user's email.
+func MyInvitationsHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invs, err := database.ListInvitationsForEmail(c.Request.Context(), c.GetString("email"))
+		if err != nil {
+			logger.Log.Error("Failed to list invitations", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"invitations": invs})
+	}
+}
+
+func AcceptInvitationHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		inv, err := database.AcceptOrgInvitation(c.Request.Context(), c.Param("token"), u.ID, u.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+			return
+		}
+		if err != nil {
+			logger.Log.Error("Failed to accept invitation", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Joined organization", "org_id": inv.OrgID, "role": inv.Role})
+	}
+}
+
+func ListOrgKeysHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := database.ListOrgAPIKeys(c.Request.Context(), c.GetInt("org_id"))
+		if err != nil {
+			logger.Log.Error("Failed to list organization keys", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+
+		type KeyInfo struct {
+			ID            int    `json:"id"`
+			APIKey        string `json:"api_key"`
+			AllowedModels string `json:"allowed_models"`
+			RPM           int    `json:"rpm"`
+		}
+		out := make([]KeyInfo, 0, len(keys))
+		for _, k := range keys {
+			out = append(out, KeyInfo{ID: k.ID, APIKey: k.APIKey, AllowedModels: k.AllowedModels, RPM: k.RPM})
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": out})
+	}
+}
+
+func CreateOrgKeyHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateOrgKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.AllowedModels == "" {
+			req.AllowedModels = "*"
+		}
+		rpm := 60
+		if req.RPM != nil {
+			rpm = *req.RPM
+		}
+
+		key, err := database.CreateOrgAPIKey(c.Request.Context(), c.GetInt("org_id"), generateToken("sk-colink"), req.AllowedModels, rpm)
+		if err != nil {
+			logger.Log.Error("Failed to create organization key", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create key"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": gin.H{
+			"id":             key.ID,
+			"api_key":        key.APIKey,
+			"allowed_models": key.AllowedModels,
+			"rpm":            key.RPM,
+		}})
+	}
+}
+
+func DeleteOrgKeyHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := strconv.Atoi(c.Param("key_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key id"})
+			return
+		}
+		if err := database.DeleteOrgAPIKey(c.Request.Context(), c.GetInt("org_id"), keyID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key deleted"})
+	}
+}
+
+func ListNodeTokensHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokens, err := database.ListNodeTokens(c.Request.Context(), c.GetInt("org_id"))
+		if err != nil {
+			logger.Log.Error("Failed to list node tokens", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"node_tokens": tokens})
+	}
+}
+
+func CreateNodeTokenHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateNodeTokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		nt, err := database.CreateNodeToken(c.Request.Context(), c.GetInt("org_id"), strings.TrimSpace(req.Name), generateToken("client"))
+		if err != nil {
+			logger.Log.Error("Failed to create node token", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create node token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"node_token": nt})
+	}
+}
+
+// DeleteNodeTokenHandler revokes a node token and disconnects the nodes using it.
+func DeleteNodeTokenHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, err := strconv.Atoi(c.Param("token_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token id"})
+			return
+		}
+		token, err := database.DeleteNodeToken(c.Request.Context(), c.GetInt("org_id"), tokenID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Node token not found"})
+			return
+		}
+		if n := hub.DisconnectToken(token); n > 0 {
+			logger.Log.Info("Disconnected nodes of revoked node token", "org_id", c.GetInt("org_id"), "nodes", n)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Node token deleted"})
+	}
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/pkg/logger"
+)
+
+// How the score of a node owner is made up. Verification weighs most, being the only
+// direct evidence that the answers are genuine.
+const (
+	reputationUptimeWeight  = 0.2
+	reputationSuccessWeight = 0.3
+	reputationVerifyWeight  = 0.5
+	reputationReportCost    = 0.1 // per report filed by a user
+
+	// Change of the verification score with each check passed or failed
+	reputationPassBonus = 0.05
+	reputationFailCost  = 0.25
+
+	reputationFlushEvery = time.Minute
+)
+
+// tierRules are what a node owner must have achieved to be ranked in a tier, highest first.
+// An admin can set the tier of an owner instead.
+var tierRules = []struct {
+	tier          string
+	age           time.Duration // since the owner was first seen
+	requests      int64
+	score         float64
+	verifications int // passed
+}{
+	{db.TierTrusted, 7 * 24 * time.Hour, 1000, 0.9, 10},
+	{db.TierVerified, 24 * time.Hour, 100, 0.7, 0},
+}
+
+// NodeStanding is the reputation of a node owner with the score and tier it earns.
+type NodeStanding struct {
+	db.NodeReputation
+	Score  float64 `json:"score"`
+	Tier   string  `json:"tier"`
+	Online bool    `json:"online"`
+}
+
+// ReputationBook keeps the reputation of every node owner: how long its nodes stay
+// connected, how many of their requests fail, how they fare in verification and how often
+// users report their answers. Like bans, reputation belongs to the user or organization
+// behind a client token rather than to the token, so a new token of a user or organization
+// inherits its record. Records live in memory and are written to the database every
+// minute. A nil *ReputationBook ranks every node as new and records nothing.
+type ReputationBook struct {
+	db db.Store
+
+	// Tokens always ranked trusted, whatever their owner's record
+	Pinned map[string]bool
+
+	mu      sync.Mutex
+	records map[string]*reputationRecord // by owner
+	owners  map[string]string            // owner of each token seen, see bind
+}
+
+type reputationRecord struct {
+	db.NodeReputation
+	online int       // connected nodes using the token
+	since  time.Time // up to when the online time has been counted
+	dirty  bool
+}
+
+// NewReputationBook loads the reputation recorded so far.
+func NewReputationBook(store db.Store) (*ReputationBook, error) {
+	reps, err := store.ListNodeReputations(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	b := &ReputationBook{
+		db:      store,
+		Pinned:  make(map[string]bool),
+		records: make(map[string]*reputationRecord, len(reps)),
+		owners:  make(map[string]string),
+	}
+	for _, r := range reps {
+		b.records[r.Owner] = &reputationRecord{NodeReputation: r}
+	}
+	return b, nil
+}
+
+// Run writes changed records to the database every minute. It never returns.
+func (b *ReputationBook) Run() {
+	ticker := time.NewTicker(reputationFlushEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.flush()
+	}
+}
+
+func (b *ReputationBook) flush() {
+	now := time.Now()
+	var changed []db.NodeReputation
+	b.mu.Lock()
+	for _, r := range b.records {
+		r.countOnline(now)
+		if r.dirty {
+			changed = append(changed, r.NodeReputation)
+			r.dirty = false
+		}
+	}
+	b.mu.Unlock()
+
+	for i := range changed {
+		if err := b.db.SaveNodeReputation(context.Background(), &changed[i]); err != nil {
+			logger.Log.Error("Failed to save node reputation", "owner", changed[i].Owner, "err", err)
+		}
+	}
+}
+
+// bind records that token belongs to owner, as returned by db.NodeTokenOwner. WsHandler
+// binds the token of every node before it connects.
+func (b *ReputationBook) bind(token, owner string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.owners == nil {
+		b.owners = make(map[string]string)
+	}
+	b.owners[token] = owner
+}
+
+// resolve binds token to its owner unless it is already bound. An owner ("user:<id>" or
+// "org:<id>") is taken as it is.
+func (b *ReputationBook) resolve(ctx context.Context, token string) (string, error) {
+	if strings.HasPrefix(token, "user:") || strings.HasPrefix(token, "org:") {
+		return token, nil
+	}
+	b.mu.Lock()
+	owner, ok := b.owners[token]
+	b.mu.Unlock()
+	if ok {
+		return owner, nil
+	}
+	owner, err := b.db.NodeTokenOwner(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	b.bind(token, owner)
+	return owner, nil
+}
+
+// owner returns the owner token is bound to, or the token itself if it is not bound. The
+// caller must hold mu.
+func (b *ReputationBook) owner(token string) string {
+	if owner, ok := b.owners[token]; ok {
+		return owner
+	}
+	return token
+}
+
+// record returns the record of token's owner, starting one if it has none. The caller must
+// hold mu.
+func (b *ReputationBook) record(token string) *reputationRecord {
+	owner := b.owner(token)
+	r, ok := b.records[owner]
+	if !ok {
+		r = &reputationRecord{NodeReputation: db.NodeReputation{
+			Owner:             owner,
+			FirstSeen:         time.Now(),
+			VerificationScore: 1,
+		}}
+		b.records[owner] = r
+	}
+	r.dirty = true
+	return r
+}
+
+// countOnline adds the time the owner has been online since it was last counted.
+func (r *reputationRecord) countOnline(now time.Time) {
+	if r.online == 0 {
+		return
+	}
+	secs := int64(now.Sub(r.since) / time.Second)
+	if secs > 0 {
+		r.OnlineSeconds += secs
+		r.since = r.since.Add(time.Duration(secs) * time.Second)
+		r.dirty = true
+	}
+}
+
+func (b *ReputationBook) connected(token string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.record(token)
+	if r.online == 0 {
+		r.since = time.Now()
+	}
+	r.online++
+}
+
+func (b *ReputationBook) disconnected(token string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.record(token)
+	r.countOnline(time.Now())
+	r.online = max(0, r.online-1)
+}
+
+// served counts a request the token's node finished, failed or not.
+func (b *ReputationBook) served(token string, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.record(token)
+	r.Requests++
+	if failed {
+		r.Errors++
+	}
+}
+
+// verified counts a verification of the token's answers, failed if failure is set, and
+// returns its verification score: 1 to begin with, a little higher with every check passed
+// and a lot lower with every one failed.
+func (b *ReputationBook) verified(token, failure string) float64 {
+	if b == nil {
+		return 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.record(token)
+	if failure == "" {
+		r.VerificationsPassed++
+		r.VerificationScore = min(1, r.VerificationScore+reputationPassBonus)
+	} else {
+		r.VerificationsFailed++
+		r.VerificationScore = max(0, r.VerificationScore-reputationFailCost)
+		r.LastFailure = failure
+	}
+	return r.VerificationScore
+}
+
+// reported counts a user report about an answer of the token's nodes. Like the report
+// itself, it is saved right away.
+func (b *ReputationBook) reported(ctx context.Context, token string) error {
+	if b == nil {
+		return nil
+	}
+	if _, err := b.resolve(ctx, token); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	b.mu.Lock()
+	r := b.record(token)
+	r.Reports++
+	return b.save(ctx, r)
+}
+
+// Tier returns the trust tier of token's owner.
+func (b *ReputationBook) Tier(token string) string {
+	if b == nil {
+		return db.TierNew
+	}
+	if b.Pinned[token] {
+		return db.TierTrusted
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.records[b.owner(token)]
+	if !ok {
+		return db.TierNew
+	}
+	return r.standing(time.Now()).Tier
+}
+
+// Get returns the standing of token's owner, or nil if it has no record.
+func (b *ReputationBook) Get(token string) *NodeStanding {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.records[b.owner(token)]
+	if !ok {
+		return nil
+	}
+	s := r.standing(time.Now())
+	if b.Pinned[token] {
+		s.Tier = db.TierTrusted
+	}
+	return &s
+}
+
+// List returns the standing of every owner, lowest score first. An owner with a pinned
+// token is listed as trusted.
+func (b *ReputationBook) List() []NodeStanding {
+	if b == nil {
+		return []NodeStanding{}
+	}
+	now := time.Now()
+	b.mu.Lock()
+	pinned := make(map[string]bool)
+	for token := range b.Pinned {
+		pinned[b.owner(token)] = true
+	}
+	out := make([]NodeStanding, 0, len(b.records))
+	for owner, r := range b.records {
+		s := r.standing(now)
+		if pinned[owner] {
+			s.Tier = db.TierTrusted
+		}
+		out = append(out, s)
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b NodeStanding) int {
+		if c := cmp.Compare(a.Score, b.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Owner, b.Owner)
+	})
+	return out
+}
+
+// SetTier fixes the tier of the owner of token, or lets it be computed again if tier is
+// empty. token may also be the owner itself, as List shows it.
+func (b *ReputationBook) SetTier(ctx context.Context, token, tier string) error {
+	if b == nil {
+		return nil
+	}
+	owner, err := b.resolve(ctx, token)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	r := b.record(owner)
+	r.TierOverride = tier
+	return b.save(ctx, r)
+}
+
+// save writes r to the database now rather than with the next flush. The caller must hold
+// mu, which save releases.
+func (b *ReputationBook) save(ctx context.Context, r *reputationRecord) error {
+	r.countOnline(time.Now())
+	rep := r.NodeReputation
+	r.dirty = false
+	b.mu.Unlock()
+	if err := b.db.SaveNodeReputation(ctx, &rep); err != nil {
+		b.mu.Lock()
+		r.dirty = true // try again with the next flush
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// standing scores the record. The caller must hold ReputationBook.mu.
+func (r *reputationRecord) standing(now time.Time) NodeStanding {
+	s := NodeStanding{NodeReputation: r.NodeReputation, Online: r.online > 0}
+	if r.online > 0 {
+		s.OnlineSeconds += int64(now.Sub(r.since) / time.Second)
+	}
+
+	age := now.Sub(r.FirstSeen)
+	uptime := 1.0
+	if age >= time.Second {
+		uptime = min(1, float64(s.OnlineSeconds)/age.Seconds())
+	}
+	// As if the node had already served ten requests and failed one, so that a handful of
+	// requests doesn't decide its standing
+	success := (float64(r.Requests-r.Errors) + 9) / (float64(r.Requests) + 10)
+	s.Score = reputationUptimeWeight*uptime + reputationSuccessWeight*success +
+		reputationVerifyWeight*r.VerificationScore - reputationReportCost*float64(r.Reports)
+	s.Score = min(1, max(0, s.Score))
+
+	s.Tier = db.TierNew
+	if r.TierOverride != "" {
+		s.Tier = r.TierOverride
+		return s
+	}
+	for _, rule := range tierRules {
+		if age >= rule.age && r.Requests >= rule.requests && s.Score >= rule.score &&
+			r.VerificationsPassed >= rule.verifications {
+			s.Tier = rule.tier
+			break
+		}
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"CoLinkPlan/internal/db"
+)
+
+func TestReputationSharedByOwner(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+	if err := store.CreateUser(ctx, "a@x.io", "hash", "sk-a", "client-a"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetUserByEmail(ctx, "a@x.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := store.CreateOrganization(ctx, "org", u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"client-rack1", "client-rack2"} {
+		if _, err := store.CreateNodeToken(ctx, org.ID, token, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewReputationBook(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"client-a", "client-rack1"} {
+		if _, err := b.resolve(ctx, token); err != nil {
+			t.Fatalf("resolve %s: %v", token, err)
+		}
+	}
+	b.served("client-a", false)
+	b.served("client-rack1", true)
+	if err := b.reported(ctx, "client-rack2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every token of the organization shares its record, apart from the user's own
+	orgOwner := fmt.Sprintf("org:%d", org.ID)
+	for _, token := range []string{"client-rack1", "client-rack2"} {
+		s := b.Get(token)
+		if s == nil || s.Owner != orgOwner || s.Requests != 1 || s.Errors != 1 || s.Reports != 1 {
+			t.Errorf("standing of %s: %+v, want %s with 1 failed request and 1 report", token, s, orgOwner)
+		}
+	}
+	if s := b.Get("client-a"); s == nil || s.Owner != fmt.Sprintf("user:%d", u.ID) || s.Requests != 1 || s.Reports != 0 {
+		t.Errorf("standing of the user's token: %+v", s)
+	}
+
+	if err := b.SetTier(ctx, "client-rack2", db.TierTrusted); err != nil {
+		t.Fatal(err)
+	}
+	if tier := b.Tier("client-rack1"); tier != db.TierTrusted {
+		t.Errorf("tier of another token of the organization %q, want trusted", tier)
+	}
+	if tier := b.Tier("client-a"); tier != db.TierNew {
+		t.Errorf("tier of the user's token %q, want new", tier)
+	}
+	if err := b.SetTier(ctx, "client-unknown", db.TierTrusted); err == nil {
+		t.Error("tier set for an unknown token")
+	}
+
+	// Records are saved and loaded by owner
+	b.flush()
+	b, err = NewReputationBook(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.List()) != 2 {
+		t.Fatalf("reloaded %+v, want a record for the user and one for the organization", b.List())
+	}
+	if _, err := b.resolve(ctx, "client-rack2"); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Get("client-rack2"); s == nil || s.Tier != db.TierTrusted || s.Requests != 1 {
+		t.Errorf("reloaded standing %+v", s)
+	}
+}
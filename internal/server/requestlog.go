@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestLogQueueSize  = 1024
+	requestLogPruneEvery = time.Hour
+	redactedText         = "[REDACTED]"
+)
+
+// RequestLogger writes the request log in the background, so logging never delays a
+// response, and prunes entries older than the retention period. A nil *RequestLogger is
+// valid and records nothing, which is how request logging is turned off.
+type RequestLogger struct {
+	db        db.Store
+	retention time.Duration // 0 keeps entries forever
+	redact    []*regexp.Regexp
+	queue     chan *db.RequestLog
+}
+
+// NewRequestLogger loads redaction rules from redactFile, if set: one regular expression per
+// line, blank lines and lines starting with # ignored. Matches are replaced in logged
+// prompts and completions before they are stored.
+func NewRequestLogger(store db.Store, retention time.Duration, redactFile string) (*RequestLogger, error) {
+	l := &RequestLogger{
+		db:        store,
+		retention: retention,
+		queue:     make(chan *db.RequestLog, requestLogQueueSize),
+	}
+	if redactFile == "" {
+		return l, nil
+	}
+
+	f, err := os.Open(redactFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", redactFile, line, err)
+		}
+		l.redact = append(l.redact, re)
+	}
+	return l, scanner.Err()
+}
+
+// Run writes queued entries and periodically prunes old ones. It never returns.
+func (l *RequestLogger) Run() {
+	ticker := time.NewTicker(requestLogPruneEvery)
+	defer ticker.Stop()
+
+	l.prune()
+	for {
+		select {
+		case entry := <-l.queue:
+			entry.Prompt = l.redacted(entry.Prompt)
+			entry.Completion = l.redacted(entry.Completion)
+			if err := l.db.InsertRequestLog(context.Background(), entry); err != nil {
+				logger.Log.Error("Failed to write request log", "request_id", entry.RequestID, "err", err)
+			}
+		case <-ticker.C:
+			l.prune()
+		}
+	}
+}
+
+// Record queues entry for writing. Entries are dropped rather than block if the database
+// can't keep up.
+func (l *RequestLogger) Record(entry *db.RequestLog) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.queue <- entry:
+	default:
+		logger.Log.Warn("Request log queue full, dropping entry", "request_id", entry.RequestID)
+	}
+}
+
+func (l *RequestLogger) redacted(s *string) *string {
+	if s == nil || len(l.redact) == 0 {
+		return s
+	}
+	out := *s
+	for _, re := range l.redact {
+		out = re.ReplaceAllString(out, redactedText)
+	}
+	return &out
+}
+
+func (l *RequestLogger) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	n, err := l.db.PruneRequestLogs(context.Background(), time.Now().Add(-l.retention))
+	if err != nil {
+		logger.Log.Error("Failed to prune request log", "err", err)
+		return
+	}
+	if n > 0 {
+		logger.Log.Info("Pruned request log", "deleted", n)
+	}
+}
+
+// requestTrace follows one chat completion through the gateway and turns it into a request
+// log entry once the response is done.
+type requestTrace struct {
+	entry       db.RequestLog
+	start       time.Time
+	keepContent bool
+	collect     bool // gather the completion even if it isn't logged
+	completion  strings.Builder
+
+	cached      *cachedResponse // the response for the cache, nil if it isn't cached
+	cachedLimit int
+}
+
+func newRequestTrace(reqID string, key *db.APIKeyRecord, req *protocol.ChatCompletionRequest, body []byte, keepContent bool) *requestTrace {
+	t := &requestTrace{
+		entry: db.RequestLog{
+			RequestID: reqID,
+			APIKey:    key.APIKey,
+			Model:     req.Model,
+			Stream:    req.Stream,
+		},
+		start:       time.Now(),
+		keepContent: keepContent,
+	}
+	if keepContent {
+		prompt := string(body)
+		t.entry.Prompt = &prompt
+	}
+	return t
+}
+
+// Observe notes the arrival of the first chunk and collects generated text, and the chunk
+// itself if the response is cached.
+func (t *requestTrace) Observe(msg protocol.WSPayload) {
+	if msg.Type != protocol.MsgTypeStream {
+		return
+	}
+	if t.entry.FirstChunkMS == 0 {
+		t.entry.FirstChunkMS = max(1, int(time.Since(t.start).Milliseconds()))
+	}
+	if t.keepContent || t.collect {
+		if _, content, ok := parseChunk(msg); ok {
+			t.completion.WriteString(content)
+		}
+	}
+	t.cached.add(msg, t.cachedLimit)
+}
+
+// Completion returns the text generated so far, if it is being gathered.
+func (t *requestTrace) Completion() string {
+	return t.completion.String()
+}
+
+// Fail records why the request failed. Only the first failure is kept.
+func (t *requestTrace) Fail(reason string) {
+	if t.entry.Error == "" {
+		t.entry.Error = reason
+	}
+}
+
+// Finish completes the entry with the response status and token usage.
+func (t *requestTrace) Finish(status int, usage protocol.UsageStat) *db.RequestLog {
+	t.entry.Status = status
+	t.entry.LatencyMS = int(time.Since(t.start).Milliseconds())
+	t.entry.PromptTokens = usage.PromptTokens
+	t.entry.CompletionTokens = usage.CompletionTokens
+	t.entry.TotalTokens = usage.TotalTokens
+	if t.keepContent {
+		completion := t.completion.String()
+		t.entry.Completion = &completion
+	}
+	return &t.entry
+}
+
+// errorMessage returns the message of an ERROR payload.
+func errorMessage(msg protocol.WSPayload) string {
+	return msg.ErrorData().Message
+}
+
+// userRequest is a request log entry as its user sees it, with the node that served it named
+// by its public ID.
+type userRequest struct {
+	db.RequestLog
+	NodeID string `json:"node_id"`
+}
+
+// UserRequestsHandler lists the request log of the current user's API key, newest first.
+// GET /api/user/requests
+func UserRequestsHandler(database db.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		limit, offset := pagination(c)
+		logs, err := database.ListRequestLogs(c.Request.Context(), u.APIToken, limit, offset)
+		if err != nil {
+			logger.Log.Error("Failed to list request log", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		requests := make([]userRequest, len(logs))
+		for i, l := range logs {
+			requests[i] = userRequest{RequestLog: l, NodeID: publicNodeID(l.NodeID)}
+		}
+		c.JSON(http.StatusOK, gin.H{"requests": requests})
+	}
+}
+
+type ReportRequestRequest struct {
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+// ReportRequestHandler lets a user report a bad answer to one of their logged requests. The
+// report counts against the reputation of the node that served it. A request can only be
+// reported once.
+// POST /api/user/requests/:request_id/report
+func ReportRequestHandler(database db.Store, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c, database)
+		if !ok {
+			return
+		}
+		var req ReportRequestRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		entry, err := database.GetRequestLog(ctx, u.APIToken, c.Param("request_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+			return
+		}
+		token, _, _ := strings.Cut(entry.NodeID, "_")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request was not served by a node"})
+			return
+		}
+
+		err = database.CreateNodeReport(ctx, &db.NodeReport{RequestID: entry.RequestID, Token: token, APIKey: u.APIToken, Reason: req.Reason})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Request already reported"})
+			return
+		}
+		if err != nil {
+			logger.Log.Error("Failed to file report", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			return
+		}
+		if err := hub.Reputation.reported(ctx, token); err != nil {
+			logger.Log.Error("Failed to save node reputation", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Request reported"})
+	}
+}
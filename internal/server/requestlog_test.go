@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"CoLinkPlan/internal/db"
+)
+
+func TestRequestLoggerRedaction(t *testing.T) {
+	rules := strings.Join([]string{
+		"# e-mail addresses",
+		`[\w.+-]+@[\w-]+\.[\w.]+`,
+		"",
+		"   ",
+		`sk-[A-Za-z0-9]{8,}`,
+		`(?i)password:\s*\S+`,
+	}, "\n")
+	path := filepath.Join(t.TempDir(), "redact.txt")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewRequestLogger(nil, 0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.redact) != 3 {
+		t.Fatalf("%d rules loaded, want 3", len(l.redact))
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"mail bob@example.com now", "mail [REDACTED] now"},
+		{"a@x.io and b.c+d@y.co.uk", "[REDACTED] and [REDACTED]"},
+		{`{"key":"sk-abcdef123456"}`, `{"key":"[REDACTED]"}`},
+		{"sk-short stays", "sk-short stays"},
+		{"Password: hunter2, ok", "[REDACTED] ok"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		in := tt.in
+		got := l.redacted(&in)
+		if *got != tt.want {
+			t.Errorf("redacted(%q) = %q, want %q", tt.in, *got, tt.want)
+		}
+		if in != tt.in {
+			t.Errorf("redacted changed its input %q", tt.in)
+		}
+	}
+	if l.redacted(nil) != nil {
+		t.Error("nil content redacted to something")
+	}
+}
+
+func TestRequestLoggerRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{"no rules", "", ""},
+		{"comments only", "# nothing yet\n\n", ""},
+		{"invalid rule", "ok\n# fine\n[unclosed\n", "redact.txt:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "redact.txt")
+			if err := os.WriteFile(path, []byte(tt.rules), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			l, err := NewRequestLogger(nil, 0, path)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			case err == nil:
+				s := "a@x.io"
+				if got := l.redacted(&s); got != &s {
+					t.Errorf("content changed without rules: %q", *got)
+				}
+			}
+		})
+	}
+
+	if _, err := NewRequestLogger(nil, 0, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing rules file accepted")
+	}
+}
+
+func TestPublicNodeID(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"client-f4074beea294ed85a71ca52797475141_89b217c0", "89b217c0"},
+		{"client-with_underscore_89b217c0", "89b217c0"},
+		{"89b217c0", "89b217c0"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := publicNodeID(tt.id); got != tt.want {
+			t.Errorf("publicNodeID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestUserRequestHidesNodeToken(t *testing.T) {
+	const token = "client-f4074beea294ed85a71ca52797475141"
+	l := db.RequestLog{RequestID: "req-1", NodeID: token + "_89b217c0"}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), token) {
+		t.Errorf("request log entry shows the node's token: %s", b)
+	}
+
+	b, err = json.Marshal(userRequest{RequestLog: l, NodeID: publicNodeID(l.NodeID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), token) {
+		t.Errorf("user's request shows the node's token: %s", b)
+	}
+	var out map[string]interface{}
+	json.Unmarshal(b, &out)
+	if out["node_id"] != "89b217c0" {
+		t.Errorf("node_id = %v, want the public node ID", out["node_id"])
+	}
+}
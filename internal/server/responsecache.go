@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"CoLinkPlan/internal/cache"
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCacheMaxResponse is the size of the largest response ResponseCache stores.
+const DefaultCacheMaxResponse = 1 << 20
+
+// Values of the X-CoLink-Cache response header
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS"
+)
+
+// ResponseCache answers repeated deterministic requests, those with temperature 0, from a
+// cache rather than a node. Responses are cached per API key, under a hash of the model and
+// the request body with its keys sorted and whitespace removed. A request with
+// "Cache-Control: no-cache" is sent to a node and its response cached anew, one with
+// "no-store" bypasses the cache entirely.
+type ResponseCache struct {
+	Store       cache.Cache
+	TTL         time.Duration
+	MaxResponse int // bytes
+}
+
+// cachedResponse is a response as stored: the body of a non-stream response, or the chunks
+// of a stream.
+type cachedResponse struct {
+	Model  string            `json:"model"` // that served it
+	Chunks []json.RawMessage `json:"chunks"`
+
+	size     int
+	tooLarge bool
+}
+
+// add collects the chunk of msg, until the response grows too large to be cached.
+func (r *cachedResponse) add(msg protocol.WSPayload, limit int) {
+	if r == nil || r.tooLarge {
+		return
+	}
+	chunk, ok := msg.ChunkBytes()
+	if !ok {
+		return
+	}
+	if r.size += len(chunk); r.size > limit {
+		r.tooLarge, r.Chunks = true, nil
+		return
+	}
+	r.Chunks = append(r.Chunks, bytes.Clone(chunk))
+}
+
+// lookup decides how the request is cached, setting X-CoLink-Cache unless it isn't
+// cacheable. It returns the cache key to store the response under, empty if it mustn't be
+// stored, and the cached response if one may be served.
+func (rc *ResponseCache) lookup(c *gin.Context, apiKey, model string, body []byte) (string, *cachedResponse) {
+	if rc == nil {
+		return "", nil
+	}
+	key, ok := cacheKey(apiKey, model, body)
+	if !ok {
+		return "", nil
+	}
+	directives := strings.Split(strings.ToLower(c.GetHeader("Cache-Control")), ",")
+	for i := range directives {
+		directives[i] = strings.TrimSpace(directives[i])
+	}
+	switch {
+	case slices.Contains(directives, "no-store"):
+		c.Header("X-CoLink-Cache", cacheBypass)
+		return "", nil
+	case slices.Contains(directives, "no-cache"):
+		c.Header("X-CoLink-Cache", cacheBypass)
+		return key, nil
+	}
+
+	b, err := rc.Store.Get(c.Request.Context(), key)
+	if err != nil {
+		logger.Log.Warn("Failed to read response cache", "err", err)
+	}
+	var cached cachedResponse
+	if b == nil || json.Unmarshal(b, &cached) != nil || len(cached.Chunks) == 0 {
+		c.Header("X-CoLink-Cache", cacheMiss)
+		return key, nil
+	}
+	c.Header("X-CoLink-Cache", cacheHit)
+	return key, &cached
+}
+
+// store caches a response received in full.
+func (rc *ResponseCache) store(key string, r *cachedResponse) {
+	if r == nil || r.tooLarge || len(r.Chunks) == 0 {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err == nil {
+		err = rc.Store.Set(context.Background(), key, b, rc.TTL)
+	}
+	if err != nil {
+		logger.Log.Warn("Failed to write response cache", "err", err)
+	}
+}
+
+// serve writes a cached response, as SSE if stream is set, with model in the chunks' model
+// field unless it is empty, as the gateway does for a response from a node. The chunks are
+// observed by rt.
+func (rc *ResponseCache) serve(c *gin.Context, stream bool, model string, r *cachedResponse, rt *requestTrace) {
+	c.Header("X-CoLink-Model", r.Model)
+	chunks := make([][]byte, len(r.Chunks))
+	for i, chunk := range r.Chunks {
+		msg := withChunkModel(protocol.WSPayload{
+			Type: protocol.MsgTypeStream,
+			Data: protocol.StreamData{RequestID: rt.entry.RequestID, Chunk: chunk},
+		}, model)
+		rt.Observe(msg)
+		chunks[i], _ = msg.ChunkBytes()
+	}
+	if !stream {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", chunks[0])
+		return
+	}
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	for _, chunk := range chunks {
+		c.Writer.Write([]byte("data: "))
+		c.Writer.Write(chunk)
+		c.Writer.Write([]byte("\n\n"))
+	}
+	c.Writer.Write([]byte("data: [DONE]\n\n"))
+	c.Writer.Flush()
+}
+
+// cacheKey hashes a request of apiKey for model, reporting false if its response mustn't be
+// cached: it isn't JSON or doesn't ask for temperature 0.
+func cacheKey(apiKey, model string, body []byte) (string, bool) {
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		return "", false
+	}
+	if t, ok := fields["temperature"].(float64); !ok || t != 0 {
+		return "", false
+	}
+	// Maps are encoded with sorted keys and numbers in shortest form, which makes the
+	// encoding canonical
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write([]byte(apiKey))
+	h.Write([]byte{0})
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
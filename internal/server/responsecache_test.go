@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/cache"
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/limiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCacheKey(t *testing.T) {
+	const base = `{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	baseKey, ok := cacheKey("sk-a", "m", []byte(base))
+	if !ok {
+		t.Fatal("request with temperature 0 not cacheable")
+	}
+
+	tests := []struct {
+		name      string
+		apiKey    string
+		model     string
+		body      string
+		cacheable bool
+		same      bool // as the base request
+	}{
+		{"keys reordered", "sk-a", "m", `{"messages":[{"content":"hi","role":"user"}],"temperature":0,"model":"m"}`, true, true},
+		{"whitespace", "sk-a", "m", "{ \"model\" : \"m\",\n\t\"temperature\": 0, \"messages\": [ {\"role\": \"user\", \"content\": \"hi\"} ] }", true, true},
+		{"temperature 0.0", "sk-a", "m", `{"model":"m","temperature":0.0,"messages":[{"role":"user","content":"hi"}]}`, true, true},
+		{"temperature 0e0", "sk-a", "m", `{"model":"m","temperature":0e0,"messages":[{"role":"user","content":"hi"}]}`, true, true},
+		{"other content", "sk-a", "m", `{"model":"m","temperature":0,"messages":[{"role":"user","content":"hello"}]}`, true, false},
+		{"extra field", "sk-a", "m", `{"model":"m","temperature":0,"max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`, true, false},
+		{"other API key", "sk-b", "m", base, true, false},
+		{"other model", "sk-a", "m2", base, true, false},
+		{"no temperature", "sk-a", "m", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, false, false},
+		{"temperature above 0", "sk-a", "m", `{"model":"m","temperature":0.7,"messages":[]}`, false, false},
+		{"temperature as string", "sk-a", "m", `{"model":"m","temperature":"0","messages":[]}`, false, false},
+		{"not JSON", "sk-a", "m", `model=m&temperature=0`, false, false},
+		{"not an object", "sk-a", "m", `[0]`, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := cacheKey(tt.apiKey, tt.model, []byte(tt.body))
+			if ok != tt.cacheable {
+				t.Fatalf("cacheable = %v, want %v", ok, tt.cacheable)
+			}
+			if ok && (key == baseKey) != tt.same {
+				t.Errorf("same key as the base request = %v, want %v", key == baseKey, tt.same)
+			}
+		})
+	}
+}
+
+func TestResponseCacheLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const body = `{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	rc := &ResponseCache{Store: cache.NewMemoryCache(1 << 20), TTL: time.Minute, MaxResponse: DefaultCacheMaxResponse}
+	key, _ := cacheKey("sk-a", "m", []byte(body))
+	stored, _ := json.Marshal(cachedResponse{Model: "m", Chunks: []json.RawMessage{json.RawMessage(`{"id":"x"}`)}})
+	rc.Store.Set(t.Context(), key, stored, time.Minute)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		body         string
+		header       string // X-CoLink-Cache
+		stores       bool   // a key to store the response under is returned
+		hit          bool
+	}{
+		{"cached", "", body, cacheHit, true, true},
+		{"no-cache", "no-cache", body, cacheBypass, true, false},
+		{"no-store", "no-store", body, cacheBypass, false, false},
+		{"directives in any case", "max-age=0, No-Cache", body, cacheBypass, true, false},
+		{"no-store wins", "no-cache, no-store", body, cacheBypass, false, false},
+		{"unrelated directive", "max-age=60", body, cacheHit, true, true},
+		{"not cached yet", "", `{"model":"m","temperature":0,"messages":[]}`, cacheMiss, true, false},
+		{"not cacheable", "", `{"model":"m","temperature":1,"messages":[]}`, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.cacheControl != "" {
+				c.Request.Header.Set("Cache-Control", tt.cacheControl)
+			}
+
+			key, cached := rc.lookup(c, "sk-a", "m", []byte(tt.body))
+			if got := w.Header().Get("X-CoLink-Cache"); got != tt.header {
+				t.Errorf("X-CoLink-Cache = %q, want %q", got, tt.header)
+			}
+			if (key != "") != tt.stores {
+				t.Errorf("store key %q, want one = %v", key, tt.stores)
+			}
+			if (cached != nil) != tt.hit {
+				t.Errorf("cached response %v, want one = %v", cached, tt.hit)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsCacheHit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestStore(t)
+	h := NewHub()
+	go h.Run()
+	startNode(t, h, "gpt-4o")
+
+	requestLog, _ := NewRequestLogger(store, 0, "")
+	go requestLog.Run()
+	g := NewGateway(h, store, limiter.NewMemoryLimiter(), requestLog)
+	g.Aliases = ModelAliases{"smart": {"gpt-4o"}}
+	g.Cache = &ResponseCache{Store: cache.NewMemoryCache(1 << 20), TTL: time.Minute, MaxResponse: DefaultCacheMaxResponse}
+	router := gin.New()
+	router.POST("/v1/chat/completions", g.ChatCompletionsHandler)
+
+	const apiKey = "sk-a"
+	if err := store.CreateUser(ctx, "a@x.io", "hash", apiKey, "client-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stream cached with the node's own name for the model
+	const streamBody = `{"model":"smart","stream":true,"temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	key, _ := cacheKey(apiKey, "smart", []byte(streamBody))
+	stored, _ := json.Marshal(cachedResponse{Model: "gpt-4o", Chunks: []json.RawMessage{
+		json.RawMessage(`{"model":"local-name","choices":[{"index":0,"delta":{"content":"hi"}}]}`),
+	}})
+	g.Cache.Store.Set(ctx, key, stored, time.Minute)
+
+	const body = `{"model":"smart","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		body  string
+		cache string // X-CoLink-Cache
+	}{
+		{body, cacheMiss},
+		{body, cacheHit},
+		{streamBody, cacheHit},
+	}
+	for _, tt := range tests {
+		w := complete(router, apiKey, tt.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-CoLink-Cache"); got != tt.cache {
+			t.Errorf("X-CoLink-Cache %q, want %q", got, tt.cache)
+		}
+		if got := w.Header().Get("X-CoLink-Model"); got != "gpt-4o" {
+			t.Errorf("X-CoLink-Model %q, want gpt-4o", got)
+		}
+		if !strings.Contains(w.Body.String(), `"model":"gpt-4o"`) || strings.Contains(w.Body.String(), "local-name") {
+			t.Errorf("%s response %s, want model gpt-4o", tt.cache, w.Body)
+		}
+
+		// A response is cached in the background
+		key, _ := cacheKey(apiKey, "smart", []byte(tt.body))
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if b, _ := g.Cache.Store.Get(ctx, key); b != nil {
+				break
+			}
+		}
+	}
+
+	// Hits are logged and counted as API calls, like the miss
+	var logs []db.RequestLog
+	var calls int
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		logs, _ = store.ListRequestLogs(ctx, apiKey, 10, 0)
+		u, _ := store.GetUserByEmail(ctx, "a@x.io")
+		calls = u.TotalAPICalls
+		if len(logs) == len(tests) && calls == len(tests) {
+			break
+		}
+	}
+	if calls != len(tests) {
+		t.Errorf("%d API calls counted, want %d", calls, len(tests))
+	}
+	if len(logs) != len(tests) {
+		t.Fatalf("%d requests logged, want %d", len(logs), len(tests))
+	}
+	slices.Reverse(logs) // oldest first
+	for i, l := range logs {
+		hit := tests[i].cache == cacheHit
+		if l.Cached != hit || l.Model != "gpt-4o" || l.Status != http.StatusOK || (l.NodeID == "") != hit {
+			t.Errorf("request %d logged as cached %v, model %q, status %d, node %q", i+1, l.Cached, l.Model, l.Status, l.NodeID)
+		}
+	}
+}
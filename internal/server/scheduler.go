@@ -0,0 +1,185 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DefaultQueueTimeout is how long a request waits for a free node before it fails.
+const DefaultQueueTimeout = 30 * time.Second
+
+// queuePoll is how often queued requests look for a free node themselves, for capacity that
+// frees up without notice, such as a node's penalty running out.
+const queuePoll = time.Second
+
+var errQueueTimeout = errors.New("timed out waiting for a free node")
+
+// While all nodes are busy, requests wait in the hub's queue and get the nodes that free up
+// by weighted fair queuing: each flow, the requests of one user or organization, receives a
+// share of the nodes in proportion to its weight, however many requests it queues. Queued
+// interactive requests always go before queued batch ones.
+//
+// Shares are kept by self-clocked fair queuing. A request is stamped with a virtual finish
+// time, its flow's previous finish time or the queue's virtual time if that is later, plus
+// 1/weight, and requests are served in order of finish time. The virtual time is the finish
+// time of the request served last.
+
+// ticket is a request waiting in the queue.
+type ticket struct {
+	model  string
+	need   Requirements
+	finish float64
+	seq    uint64           // breaks ties in order of arrival
+	grant  chan *ClientConn // the node reserved for it, nil if none serves it any more
+}
+
+// fairQueue is the queue of one priority class.
+type fairQueue struct {
+	tickets []*ticket // in order of finish time
+	vtime   float64
+	finish  map[string]float64 // of each flow's last request
+}
+
+func (q *fairQueue) push(t *ticket) {
+	weight := float64(max(1, t.need.Weight))
+	t.finish = max(q.vtime, q.finish[t.need.Flow]) + 1/weight
+	q.finish[t.need.Flow] = t.finish
+	i, _ := slices.BinarySearchFunc(q.tickets, t, func(a, b *ticket) int {
+		if c := cmp.Compare(a.finish, b.finish); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.seq, b.seq)
+	})
+	q.tickets = slices.Insert(q.tickets, i, t)
+}
+
+// queue returns the queue of need's priority class. The caller must hold mu.
+func (h *Hub) queue(need Requirements) *fairQueue {
+	if need.Batch {
+		return &h.queues[1]
+	}
+	return &h.queues[0]
+}
+
+// acquire reserves a slot of a node that serves model and meets need, waiting in the queue
+// up to QueueTimeout while they are all busy. It fails at once if none is connected, and
+// when the queue is left with the slot, if any, given back if ctx is done.
+func (h *Hub) acquire(ctx context.Context, model string, need Requirements) (*ClientConn, error) {
+	h.mu.Lock()
+	if !h.servesLocked(model, need) {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("no available clients for model: %s", model)
+	}
+	h.queueSeq++
+	t := &ticket{model: model, need: need, seq: h.queueSeq, grant: make(chan *ClientConn, 1)}
+	h.queue(need).push(t)
+	h.scheduleLocked()
+	h.mu.Unlock()
+
+	timeout := time.NewTimer(h.QueueTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(queuePoll)
+	defer poll.Stop()
+	for {
+		select {
+		case c := <-t.grant:
+			return granted(c, model)
+		case <-poll.C:
+			h.mu.Lock()
+			h.scheduleLocked()
+			h.mu.Unlock()
+		case <-timeout.C:
+			if c, ok := h.leave(t); ok {
+				return granted(c, model)
+			}
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			if c, _ := h.leave(t); c != nil {
+				h.mu.Lock()
+				h.release(c, model)
+				h.mu.Unlock()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func granted(c *ClientConn, model string) (*ClientConn, error) {
+	if c == nil {
+		return nil, fmt.Errorf("no available clients for model: %s", model)
+	}
+	return c, nil
+}
+
+// leave takes t out of the queue. If it was granted a slot meanwhile, it returns the node
+// instead, and true.
+func (h *Hub) leave(t *ticket) (*ClientConn, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q := h.queue(t.need)
+	if i := slices.Index(q.tickets, t); i >= 0 {
+		q.tickets = slices.Delete(q.tickets, i, i+1)
+		return nil, false
+	}
+	return <-t.grant, true
+}
+
+// release frees a slot reserved for a task of model that was never sent, handing it to the
+// next request in the queue. The caller must hold mu.
+func (h *Hub) release(c *ClientConn, model string) {
+	c.ActiveTasks = max(0, c.ActiveTasks-1)
+	c.releaseModelTask(model)
+	h.scheduleLocked()
+}
+
+// scheduleLocked hands free slots to queued requests, interactive ones first and each class
+// in order of finish time. Requests no connected node serves any more fail. It is called
+// whenever slots may have freed up. The caller must hold mu.
+func (h *Hub) scheduleLocked() {
+	for i := range h.queues {
+		q := &h.queues[i]
+		if len(q.tickets) == 0 {
+			continue
+		}
+		waiting := q.tickets[:0]
+		for _, t := range q.tickets {
+			if c := h.selectLocked(t.model, t.need); c != nil {
+				c.reserve(t.model)
+				q.vtime = max(q.vtime, t.finish)
+				t.grant <- c
+			} else if h.servesLocked(t.model, t.need) {
+				waiting = append(waiting, t)
+			} else {
+				t.grant <- nil
+			}
+		}
+		clear(q.tickets[len(waiting):])
+		q.tickets = waiting
+		if len(waiting) == 0 {
+			// Every flow is idle, none is ahead of the others
+			clear(q.finish)
+		}
+	}
+}
+
+// serves reports whether a registered node serves model and meets need, busy or not.
+func (h *Hub) serves(model string, need Requirements) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.servesLocked(model, need)
+}
+
+// servesLocked reports whether a registered node serves model and meets need, busy or not.
+// The caller must hold mu.
+func (h *Hub) servesLocked(model string, need Requirements) bool {
+	for c := range h.clients {
+		if c.MaxParallel > 0 && c.SupportedModels[model] && len(c.lacks(model, need)) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFairQueueOrder(t *testing.T) {
+	type push struct {
+		flow   string
+		weight int
+	}
+	tests := []struct {
+		name   string
+		vtime  float64
+		finish map[string]float64
+		pushes []push
+		want   []string // flows in the order they are served
+	}{
+		{
+			name:   "equal weights take turns",
+			pushes: []push{{"a", 1}, {"a", 1}, {"a", 1}, {"b", 1}, {"b", 1}},
+			want:   []string{"a", "b", "a", "b", "a"},
+		},
+		{
+			name:   "double weight gets two turns for one",
+			pushes: []push{{"a", 2}, {"a", 2}, {"a", 2}, {"a", 2}, {"b", 1}, {"b", 1}},
+			want:   []string{"a", "a", "b", "a", "a", "b"},
+		},
+		{
+			name:   "weight below one counts as one",
+			pushes: []push{{"a", 0}, {"a", 0}, {"b", 1}},
+			want:   []string{"a", "b", "a"},
+		},
+		{
+			name:   "ties go in order of arrival",
+			pushes: []push{{"b", 1}, {"a", 1}, {"c", 1}},
+			want:   []string{"b", "a", "c"},
+		},
+		{
+			name:   "flow ahead of the virtual time waits for the others",
+			vtime:  3,
+			finish: map[string]float64{"a": 5},
+			pushes: []push{{"a", 1}, {"b", 1}, {"b", 1}, {"b", 1}},
+			want:   []string{"b", "b", "a", "b"},
+		},
+		{
+			name:   "idle flow starts at the virtual time, not behind it",
+			vtime:  10,
+			finish: map[string]float64{"a": 2},
+			pushes: []push{{"b", 1}, {"a", 1}},
+			want:   []string{"b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := fairQueue{vtime: tt.vtime, finish: make(map[string]float64)}
+			for flow, f := range tt.finish {
+				q.finish[flow] = f
+			}
+			for i, p := range tt.pushes {
+				q.push(&ticket{need: Requirements{Flow: p.flow, Weight: p.weight}, seq: uint64(i + 1)})
+			}
+			var got []string
+			for _, tk := range q.tickets {
+				got = append(got, tk.need.Flow)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("served %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// queueTicket queues a request for model as acquire does. The caller must hold h.mu.
+func queueTicket(h *Hub, model string, need Requirements) *ticket {
+	h.queueSeq++
+	t := &ticket{model: model, need: need, seq: h.queueSeq, grant: make(chan *ClientConn, 1)}
+	h.queue(need).push(t)
+	return t
+}
+
+func TestScheduleLocked(t *testing.T) {
+	h := NewHub()
+	c := NewClientConn(h, nil, "client-t_0123abcd")
+	c.MaxParallel = 1
+	c.SupportedModels["m"] = true
+	c.reserve("m")
+	h.clients[c] = true
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	batch := queueTicket(h, "m", Requirements{Flow: "a", Batch: true})
+	a1 := queueTicket(h, "m", Requirements{Flow: "a"})
+	a2 := queueTicket(h, "m", Requirements{Flow: "a"})
+	b1 := queueTicket(h, "m", Requirements{Flow: "b"})
+	gone := queueTicket(h, "gone", Requirements{Flow: "c"})
+
+	granted := func(tk *ticket) bool {
+		select {
+		case got := <-tk.grant:
+			if got != c {
+				t.Fatalf("granted %v", got)
+			}
+			return true
+		default:
+			return false
+		}
+	}
+
+	// The node is busy: only the request for a model nobody serves is answered, with nil
+	h.scheduleLocked()
+	if got := <-gone.grant; got != nil {
+		t.Errorf("request for an unserved model granted %s", got.ID)
+	}
+	for _, tk := range []*ticket{batch, a1, a2, b1} {
+		if granted(tk) {
+			t.Fatal("request granted a busy node")
+		}
+	}
+
+	// Each freed slot goes to the interactive request with the earliest finish time, and
+	// only then to the batch one
+	for _, want := range []*ticket{a1, b1, a2, batch} {
+		h.release(c, "m")
+		if !granted(want) {
+			t.Fatalf("slot not granted to flow %s (batch %v)", want.need.Flow, want.need.Batch)
+		}
+		for _, tk := range []*ticket{batch, a1, a2, b1} {
+			if tk != want && granted(tk) {
+				t.Fatalf("slot also granted to flow %s", tk.need.Flow)
+			}
+		}
+	}
+	for i := range h.queues {
+		if len(h.queues[i].tickets) > 0 || len(h.queues[i].finish) > 0 {
+			t.Errorf("queue %d not empty after every request was served", i)
+		}
+	}
+}
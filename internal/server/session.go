@@ -0,0 +1,184 @@
+package server
+
+import (
+	"slices"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultSessionGrace is how long the requests of a node whose connection dropped are held
+// for it to resume its session.
+const DefaultSessionGrace = 30 * time.Second
+
+// ackEvery is how many numbered messages the server receives between ACKs.
+const ackEvery = 32
+
+// resumeWait bounds how long a resuming node waits for the server to notice that the
+// session's previous connection is gone.
+const resumeWait = 5 * time.Second
+
+// suspend holds the session of a node whose connection dropped, returning false if it
+// cannot be resumed: the node did not negotiate resumption, or was disconnected on purpose.
+// The caller is the ReadLoop of c, which has ended.
+func (h *Hub) suspend(c *ClientConn) bool {
+	if c.SessionID == "" || h.SessionGrace <= 0 || c.closing.Load() {
+		return false
+	}
+
+	h.mu.Lock()
+	h.suspended[c.SessionID] = c
+	c.suspension++
+	suspension := c.suspension
+	c.graceTimer = time.AfterFunc(h.SessionGrace, func() { h.expire(c, suspension) })
+	h.mu.Unlock()
+
+	c.PendingMutex.RLock()
+	pending := len(c.PendingStreams)
+	c.PendingMutex.RUnlock()
+	logger.Log.Info("Holding session for the node to resume", "client_id", c.ID, "pending", pending, "grace", h.SessionGrace)
+	return true
+}
+
+// expire ends a suspended session that was not resumed in time. suspension identifies the
+// suspension the grace period was given for: a session resumed and suspended again since
+// gets a grace period of its own.
+func (h *Hub) expire(c *ClientConn, suspension uint64) {
+	h.mu.Lock()
+	if h.suspended[c.SessionID] != c || c.suspension != suspension {
+		h.mu.Unlock()
+		return // resumed
+	}
+	delete(h.suspended, c.SessionID)
+	h.mu.Unlock()
+
+	logger.Log.Info("Session expired", "client_id", c.ID)
+	c.failPending("node disconnected")
+	close(c.closeCh)
+}
+
+// resume hands the session with the given ID over to a new connection of the node that
+// held it, or returns nil if there is no such session: it expired, or belongs to another
+// token. A session whose previous connection still looks alive is taken from it.
+func (h *Hub) resume(sessionID, token string, conn *websocket.Conn) *ClientConn {
+	deadline := time.Now().Add(resumeWait)
+	for {
+		h.mu.Lock()
+		if c, ok := h.suspended[sessionID]; ok {
+			if c.Token() != token {
+				h.mu.Unlock()
+				return nil
+			}
+			delete(h.suspended, sessionID)
+			c.graceTimer.Stop()
+			c.attach(conn)
+			h.mu.Unlock()
+			return c
+		}
+
+		// The node may notice a dead connection before the server does: close it, and wait
+		// for its ReadLoop to suspend the session
+		var active *ClientConn
+		var detached chan struct{}
+		for client := range h.clients {
+			if client.SessionID == sessionID && client.Token() == token {
+				active, detached = client, client.detached
+			}
+		}
+		h.mu.Unlock()
+		if active == nil || time.Now().After(deadline) {
+			return nil
+		}
+		active.ConnMutex.Lock()
+		active.Conn.Close()
+		active.ConnMutex.Unlock()
+		select {
+		case <-detached:
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+}
+
+// attach gives a suspended session its new connection. The caller must hold Hub.mu.
+func (c *ClientConn) attach(conn *websocket.Conn) {
+	c.ConnMutex.Lock()
+	c.Conn = conn
+	c.ConnMutex.Unlock()
+	c.detached = make(chan struct{})
+	c.resuming = true
+}
+
+// newSession starts a resumable session for a node that negotiated FeatureResume.
+func (c *ClientConn) newSession() {
+	c.SessionID = uuid.New().String()
+	c.recvSeq, c.ackedSeq = 0, 0
+}
+
+// resumeSession picks up the pending requests of a resumed session once the node said which
+// requests it still has. Requests it knows nothing about can no longer complete and fail;
+// the others get their credits and cancellations again, in case they were lost with the
+// previous connection.
+func (c *ClientConn) resumeSession(known []string) {
+	var lost, cancelled []string
+	var credits []protocol.CreditData
+
+	c.PendingMutex.RLock()
+	for reqID, s := range c.PendingStreams {
+		switch {
+		case !slices.Contains(known, reqID):
+			lost = append(lost, reqID)
+		case s.closed:
+			cancelled = append(cancelled, reqID)
+		case s.credits > 0:
+			credits = append(credits, protocol.CreditData{RequestID: reqID, Credits: s.granted})
+		}
+	}
+	c.PendingMutex.RUnlock()
+
+	logger.Log.Info("Client resumed session", "client_id", c.ID, "last_seq", c.recvSeq,
+		"pending", len(credits)+len(cancelled), "lost", len(lost))
+	for _, reqID := range lost {
+		c.Hub.CompleteTask(c, reqID, "node lost the request")
+	}
+	for _, reqID := range cancelled {
+		c.cancel(reqID, "abandoned while the node was disconnected")
+	}
+	for _, credit := range credits {
+		c.SendMessage(protocol.WSPayload{Type: protocol.MsgTypeCredit, Data: credit})
+	}
+}
+
+// received records a numbered message, returning false if it is a duplicate the node sent
+// again after resuming. Called by ReadLoop only.
+func (c *ClientConn) received(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if seq <= c.recvSeq {
+		return false
+	}
+	c.recvSeq = seq
+	if c.recvSeq-c.ackedSeq >= ackEvery {
+		c.ackedSeq = c.recvSeq
+		c.SendMessage(protocol.WSPayload{Type: protocol.MsgTypeAck, Data: protocol.AckData{Seq: c.recvSeq}})
+	}
+	return true
+}
+
+// failPending ends every request still pending on the node.
+func (c *ClientConn) failPending(reason string) {
+	c.PendingMutex.RLock()
+	reqIDs := make([]string, 0, len(c.PendingStreams))
+	for reqID := range c.PendingStreams {
+		reqIDs = append(reqIDs, reqID)
+	}
+	c.PendingMutex.RUnlock()
+	for _, reqID := range reqIDs {
+		// Ensure wait handlers are unblocked and gracefully exit
+		c.Hub.CompleteTask(c, reqID, reason)
+	}
+}
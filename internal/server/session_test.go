@@ -0,0 +1,149 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair connects a websocket client to a test server, returning the server's end of the
+// connection and the client's.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	server := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := <-server
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+// readAcks returns the sequence numbers of the ACKs the node has been sent, waiting for
+// more until none come for a while.
+func readAcks(t *testing.T, client *websocket.Conn) []uint64 {
+	t.Helper()
+	var acks []uint64
+	for {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, message, err := client.ReadMessage()
+		if err != nil {
+			return acks
+		}
+		payload, err := protocol.DecodeMessage(message)
+		if err != nil || payload.Type != protocol.MsgTypeAck {
+			t.Fatalf("node sent %s (%v), want an ACK", message, err)
+		}
+		ack, ok := payload.Data.(protocol.AckData)
+		if !ok {
+			t.Fatalf("ACK data %T", payload.Data)
+		}
+		acks = append(acks, ack.Seq)
+	}
+}
+
+// seqs returns the sequence numbers from through to.
+func seqs(from, to uint64) []uint64 {
+	var s []uint64
+	for seq := from; seq <= to; seq++ {
+		s = append(s, seq)
+	}
+	return s
+}
+
+func TestReceived(t *testing.T) {
+	tests := []struct {
+		name     string
+		recvSeq  uint64 // received before, as after a resume
+		ackedSeq uint64
+		seqs     []uint64
+		dups     []uint64 // of seqs, those received before
+		acks     []uint64
+	}{
+		{name: "unnumbered", seqs: []uint64{0, 0, 0}},
+		{name: "in order", seqs: seqs(1, 5)},
+		{name: "repeated", seqs: []uint64{1, 2, 2, 3, 1}, dups: []uint64{2, 1}},
+		{name: "unnumbered between numbered", seqs: []uint64{1, 0, 2, 0}},
+		{name: "gap", seqs: []uint64{1, 2, 5, 3, 6}, dups: []uint64{3}},
+		{name: "ack every 32", seqs: seqs(1, 70), acks: []uint64{32, 64}},
+		{name: "ack counts from the last one", ackedSeq: 30, recvSeq: 30, seqs: seqs(31, 62), acks: []uint64{62}},
+		{name: "resent after resume", recvSeq: 40, ackedSeq: 32, seqs: append(seqs(35, 41), 42), dups: seqs(35, 40)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := wsPair(t)
+			c := NewClientConn(NewHub(), conn, "client-t_0123abcd")
+			c.recvSeq, c.ackedSeq = tt.recvSeq, tt.ackedSeq
+
+			var dups []uint64
+			for _, seq := range tt.seqs {
+				if !c.received(seq) {
+					dups = append(dups, seq)
+				}
+			}
+			if !slices.Equal(dups, tt.dups) {
+				t.Errorf("duplicates %v, want %v", dups, tt.dups)
+			}
+			if acks := readAcks(t, client); !slices.Equal(acks, tt.acks) {
+				t.Errorf("acked %v, want %v", acks, tt.acks)
+			}
+		})
+	}
+}
+
+func TestResumedSessionGetsFreshGrace(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	h := NewHub()
+	h.SessionGrace = grace
+	c := NewClientConn(h, nil, "client-t_0123abcd")
+	c.SessionID = "session"
+
+	if !h.suspend(c) {
+		t.Fatal("session not suspended")
+	}
+	time.Sleep(grace / 2)
+	if h.resume("session", "client-t", nil) != c {
+		t.Fatal("session not resumed")
+	}
+	if !h.suspend(c) {
+		t.Fatal("session not suspended again")
+	}
+
+	// Past the end of the first grace period, within the second
+	time.Sleep(grace * 3 / 4)
+	select {
+	case <-c.closeCh:
+		t.Fatal("session expired by the grace period of its first suspension")
+	default:
+	}
+
+	select {
+	case <-c.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("session never expired")
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.suspended["session"]; ok {
+		t.Error("expired session still held")
+	}
+}
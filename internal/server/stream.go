@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+)
+
+// DefaultStreamCredits is how many STREAM messages a flow-controlled node may send ahead of
+// the gateway handler consuming them.
+const DefaultStreamCredits = 32
+
+// unpacedStreamBuffer is the stream buffer of requests on nodes without flow control, which
+// send as fast as their provider answers.
+const unpacedStreamBuffer = 1024
+
+var errStreamClosed = errors.New("stream closed prematurely")
+
+// TaskStream carries the messages of a dispatched request from the node's ReadLoop to the
+// gateway handler waiting on it. ReadLoop never blocks on a stream: a node that runs ahead
+// of its consumer, beyond its credits or the buffer of an unpaced node, gets the request
+// abandoned instead of stalling every other request on the connection.
+type TaskStream struct {
+	RequestID string
+	Client    *ClientConn
+
+	ch      chan protocol.WSPayload
+	credits int                     // initial credits granted in CALL, 0 if the node is not flow controlled
+	cipher  *protocol.RequestCipher // opens the chunks of a sealed request, owned by the consumer
+
+	// Guarded by Client.PendingMutex; every send on ch and its close happen under it
+	closed   bool
+	reason   string // why the stream was abandoned, if it was
+	consumed int    // STREAM messages consumed
+	granted  int    // STREAM messages the node may have sent, see protocol.CreditData
+
+	peeked *protocol.WSPayload // owned by the consumer
+}
+
+func newTaskStream(client *ClientConn, requestID string, credits int) *TaskStream {
+	size := unpacedStreamBuffer
+	if credits > 0 {
+		size = credits + 2 // room for FINISH or ERROR after a full window
+	}
+	return &TaskStream{
+		RequestID: requestID,
+		Client:    client,
+		ch:        make(chan protocol.WSPayload, size),
+		credits:   credits,
+		granted:   credits,
+	}
+}
+
+// Peek waits for the first message without consuming it, so that Recv returns it again.
+func (s *TaskStream) Peek(ctx context.Context) (protocol.WSPayload, error) {
+	if s.peeked == nil {
+		msg, err := s.next(ctx)
+		if err != nil {
+			return msg, err
+		}
+		s.peeked = &msg
+	}
+	return *s.peeked, nil
+}
+
+// Recv waits for the next message of the request, granting the node more credits as they
+// are used up. It fails with ctx's error, or once the stream is closed.
+func (s *TaskStream) Recv(ctx context.Context) (protocol.WSPayload, error) {
+	var msg protocol.WSPayload
+	if s.peeked != nil {
+		msg, s.peeked = *s.peeked, nil
+	} else {
+		var err error
+		if msg, err = s.next(ctx); err != nil {
+			return msg, err
+		}
+	}
+
+	if s.credits > 0 && msg.Type == protocol.MsgTypeStream {
+		s.Client.PendingMutex.Lock()
+		s.consumed++
+		// Grant in batches of half the window, so the node rarely has to wait
+		grant := 0
+		if s.consumed+s.credits-s.granted >= max(1, s.credits/2) {
+			s.granted = s.consumed + s.credits
+			grant = s.granted
+		}
+		s.Client.PendingMutex.Unlock()
+		if grant > 0 {
+			s.Client.SendMessage(protocol.WSPayload{
+				Type: protocol.MsgTypeCredit,
+				Data: protocol.CreditData{RequestID: s.RequestID, Credits: grant},
+			})
+		}
+	}
+	return msg, nil
+}
+
+func (s *TaskStream) next(ctx context.Context) (protocol.WSPayload, error) {
+	select {
+	case <-ctx.Done():
+		return protocol.WSPayload{}, ctx.Err()
+	case msg, ok := <-s.ch:
+		if !ok {
+			return msg, s.err()
+		}
+		if s.cipher != nil {
+			switch msg.Type {
+			case protocol.MsgTypeStream:
+				return s.open(msg)
+			case protocol.MsgTypeFinish:
+				return s.finish(msg)
+			}
+		}
+		return msg, nil
+	}
+}
+
+// open replaces the sealed chunk of a STREAM message with the chunk. A chunk that does not
+// open fails the request: the node, or something on the way, is not to be trusted with it.
+func (s *TaskStream) open(msg protocol.WSPayload) (protocol.WSPayload, error) {
+	sealed, _ := msg.ChunkBytes()
+	chunk, err := s.cipher.OpenChunk(sealed)
+	if err != nil {
+		s.Abandon("invalid sealed chunk")
+		return msg, err
+	}
+	return protocol.WSPayload{
+		Type: msg.Type,
+		Data: protocol.StreamData{RequestID: s.RequestID, Chunk: chunk},
+		Seq:  msg.Seq,
+	}, nil
+}
+
+// finish checks the FINISH of a sealed request: a response missing chunks at its end fails
+// like one with a chunk that does not open.
+func (s *TaskStream) finish(msg protocol.WSPayload) (protocol.WSPayload, error) {
+	fd, _ := msg.Data.(protocol.FinishData)
+	if err := s.cipher.OpenFinish(fd.Sealed); err != nil {
+		s.Abandon("invalid sealed finish")
+		return msg, err
+	}
+	return msg, nil
+}
+
+func (s *TaskStream) err() error {
+	s.Client.PendingMutex.Lock()
+	defer s.Client.PendingMutex.Unlock()
+	if s.reason != "" {
+		return errors.New(s.reason)
+	}
+	return errStreamClosed
+}
+
+// Abandon gives up on a request whose response is no longer wanted. Messages still coming
+// for it are dropped, and a node that supports cancellation is told to stop; its slot is
+// released when the node ends the request. Does nothing once the request has ended.
+func (s *TaskStream) Abandon(reason string) {
+	s.Client.PendingMutex.Lock()
+	abandoned := s.abandonLocked(reason)
+	s.Client.PendingMutex.Unlock()
+	if abandoned {
+		s.Client.cancel(s.RequestID, reason)
+	}
+}
+
+// abandonLocked closes a stream that is still open, returning false if it was not. The
+// caller must hold Client.PendingMutex.
+func (s *TaskStream) abandonLocked(reason string) bool {
+	if s.closed || s.Client.PendingStreams[s.RequestID] != s {
+		return false
+	}
+	s.closed = true
+	s.reason = reason
+	close(s.ch)
+	return true
+}
+
+// deliver hands a message from the node to the request's stream without blocking. It
+// returns false if the request is unknown.
+func (c *ClientConn) deliver(requestID string, payload protocol.WSPayload) bool {
+	c.PendingMutex.Lock()
+	s, ok := c.PendingStreams[requestID]
+	if !ok {
+		c.PendingMutex.Unlock()
+		return false
+	}
+	if s.closed {
+		// Abandoned: the node may still be sending until it sees CANCEL
+		c.PendingMutex.Unlock()
+		return true
+	}
+
+	overrun := false
+	select {
+	case s.ch <- payload:
+	default:
+		overrun = s.abandonLocked("response consumer fell behind")
+	}
+	c.PendingMutex.Unlock()
+
+	if overrun {
+		logger.Log.Warn("Abandoned request whose consumer fell behind", "request_id", requestID, "client_id", c.ID,
+			"buffered", cap(s.ch))
+		c.cancel(requestID, "response consumer fell behind")
+	}
+	return true
+}
+
+// cancel tells the node to stop working on a request, if it supports cancellation.
+func (c *ClientConn) cancel(requestID, reason string) {
+	c.Hub.mu.RLock()
+	supported := c.Features[protocol.FeatureCancel]
+	c.Hub.mu.RUnlock()
+	if !supported {
+		return
+	}
+	c.SendMessage(protocol.WSPayload{
+		Type: protocol.MsgTypeCancel,
+		Data: protocol.CancelData{RequestID: requestID, Reason: reason},
+	})
+}
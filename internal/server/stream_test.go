@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"CoLinkPlan/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// openStream dispatches request "req-1" with credits to a new node connection, returning its
+// stream and the node's end of the connection.
+func openStream(t *testing.T, credits int, features ...string) (*TaskStream, *websocket.Conn) {
+	t.Helper()
+	conn, node := wsPair(t)
+	c := NewClientConn(NewHub(), conn, "client-t_0123abcd")
+	for _, f := range features {
+		c.Features[f] = true
+	}
+	s := newTaskStream(c, "req-1", credits)
+	c.PendingStreams[s.RequestID] = s
+	return s, node
+}
+
+// readSent returns the messages the node has been sent, waiting for more until none come
+// for a while.
+func readSent(t *testing.T, node *websocket.Conn) []protocol.WSPayload {
+	t.Helper()
+	var sent []protocol.WSPayload
+	for {
+		node.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, message, err := node.ReadMessage()
+		if err != nil {
+			return sent
+		}
+		payload, err := protocol.DecodeMessage(message)
+		if err != nil {
+			t.Fatalf("node sent %s: %v", message, err)
+		}
+		sent = append(sent, payload)
+	}
+}
+
+func streamChunk(requestID string) protocol.WSPayload {
+	return protocol.WSPayload{Type: protocol.MsgTypeStream, Data: protocol.StreamData{RequestID: requestID, Chunk: map[string]string{}}}
+}
+
+func TestStreamCredits(t *testing.T) {
+	tests := []struct {
+		name    string
+		credits int
+		chunks  int
+		peek    bool
+		grants  []int // credits granted in turn
+	}{
+		{name: "half a window at a time", credits: 4, chunks: 5, grants: []int{6, 8}},
+		{name: "window of one", credits: 1, chunks: 3, grants: []int{2, 3, 4}},
+		{name: "peeked first chunk", credits: 2, chunks: 2, peek: true, grants: []int{3, 4}},
+		{name: "not flow controlled", credits: 0, chunks: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, node := openStream(t, tt.credits)
+			ctx := context.Background()
+			for range tt.chunks {
+				if !s.Client.deliver(s.RequestID, streamChunk(s.RequestID)) {
+					t.Fatal("stream unknown")
+				}
+				if tt.peek {
+					if _, err := s.Peek(ctx); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if msg, err := s.Recv(ctx); err != nil || msg.Type != protocol.MsgTypeStream {
+					t.Fatalf("received %v, %v", msg.Type, err)
+				}
+			}
+			// The end of the request uses no credit
+			s.Client.deliver(s.RequestID, protocol.WSPayload{Type: protocol.MsgTypeFinish, Data: protocol.FinishData{RequestID: s.RequestID}})
+			if msg, err := s.Recv(ctx); err != nil || msg.Type != protocol.MsgTypeFinish {
+				t.Fatalf("received %v, %v, want FINISH", msg.Type, err)
+			}
+
+			var grants []int
+			for _, msg := range readSent(t, node) {
+				credit, ok := msg.Data.(protocol.CreditData)
+				if msg.Type != protocol.MsgTypeCredit || !ok || credit.RequestID != s.RequestID {
+					t.Fatalf("node sent %s %+v, want a CREDIT", msg.Type, msg.Data)
+				}
+				grants = append(grants, credit.Credits)
+			}
+			if !slices.Equal(grants, tt.grants) {
+				t.Errorf("granted %v, want %v", grants, tt.grants)
+			}
+		})
+	}
+}
+
+func TestDeliverOverrun(t *testing.T) {
+	tests := []struct {
+		name     string
+		credits  int
+		features []string
+		cancel   bool
+	}{
+		{name: "flow controlled", credits: 2, features: []string{protocol.FeatureFlowControl, protocol.FeatureCancel}, cancel: true},
+		{name: "without cancellation", credits: 2, features: []string{protocol.FeatureFlowControl}},
+		{name: "not flow controlled", credits: 0, features: []string{protocol.FeatureCancel}, cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, node := openStream(t, tt.credits, tt.features...)
+			c := s.Client
+
+			// Fill the buffer, then overrun it
+			buffered := cap(s.ch)
+			for i := range buffered + 1 {
+				if !c.deliver(s.RequestID, streamChunk(s.RequestID)) {
+					t.Fatalf("chunk %d: stream unknown", i)
+				}
+			}
+			if !c.deliver(s.RequestID, streamChunk(s.RequestID)) {
+				t.Error("chunk after the request was abandoned not taken")
+			}
+			if c.deliver("req-2", streamChunk("req-2")) {
+				t.Error("chunk of an unknown request taken")
+			}
+
+			// What was buffered is still consumed, then the reason the request was given up
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			for i := range buffered {
+				if _, err := s.Recv(ctx); err != nil {
+					t.Fatalf("buffered chunk %d: %v", i, err)
+				}
+			}
+			if _, err := s.Recv(ctx); err == nil || err.Error() != "response consumer fell behind" {
+				t.Errorf("stream ended with %v, want the consumer fell behind", err)
+			}
+
+			var cancels []protocol.CancelData
+			for _, msg := range readSent(t, node) {
+				if cd, ok := msg.Data.(protocol.CancelData); ok {
+					cancels = append(cancels, cd)
+				}
+			}
+			switch {
+			case !tt.cancel && len(cancels) > 0:
+				t.Errorf("node without cancellation sent %+v", cancels)
+			case tt.cancel && (len(cancels) != 1 || cancels[0].RequestID != s.RequestID):
+				t.Errorf("node sent %+v, want one CANCEL of %s", cancels, s.RequestID)
+			}
+		})
+	}
+}
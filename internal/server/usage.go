@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"CoLinkPlan/internal/protocol"
+)
+
+// bytesPerToken is the rough ratio used when a provider does not report usage.
+const bytesPerToken = 4
+
+// usageMeter tracks the token usage of one request. Usage reported by the provider (in the
+// non-stream body or a final stream chunk) wins; otherwise it is estimated from the size of
+// the request body and of the generated content.
+type usageMeter struct {
+	promptBytes     int
+	completionBytes int
+	reported        *protocol.UsageStat
+}
+
+func newUsageMeter(promptBytes int) *usageMeter {
+	return &usageMeter{promptBytes: promptBytes}
+}
+
+// Observe inspects a STREAM message for usage information and generated content.
+func (u *usageMeter) Observe(msg protocol.WSPayload) {
+	reported, content, ok := parseChunk(msg)
+	if !ok {
+		return
+	}
+	if reported != nil && reported.TotalTokens > 0 {
+		u.reported = reported
+	}
+	u.completionBytes += len(content)
+}
+
+// parseChunk extracts the usage and generated text carried by a STREAM message, whether
+// it holds a stream delta or a whole non-stream response.
+func parseChunk(msg protocol.WSPayload) (*protocol.UsageStat, string, bool) {
+	if msg.Type != protocol.MsgTypeStream {
+		return nil, "", false
+	}
+	chunkBytes, ok := msg.ChunkBytes()
+	if !ok {
+		return nil, "", false
+	}
+
+	var chunk struct {
+		Usage   *protocol.UsageStat `json:"usage"`
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(chunkBytes, &chunk); err != nil {
+		return nil, "", false
+	}
+
+	var content strings.Builder
+	for _, ch := range chunk.Choices {
+		content.WriteString(ch.Delta.Content)
+		content.WriteString(ch.Message.Content)
+	}
+	return chunk.Usage, content.String(), true
+}
+
+// Usage returns the reported usage, or an estimate if the provider reported none.
+func (u *usageMeter) Usage() protocol.UsageStat {
+	if u.reported != nil {
+		return *u.reported
+	}
+	prompt := (u.promptBytes + bytesPerToken - 1) / bytesPerToken
+	completion := (u.completionBytes + bytesPerToken - 1) / bytesPerToken
+	return protocol.UsageStat{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
+
+func (u *usageMeter) Total() int {
+	return u.Usage().TotalTokens
+}
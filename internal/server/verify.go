@@ -0,0 +1,381 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"CoLinkPlan/internal/db"
+	"CoLinkPlan/internal/protocol"
+	"CoLinkPlan/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultVerifyMinSimilarity = 0.5
+	DefaultVerifyBanBelow      = 0.3
+
+	verifyTimeout = 60 * time.Second
+	verifyPenalty = 60 * time.Second
+)
+
+// Canary is a prompt with a known answer, sent to nodes to check that they really run the
+// model they claim to.
+type Canary struct {
+	Prompt string   `json:"prompt"`
+	Expect string   `json:"expect"`           // regular expression the answer must match
+	Models []string `json:"models,omitempty"` // the models it applies to, all if empty
+
+	expect *regexp.Regexp
+}
+
+// canaryQuestion is an arithmetic question canaries are generated from.
+type canaryQuestion struct {
+	prompt string // with the two operands
+	answer func(a, b int) int
+	a, b   [2]int // ranges of the operands
+}
+
+// canaryQuestions are the questions canaries are generated from when none are configured.
+// Fresh operands make every prompt new, so that a node cannot recognize the canaries and
+// answer them from a list.
+var canaryQuestions = []canaryQuestion{
+	{"What is %d multiplied by %d? Reply with the number only.", func(a, b int) int { return a * b }, [2]int{11, 99}, [2]int{11, 99}},
+	{"Compute %d times %d. Answer with just the result.", func(a, b int) int { return a * b }, [2]int{101, 999}, [2]int{2, 9}},
+	{"What is %d plus %d? Reply with the number only.", func(a, b int) int { return a + b }, [2]int{1000, 9999}, [2]int{1000, 9999}},
+	{"Subtract %[2]d from %[1]d. Give only the resulting number.", func(a, b int) int { return a - b }, [2]int{1000, 9999}, [2]int{100, 999}},
+}
+
+// ask returns the canary asking the question about a and b.
+func (q canaryQuestion) ask(a, b int) Canary {
+	expect := numberPattern(q.answer(a, b))
+	return Canary{Prompt: fmt.Sprintf(q.prompt, a, b), Expect: expect, expect: regexp.MustCompile(expect)}
+}
+
+// generateCanary returns a canary asking a random question with random operands.
+func generateCanary() Canary {
+	q := canaryQuestions[rand.IntN(len(canaryQuestions))]
+	return q.ask(q.a[0]+rand.IntN(q.a[1]-q.a[0]+1), q.b[0]+rand.IntN(q.b[1]-q.b[0]+1))
+}
+
+// numberPattern matches n as a whole number, with or without thousands separators.
+func numberPattern(n int) string {
+	digits := strconv.Itoa(n)
+	var groups []string
+	for len(digits) > 3 {
+		groups = append([]string{digits[len(digits)-3:]}, groups...)
+		digits = digits[:len(digits)-3]
+	}
+	groups = append([]string{digits}, groups...)
+	return `\b` + strings.Join(groups, ",?") + `\b`
+}
+
+func (c *Canary) appliesTo(model string) bool {
+	return len(c.Models) == 0 || slices.Contains(c.Models, model)
+}
+
+// Verifier spot-checks the answers of untrusted nodes. Every Interval it sends each free
+// node a canary prompt for one of its models, and it replays a sampled fraction of the
+// requests of keys that allow it on a trusted node, comparing the answers. Both look like
+// ordinary requests to the node. A node that fails is penalized and its verification score,
+// part of its reputation, drops; once that is below BanBelow its client token is banned.
+type Verifier struct {
+	Hub *Hub
+	DB  db.Store
+
+	Interval      time.Duration // between canary rounds, 0 sends none
+	SampleRate    float64       // fraction of opted-in requests replayed on a trusted node
+	MinSimilarity float64       // how alike a node's answer must be to the trusted one
+	BanBelow      float64       // 0 never bans
+
+	canaries []Canary // from the canary file, nil to generate them
+}
+
+// NewVerifier loads the canaries from canaryFile, a JSON array of Canary objects, or
+// generates arithmetic ones if it is empty.
+func NewVerifier(hub *Hub, database db.Store, canaryFile string) (*Verifier, error) {
+	v := &Verifier{
+		Hub:           hub,
+		DB:            database,
+		MinSimilarity: DefaultVerifyMinSimilarity,
+		BanBelow:      DefaultVerifyBanBelow,
+	}
+	if canaryFile != "" {
+		b, err := os.ReadFile(canaryFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &v.canaries); err != nil {
+			return nil, fmt.Errorf("%s: %w", canaryFile, err)
+		}
+		if len(v.canaries) == 0 {
+			return nil, fmt.Errorf("%s: no canaries", canaryFile)
+		}
+	}
+	for i := range v.canaries {
+		re, err := regexp.Compile(v.canaries[i].Expect)
+		if err != nil {
+			return nil, fmt.Errorf("canary %q: %w", v.canaries[i].Prompt, err)
+		}
+		v.canaries[i].expect = re
+	}
+	return v, nil
+}
+
+// Run sends a round of canaries every Interval. It never returns, unless canaries are off.
+func (v *Verifier) Run() {
+	if v.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(v.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		v.canaryRound()
+	}
+}
+
+// canaryRound sends a canary to every node with a free slot that is not in the trusted tier,
+// whose answers are taken as right. The slot is taken before the hub lock is released, so
+// that the canary never exceeds the node's limits.
+func (v *Verifier) canaryRound() {
+	type check struct {
+		client *ClientConn
+		model  string
+		canary Canary
+	}
+	var checks []check
+
+	v.Hub.mu.Lock()
+	for c := range v.Hub.clients {
+		if c.MaxParallel == 0 || v.trusted(c) || time.Now().Before(c.PenaltyUntil) || c.load() >= c.MaxParallel {
+			continue
+		}
+		var candidates []check
+		for model := range c.SupportedModels {
+			if limit := c.ModelParallel[model]; limit > 0 && c.ModelTasks[model] >= limit {
+				continue
+			}
+			if v.canaries == nil {
+				candidates = append(candidates, check{c, model, generateCanary()})
+				continue
+			}
+			for _, canary := range v.canaries {
+				if canary.appliesTo(model) {
+					candidates = append(candidates, check{c, model, canary})
+				}
+			}
+		}
+		if len(candidates) > 0 {
+			ch := candidates[rand.IntN(len(candidates))]
+			c.reserve(ch.model)
+			checks = append(checks, ch)
+		}
+	}
+	v.Hub.mu.Unlock()
+
+	for _, ch := range checks {
+		go v.checkCanary(ch.client, ch.model, ch.canary)
+	}
+}
+
+// checkCanary sends a canary to c, a slot of which is reserved for it, and checks the answer.
+func (v *Verifier) checkCanary(c *ClientConn, model string, canary Canary) {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	payload := map[string]interface{}{
+		"model":       model,
+		"messages":    []map[string]interface{}{{"role": "user", "content": canary.Prompt}},
+		"temperature": 0,
+		"max_tokens":  64,
+		"stream":      false,
+	}
+	stream, err := v.Hub.send(ctx, c, "req-"+uuid.New().String(), model, payload)
+	if err == nil {
+		var answer string
+		if answer, err = collectAnswer(ctx, stream); err == nil {
+			if canary.expect.MatchString(answer) {
+				v.pass(c)
+			} else {
+				v.fail(c, fmt.Sprintf("canary %q answered %q", canary.Prompt, truncate(answer, 80)))
+			}
+			return
+		}
+	}
+	// A node that can't answer at all is the scheduler's business, not a wrong answer
+	logger.Log.Debug("Canary inconclusive", "client_id", c.ID, "model", model, "err", err)
+}
+
+// sampled decides whether to replay a request on a trusted node. Only requests of keys that
+// allow it and asking for deterministic output (temperature 0) are considered.
+func (v *Verifier) sampled(key *db.APIKeyRecord, payload interface{}) bool {
+	if v == nil || v.SampleRate <= 0 || !key.AllowVerification {
+		return false
+	}
+	body, _ := payload.(map[string]interface{})
+	if t, ok := body["temperature"].(float64); !ok || t != 0 {
+		return false
+	}
+	return rand.Float64() < v.SampleRate
+}
+
+// crossCheck replays a request that c answered on a trusted node and compares the answers.
+func (v *Verifier) crossCheck(c *ClientConn, model string, need Requirements, payload interface{}, answer string) {
+	if v.trusted(c) {
+		return
+	}
+	body, ok := payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	replay := maps.Clone(body)
+	replay["stream"] = false
+	delete(replay, "stream_options")
+	need.MinTier = db.TierTrusted
+	need.Affinity = ""
+	need.Batch = true // yields to real traffic
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	stream, err := v.Hub.RouteCall(ctx, "req-"+uuid.New().String(), model, need, replay)
+	if err != nil {
+		logger.Log.Debug("No trusted node to cross-check with", "model", model, "err", err)
+		return
+	}
+	reference, err := collectAnswer(ctx, stream)
+	if err != nil {
+		logger.Log.Debug("Cross-check inconclusive", "client_id", c.ID, "model", model, "err", err)
+		return
+	}
+
+	if sim := similarity(answer, reference); sim < v.MinSimilarity {
+		v.fail(c, fmt.Sprintf("answer differs from a trusted node's (similarity %.2f)", sim))
+		return
+	}
+	v.pass(c)
+}
+
+// collectAnswer reads a response to its end and returns the text generated.
+func collectAnswer(ctx context.Context, stream *TaskStream) (string, error) {
+	var answer strings.Builder
+	for {
+		msg, err := stream.Recv(ctx)
+		if err != nil {
+			stream.Abandon("verification timed out")
+			return "", err
+		}
+		switch msg.Type {
+		case protocol.MsgTypeFinish:
+			return answer.String(), nil
+		case protocol.MsgTypeError:
+			return "", errors.New(errorMessage(msg))
+		default:
+			if _, content, ok := parseChunk(msg); ok {
+				answer.WriteString(content)
+			}
+		}
+	}
+}
+
+// trusted reports whether c's answers are taken as right. The caller may hold Hub.mu.
+func (v *Verifier) trusted(c *ClientConn) bool {
+	return v.Hub.Reputation.Tier(c.Token()) == db.TierTrusted
+}
+
+func (v *Verifier) pass(c *ClientConn) {
+	v.Hub.Reputation.verified(c.Token(), "")
+}
+
+// fail penalizes a node that gave a wrong answer, and bans its token if its reputation has
+// sunk too low.
+func (v *Verifier) fail(c *ClientConn, reason string) {
+	token := c.Token()
+	score := v.Hub.Reputation.verified(token, reason)
+	logger.Log.Warn("Node failed verification", "client_id", c.ID, "reason", reason, "verification_score", score)
+
+	v.Hub.mu.Lock()
+	c.PenaltyUntil = time.Now().Add(verifyPenalty)
+	ev := c.event(EventNodeVerificationFailed)
+	v.Hub.mu.Unlock()
+	ev.Error = reason
+	v.Hub.publish(ev)
+
+	if v.BanBelow <= 0 || score >= v.BanBelow {
+		return
+	}
+	tokens, err := v.DB.BanNodeToken(context.Background(), token, truncate("failed verification: "+reason, 255))
+	if err != nil {
+		logger.Log.Error("Failed to ban node", "client_id", c.ID, "err", err)
+		return
+	}
+	n := 0
+	for _, token := range tokens {
+		n += v.Hub.DisconnectToken(token)
+	}
+	logger.Log.Info("Node banned", "client_id", c.ID, "disconnected", n, "reason", "reputation below threshold")
+}
+
+// similarity is the Dice coefficient of the words of a and b: 1 if they use the same words
+// as often, 0 if they share none.
+func similarity(a, b string) float64 {
+	wa, wb := words(a), words(b)
+	total := 0
+	for _, n := range wa {
+		total += n
+	}
+	for _, n := range wb {
+		total += n
+	}
+	if total == 0 {
+		return 1
+	}
+	shared := 0
+	for w, n := range wa {
+		shared += min(n, wb[w])
+	}
+	return 2 * float64(shared) / float64(total)
+}
+
+// words counts the words of s, ignoring case and punctuation. Han characters count as a
+// word each, as such text has no spaces.
+func words(s string) map[string]int {
+	out := make(map[string]int)
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			out[string(word)]++
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			out[string(r)]++
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
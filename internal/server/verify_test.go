@@ -0,0 +1,70 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNumberPattern(t *testing.T) {
+	tests := []struct {
+		n      int
+		answer string
+		want   bool
+	}{
+		{6912, "6912", true},
+		{6912, "6,912", true},
+		{6912, "The answer is 6912.", true},
+		{6912, "16912", false},
+		{6912, "69120", false},
+		{391, "391", true},
+		{391, "3910", false},
+		{1234567, "1,234,567", true},
+		{1234567, "1234,567", true},
+	}
+	for _, tt := range tests {
+		re := regexp.MustCompile(numberPattern(tt.n))
+		if got := re.MatchString(tt.answer); got != tt.want {
+			t.Errorf("numberPattern(%d) on %q = %v, want %v", tt.n, tt.answer, got, tt.want)
+		}
+	}
+}
+
+func TestCanaryQuestions(t *testing.T) {
+	tests := []struct {
+		question int
+		a, b     int
+		prompt   string
+		answer   string
+	}{
+		{0, 17, 23, "What is 17 multiplied by 23? Reply with the number only.", "391"},
+		{1, 123, 4, "Compute 123 times 4. Answer with just the result.", "492"},
+		{2, 1234, 5678, "What is 1234 plus 5678? Reply with the number only.", "6,912"},
+		{3, 5000, 250, "Subtract 250 from 5000. Give only the resulting number.", "4750"},
+	}
+	for _, tt := range tests {
+		c := canaryQuestions[tt.question].ask(tt.a, tt.b)
+		if c.Prompt != tt.prompt {
+			t.Errorf("prompt %q, want %q", c.Prompt, tt.prompt)
+		}
+		if !c.expect.MatchString(tt.answer) {
+			t.Errorf("canary %q does not accept %q", c.Prompt, tt.answer)
+		}
+	}
+
+	// Every operand in range gives a positive answer
+	for _, q := range canaryQuestions {
+		if q.answer(q.a[0], q.b[1]) <= 0 {
+			t.Errorf("question %q can have an answer below 1", q.prompt)
+		}
+	}
+}
+
+func TestGenerateCanary(t *testing.T) {
+	prompts := make(map[string]bool)
+	for range 200 {
+		prompts[generateCanary().Prompt] = true
+	}
+	if len(prompts) < 150 {
+		t.Errorf("only %d different prompts in 200 canaries", len(prompts))
+	}
+}
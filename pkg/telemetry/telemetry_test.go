@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"CoLinkPlan/internal/protocol"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetupExportsAndPropagates(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		export []byte
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/v1/traces" {
+			mu.Lock()
+			export = append(export, body...)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	ctx := context.Background()
+	shutdown, err := Setup(ctx, "colink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := Tracer.Start(ctx, "dispatch-test")
+	if !span.SpanContext().IsSampled() {
+		t.Fatal("span not recorded with an endpoint set")
+	}
+
+	// The trace context survives a CALL over the wire
+	raw, err := json.Marshal(protocol.CallData{RequestID: "req-1", TraceContext: Inject(ctx)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var call protocol.CallData
+	if err := json.Unmarshal(raw, &call); err != nil {
+		t.Fatal(err)
+	}
+	if call.TraceContext["traceparent"] == "" {
+		t.Fatalf("no traceparent in %s", raw)
+	}
+	got := trace.SpanContextFromContext(Extract(context.Background(), call.TraceContext))
+	if got.TraceID() != span.SpanContext().TraceID() || got.SpanID() != span.SpanContext().SpanID() || !got.IsRemote() {
+		t.Errorf("extracted %v, want a remote %v", got, span.SpanContext())
+	}
+	span.End()
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Contains(export, []byte("dispatch-test")) || !bytes.Contains(export, []byte("colink-test")) {
+		t.Errorf("span not exported, collector got %d bytes", len(export))
+	}
+}
+
+func TestInjectWithoutSpan(t *testing.T) {
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Errorf("trace context %v without a span", carrier)
+	}
+}
@@ -0,0 +1,5 @@
+package version
+
+// Version is the build version, set at build time with
+// -ldflags "-X CoLinkPlan/pkg/version.Version=v1.2.3".
+var Version = "dev"
@@ -53,7 +53,37 @@ const resources = {
                 penalized: "Penalized (Cooling Down)",
                 healthy: "Healthy & Ready",
                 capacity: "Capacity",
-                models: "Models Advertised"
+                models: "Models Advertised",
+                live: "Live",
+                reconnecting: "Reconnecting…",
+                mine: "mine",
+                activity: "Live Activity",
+                clientVersion: "Client",
+                protocol: "protocol",
+                legacyClient: "legacy (no handshake)",
+                encrypted: "End-to-end encrypted",
+                tiers: {
+                    verified: "verified",
+                    trusted: "trusted"
+                },
+                heartbeat: "Heartbeat",
+                reportedTasks: "Tasks reported by node",
+                orphaned: "no longer awaited",
+                upstreamOk: "ok",
+                upstreamFailing: "failing",
+                load: "load",
+                memory: "mem",
+                events: {
+                    node_connected: "Node connected",
+                    node_registered: "Node registered",
+                    node_updated: "Node configuration updated",
+                    node_disconnected: "Node disconnected",
+                    node_penalized: "Penalized after a failed dispatch",
+                    node_heartbeat: "Heartbeat",
+                    node_verification_failed: "Failed answer verification",
+                    task_started: "Task started",
+                    task_finished: "Task finished"
+                }
             },
             home: {
                 badge: "Distributed AI Compute Gateway",
@@ -131,7 +161,37 @@ const resources = {
                 penalized: "已受惩罚 (冷却等待中)",
                 healthy: "健康可用 (就绪)",
                 capacity: "当前并发任务及上限",
-                models: "挂载发布的本地模型"
+                models: "挂载发布的本地模型",
+                live: "实时",
+                reconnecting: "重新连接中…",
+                mine: "我的",
+                activity: "实时动态",
+                clientVersion: "客户端版本",
+                protocol: "协议",
+                legacyClient: "旧版客户端（无握手）",
+                encrypted: "端到端加密",
+                tiers: {
+                    verified: "已验证",
+                    trusted: "可信"
+                },
+                heartbeat: "心跳",
+                reportedTasks: "节点上报的任务数",
+                orphaned: "个任务已不再等待",
+                upstreamOk: "正常",
+                upstreamFailing: "异常",
+                load: "负载",
+                memory: "内存",
+                events: {
+                    node_connected: "节点已连接",
+                    node_registered: "节点已注册",
+                    node_updated: "节点配置已更新",
+                    node_disconnected: "节点已断开",
+                    node_penalized: "下发失败，节点受惩罚",
+                    node_heartbeat: "心跳",
+                    node_verification_failed: "答案校验未通过",
+                    task_started: "任务开始",
+                    task_finished: "任务完成"
+                }
             },
             home: {
                 badge: "分布式 AI 算力代理网关",
@@ -0,0 +1,56 @@
+const API_URL = import.meta.env.VITE_API_URL || '/api';
+
+export interface StreamEvent {
+    type: string;
+    data: any;
+}
+
+// Reads the /events server-sent event stream. EventSource can't send the Authorization
+// header, so the stream is read with fetch. Returns a function that closes the stream.
+export function subscribeEvents(onEvent: (ev: StreamEvent) => void, onClose: () => void): () => void {
+    const controller = new AbortController();
+    const headers: Record<string, string> = { Accept: 'text/event-stream' };
+    const token = localStorage.getItem('token');
+    if (token) {
+        headers.Authorization = `Bearer ${token}`;
+    }
+
+    (async () => {
+        try {
+            const res = await fetch(`${API_URL}/events`, { headers, signal: controller.signal });
+            if (!res.ok || !res.body) {
+                throw new Error(`event stream failed: ${res.status}`);
+            }
+
+            const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+            let buffer = '';
+            for (;;) {
+                const { value, done } = await reader.read();
+                if (done) break;
+                buffer += value;
+
+                let end: number;
+                while ((end = buffer.indexOf('\n\n')) >= 0) {
+                    const block = buffer.slice(0, end);
+                    buffer = buffer.slice(end + 2);
+
+                    let type = 'message';
+                    const data: string[] = [];
+                    for (const line of block.split('\n')) {
+                        if (line.startsWith('event:')) type = line.slice(6).trim();
+                        else if (line.startsWith('data:')) data.push(line.slice(5).trimStart());
+                    }
+                    if (data.length > 0) {
+                        onEvent({ type, data: JSON.parse(data.join('\n')) });
+                    }
+                }
+            }
+        } catch (e) {
+            if (controller.signal.aborted) return;
+            console.error('Event stream error', e);
+        }
+        if (!controller.signal.aborted) onClose();
+    })();
+
+    return () => controller.abort();
+}
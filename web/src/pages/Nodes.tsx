@@ -1,41 +1,132 @@
 import { useEffect, useState } from 'react';
-import { api } from '@/lib/api';
-import { Server, Activity, Cpu, Layers } from 'lucide-react';
+import { subscribeEvents } from '@/lib/events';
+import { Server, Activity, Cpu, Layers, Zap, HeartPulse, Lock } from 'lucide-react';
 import { useTranslation } from 'react-i18next';
 import { Navbar } from '@/components/Navbar';
 
 interface NodeInfo {
     id: string;
+    token?: string;
+    mine?: boolean;
     max_parallel: number;
     active_tasks: number;
     supported_models: string[];
     penalized: boolean;
+    client_version?: string;
+    protocol_version?: number;
+    encrypted?: boolean;
+    tier?: 'new' | 'verified' | 'trusted';
+    orphaned?: number;
+    heartbeat?: NodeHeartbeat;
 }
 
+interface ProviderHealth {
+    models: string[];
+    healthy: boolean;
+    requests: number;
+    errors: number;
+    consecutive_errors: number;
+    last_error?: string;
+}
+
+interface NodeHeartbeat {
+    time: string;
+    active_tasks: number;
+    providers?: Record<string, ProviderHealth>;
+    host?: {
+        cpus: number;
+        load1?: number;
+        memory_total?: number;
+        memory_available?: number;
+        goroutines: number;
+    };
+}
+
+interface HubEvent {
+    type: string;
+    time: string;
+    node: NodeInfo;
+    request_id?: string;
+    model?: string;
+    latency_ms?: number;
+    error?: string;
+}
+
+const MAX_ACTIVITY = 30;
+const RECONNECT_DELAY = 3000;
+
 export default function Nodes() {
     const { t } = useTranslation();
     const [nodes, setNodes] = useState<NodeInfo[]>([]);
+    const [activity, setActivity] = useState<HubEvent[]>([]);
     const [loading, setLoading] = useState(true);
+    const [live, setLive] = useState(false);
     const [lastUpdated, setLastUpdated] = useState<Date | null>(null);
 
     useEffect(() => {
-        const fetchNodes = async () => {
-            try {
-                const res = await api.get('/nodes');
-                setNodes(res.data.nodes || []);
+        let close = () => {};
+        let retry: ReturnType<typeof setTimeout>;
+
+        const connect = () => {
+            close = subscribeEvents(({ type, data }) => {
                 setLastUpdated(new Date());
-            } catch (e) {
-                console.error('Failed to fetch nodes', e);
-            } finally {
+                if (type === 'snapshot') {
+                    setNodes(data.nodes || []);
+                    setLive(true);
+                    setLoading(false);
+                    return;
+                }
+
+                const ev = data as HubEvent;
+                if (ev.type === 'node_heartbeat') {
+                    // Too frequent for the activity list; only refreshes the node
+                    setNodes(prev => prev.map(n => n.id === ev.node.id ? ev.node : n));
+                    return;
+                }
+                setNodes(prev => {
+                    const known = prev.some(n => n.id === ev.node.id);
+                    const update = () => prev.map(n => n.id === ev.node.id ? ev.node : n);
+                    switch (ev.type) {
+                        case 'node_connected':
+                        case 'node_disconnected':
+                            return prev.filter(n => n.id !== ev.node.id); // only registered nodes are listed
+                        case 'node_registered':
+                            return known ? update() : [...prev, ev.node];
+                        default:
+                            return known ? update() : prev; // late event of a node that is gone
+                    }
+                });
+                setActivity(prev => [ev, ...prev].slice(0, MAX_ACTIVITY));
+            }, () => {
+                setLive(false);
                 setLoading(false);
-            }
+                retry = setTimeout(connect, RECONNECT_DELAY);
+            });
         };
 
-        fetchNodes();
-        const interval = setInterval(fetchNodes, 5000);
-        return () => clearInterval(interval);
+        connect();
+        return () => {
+            clearTimeout(retry);
+            close();
+        };
     }, []);
 
+    const describe = (ev: HubEvent) => {
+        const label = t(`nodes.events.${ev.type}`);
+        if (ev.type === 'task_finished' && ev.latency_ms !== undefined) {
+            return `${label} · ${ev.latency_ms} ms${ev.error ? ` · ${ev.error}` : ''}`;
+        }
+        if (ev.type === 'node_verification_failed' && ev.error) {
+            return `${label} · ${ev.error}`;
+        }
+        if (ev.model) {
+            return `${label} · ${ev.model}`;
+        }
+        return label;
+    };
+
+    const formatGB = (bytes: number) => `${(bytes / 1024 ** 3).toFixed(1)} GB`;
+
     const totalCapacity = nodes.reduce((sum, n) => sum + n.max_parallel, 0);
     const totalActive = nodes.reduce((sum, n) => sum + n.active_tasks, 0);
     const healthyCount = nodes.filter(n => !n.penalized).length;
@@ -55,10 +146,11 @@ export default function Nodes() {
                     <div className="flex items-center gap-2 self-start">
                         <div className="flex items-center gap-2 bg-white/[0.03] border border-white/[0.06] px-3 py-1.5 rounded-full">
                             <span className="relative flex h-2 w-2">
-                                <span className="animate-ping absolute inline-flex h-full w-full rounded-full bg-green-400 opacity-60" />
-                                <span className="relative inline-flex rounded-full h-2 w-2 bg-green-500" />
+                                {live && <span className="animate-ping absolute inline-flex h-full w-full rounded-full bg-green-400 opacity-60" />}
+                                <span className={`relative inline-flex rounded-full h-2 w-2 ${live ? 'bg-green-500' : 'bg-zinc-500'}`} />
                             </span>
                             <span className="text-xs font-medium text-zinc-300">{nodes.length} {t('nodes.online')}</span>
+                            <span className="text-xs text-zinc-600">· {live ? t('nodes.live') : t('nodes.reconnecting')}</span>
                         </div>
                         {lastUpdated && (
                             <span className="text-xs text-zinc-600 hidden sm:block">
@@ -123,6 +215,11 @@ export default function Nodes() {
                                             <div>
                                                 <p className="font-mono text-xs text-zinc-300 leading-none mb-1">
                                                     {node.id ? `...${node.id.split('-').pop()}` : `node-${i}`}
+                                                    {node.mine && <span className="ml-1.5 text-[10px] text-blue-400">{t('nodes.mine')}</span>}
+                                                    {node.encrypted && <Lock className="inline w-3 h-3 ml-1.5 text-green-400" aria-label={t('nodes.encrypted')} />}
+                                                    {node.tier && node.tier !== 'new' && (
+                                                        <span className={`ml-1.5 text-[10px] ${node.tier === 'trusted' ? 'text-green-400' : 'text-blue-400'}`}>{t(`nodes.tiers.${node.tier}`)}</span>
+                                                    )}
                                                 </p>
                                                 <div className="flex items-center gap-1.5">
                                                     <Activity className="w-3 h-3 text-zinc-600" />
@@ -151,6 +248,44 @@ export default function Nodes() {
                                         </div>
                                     </div>
 
+                                    {/* Heartbeat */}
+                                    {node.heartbeat && (
+                                        <div className="mb-4">
+                                            <div className="flex items-center justify-between mb-2">
+                                                <div className="flex items-center gap-1.5">
+                                                    <HeartPulse className="w-3 h-3 text-zinc-600" />
+                                                    <span className="text-[10px] text-zinc-600 uppercase tracking-wider">{t('nodes.heartbeat')}</span>
+                                                </div>
+                                                <span className="text-[10px] text-zinc-500">{new Date(node.heartbeat.time).toLocaleTimeString()}</span>
+                                            </div>
+                                            <div className="text-[10px] text-zinc-500 mb-2">
+                                                {t('nodes.reportedTasks')}: <span className="font-mono text-zinc-300">{node.heartbeat.active_tasks}</span>
+                                                {!!node.orphaned && <span className="text-orange-400"> · {node.orphaned} {t('nodes.orphaned')}</span>}
+                                            </div>
+                                            {node.heartbeat.providers && (
+                                                <div className="flex flex-wrap gap-1.5 mb-2">
+                                                    {Object.entries(node.heartbeat.providers).map(([name, p]) => (
+                                                        <span
+                                                            key={name}
+                                                            title={p.last_error || undefined}
+                                                            className={`px-2 py-0.5 text-[10px] rounded font-mono border ${p.healthy ? 'bg-green-500/8 border-green-500/15 text-green-300' : 'bg-orange-500/8 border-orange-500/20 text-orange-300'}`}
+                                                        >
+                                                            {name} · {p.healthy ? t('nodes.upstreamOk') : `${t('nodes.upstreamFailing')} (${p.consecutive_errors})`}
+                                                        </span>
+                                                    ))}
+                                                </div>
+                                            )}
+                                            {node.heartbeat.host && (
+                                                <div className="text-[10px] text-zinc-500 font-mono">
+                                                    {node.heartbeat.host.cpus} CPU
+                                                    {node.heartbeat.host.load1 !== undefined && ` · ${t('nodes.load')} ${node.heartbeat.host.load1.toFixed(2)}`}
+                                                    {!!node.heartbeat.host.memory_total && node.heartbeat.host.memory_available !== undefined &&
+                                                        ` · ${t('nodes.memory')} ${formatGB(node.heartbeat.host.memory_total - node.heartbeat.host.memory_available)} / ${formatGB(node.heartbeat.host.memory_total)}`}
+                                                </div>
+                                            )}
+                                        </div>
+                                    )}
+
                                     {/* Models */}
                                     {node.supported_models.length > 0 && (
                                         <div>
@@ -167,11 +302,38 @@ export default function Nodes() {
                                             </div>
                                         </div>
                                     )}
+
+                                    {/* Client version */}
+                                    <div className="mt-4 pt-3 border-t border-white/[0.04] flex items-center justify-between text-[10px] text-zinc-600">
+                                        <span>{t('nodes.clientVersion')}</span>
+                                        <span className="font-mono text-zinc-400">
+                                            {node.protocol_version === 1 ? t('nodes.legacyClient') : `${node.client_version || '?'} · ${t('nodes.protocol')} ${node.protocol_version ?? '?'}`}
+                                        </span>
+                                    </div>
                                 </div>
                             );
                         })}
                     </div>
                 )}
+
+                {/* Live activity */}
+                {activity.length > 0 && (
+                    <div className="mt-10">
+                        <div className="flex items-center gap-1.5 mb-3">
+                            <Zap className="w-3.5 h-3.5 text-zinc-500" />
+                            <h2 className="text-xs text-zinc-500 uppercase tracking-wider">{t('nodes.activity')}</h2>
+                        </div>
+                        <div className="rounded-xl border border-white/[0.06] bg-white/[0.02] divide-y divide-white/[0.04]">
+                            {activity.map((ev, i) => (
+                                <div key={`${ev.time}-${i}`} className="flex items-center gap-3 px-4 py-2 text-xs">
+                                    <span className="text-zinc-600 font-mono w-20 flex-shrink-0">{new Date(ev.time).toLocaleTimeString()}</span>
+                                    <span className="font-mono text-zinc-400 w-24 flex-shrink-0 truncate">...{ev.node.id.split('-').pop()}</span>
+                                    <span className={ev.error || ev.type === 'node_penalized' || ev.type === 'node_verification_failed' ? 'text-orange-400' : 'text-zinc-300'}>{describe(ev)}</span>
+                                </div>
+                            ))}
+                        </div>
+                    </div>
+                )}
             </div>
         </div>
     );